@@ -1,11 +1,22 @@
 package main
 
 import (
+    "archive/zip"
     "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    cryptorand "crypto/rand"
     "crypto/sha256"
     "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/csv"
     "encoding/json"
+    "errors"
     "fmt"
+    "hash/fnv"
+    "io"
     "io/ioutil"
     "log"
     "math"
@@ -15,13 +26,22 @@ import (
     "os"
     "os/exec"
     "os/signal"
+    "path/filepath"
+    "reflect"
+    "runtime"
+    "sort"
     "strings"
     "sync"
+    "sync/atomic"
     "syscall"
     "time"
     "strconv"
 
     mqtt "github.com/eclipse/paho.mqtt.golang"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "github.com/santhosh-tekuri/jsonschema/v5"
+    "golang.org/x/sync/singleflight"
     "gopkg.in/yaml.v3"
 )
 
@@ -38,6 +58,7 @@ const (
     EventMQTTMessage
     EventConfigUpdate
     EventConfigRequest
+    EventAPIDirective
 )
 
 // Event represents an internal event in the system
@@ -61,6 +82,7 @@ type UpdateStatus struct {
     StartTime      time.Time // When update started
     SuspendMeasure bool      // Whether to suspend measurements during update
     StatusMessage  string    // Status/error message
+    Failed         bool      // Whether the last update could not be applied
 }
 
 // ConfiguredEndDevice represents an end device with flexible parameter set handling
@@ -73,7 +95,7 @@ type ConfiguredEndDevice struct {
     Status            string                 // online, offline, error
     LastMeasurement   time.Time              // When last measurement was taken
     DeviceConfig      map[string]interface{} // Device-specific configuration
-    StopChan          chan bool              // Channel to signal shutdown
+    StopChan          chan bool              // Channel to signal shutdown (close via stop)
     StartTime         time.Time              // When device was started
     UptimeSeconds     int64                  // Device uptime in seconds
     
@@ -92,6 +114,82 @@ type ConfiguredEndDevice struct {
     // Metadata
     FirmwareVersion    string                // Device firmware version  
     DiagnosticInfo     map[string]interface{} // Additional diagnostic info
+    
+    // Time source for generated measurements (defaults to time.Now)
+    Clock              func() time.Time
+    
+    // Random source for generated values (defaults to a shared clock-seeded source)
+    Rand               *rand.Rand
+    
+    // Measurement sequence tracking
+    sequence           int64                 // Last sequence number assigned
+    lastSentSequence   int64                 // Last sequence number successfully published
+    batchDay           string                // Day (YYYYMMDD) the batch counter belongs to
+    batchNext          int                   // Next batch counter value within batchDay
+    formatSequence     int64                 // Last {SEQ} format value handed out
+    sequenceMutex      sync.Mutex            // Protects sequence, lastSentSequence and the format counters
+    
+    // Correlated anomaly injection
+    anomaly            *AnomalyShift         // Active anomaly shift, if any
+    anomalyMutex       sync.Mutex            // Protects anomaly
+    
+    // Dataset replay
+    dataset            *MeasurementDataset   // Loaded dataset, if configured
+    datasetIndex       int                   // Next dataset position for sequential replay
+    datasetMutex       sync.Mutex            // Protects dataset, datasetIndex and replayIndex
+    replayIndex        int                   // Next REPLAY_FILE event to publish
+    
+    // Mirroring of a real device's measurements
+    mirrorValue        float64               // Last weight received from the mirror source
+    hasMirrorValue     bool                  // Whether mirrorValue has been received
+    mirrorMutex        sync.Mutex            // Protects mirrorValue and hasMirrorValue
+    
+    // Simulated faults, guarded by the device manager's DeviceMutex like Status
+    FaultUntil         time.Time             // When the current simulated fault ends (zero = none)
+    statusBeforeFault  string                // Status restored when the fault ends
+    
+    // Simulated battery
+    batteryDrained     float64               // Percentage points drained since the device started
+    lowBatteryReported bool                  // Whether the low_battery event has been sent
+    batteryMutex       sync.Mutex            // Protects batteryDrained and lowBatteryReported
+    
+    // Simulated sensor drift
+    Drift              float64               // Calibration factor drift accumulated since the last recalibration
+    LastRecalibration  time.Time             // When drift was last reset
+    driftMutex         sync.Mutex            // Protects Drift and LastRecalibration
+    
+    stopOnce           sync.Once             // Ensures StopChan is closed exactly once
+}
+
+// MeasurementDataset holds recorded weight values for devices to replay
+type MeasurementDataset struct {
+    Path   string    // File the values were loaded from
+    Values []float64 // Weight values in file order
+}
+
+// Dataset cache shared by devices replaying the same file
+var (
+    datasetCache      = make(map[string]*MeasurementDataset)
+    datasetCacheMutex sync.Mutex
+)
+
+// CorrelatedAnomaly describes a measurement shift applied to a group of devices at once
+type CorrelatedAnomaly struct {
+    Name             string        // Anomaly name used to trigger it
+    DeviceIDs        []string      // Device IDs or numeric suffixes in the group (empty = all)
+    ParameterSet     string        // Only devices using this parameter set (empty = any)
+    WeightMultiplier float64       // Multiplier applied to the calibrated weight
+    WeightOffset     float64       // Offset added to the calibrated weight
+    Duration         time.Duration // How long the anomaly lasts once triggered
+    Schedule         []string      // Daily trigger times in HH:MM
+}
+
+// AnomalyShift is an active anomaly on a single device
+type AnomalyShift struct {
+    Name       string
+    Multiplier float64
+    Offset     float64
+    Until      time.Time
 }
 
 // Config represents a YAML configuration for end devices
@@ -100,82 +198,327 @@ type Config struct {
     UpdatedAt time.Time // When the config was last updated
 }
 
-// DeviceManager manages multiple end devices
+// ConfigHistoryEntry is a previously stored configuration that can be rolled back to
+type ConfigHistoryEntry struct {
+    Version  string    // Version hash of the configuration
+    YAML     string    // The raw YAML configuration
+    StoredAt time.Time // When the configuration was last stored
+}
+
+// DeviceManager manages multiple end devices.
+//
+// Lock ordering: the gateway's configMutex is taken before applyMutex, applyMutex
+// before DeviceMutex, and DeviceMutex before ConfigMutex, all of them before the leaf
+// mutexes (tombstoneMutex, mirrorMutex and each device's own mutexes), which never
+// nest. Simulation goroutines read a device's config under DeviceMutex.RLock and
+// never publish while holding DeviceMutex.
 type DeviceManager struct {
+    gateway          *Gateway                       // Gateway the devices belong to
     Devices          map[string]*ConfiguredEndDevice // Map of device ID to device
-    DeviceMutex      sync.RWMutex                   // Protect access to devices map
+    DeviceMutex      sync.RWMutex                   // Protects the devices map and device configs and status
+    applyMutex       sync.Mutex                     // Serializes whole config applies
     ConfigMutex      sync.RWMutex                   // Protect access to configuration
+    
+    // Correlated anomalies (guarded by ConfigMutex)
+    Anomalies        map[string]*CorrelatedAnomaly  // Configured anomalies by name
+    anomalyTriggers  map[string]string              // Last scheduled trigger slot per anomaly
+    
+    dedup            *measurementDedup              // Recently published measurement IDs
+    configApplied    bool                           // Whether a config has been applied (guarded by DeviceMutex)
+    configLockHold   time.Duration                  // DeviceMutex hold time of the last config apply, both phases (guarded by DeviceMutex)
+    
+    // Statistics of removed devices, kept for reconciliation
+    tombstones       []DeviceTombstone              // Oldest first
+    tombstoneMutex   sync.Mutex                     // Protects tombstones
+    tombstoneTTL     time.Duration                  // How long tombstones are kept (0 = disabled)
+    tombstoneLimit   int                            // Maximum number of tombstones kept
+    
+    batcher          *measurementBatcher            // Groups measurements into batch messages (nil = disabled)
+    schemas          *SchemaRegistry                // Validates measurements against registry schemas (nil = disabled)
+    replay           *ReplayRecording               // Recorded events published instead of generated ones (nil = disabled)
+    stats            *deviceStatsStore              // Persists device counters across restarts (nil = disabled)
+    offline          *offlineBuffer                 // Measurements held while MQTT is disconnected (nil = dropped)
+    
+    // Devices mirroring real measurement topics
+    mirrors          map[string]map[string]*ConfiguredEndDevice // Source topic -> mirroring devices by ID
+    mirrorMutex      sync.Mutex                     // Protects mirrors
+}
+
+// DeviceTombstone records the final statistics of a removed device
+type DeviceTombstone struct {
+    DeviceID            string    `json:"device_id"`
+    ParameterSet        string    `json:"parameter_set"`
+    FirmwareVersion     string    `json:"firmware_version"`
+    MeasurementCount    int       `json:"measurement_count"`
+    TotalWeightMeasured float64   `json:"total_weight"`
+    UptimeSeconds       int64     `json:"uptime"`
+    StartedAt           time.Time `json:"started_at"`
+    RemovedAt           time.Time `json:"removed_at"`
+}
+
+// measurementDedup is a bounded set of recently published measurement IDs
+type measurementDedup struct {
+    mu       sync.Mutex
+    window   time.Duration        // How long an ID is remembered
+    capacity int                  // Maximum number of IDs remembered
+    seen     map[string]time.Time // Measurement ID -> time it was reserved
+    order    []dedupEntry         // Reservations in insertion order for eviction
+}
+
+// dedupEntry is a single reservation in a measurementDedup
+type dedupEntry struct {
+    id string
+    at time.Time
+}
+
+// newMeasurementDedup creates a dedup set with the given window and capacity
+func newMeasurementDedup(window time.Duration, capacity int) *measurementDedup {
+    return &measurementDedup{
+        window:   window,
+        capacity: capacity,
+        seen:     make(map[string]time.Time),
+    }
+}
+
+// Reserve records a measurement ID, returning false if it was already seen within the window
+func (d *measurementDedup) Reserve(id string, now time.Time) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    
+    // Evict expired entries and enforce capacity, oldest first
+    for len(d.order) > 0 {
+        oldest := d.order[0]
+        if now.Sub(oldest.at) < d.window && len(d.order) < d.capacity {
+            break
+        }
+        d.order = d.order[1:]
+        // Only drop the ID if it wasn't reserved again since
+        if seenAt, ok := d.seen[oldest.id]; ok && seenAt.Equal(oldest.at) {
+            delete(d.seen, oldest.id)
+        }
+    }
+    
+    if seenAt, ok := d.seen[id]; ok && now.Sub(seenAt) < d.window {
+        return false
+    }
+    
+    d.seen[id] = now
+    d.order = append(d.order, dedupEntry{id: id, at: now})
+    return true
+}
+
+// Forget removes a measurement ID so it can be published again
+func (d *measurementDedup) Forget(id string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    delete(d.seen, id)
 }
 
 // Constants
 const (
-    CertPath          = "/app/certificates/cert.pem"
-    KeyPath           = "/app/certificates/key.pem"
-    CheckInterval     = 5 * time.Second
-    HeartbeatInterval = 300 * time.Second
+    CertPath             = "/app/certificates/cert.pem"
+    KeyPath              = "/app/certificates/key.pem"
+    CheckInterval        = 5 * time.Second
+    HeartbeatInterval    = 300 * time.Second
+    DefaultGatewayIDFile = "/app/data/gateway_id"
 )
 
-// Global variables
-var (
+// Gateway holds the state of one simulated gateway. The event loop, HTTP
+// handlers and MQTT callbacks are methods on it, so tests can build their own.
+type Gateway struct {
     gatewayID       string
     sessionID       string                  // Unique ID for this gateway process instance
     brokerAddress   string
-    mqttProtocol    string = "tcp"          // MQTT protocol (tcp, ssl, tls)
+    mqttProtocol    string                  // MQTT protocol (tcp, ssl, tls)
     mqttClient      mqtt.Client
-    eventChan       chan Event = make(chan Event, 100) // Buffered channel for events
-    hasCertificates bool = false
-    isMqttConnected bool = false
+    eventChan       chan Event              // Buffered channel for events
+    hasCertificates atomic.Bool             // Written by the certificate watcher, read by handlers
+    isMqttConnected atomic.Bool             // Written by the event loop, read by handlers and devices
     mtx             http.ServeMux
+    heartbeatIntervalChan chan time.Duration // Heartbeat interval changes
     currentConfig   Config                  // Store the current configuration
-    configMutex     sync.RWMutex            // Mutex to protect access to the configuration
+    configHistory   []ConfigHistoryEntry    // Recently stored configurations, oldest first
+    configMutex     sync.RWMutex            // Mutex to protect access to the configuration and its history
     endDeviceManager *DeviceManager
     currentUpdateID string
-)
+    eventLoopWatchdog *EventLoopWatchdog    // Detects a stalled event loop
+    gatewayStateMutex sync.RWMutex          // Guards endDeviceManager writes against probe reads
+    
+    // Hooks run by the event loop on connection transitions
+    connectionHooks      map[ConnectionTransition][]ConnectionHook
+    connectionHooksMutex sync.RWMutex
+    
+    // Cleanup steps run on shutdown
+    shutdownSteps      []ShutdownStep
+    shutdownStepsMutex sync.Mutex
+    
+    // Progress of applying the stored configuration to the device manager
+    deviceManagerInit      DeviceManagerInitState
+    deviceManagerInitMutex sync.Mutex
+    
+    negotiatedHeartbeatSchema int32 // Schema requested by the backend (0 = not negotiated)
+    registered                int32 // Set once the backend acknowledged the capabilities event
+    
+    // Closed when shutdown begins so background retries stop waiting
+    shutdown     chan struct{}
+    shutdownOnce sync.Once
+    
+    configAcks sync.WaitGroup // Config acknowledgments still being published
+}
+
+// NewGateway creates a gateway with no ID, broker or devices yet
+func NewGateway() *Gateway {
+    return &Gateway{
+        mqttProtocol:          "tcp",
+        eventChan:             make(chan Event, 100),
+        heartbeatIntervalChan: make(chan time.Duration, 1),
+        eventLoopWatchdog:     NewEventLoopWatchdog(),
+        connectionHooks:       make(map[ConnectionTransition][]ConnectionHook),
+        shutdown:              make(chan struct{}),
+    }
+}
+
+// beginShutdown signals background work that the gateway is shutting down
+func (g *Gateway) beginShutdown() {
+    g.shutdownOnce.Do(func() { close(g.shutdown) })
+}
 
 func main() {
     log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-    rand.Seed(time.Now().UnixNano())
-    sessionID = fmt.Sprintf("%d", time.Now().UnixNano())
-    setupSignalHandling()
-    setupGatewayID()
-    setupBrokerAddress()
+    rand.Seed(gatewayRandomSeed())
+    g := NewGateway()
+    g.sessionID = fmt.Sprintf("%d", time.Now().UnixNano())
+    g.setupSignalHandling()
+    g.setupGatewayID()
+    g.setupBrokerAddress()
+    g.registerDefaultConnectionHooks()
+    g.registerDefaultShutdownSteps()
     
     // Start HTTP server in a goroutine
-    go startHTTPServer()
+    go g.startHTTPServer()
     
     // Start certificate watcher in a goroutine
-    go watchCertificates()
+    go g.watchCertificates()
     
     // Start heartbeat timer in a goroutine
-    go heartbeatTimer()
+    go g.heartbeatTimer()
+    
+    // Start event loop watchdog in a goroutine
+    go g.eventLoopWatchdog.Run()
+    
+    // Register with the backend in a goroutine, without waiting for MQTT
+    go g.registerWithBackend()
     
     // Main event loop
-    mainEventLoop()
+    g.mainEventLoop()
 }
 
 // setupSignalHandling sets up handlers for system signals
-func setupSignalHandling() {
+func (g *Gateway) setupSignalHandling() {
     c := make(chan os.Signal, 1)
     signal.Notify(c, os.Interrupt, syscall.SIGTERM)
     
     go func() {
         sig := <-c
         log.Printf("Received signal %v, shutting down...", sig)
-        eventChan <- Event{Type: EventShutdown, Time: time.Now()}
+        g.eventChan <- Event{Type: EventShutdown, Time: time.Now()}
     }()
 }
 
-// setupGatewayID gets the gateway ID from environment
-func setupGatewayID() {
-    gatewayID = os.Getenv("GATEWAY_ID")
-    if gatewayID == "" {
-        gatewayID = fmt.Sprintf("gateway-%d", time.Now().Unix())
-        log.Printf("GATEWAY_ID not set, using generated ID: %s", gatewayID)
+// setupGatewayID gets the gateway ID from the environment or the source named by GATEWAY_ID_SOURCE
+func (g *Gateway) setupGatewayID() {
+    g.gatewayID = os.Getenv("GATEWAY_ID")
+    if g.gatewayID != "" {
+        return
+    }
+    
+    source := os.Getenv("GATEWAY_ID_SOURCE")
+    var err error
+    switch source {
+    case "file":
+        path := os.Getenv("GATEWAY_ID_FILE")
+        if path == "" {
+            path = DefaultGatewayIDFile
+        }
+        g.gatewayID, err = gatewayIDFromFile(path)
+    case "hostname":
+        g.gatewayID, err = gatewayIDFromHostname()
+    case "mac":
+        g.gatewayID, err = gatewayIDFromMAC(os.Getenv("GATEWAY_ID_INTERFACE"))
+    case "", "env":
+    default:
+        log.Printf("Unknown GATEWAY_ID_SOURCE %q, falling back to generated ID", source)
+    }
+    
+    if err != nil {
+        log.Printf("Error deriving gateway ID from %s: %v", source, err)
+        g.gatewayID = ""
+    }
+    if g.gatewayID != "" {
+        log.Printf("Using gateway ID from %s: %s", source, g.gatewayID)
+        return
+    }
+    
+    g.gatewayID = fmt.Sprintf("gateway-%d", time.Now().Unix())
+    log.Printf("GATEWAY_ID not set, using generated ID: %s", g.gatewayID)
+}
+
+// gatewayIDFromFile reads a persisted gateway ID, generating and writing one on first run
+func gatewayIDFromFile(path string) (string, error) {
+    if data, err := ioutil.ReadFile(path); err == nil {
+        if id := strings.TrimSpace(string(data)); id != "" {
+            return id, nil
+        }
+    } else if !os.IsNotExist(err) {
+        return "", err
+    }
+    
+    id := fmt.Sprintf("gateway-%d", time.Now().UnixNano())
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return "", err
+    }
+    if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+        return "", err
+    }
+    log.Printf("Persisted new gateway ID to %s", path)
+    return id, nil
+}
+
+// gatewayIDFromHostname derives a gateway ID from the machine hostname
+func gatewayIDFromHostname() (string, error) {
+    hostname, err := os.Hostname()
+    if err != nil {
+        return "", err
+    }
+    return "gateway-" + hostname, nil
+}
+
+// gatewayIDFromMAC derives a gateway ID from a network interface's MAC address.
+// If ifaceName is empty the first non-loopback interface with a MAC is used.
+func gatewayIDFromMAC(ifaceName string) (string, error) {
+    interfaces, err := net.Interfaces()
+    if err != nil {
+        return "", err
+    }
+    
+    for _, iface := range interfaces {
+        if ifaceName != "" && iface.Name != ifaceName {
+            continue
+        }
+        if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+            continue
+        }
+        return "gateway-" + strings.ReplaceAll(iface.HardwareAddr.String(), ":", ""), nil
+    }
+    
+    if ifaceName != "" {
+        return "", fmt.Errorf("interface %s not found or has no MAC address", ifaceName)
     }
+    return "", fmt.Errorf("no interface with a MAC address found")
 }
 
 // setupBrokerAddress gets the MQTT broker address from environment
-func setupBrokerAddress() {
+func (g *Gateway) setupBrokerAddress() {
     // Check environment variable
     envBroker := os.Getenv("MQTT_BROKER_ADDRESS")
     
@@ -197,22 +540,22 @@ func setupBrokerAddress() {
     
     // In Docker Desktop, always prioritize using host.docker.internal
     if isDockerDesktop && (envBroker == "" || envBroker == "mqtt-broker:1883") {
-        brokerAddress = "host.docker.internal:1883"
+        g.brokerAddress = "host.docker.internal:1883"
         log.Printf("Docker Desktop detected, using host.docker.internal:1883")
     } else if envBroker != "" {
         // Use whatever broker address was provided
-        brokerAddress = envBroker
-        log.Printf("Using MQTT broker address from environment: %s", brokerAddress)
+        g.brokerAddress = envBroker
+        log.Printf("Using MQTT broker address from environment: %s", g.brokerAddress)
     } else {
         // Default to service name for Docker DNS resolution
-        brokerAddress = "mqtt-broker:1883"
-        log.Printf("No broker address specified, using service name: %s", brokerAddress)
+        g.brokerAddress = "mqtt-broker:1883"
+        log.Printf("No broker address specified, using service name: %s", g.brokerAddress)
     }
     
     // Extract host for resolution checks
-    hostname := brokerAddress
-    if strings.Contains(brokerAddress, ":") {
-        parts := strings.Split(brokerAddress, ":")
+    hostname := g.brokerAddress
+    if strings.Contains(g.brokerAddress, ":") {
+        parts := strings.Split(g.brokerAddress, ":")
         hostname = parts[0]
     }
     
@@ -226,8 +569,8 @@ func setupBrokerAddress() {
             // Don't try alternative approaches in Docker Desktop
             if !isDockerDesktop {
                 // Try to verify the MQTT service is accessible
-                if !checkTCPConnectivity(brokerAddress) {
-                    log.Printf("MQTT broker at %s is not accessible, checking Docker DNS", brokerAddress)
+                if !checkTCPConnectivity(g.brokerAddress) {
+                    log.Printf("MQTT broker at %s is not accessible, checking Docker DNS", g.brokerAddress)
                     // This might be a Docker DNS service name issue
                     log.Printf("Note: In Docker environments, ensure all containers are on the same network")
                     log.Printf("Check that 'mqtt-broker' service is running and on the 'iot-network'")
@@ -238,21 +581,21 @@ func setupBrokerAddress() {
         }
     }
 
-    log.Printf("Final MQTT broker address: %s", brokerAddress)
+    log.Printf("Final MQTT broker address: %s", g.brokerAddress)
 
     // Determine MQTT protocol (tcp, ssl, or tls)
     envProtocol := os.Getenv("MQTT_PROTOCOL")
     if envProtocol != "" {
         // Use explicitly specified protocol
-        mqttProtocol = envProtocol
-        log.Printf("Using MQTT protocol from environment: %s", mqttProtocol)
+        g.mqttProtocol = envProtocol
+        log.Printf("Using MQTT protocol from environment: %s", g.mqttProtocol)
     } else {
         // Auto-detect: use ssl if we have certificates, tcp otherwise
-        if hasCertificates {
-            mqttProtocol = "ssl"
+        if g.hasCertificates.Load() {
+            g.mqttProtocol = "ssl"
             log.Printf("Certificates detected, using SSL/TLS protocol")
         } else {
-            mqttProtocol = "tcp"
+            g.mqttProtocol = "tcp"
             log.Printf("No certificates detected, using TCP protocol")
         }
     }
@@ -307,11 +650,11 @@ func setupApiUrl() string {
 }
 
 // watchCertificates monitors certificate files and sends events when they change
-func watchCertificates() {
+func (g *Gateway) watchCertificates() {
     ticker := time.NewTicker(CheckInterval)
     defer ticker.Stop()
     
-    var prevHasCerts bool = hasCertificates
+    var prevHasCerts bool = g.hasCertificates.Load()
     
     for {
         select {
@@ -322,10 +665,10 @@ func watchCertificates() {
             if currHasCerts != prevHasCerts {
                 if currHasCerts {
                     log.Printf("Certificates found")
-                    eventChan <- Event{Type: EventCertificateFound, Time: time.Now()}
+                    g.eventChan <- Event{Type: EventCertificateFound, Time: time.Now()}
                 } else {
                     log.Printf("Certificates removed")
-                    eventChan <- Event{Type: EventCertificateRemoved, Time: time.Now()}
+                    g.eventChan <- Event{Type: EventCertificateRemoved, Time: time.Now()}
                 }
                 prevHasCerts = currHasCerts
             }
@@ -334,20 +677,23 @@ func watchCertificates() {
 }
 
 // heartbeatTimer triggers heartbeat events at regular intervals
-func heartbeatTimer() {
+func (g *Gateway) heartbeatTimer() {
     ticker := time.NewTicker(HeartbeatInterval)
     defer ticker.Stop()
     
     for {
         select {
         case <-ticker.C:
-            eventChan <- Event{Type: EventHeartbeatDue, Time: time.Now()}
+            g.eventChan <- Event{Type: EventHeartbeatDue, Time: time.Now()}
+        case interval := <-g.heartbeatIntervalChan:
+            log.Printf("Heartbeat interval changed to %v", interval)
+            ticker.Reset(interval)
         }
     }
 }
 
 // handleShadowDelta processes shadow delta messages from AWS IoT
-func handleShadowDelta(msg mqtt.Message) {
+func (g *Gateway) handleShadowDelta(msg mqtt.Message) {
     // Parse shadow delta
     var shadowDelta map[string]interface{}
     if err := json.Unmarshal(msg.Payload(), &shadowDelta); err != nil {
@@ -367,26 +713,26 @@ func handleShadowDelta(msg mqtt.Message) {
     // Check for config_version (which contains the update_id)
     if configVersion, ok := state["config_version"].(string); ok && configVersion != "" {
         log.Printf("New config version detected in shadow: %s", configVersion)
-        currentUpdateID = configVersion
+        g.currentUpdateID = configVersion
 
         // Send config request with the update_id
-        requestConfigWithUpdateID(configVersion)
+        g.requestConfigWithUpdateID(configVersion)
     }
 }
 
 // requestConfig sends a request for the latest configuration (without update_id)
-func requestConfig() {
-    requestConfigWithUpdateID("")
+func (g *Gateway) requestConfig() {
+    g.requestConfigWithUpdateID("")
 }
 
 // requestConfigWithUpdateID sends a request for configuration with optional update_id
-func requestConfigWithUpdateID(updateID string) {
-    if !isMqttConnected || mqttClient == nil {
+func (g *Gateway) requestConfigWithUpdateID(updateID string) {
+    if !g.isMqttConnected.Load() || g.mqttClient == nil {
         log.Printf("Cannot request config: MQTT not connected")
         return
     }
 
-    topic := fmt.Sprintf("gateway/%s/config/request", gatewayID)
+    topic := fmt.Sprintf("gateway/%s/config/request", g.gatewayID)
     payload := map[string]interface{}{
         "timestamp": time.Now().Format(time.RFC3339),
     }
@@ -396,6 +742,11 @@ func requestConfigWithUpdateID(updateID string) {
         payload["update_id"] = updateID
         log.Printf("Config request includes update_id: %s", updateID)
     }
+    
+    // Let the rules engine fall back to a cluster-scoped configuration
+    if cluster := g.gatewayCluster(); cluster != nil {
+        payload["cluster"] = cluster
+    }
 
     jsonData, err := json.Marshal(payload)
     if err != nil {
@@ -403,7 +754,7 @@ func requestConfigWithUpdateID(updateID string) {
         return
     }
 
-    token := mqttClient.Publish(topic, 0, false, jsonData)
+    token := g.mqttClient.Publish(topic, publishQoS(), false, jsonData)
     token.Wait()
 
     if token.Error() != nil {
@@ -417,22 +768,24 @@ func requestConfigWithUpdateID(updateID string) {
     }
 }
 
-// storeConfig safely stores a new configuration
-func storeConfig(yamlConfig string) {
-    configMutex.Lock()
-    defer configMutex.Unlock()
+// storeConfig validates, stores and applies a new configuration, keeping the
+// previous one and returning the reason if it is rejected. The result reports
+// the stored version and how each device took it.
+func (g *Gateway) storeConfig(yamlConfig string) (ConfigApplyResult, error) {
+    g.configMutex.Lock()
+    defer g.configMutex.Unlock()
 
     // Extract port from brokerAddress
     brokerPort := "1883" // Default MQTT port
-    if strings.Contains(brokerAddress, ":") {
-        parts := strings.Split(brokerAddress, ":")
+    if strings.Contains(g.brokerAddress, ":") {
+        parts := strings.Split(g.brokerAddress, ":")
         if len(parts) > 1 {
             brokerPort = parts[1]
         }
     }
 
     log.Printf("Storing configuration, broker address: %s, port: %s",
-                brokerAddress, brokerPort)
+                g.brokerAddress, brokerPort)
     
     // Initialize update_id as empty
     updateID := ""
@@ -443,7 +796,6 @@ func storeConfig(yamlConfig string) {
         // Check for update_id in the JSON
         if id, ok := configData["update_id"].(string); ok && id != "" {
             updateID = id
-            currentUpdateID = id
             log.Printf("Extracted update_id from config: %s", updateID)
 
             // AWS Implementation: Check for presigned S3 URL
@@ -453,7 +805,7 @@ func storeConfig(yamlConfig string) {
                 resp, err := http.Get(cfgURL)
                 if err != nil {
                     log.Printf("Error downloading config from S3: %v", err)
-                    return
+                    return ConfigApplyResult{}, fmt.Errorf("downloading config: %w", err)
                 }
                 defer resp.Body.Close()
 
@@ -461,13 +813,13 @@ func storeConfig(yamlConfig string) {
                     respBody, _ := ioutil.ReadAll(resp.Body)
                     log.Printf("Error downloading config: HTTP %d", resp.StatusCode)
                     log.Printf("S3 Response: %s", string(respBody))
-                    return
+                    return ConfigApplyResult{}, fmt.Errorf("downloading config: HTTP %d", resp.StatusCode)
                 }
 
                 content, err := ioutil.ReadAll(resp.Body)
                 if err != nil {
                     log.Printf("Error reading S3 response: %v", err)
-                    return
+                    return ConfigApplyResult{}, fmt.Errorf("reading downloaded config: %w", err)
                 }
                 yamlConfig = string(content)
                 log.Printf("Downloaded config from S3, size: %d bytes", len(yamlConfig))
@@ -507,243 +859,1053 @@ func storeConfig(yamlConfig string) {
         }
     }
     
-    currentConfig = Config{
+    // Parse the configuration to validate and apply to devices
+    var configMap map[string]interface{}
+    log.Printf("Attempting to parse YAML, length: %d, first 50 chars: %s", len(yamlConfig), yamlConfig[:min(50, len(yamlConfig))])
+    if err := yaml.Unmarshal([]byte(yamlConfig), &configMap); err != nil {
+        log.Printf("Error parsing configuration YAML: %v", err)
+        log.Printf("Full YAML content for debugging: %s", yamlConfig)
+        return ConfigApplyResult{}, fmt.Errorf("invalid YAML: %w", err)
+    }
+    configMap = normalizeYAMLMap(configMap)
+    
+    // Dangling parameter set references are only fatal in strict mode
+    if !strictConfigValidation() {
+        for _, problem := range validateParameterSetReferences(configMap) {
+            log.Printf("Config warning: %s", problem)
+        }
+    }
+    if err := validateGatewayConfig(configMap); err != nil {
+        log.Printf("Rejecting configuration, keeping the previous one: %v", err)
+        return ConfigApplyResult{}, err
+    }
+    
+    // Only an accepted configuration becomes the current update
+    if updateID != "" {
+        g.currentUpdateID = updateID
+    }
+    g.currentConfig = Config{
         YAML:      yamlConfig,
         UpdatedAt: time.Now(),
     }
+    g.recordConfigHistory(g.currentConfig)
+    result := ConfigApplyResult{Version: configVersionHash(yamlConfig)}
     
     // Update device manager with the new configuration
-    if endDeviceManager != nil {
-        // Parse the configuration to apply to devices
-        var configMap map[string]interface{}
-        log.Printf("Attempting to parse YAML, length: %d, first 50 chars: %s", len(yamlConfig), yamlConfig[:min(50, len(yamlConfig))])
-        if err := yaml.Unmarshal([]byte(yamlConfig), &configMap); err != nil {
-            log.Printf("Error parsing configuration YAML: %v", err)
-            log.Printf("Full YAML content for debugging: %s", yamlConfig)
-            return
-        }
-        
+    if g.endDeviceManager != nil {
         // Update all devices with the new configuration
-        if endDeviceManager.UpdateDeviceConfig(configMap) {
+        result = g.endDeviceManager.UpdateDeviceConfig(configMap)
+        result.Version = configVersionHash(yamlConfig)
+        if result.Updated > 0 {
             log.Printf("Device configurations updated successfully")
         }
     }
     
     log.Printf("New configuration stored, size: %d bytes", len(yamlConfig))
+    return result, nil
+}
+
+// configHistorySize returns how many stored configurations are kept for
+// rollback, from CONFIG_HISTORY_SIZE (default 10, 0 = no history)
+func configHistorySize() int {
+    if value := os.Getenv("CONFIG_HISTORY_SIZE"); value != "" {
+        if size, err := strconv.Atoi(value); err == nil && size >= 0 {
+            return size
+        }
+        log.Printf("Invalid CONFIG_HISTORY_SIZE %q, using default", value)
+    }
+    return 10
+}
+
+// recordConfigHistory adds a stored configuration to the history, moving a
+// re-stored version to the end and dropping the oldest entries beyond the limit.
+// The caller must hold configMutex.
+func (g *Gateway) recordConfigHistory(config Config) {
+    version := configVersionHash(config.YAML)
+    history := g.configHistory[:0]
+    for _, entry := range g.configHistory {
+        if entry.Version != version {
+            history = append(history, entry)
+        }
+    }
+    history = append(history, ConfigHistoryEntry{
+        Version:  version,
+        YAML:     config.YAML,
+        StoredAt: config.UpdatedAt,
+    })
+    if limit := configHistorySize(); len(history) > limit {
+        history = append([]ConfigHistoryEntry(nil), history[len(history)-limit:]...)
+    }
+    g.configHistory = history
+}
+
+// getConfigHistory returns a copy of the configuration history, oldest first
+func (g *Gateway) getConfigHistory() []ConfigHistoryEntry {
+    g.configMutex.RLock()
+    defer g.configMutex.RUnlock()
+    return append([]ConfigHistoryEntry(nil), g.configHistory...)
+}
+
+// findConfigVersion returns the configuration with the given version hash from the history
+func (g *Gateway) findConfigVersion(version string) (ConfigHistoryEntry, bool) {
+    for _, entry := range g.getConfigHistory() {
+        if entry.Version == version {
+            return entry, true
+        }
+    }
+    return ConfigHistoryEntry{}, false
+}
+
+// rollbackConfig stores and applies a previous configuration from the history again
+func (g *Gateway) rollbackConfig(version string) (ConfigApplyResult, error) {
+    entry, ok := g.findConfigVersion(version)
+    if !ok {
+        return ConfigApplyResult{}, fmt.Errorf("config version %q is not in the history", version)
+    }
+    log.Printf("Rolling back to configuration version %s stored at %s", version, entry.StoredAt.Format(time.RFC3339))
+    return g.storeConfig(entry.YAML)
+}
+
+// validateGatewayConfig checks that a configuration has the devices and
+// parameter_sets sections and sane measurement bounds. Dangling parameter set
+// references are included when CONFIG_STRICT_VALIDATION is enabled.
+func validateGatewayConfig(config map[string]interface{}) error {
+    var problems []string
+    
+    for _, section := range []string{"devices", "parameter_sets"} {
+        value, exists := config[section]
+        if !exists {
+            problems = append(problems, fmt.Sprintf("missing %s section", section))
+        } else if _, ok := value.(map[string]interface{}); !ok {
+            problems = append(problems, fmt.Sprintf("%s must be a mapping", section))
+        }
+    }
+    
+    if measurement, ok := config["measurement"].(map[string]interface{}); ok {
+        for _, bounds := range [][2]string{{"min_weight_kg", "max_weight_kg"}, {"min_temperature_c", "max_temperature_c"}} {
+            min, hasMin := toFloat64(measurement[bounds[0]])
+            max, hasMax := toFloat64(measurement[bounds[1]])
+            if hasMin && hasMax && min >= max {
+                problems = append(problems, fmt.Sprintf("measurement.%s (%v) must be below %s (%v)", bounds[0], min, bounds[1], max))
+            }
+        }
+        if value, exists := measurement["precision"]; exists {
+            if precision, ok := toFloat64(value); !ok || precision <= 0 {
+                problems = append(problems, fmt.Sprintf("measurement.precision must be positive, got %v", value))
+            }
+        }
+    }
+    
+    if strictConfigValidation() {
+        problems = append(problems, validateParameterSetReferences(config)...)
+    }
+    
+    if len(problems) > 0 {
+        return errors.New(strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+// normalizeYAMLMap converts any map[interface{}]interface{} produced by
+// anchor/alias expansion into map[string]interface{}, recursively
+func normalizeYAMLMap(config map[string]interface{}) map[string]interface{} {
+    if config == nil {
+        return nil
+    }
+    return normalizeYAMLValue(config).(map[string]interface{})
+}
+
+// normalizeYAMLValue normalizes a single decoded YAML value
+func normalizeYAMLValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case map[interface{}]interface{}:
+        result := make(map[string]interface{}, len(v))
+        for key, item := range v {
+            result[fmt.Sprintf("%v", key)] = normalizeYAMLValue(item)
+        }
+        return result
+    case map[string]interface{}:
+        result := make(map[string]interface{}, len(v))
+        for key, item := range v {
+            result[key] = normalizeYAMLValue(item)
+        }
+        return result
+    case []interface{}:
+        result := make([]interface{}, len(v))
+        for i, item := range v {
+            result[i] = normalizeYAMLValue(item)
+        }
+        return result
+    default:
+        return value
+    }
+}
+
+// validateParameterSetReferences returns a description of every parameter set
+// mapping or default that references a set missing from parameter_sets
+func validateParameterSetReferences(config map[string]interface{}) []string {
+    var problems []string
+    
+    devicesConfig, ok := config["devices"].(map[string]interface{})
+    if !ok {
+        return problems
+    }
+    parameterSets, _ := config["parameter_sets"].(map[string]interface{})
+    
+    if mappings, ok := devicesConfig["parameter_set_mappings"].(map[string]interface{}); ok {
+        deviceIDs := make([]string, 0, len(mappings))
+        for deviceID := range mappings {
+            deviceIDs = append(deviceIDs, deviceID)
+        }
+        sort.Strings(deviceIDs)
+        
+        for _, deviceID := range deviceIDs {
+            setName, _ := mappings[deviceID].(string)
+            if _, exists := parameterSets[setName]; !exists {
+                problems = append(problems, fmt.Sprintf(
+                    "parameter_set_mappings[%s] references unknown parameter set %q", deviceID, setName))
+            }
+        }
+    }
+    
+    if defaultSet, ok := devicesConfig["default_parameter_set"].(string); ok && defaultSet != "" {
+        if _, exists := parameterSets[defaultSet]; !exists {
+            problems = append(problems, fmt.Sprintf(
+                "default_parameter_set references unknown parameter set %q", defaultSet))
+        }
+    }
+    
+    return problems
+}
+
+// strictConfigValidation reports whether configs with dangling references should be rejected
+func strictConfigValidation() bool {
+    return os.Getenv("CONFIG_STRICT_VALIDATION") == "true"
 }
 
 // getConfig safely retrieves the current configuration
-func getConfig() Config {
-    configMutex.RLock()
-    defer configMutex.RUnlock()
+func (g *Gateway) getConfig() Config {
+    g.configMutex.RLock()
+    defer g.configMutex.RUnlock()
     
-    return currentConfig
+    return g.currentConfig
+}
+
+// configUpdateID returns the update_id of a JSON config update payload, if any
+func configUpdateID(payload []byte) string {
+    var configData map[string]interface{}
+    if err := json.Unmarshal(payload, &configData); err != nil {
+        return ""
+    }
+    updateID, _ := configData["update_id"].(string)
+    return updateID
 }
 
-// sendConfigAcknowledgment sends an acknowledgment for a received configuration
-func sendConfigAcknowledgment(status string) {
-    if !isMqttConnected || mqttClient == nil {
+// sendConfigAcknowledgment tells the backend how a delivered configuration was
+// applied: the stored version and per-device outcome, or the reason it was
+// rejected and the previous one is still in use
+func (g *Gateway) sendConfigAcknowledgment(updateID string, result ConfigApplyResult, storeErr error) {
+    if !g.isMqttConnected.Load() || g.mqttClient == nil {
         log.Printf("Cannot send config acknowledgment: MQTT not connected")
         return
     }
     
-    topic := fmt.Sprintf("gateway/%s/config/delivered", gatewayID)
+    topic := fmt.Sprintf("gateway/%s/config/delivered", g.gatewayID)
 
     // Ensure we have the original update_id
-    updateID := currentUpdateID
     if updateID == "" {
         log.Printf("Warning: Missing update_id, config acknowledgment may not be tracked properly")
     }
     
     payload := map[string]interface{}{
-        "status": status,
         "timestamp": time.Now().Format(time.RFC3339),
         "update_id": updateID,
     }
     
+    // Include the version hash so the backend can correlate; a rejected config
+    // reports the version still in use
+    if storeErr == nil && result.Version != "" {
+        payload["config_version"] = result.Version
+    } else if yamlConfig := g.getConfig().YAML; yamlConfig != "" {
+        payload["config_version"] = configVersionHash(yamlConfig)
+    }
+    
+    if storeErr != nil {
+        payload["status"] = "rejected"
+        payload["error"] = storeErr.Error()
+    } else {
+        payload["status"] = result.status()
+        payload["devices_total"] = result.Devices
+        payload["devices_updated"] = result.Updated
+        payload["devices_unchanged"] = result.Unchanged
+        payload["devices_failed"] = len(result.Failed)
+        // Report devices that could not apply the configuration
+        if len(result.Failed) > 0 {
+            payload["device_errors"] = result.Failed
+        }
+    }
+    
     jsonData, err := json.Marshal(payload)
     if err != nil {
         log.Printf("Error marshaling config acknowledgment: %v", err)
         return
     }
     
-    token := mqttClient.Publish(topic, 0, false, jsonData)
-    token.Wait()
-    
-    if token.Error() != nil {
-        log.Printf("Error sending config acknowledgment: %v", token.Error())
-    } else {
-        log.Printf("Configuration acknowledgment sent to topic: %s", topic)
+    // Retries back off for up to minutes, so keep them off the event loop
+    g.configAcks.Add(1)
+    go func() {
+        defer g.configAcks.Done()
+        g.publishConfigAcknowledgment(topic, jsonData)
+    }()
+}
+
+var (
+    // Delay before the first ack retry, doubled per attempt up to configAckMaxBackoff
+    configAckBackoff    = time.Second
+    configAckMaxBackoff = 30 * time.Second
+)
+
+// publishQoS reads GATEWAY_PUBLISH_QOS (0-2, default 0), the QoS for measurements,
+// heartbeats and config requests
+func publishQoS() byte {
+    if qos, err := strconv.Atoi(os.Getenv("GATEWAY_PUBLISH_QOS")); err == nil && qos >= 0 && qos <= 2 {
+        return byte(qos)
     }
+    return 0
 }
 
-// NewDeviceManager creates a new device manager
-func NewDeviceManager() *DeviceManager {
-    manager := &DeviceManager{
-        Devices: make(map[string]*ConfiguredEndDevice),
+// configAckQoS reads CONFIG_ACK_QOS (0-2), falling back to GATEWAY_PUBLISH_QOS and then 1
+func configAckQoS() byte {
+    if qos, err := strconv.Atoi(os.Getenv("CONFIG_ACK_QOS")); err == nil && qos >= 0 && qos <= 2 {
+        return byte(qos)
     }
-    return manager
+    if os.Getenv("GATEWAY_PUBLISH_QOS") != "" {
+        return publishQoS()
+    }
+    return 1
 }
 
-// UpdateDeviceConfig updates devices with a new configuration
-func (dm *DeviceManager) UpdateDeviceConfig(gatewayConfig map[string]interface{}) bool {
-    dm.DeviceMutex.Lock()
-    defer dm.DeviceMutex.Unlock()
-    
-    // First create/update devices based on config
-    dm.updateDevices(gatewayConfig)
-    
-    // Process configuration for each device
-    updatedAny := false
-    for id, device := range dm.Devices {
-        // Extract device-specific config
-        deviceConfig := getDeviceConfig(id, device.Type, gatewayConfig)
+// configAckMaxAttempts reads CONFIG_ACK_MAX_ATTEMPTS (default 5)
+func configAckMaxAttempts() int {
+    if attempts, err := strconv.Atoi(os.Getenv("CONFIG_ACK_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+        return attempts
+    }
+    return 5
+}
+
+// publishConfigAcknowledgment publishes the ack, retrying with exponential backoff
+// until the broker confirms it, CONFIG_ACK_MAX_ATTEMPTS is reached or the gateway
+// shuts down
+func (g *Gateway) publishConfigAcknowledgment(topic string, jsonData []byte) bool {
+    qos := configAckQoS()
+    maxAttempts := configAckMaxAttempts()
+    backoff := configAckBackoff
+    
+    for attempt := 1; attempt <= maxAttempts; attempt++ {
+        token := g.mqttClient.Publish(topic, qos, false, jsonData)
+        token.Wait()
         
-        // Create config hash
-        h := sha256.New()
-        configBytes, _ := yaml.Marshal(deviceConfig)
-        h.Write(configBytes)
-        newVersion := fmt.Sprintf("%x", h.Sum(nil))[:8]
+        if token.Error() == nil {
+            log.Printf("Configuration acknowledgment sent to topic: %s (attempt %d)", topic, attempt)
+            return true
+        }
+        log.Printf("Error sending config acknowledgment (attempt %d/%d): %v", attempt, maxAttempts, token.Error())
         
-        // Check if config has changed
-        if device.ConfigVersion != newVersion {
-            log.Printf("Configuration changed for device %s: %s -> %s", 
-                id, device.ConfigVersion, newVersion)
-            
-            // Initialize update status
-            if device.UpdateStatus == nil {
-                device.UpdateStatus = &UpdateStatus{}
+        if attempt < maxAttempts {
+            select {
+            case <-time.After(backoff):
+            case <-g.shutdown:
+                log.Printf("Abandoning config acknowledgment retries: gateway shutting down")
+                return false
+            }
+            if backoff *= 2; backoff > configAckMaxBackoff {
+                backoff = configAckMaxBackoff
             }
-            
-            // Start update process
-            device.UpdateStatus.InProgress = true
-            device.UpdateStatus.StartTime = time.Now()
-            device.UpdateStatus.SuspendMeasure = true
-            device.UpdateStatus.StatusMessage = "Updating configuration"
-            
-            // Store new config
-            device.DeviceConfig = deviceConfig
-            device.ConfigVersion = newVersion
-            device.LastConfigFetch = time.Now()
-            device.HasDefaultConfig = false
-            
-            // Activate the right parameter set
-            activateParameterSet(deviceConfig)
-            
-            // Complete update
-            device.UpdateStatus.InProgress = false
-            device.UpdateStatus.SuspendMeasure = false
-            device.UpdateStatus.StatusMessage = "Configuration updated successfully"
-            
-            updatedAny = true
         }
-        log.Printf("Device %s assigned parameter set: %s", id, device.DeviceConfig["active_parameter_set"])
     }
-    return updatedAny
+    
+    log.Printf("Giving up on config acknowledgment after %d attempts", maxAttempts)
+    return false
 }
 
-// updateDevices manages devices based on gateway configuration
-func (dm *DeviceManager) updateDevices(config map[string]interface{}) {
-    // Get device configuration
-    devicesConfig, ok := config["devices"].(map[string]interface{})
-    if !ok {
-        log.Printf("No devices configuration found")
-        return
+// configVersionHash returns the short version hash of a YAML configuration
+func configVersionHash(yamlConfig string) string {
+    h := sha256.New()
+    h.Write([]byte(yamlConfig))
+    return fmt.Sprintf("%x", h.Sum(nil))[:8]
+}
+
+// NewDeviceManager creates a new device manager
+func NewDeviceManager(gateway *Gateway) *DeviceManager {
+    manager := &DeviceManager{
+        gateway:         gateway,
+        Devices:         make(map[string]*ConfiguredEndDevice),
+        Anomalies:       make(map[string]*CorrelatedAnomaly),
+        anomalyTriggers: make(map[string]string),
+        mirrors:         make(map[string]map[string]*ConfiguredEndDevice),
     }
     
-    // Get target device count
-    targetCount := 5 // Default
-    if count, ok := devicesConfig["count"].(int); ok && count > 0 {
-        targetCount = count
+    // Configure measurement deduplication
+    window := 60 * time.Second
+    if value := os.Getenv("MEASUREMENT_DEDUP_WINDOW_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+            window = time.Duration(seconds) * time.Second
+        }
+    }
+    capacity := 1000
+    if value := os.Getenv("MEASUREMENT_DEDUP_SIZE"); value != "" {
+        if size, err := strconv.Atoi(value); err == nil && size > 0 {
+            capacity = size
+        }
+    }
+    if window > 0 {
+        manager.dedup = newMeasurementDedup(window, capacity)
     }
     
-    // Get current device count
-    currentCount := len(dm.Devices)
+    // Configure buffering while disconnected
+    manager.offline = newOfflineBufferFromEnv()
     
-    // Create new devices if needed
-    for i := currentCount + 1; i <= targetCount; i++ {
-        deviceID := fmt.Sprintf("scale-%s-%d", gatewayID, i)
-        log.Printf("Creating new device: %s", deviceID)
-        
-        device := &ConfiguredEndDevice{
-            ID:              deviceID,
-            GatewayID:       gatewayID,
-            Type:            "scale",
-            Status:          "online",
-            StopChan:        make(chan bool),
-            Capabilities:    make(map[string]bool),
-            DiagnosticInfo:  make(map[string]interface{}),
-            MeasurementCount: 0,
-            FirmwareVersion: "v1.2.3",
-        }
-        
-        // Get device-specific configuration
-        deviceConfig := getDeviceConfig(deviceID, "scale", config)
-        device.DeviceConfig = deviceConfig
-        
-        // Activate the appropriate parameter set
-        activateParameterSet(deviceConfig)
-        
-        dm.Devices[deviceID] = device
-        
-        // Start the device simulation
-        go dm.runDeviceSimulation(device)
+    // Configure measurement batching
+    if manager.batcher = newMeasurementBatcherFromEnv(); manager.batcher != nil {
+        go manager.runBatchFlusher()
     }
     
-    // Remove excess devices if needed
-    if currentCount > targetCount {
-        // Find devices to remove
-        var toRemove []string
-        count := 0
-        for id := range dm.Devices {
-            if count >= (currentCount - targetCount) {
-                break
-            }
-            toRemove = append(toRemove, id)
-            count++
+    // Configure measurement schema validation
+    manager.schemas = newSchemaRegistryFromEnv()
+    
+    // Configure replay of recorded measurements
+    manager.replay = newReplayRecordingFromEnv()
+    
+    // Restore device counters saved by a previous run
+    if manager.stats = newDeviceStatsStoreFromEnv(); manager.stats != nil {
+        go manager.runStatsSaver()
+    }
+    
+    // Configure removed-device tombstones
+    if value := os.Getenv("DEVICE_TOMBSTONE_RETENTION_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+            manager.tombstoneTTL = time.Duration(seconds) * time.Second
         }
-        
-        // Stop and remove each device
-        for _, id := range toRemove {
-            device := dm.Devices[id]
-            close(device.StopChan) // Signal to stop
-            delete(dm.Devices, id)
-            log.Printf("Removed device: %s", id)
+    }
+    manager.tombstoneLimit = 100
+    if value := os.Getenv("DEVICE_TOMBSTONE_MAX"); value != "" {
+        if size, err := strconv.Atoi(value); err == nil && size > 0 {
+            manager.tombstoneLimit = size
+        }
+    }
+    return manager
+}
+
+// removeDevice stops a device and drops it from the manager, keeping a tombstone
+// of its statistics if enabled. The caller must hold DeviceMutex.
+func (dm *DeviceManager) removeDevice(id string) {
+    device, ok := dm.Devices[id]
+    if !ok {
+        return
+    }
+    device.stop()
+    delete(dm.Devices, id)
+    dm.recordTombstone(device, time.Now())
+    log.Printf("Removed device: %s", id)
+}
+
+// stop signals the device's simulation to exit; repeated calls are no-ops
+func (device *ConfiguredEndDevice) stop() {
+    device.stopOnce.Do(func() {
+        close(device.StopChan)
+    })
+}
+
+// deviceIndex returns the numeric suffix of a device ID (0 if it has none)
+func deviceIndex(id string) int {
+    index, _ := strconv.Atoi(id[strings.LastIndex(id, "-")+1:])
+    return index
+}
+
+// sortByIndexDescending orders device IDs highest index first, so a shrinking
+// fleet always drops its newest devices
+func sortByIndexDescending(ids []string) {
+    sort.Slice(ids, func(i, j int) bool {
+        if a, b := deviceIndex(ids[i]), deviceIndex(ids[j]); a != b {
+            return a > b
+        }
+        return ids[i] > ids[j]
+    })
+}
+
+// RemoveDevice stops a single device and drops it from the manager, reporting
+// whether the device existed
+func (dm *DeviceManager) RemoveDevice(id string) bool {
+    dm.DeviceMutex.Lock()
+    defer dm.DeviceMutex.Unlock()
+    
+    if _, ok := dm.Devices[id]; !ok {
+        return false
+    }
+    dm.removeDevice(id)
+    return true
+}
+
+// nextDeviceID returns the first unused device ID at or after index, so devices
+// created after an individual removal never replace a running one. The caller
+// must hold DeviceMutex.
+func (dm *DeviceManager) nextDeviceID(deviceType string, index int) string {
+    for {
+        deviceID := fmt.Sprintf("%s-%s-%d", deviceTypePrefixes[deviceType], dm.gateway.gatewayID, index)
+        if _, exists := dm.Devices[deviceID]; !exists {
+            return deviceID
         }
+        index++
+    }
+}
+
+// DeviceStats are the counters of one device saved to DEVICE_STATS_FILE
+type DeviceStats struct {
+    DeviceID            string  `json:"device_id"`
+    MeasurementCount    int     `json:"measurement_count"`
+    TotalWeightMeasured float64 `json:"total_weight"`
+    ConfigVersion       string  `json:"config_version"`
+}
+
+// deviceStatsStore saves device counters to a JSON file and restores them on startup
+type deviceStatsStore struct {
+    path     string
+    interval time.Duration
+    restored map[string]DeviceStats // Saved stats by device ID, applied as devices are created (guarded by DeviceMutex)
+}
+
+// newDeviceStatsStoreFromEnv reads DEVICE_STATS_FILE (unset = no persistence) and
+// DEVICE_STATS_SAVE_INTERVAL_SECONDS (default 60), loading any previously saved stats
+func newDeviceStatsStoreFromEnv() *deviceStatsStore {
+    path := os.Getenv("DEVICE_STATS_FILE")
+    if path == "" {
+        return nil
+    }
+    store := &deviceStatsStore{path: path, interval: 60 * time.Second, restored: make(map[string]DeviceStats)}
+    if seconds, err := strconv.Atoi(os.Getenv("DEVICE_STATS_SAVE_INTERVAL_SECONDS")); err == nil && seconds > 0 {
+        store.interval = time.Duration(seconds) * time.Second
+    }
+    store.load()
+    return store
+}
+
+// load reads saved stats, starting fresh if the file is missing or corrupt
+func (s *deviceStatsStore) load() {
+    data, err := ioutil.ReadFile(s.path)
+    if os.IsNotExist(err) {
+        return
+    }
+    if err != nil {
+        log.Printf("Error reading device stats from %s, starting fresh: %v", s.path, err)
+        return
     }
     
-    // Update existing devices with new configuration
+    var saved []DeviceStats
+    if err := json.Unmarshal(data, &saved); err != nil {
+        log.Printf("Corrupt device stats file %s, starting fresh: %v", s.path, err)
+        return
+    }
+    for _, stats := range saved {
+        s.restored[stats.DeviceID] = stats
+    }
+    log.Printf("Loaded saved stats for %d device(s) from %s", len(saved), s.path)
+}
+
+// restore applies a new device's saved counters. The caller must hold DeviceMutex.
+func (s *deviceStatsStore) restore(device *ConfiguredEndDevice) {
+    if s == nil {
+        return
+    }
+    stats, ok := s.restored[device.ID]
+    if !ok {
+        return
+    }
+    delete(s.restored, device.ID)
+    device.MeasurementCount = stats.MeasurementCount
+    device.TotalWeightMeasured = stats.TotalWeightMeasured
+    log.Printf("Device %s: restored %d measurement(s) saved under config version %s",
+        device.ID, stats.MeasurementCount, stats.ConfigVersion)
+}
+
+// saveStats writes every device's counters to DEVICE_STATS_FILE
+func (dm *DeviceManager) saveStats() error {
+    dm.DeviceMutex.RLock()
+    saved := make([]DeviceStats, 0, len(dm.Devices))
     for id, device := range dm.Devices {
-        // Skip newly created devices
-        if device.ConfigVersion == "" {
-            // Get device-specific configuration
-            deviceConfig := getDeviceConfig(id, "scale", config)
-            device.DeviceConfig = deviceConfig
+        saved = append(saved, DeviceStats{
+            DeviceID:            id,
+            MeasurementCount:    device.MeasurementCount,
+            TotalWeightMeasured: device.TotalWeightMeasured,
+            ConfigVersion:       device.ConfigVersion,
+        })
+    }
+    dm.DeviceMutex.RUnlock()
+    sort.Slice(saved, func(i, j int) bool { return saved[i].DeviceID < saved[j].DeviceID })
+    
+    data, err := json.MarshalIndent(saved, "", "  ")
+    if err != nil {
+        return err
+    }
+    
+    // Write to a temporary file first so a crash never leaves a half-written file
+    tmpPath := dm.stats.path + ".tmp"
+    if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmpPath, dm.stats.path)
+}
+
+// runStatsSaver saves device counters periodically
+func (dm *DeviceManager) runStatsSaver() {
+    ticker := time.NewTicker(dm.stats.interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if err := dm.saveStats(); err != nil {
+            log.Printf("Error saving device stats: %v", err)
+        }
+    }
+}
+
+// recordTombstone stores the final statistics of a removed device
+func (dm *DeviceManager) recordTombstone(device *ConfiguredEndDevice, now time.Time) {
+    if dm.tombstoneTTL <= 0 {
+        return
+    }
+    
+    parameterSet, _ := device.DeviceConfig["active_parameter_set"].(string)
+    uptime := device.UptimeSeconds
+    if !device.StartTime.IsZero() {
+        uptime = int64(now.Sub(device.StartTime).Seconds())
+    }
+    
+    dm.tombstoneMutex.Lock()
+    defer dm.tombstoneMutex.Unlock()
+    dm.tombstones = append(dm.tombstones, DeviceTombstone{
+        DeviceID:            device.ID,
+        ParameterSet:        parameterSet,
+        FirmwareVersion:     device.FirmwareVersion,
+        MeasurementCount:    device.MeasurementCount,
+        TotalWeightMeasured: device.TotalWeightMeasured,
+        UptimeSeconds:       uptime,
+        StartedAt:           device.StartTime,
+        RemovedAt:           now,
+    })
+    if excess := len(dm.tombstones) - dm.tombstoneLimit; excess > 0 {
+        dm.tombstones = dm.tombstones[excess:]
+    }
+}
+
+// RemovedDevices returns the tombstones still within the retention period
+func (dm *DeviceManager) RemovedDevices(now time.Time) []DeviceTombstone {
+    dm.tombstoneMutex.Lock()
+    defer dm.tombstoneMutex.Unlock()
+    
+    // Evict expired tombstones (they are ordered by removal time)
+    expired := 0
+    for expired < len(dm.tombstones) && now.Sub(dm.tombstones[expired].RemovedAt) > dm.tombstoneTTL {
+        expired++
+    }
+    dm.tombstones = dm.tombstones[expired:]
+    
+    return append([]DeviceTombstone{}, dm.tombstones...)
+}
+
+// UpdateDeviceConfig updates devices with a new configuration in three phases:
+// devices are created or removed under the write lock, per-device configs are
+// computed by parallel workers holding no lock, and changed configs are swapped in
+// under the write lock. New devices start simulating only after the swap, so their
+// goroutines never see a device without configuration. Whole applies are
+// serialized, so one config's phases never interleave with another's.
+func (dm *DeviceManager) UpdateDeviceConfig(gatewayConfig map[string]interface{}) ConfigApplyResult {
+    dm.applyMutex.Lock()
+    defer dm.applyMutex.Unlock()
+    
+    dm.DeviceMutex.Lock()
+    reconcileStart := time.Now()
+    
+    // Create and remove devices based on config
+    created := dm.reconcileDevices(gatewayConfig)
+    
+    // Load correlated anomaly definitions
+    dm.loadAnomalies(gatewayConfig)
+    
+    // Snapshot the fleet so configs can be computed without the lock
+    updates := make([]*deviceConfigUpdate, 0, len(dm.Devices))
+    for _, device := range dm.Devices {
+        updates = append(updates, &deviceConfigUpdate{
+            device:          device,
+            deviceType:      device.Type,
+            firmwareVersion: device.FirmwareVersion,
+        })
+    }
+    reconcileHold := time.Since(reconcileStart)
+    dm.DeviceMutex.Unlock()
+    
+    computeDeviceConfigs(updates, gatewayConfig, configApplyWorkers())
+    
+    dm.DeviceMutex.Lock()
+    lockStart := time.Now()
+    
+    // Process configuration for each device
+    result := ConfigApplyResult{Failed: make(map[string]string)}
+    for _, update := range updates {
+        device := update.device
+        id := device.ID
+        
+        // Skip devices removed while configs were being computed
+        if dm.Devices[id] != device {
+            continue
+        }
+        
+        // Check if config has changed
+        if device.ConfigVersion != update.version {
+            if device.ConfigVersion == "" {
+                log.Printf("Initialized configuration for device %s: version %s", id, update.version)
+            } else {
+                log.Printf("Configuration changed for device %s: %s -> %s",
+                    id, device.ConfigVersion, update.version)
+            }
+            
+            // Keep the current configuration if the new one can't be activated
+            if update.err != nil {
+                device.markUpdateFailed(update.err)
+                result.Failed[id] = device.UpdateStatus.StatusMessage
+                result.Devices++
+                continue
+            }
             
-            // Activate parameter set
-            activateParameterSet(deviceConfig)
+            // Initialize update status
+            if device.UpdateStatus == nil {
+                device.UpdateStatus = &UpdateStatus{}
+            }
+            device.UpdateStatus.Failed = false
+            
+            // Start update process
+            device.UpdateStatus.InProgress = true
+            device.UpdateStatus.StartTime = time.Now()
+            device.UpdateStatus.SuspendMeasure = true
+            device.UpdateStatus.StatusMessage = "Updating configuration"
             
-            // Generate version hash
-            h := sha256.New()
-            configBytes, _ := yaml.Marshal(deviceConfig)
-            h.Write(configBytes)
-            device.ConfigVersion = fmt.Sprintf("%x", h.Sum(nil))[:8]
+            // Store new config (its parameter set was activated by the worker)
+            device.DeviceConfig = update.config
+            device.Capabilities = update.capabilities
+            device.ConfigVersion = update.version
             device.LastConfigFetch = time.Now()
+            device.HasDefaultConfig = false
+            
+            // Complete update
+            device.UpdateStatus.InProgress = false
+            device.UpdateStatus.SuspendMeasure = false
+            device.UpdateStatus.StatusMessage = "Configuration updated successfully"
             
-            log.Printf("Initialized configuration for device %s: version %s", 
-                id, device.ConfigVersion)
+            result.Updated++
+        } else {
+            result.Unchanged++
+        }
+        result.Devices++
+        log.Printf("Device %s assigned parameter set: %s", id, device.DeviceConfig["active_parameter_set"])
+    }
+    dm.configApplied = true
+    dm.configLockHold = reconcileHold + time.Since(lockStart)
+    log.Printf("Applied configuration to %d devices, device lock held for %v", len(updates), dm.configLockHold)
+    
+    // Start the new devices that weren't removed in the meantime
+    var started []*ConfiguredEndDevice
+    for _, device := range created {
+        if dm.Devices[device.ID] == device {
+            started = append(started, device)
+        }
+    }
+    dm.DeviceMutex.Unlock()
+    
+    for _, device := range started {
+        go dm.runDeviceSimulation(device)
+    }
+    return result
+}
+
+// ConfigApplyResult is the outcome of applying a gateway configuration to the devices
+type ConfigApplyResult struct {
+    Version   string            // Version hash of the configuration
+    Devices   int               // Devices the configuration was applied to
+    Updated   int               // Devices whose configuration changed
+    Unchanged int               // Devices already on this configuration
+    Failed    map[string]string // Devices that kept their previous configuration, with the reason
+}
+
+// status summarizes the result for the config acknowledgment
+func (result ConfigApplyResult) status() string {
+    if len(result.Failed) > 0 {
+        return "partial_failure"
+    }
+    return "success"
+}
+
+// deviceConfigUpdate is a device's new configuration, computed before it is applied
+type deviceConfigUpdate struct {
+    device          *ConfiguredEndDevice
+    deviceType      string
+    firmwareVersion string
+    
+    config       map[string]interface{}
+    capabilities map[string]bool
+    version      string
+    err          error // Set when the config can't be activated
+}
+
+// configApplyWorkers reads CONFIG_APPLY_WORKERS (default: number of CPUs)
+func configApplyWorkers() int {
+    if workers, err := strconv.Atoi(os.Getenv("CONFIG_APPLY_WORKERS")); err == nil && workers > 0 {
+        return workers
+    }
+    return runtime.NumCPU()
+}
+
+// computeDeviceConfigs fills in each update using up to workers goroutines. Every
+// device gets a private copy of the gateway config, since activating a parameter set
+// and applying overrides modify the nested maps.
+func computeDeviceConfigs(updates []*deviceConfigUpdate, gatewayConfig map[string]interface{}, workers int) {
+    if workers > len(updates) {
+        workers = len(updates)
+    }
+    
+    jobs := make(chan *deviceConfigUpdate)
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for update := range jobs {
+                update.compute(gatewayConfig)
+            }
+        }()
+    }
+    for _, update := range updates {
+        jobs <- update
+    }
+    close(jobs)
+    wg.Wait()
+}
+
+// compute derives the device config, its version hash and capabilities
+func (update *deviceConfigUpdate) compute(gatewayConfig map[string]interface{}) {
+    id := update.device.ID
+    privateConfig := deepCopyValue(gatewayConfig).(map[string]interface{})
+    
+    // Extract device-specific config
+    update.config = getDeviceConfig(id, update.deviceType, update.firmwareVersion, privateConfig)
+    
+    // Create config hash
+    h := sha256.New()
+    configBytes, _ := yaml.Marshal(update.config)
+    h.Write(configBytes)
+    update.version = fmt.Sprintf("%x", h.Sum(nil))[:8]
+    
+    if update.err = validateDeviceConfig(update.config); update.err != nil {
+        return
+    }
+    update.capabilities = resolveCapabilities(id, update.firmwareVersion, privateConfig)
+    
+    // Activate the right parameter set
+    activateParameterSet(update.config)
+}
+
+// deepCopyValue copies nested maps and slices so the copy can be modified independently
+func deepCopyValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case map[string]interface{}:
+        result := make(map[string]interface{}, len(v))
+        for key, item := range v {
+            result[key] = deepCopyValue(item)
+        }
+        return result
+    case []interface{}:
+        result := make([]interface{}, len(v))
+        for i, item := range v {
+            result[i] = deepCopyValue(item)
+        }
+        return result
+    default:
+        return value
+    }
+}
+
+// validateDeviceConfig checks that a device's active parameter set can be activated
+func validateDeviceConfig(deviceConfig map[string]interface{}) error {
+    activeSetName, _ := deviceConfig["active_parameter_set"].(string)
+    if activeSetName == "" {
+        return nil
+    }
+    
+    parameterSets, _ := deviceConfig["parameter_sets"].(map[string]interface{})
+    activeSet, ok := parameterSets[activeSetName].(map[string]interface{})
+    if !ok {
+        return fmt.Errorf("parameter set %q is not defined", activeSetName)
+    }
+    
+    required, hasRequired := activeSet["required_parameters"]
+    if !hasRequired || required == nil {
+        return nil
+    }
+    requiredList, ok := required.([]interface{})
+    if !ok {
+        return fmt.Errorf("parameter set %q: required_parameters must be a list", activeSetName)
+    }
+    definitions, _ := activeSet["parameter_definitions"].(map[string]interface{})
+    for _, param := range requiredList {
+        name, ok := param.(string)
+        if !ok {
+            return fmt.Errorf("parameter set %q: invalid required parameter %v", activeSetName, param)
+        }
+        if _, ok := definitions[name].(map[string]interface{}); !ok {
+            return fmt.Errorf("parameter set %q: required parameter %q has no definition", activeSetName, name)
+        }
+    }
+    return nil
+}
+
+// markUpdateFailed records a configuration that could not be applied to the device
+func (device *ConfiguredEndDevice) markUpdateFailed(err error) {
+    log.Printf("Device %s: configuration not applied, keeping version %q: %v", device.ID, device.ConfigVersion, err)
+    if device.UpdateStatus == nil {
+        device.UpdateStatus = &UpdateStatus{}
+    }
+    device.UpdateStatus.InProgress = false
+    device.UpdateStatus.SuspendMeasure = false
+    device.UpdateStatus.Failed = true
+    device.UpdateStatus.StatusMessage = err.Error()
+}
+
+// ConfigApplied reports whether a gateway configuration has been applied to the devices
+func (dm *DeviceManager) ConfigApplied() bool {
+    dm.DeviceMutex.RLock()
+    defer dm.DeviceMutex.RUnlock()
+    return dm.configApplied
+}
+
+// reconcileDevices creates and removes devices to match the configured fleet,
+// returning the new devices. They have no configuration yet and are not started.
+// The caller must hold DeviceMutex.
+func (dm *DeviceManager) reconcileDevices(config map[string]interface{}) []*ConfiguredEndDevice {
+    // Get device configuration
+    devicesConfig, ok := config["devices"].(map[string]interface{})
+    if !ok {
+        log.Printf("No devices configuration found")
+        return nil
+    }
+    
+    // Get target device counts per type
+    targetCounts := deviceTypeCounts(devicesConfig)
+    
+    // Get current device counts per type
+    currentIDs := make(map[string][]string)
+    for id, device := range dm.Devices {
+        currentIDs[device.Type] = append(currentIDs[device.Type], id)
+    }
+    for _, ids := range currentIDs {
+        sortByIndexDescending(ids)
+    }
+    
+    // Remove devices of types no longer configured
+    for deviceType, ids := range currentIDs {
+        if _, ok := targetCounts[deviceType]; !ok {
+            for _, id := range ids {
+                dm.removeDevice(id)
+            }
+        }
+    }
+    
+    var created []*ConfiguredEndDevice
+    for _, deviceType := range supportedDeviceTypes {
+        targetCount, ok := targetCounts[deviceType]
+        if !ok {
+            continue
+        }
+        currentCount := len(currentIDs[deviceType])
+        created = append(created, dm.createDevices(deviceType, currentCount, targetCount, devicesConfig)...)
+        
+        // Remove excess devices, newest first
+        if currentCount > targetCount {
+            for _, id := range currentIDs[deviceType][:currentCount-targetCount] {
+                dm.removeDevice(id)
+            }
+        }
+    }
+    
+    return created
+}
+
+// deviceTypeCounts reads the device fleet from devices.types, a list of
+// {type, count} entries, falling back to devices.count scales (default 5
+// when unset; an explicit 0 removes every device)
+func deviceTypeCounts(devicesConfig map[string]interface{}) map[string]int {
+    types, ok := devicesConfig["types"].([]interface{})
+    if !ok {
+        count := 5 // Default
+        if c, ok := toInt(devicesConfig["count"]); ok && c >= 0 {
+            count = c
+        } else if raw, present := devicesConfig["count"]; present {
+            log.Printf("Ignoring invalid device count %v, using %d", raw, count)
+        }
+        return map[string]int{"scale": count}
+    }
+    
+    counts := make(map[string]int)
+    for _, entry := range types {
+        typeConfig, _ := entry.(map[string]interface{})
+        deviceType, _ := typeConfig["type"].(string)
+        if _, ok := deviceTypePrefixes[deviceType]; !ok {
+            log.Printf("Ignoring unsupported device type %q", deviceType)
+            continue
+        }
+        count, _ := toInt(typeConfig["count"])
+        if count < 0 {
+            count = 0
+        }
+        counts[deviceType] += count
+    }
+    return counts
+}
+
+// createDevices adds devices of one type until there are targetCount of them,
+// returning the new devices for the caller to start
+func (dm *DeviceManager) createDevices(deviceType string, currentCount int, targetCount int, devicesConfig map[string]interface{}) []*ConfiguredEndDevice {
+    var created []*ConfiguredEndDevice
+    for i := currentCount + 1; i <= targetCount; i++ {
+        deviceID := dm.nextDeviceID(deviceType, i)
+        log.Printf("Creating new device: %s", deviceID)
+        
+        device := &ConfiguredEndDevice{
+            ID:              deviceID,
+            GatewayID:       dm.gateway.gatewayID,
+            Type:            deviceType,
+            Status:          "online",
+            StopChan:        make(chan bool),
+            Capabilities:    make(map[string]bool),
+            DiagnosticInfo:  make(map[string]interface{}),
+            MeasurementCount: 0,
+            FirmwareVersion: "v1.2.3",
+            Rand:            newDeviceRand(deviceRandomSeed(deviceID)),
+        }
+        
+        if firmware, ok := devicesConfig["firmware_version"].(string); ok && firmware != "" {
+            device.FirmwareVersion = firmware
         }
+        
+        // DeviceConfig and Capabilities are filled in by computeDeviceConfigs, from a
+        // private copy of the gateway config and outside the device lock
+        dm.stats.restore(device)
+        dm.Devices[deviceID] = device
+        created = append(created, device)
     }
+    return created
 }
 
 // getDeviceConfig extracts device-specific configuration from gateway YAML
-func getDeviceConfig(deviceID string, deviceType string, config map[string]interface{}) map[string]interface{} {
+func getDeviceConfig(deviceID string, deviceType string, firmwareVersion string, config map[string]interface{}) map[string]interface{} {
     // Initialize result with entire config (we'll selectively copy what's needed)
     result := make(map[string]interface{})
 
-    // Initialize parameterSets as an empty map
-    parameterSets := make(map[string]interface{})
-    
     // Copy global measurement settings
     if measurement, ok := config["measurement"].(map[string]interface{}); ok {
         result["measurement"] = measurement
@@ -783,20 +1945,57 @@ func getDeviceConfig(deviceID string, deviceType string, config map[string]inter
             }
         }
         
-        // If no pattern match found, use the first parameter set
-        if activeParameterSet == "" && len(parameterSets) > 0 {
-            for name := range parameterSets {
-                activeParameterSet = name
-                log.Printf("Device %s using default parameter set: %s", deviceID, activeParameterSet)
-                break
+        // A mapping to an undefined set falls back to devices.default_parameter_set;
+        // without one the bad name is kept so the update fails visibly
+        defaultSet, _ := devicesConfig["default_parameter_set"].(string)
+        sets, _ := result["parameter_sets"].(map[string]interface{})
+        if activeParameterSet != "" {
+            if _, exists := sets[activeParameterSet]; !exists {
+                log.Printf("Warning: device %s is mapped to unknown parameter set %q", deviceID, activeParameterSet)
+                if _, exists := sets[defaultSet]; exists {
+                    activeParameterSet = defaultSet
+                    log.Printf("Device %s falling back to default parameter set: %s", deviceID, defaultSet)
+                }
             }
         }
         
-        // Store active parameter set
-        result["active_parameter_set"] = activeParameterSet
+        // If no pattern match found, use the default parameter set, else spread
+        // devices across all defined sets
+        if activeParameterSet == "" && len(sets) > 0 {
+            if _, exists := sets[defaultSet]; exists {
+                activeParameterSet = defaultSet
+            } else {
+                activeParameterSet = determineParameterSet(deviceID, sets)
+            }
+            log.Printf("Device %s using default parameter set: %s", deviceID, activeParameterSet)
+        }
         
-        // Apply device-specific overrides if any
-        if overrides, ok := devicesConfig["overrides"].(map[string]interface{}); ok {
+        // Skip parameter sets gated behind newer firmware
+        if sets, ok := result["parameter_sets"].(map[string]interface{}); ok && activeParameterSet != "" {
+            if !firmwareSupports(sets[activeParameterSet], firmwareVersion) {
+                log.Printf("Warning: device %s firmware %s is below min_firmware for parameter set %s",
+                    deviceID, firmwareVersion, activeParameterSet)
+                activeParameterSet = ""
+                names := make([]string, 0, len(sets))
+                for name := range sets {
+                    names = append(names, name)
+                }
+                sort.Strings(names)
+                for _, name := range names {
+                    if firmwareSupports(sets[name], firmwareVersion) {
+                        activeParameterSet = name
+                        log.Printf("Device %s falling back to parameter set: %s", deviceID, name)
+                        break
+                    }
+                }
+            }
+        }
+        
+        // Store active parameter set
+        result["active_parameter_set"] = activeParameterSet
+        
+        // Apply device-specific overrides if any
+        if overrides, ok := devicesConfig["overrides"].(map[string]interface{}); ok {
             if deviceOverride, ok := overrides[deviceID].(map[string]interface{}); ok {
                 // Apply overrides to appropriate sections
                 applyDeviceOverrides(result, deviceOverride)
@@ -807,8 +2006,89 @@ func getDeviceConfig(deviceID string, deviceType string, config map[string]inter
     return result
 }
 
-// determineParameterSet decides which parameter set to use based on device ID
-// determineParameterSet decides which parameter set to use based on device ID
+// firmwareSupports checks a definition's optional min_firmware against a device firmware version
+func firmwareSupports(definition interface{}, firmwareVersion string) bool {
+    def, ok := definition.(map[string]interface{})
+    if !ok {
+        return true
+    }
+    minFirmware, ok := def["min_firmware"].(string)
+    if !ok || minFirmware == "" {
+        return true
+    }
+    return compareVersions(firmwareVersion, minFirmware) >= 0
+}
+
+// compareVersions compares two semver-like versions (e.g. "v1.2.3"), returning -1, 0 or 1
+func compareVersions(a, b string) int {
+    parse := func(version string) []int {
+        version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+        if idx := strings.IndexAny(version, "-+"); idx >= 0 {
+            version = version[:idx]
+        }
+        var parts []int
+        for _, part := range strings.Split(version, ".") {
+            n, _ := strconv.Atoi(part)
+            parts = append(parts, n)
+        }
+        return parts
+    }
+    
+    pa, pb := parse(a), parse(b)
+    for i := 0; i < len(pa) || i < len(pb); i++ {
+        var x, y int
+        if i < len(pa) {
+            x = pa[i]
+        }
+        if i < len(pb) {
+            y = pb[i]
+        }
+        if x < y {
+            return -1
+        }
+        if x > y {
+            return 1
+        }
+    }
+    return 0
+}
+
+// resolveCapabilities builds a device's capability map from devices.capabilities,
+// disabling capabilities whose min_firmware is above the device firmware
+func resolveCapabilities(deviceID string, firmwareVersion string, config map[string]interface{}) map[string]bool {
+    capabilities := make(map[string]bool)
+    
+    devicesConfig, ok := config["devices"].(map[string]interface{})
+    if !ok {
+        return capabilities
+    }
+    declared, ok := devicesConfig["capabilities"].(map[string]interface{})
+    if !ok {
+        return capabilities
+    }
+    
+    for name, value := range declared {
+        switch v := value.(type) {
+        case bool:
+            capabilities[name] = v
+        case map[string]interface{}:
+            enabled := true
+            if e, ok := v["enabled"].(bool); ok {
+                enabled = e
+            }
+            if enabled && !firmwareSupports(v, firmwareVersion) {
+                log.Printf("Warning: device %s firmware %s is below min_firmware %v for capability %s",
+                    deviceID, firmwareVersion, v["min_firmware"], name)
+                enabled = false
+            }
+            capabilities[name] = enabled
+        }
+    }
+    return capabilities
+}
+
+// determineParameterSet assigns parameter sets round-robin by device number, in
+// name order, so device 1 gets the first set, device 2 the second and so on
 func determineParameterSet(deviceID string, parameterSets map[string]interface{}) string {
     // Get all available parameter set names
     availableSets := make([]string, 0, len(parameterSets))
@@ -819,23 +2099,14 @@ func determineParameterSet(deviceID string, parameterSets map[string]interface{}
     if len(availableSets) == 0 {
         return "" // No parameter sets available
     }
+    sort.Strings(availableSets)
     
-    // Extract numeric part from device ID for deterministic assignment
-    numPart := ""
-    parts := strings.Split(deviceID, "-")
-    if len(parts) > 0 {
-        numPart = parts[len(parts)-1]
-    }
-    
-    // Use numeric part to deterministically select a parameter set
-    if num, err := strconv.Atoi(numPart); err == nil && len(availableSets) > 0 {
-        // Use modulo to pick a parameter set based on device number
-        setIndex := num % len(availableSets)
-        return availableSets[setIndex]
+    // Default to first parameter set if the device has no number
+    num := deviceIndex(deviceID)
+    if num < 1 {
+        return availableSets[0]
     }
-    
-    // Default to first parameter set if we couldn't parse the number
-    return availableSets[0]
+    return availableSets[(num-1)%len(availableSets)]
 }
 
 // applyDeviceOverrides applies device-specific overrides to the configuration
@@ -887,61 +2158,316 @@ func activateParameterSet(deviceConfig map[string]interface{}) {
     log.Printf("Activated parameter set '%s' for device", activeSetName)
 }
 
-// runDeviceSimulation runs the simulation for a device
-func (dm *DeviceManager) runDeviceSimulation(device *ConfiguredEndDevice) {
-    // Get measurement interval from configuration
-    measurementInterval := 60 // Default: 60 seconds
-    if behaviorConfig, ok := device.DeviceConfig["behavior"].(map[string]interface{}); ok {
-        if frequency, ok := behaviorConfig["measurement_frequency_seconds"].(int); ok && frequency > 0 {
-            measurementInterval = frequency
+// SetParameterSet makes setName the device's active parameter set until the next
+// configuration push. The set must exist in the device's parameter_sets and be
+// supported by its firmware.
+func (dm *DeviceManager) SetParameterSet(deviceID string, setName string) error {
+    dm.DeviceMutex.Lock()
+    defer dm.DeviceMutex.Unlock()
+    
+    device, ok := dm.Devices[deviceID]
+    if !ok {
+        return fmt.Errorf("device %q not found", deviceID)
+    }
+    parameterSets, _ := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+    definition, ok := parameterSets[setName]
+    if !ok {
+        return fmt.Errorf("device %s: parameter set %q is not defined", deviceID, setName)
+    }
+    if !firmwareSupports(definition, device.FirmwareVersion) {
+        return fmt.Errorf("device %s: firmware %s does not support parameter set %q", deviceID, device.FirmwareVersion, setName)
+    }
+    
+    // Parameter set definitions can be shared between devices, so switch a private copy
+    deviceConfig := deepCopyValue(device.DeviceConfig).(map[string]interface{})
+    deviceConfig["active_parameter_set"] = setName
+    activateParameterSet(deviceConfig)
+    device.DeviceConfig = deviceConfig
+    log.Printf("Device %s: switched to parameter set %s", deviceID, setName)
+    return nil
+}
+
+// loadAnomalies reads correlated anomaly definitions from the gateway configuration
+func (dm *DeviceManager) loadAnomalies(config map[string]interface{}) {
+    anomalies := make(map[string]*CorrelatedAnomaly)
+    
+    if list, ok := config["anomalies"].([]interface{}); ok {
+        for _, item := range list {
+            def, ok := item.(map[string]interface{})
+            if !ok {
+                continue
+            }
+            
+            name, _ := def["name"].(string)
+            if name == "" {
+                log.Printf("Skipping anomaly without a name")
+                continue
+            }
+            
+            anomaly := &CorrelatedAnomaly{
+                Name:             name,
+                WeightMultiplier: 1.0,
+                Duration:         60 * time.Second,
+            }
+            
+            if group, ok := def["group"].(map[string]interface{}); ok {
+                if ids, ok := group["devices"].([]interface{}); ok {
+                    for _, id := range ids {
+                        anomaly.DeviceIDs = append(anomaly.DeviceIDs, fmt.Sprintf("%v", id))
+                    }
+                }
+                anomaly.ParameterSet, _ = group["parameter_set"].(string)
+            }
+            if mult, ok := toFloat64(def["weight_multiplier"]); ok {
+                anomaly.WeightMultiplier = mult
+            }
+            if offset, ok := toFloat64(def["weight_offset"]); ok {
+                anomaly.WeightOffset = offset
+            }
+            if duration, ok := toFloat64(def["duration_seconds"]); ok && duration > 0 {
+                anomaly.Duration = time.Duration(duration * float64(time.Second))
+            }
+            if schedule, ok := def["schedule"].([]interface{}); ok {
+                for _, at := range schedule {
+                    if atStr, ok := at.(string); ok {
+                        anomaly.Schedule = append(anomaly.Schedule, atStr)
+                    }
+                }
+            }
+            
+            anomalies[name] = anomaly
+        }
+    }
+    
+    dm.ConfigMutex.Lock()
+    dm.Anomalies = anomalies
+    dm.ConfigMutex.Unlock()
+    
+    if len(anomalies) > 0 {
+        log.Printf("Loaded %d correlated anomaly definition(s)", len(anomalies))
+    }
+}
+
+// inGroup checks whether a device belongs to the anomaly's device group
+func (a *CorrelatedAnomaly) inGroup(device *ConfiguredEndDevice) bool {
+    if a.ParameterSet != "" {
+        if setName, _ := device.DeviceConfig["active_parameter_set"].(string); setName != a.ParameterSet {
+            return false
+        }
+    }
+    
+    if len(a.DeviceIDs) == 0 {
+        return true
+    }
+    
+    for _, id := range a.DeviceIDs {
+        if device.ID == id || strings.HasSuffix(device.ID, "-"+id) {
+            return true
+        }
+    }
+    return false
+}
+
+// TriggerAnomaly applies a named anomaly to every device in its group and
+// returns the number of affected devices
+func (dm *DeviceManager) TriggerAnomaly(name string, now time.Time) (int, error) {
+    dm.ConfigMutex.RLock()
+    anomaly, ok := dm.Anomalies[name]
+    dm.ConfigMutex.RUnlock()
+    if !ok {
+        return 0, fmt.Errorf("unknown anomaly: %s", name)
+    }
+    
+    dm.DeviceMutex.RLock()
+    defer dm.DeviceMutex.RUnlock()
+    
+    affected := 0
+    for _, device := range dm.Devices {
+        if !anomaly.inGroup(device) {
+            continue
         }
+        device.anomalyMutex.Lock()
+        device.anomaly = &AnomalyShift{
+            Name:       anomaly.Name,
+            Multiplier: anomaly.WeightMultiplier,
+            Offset:     anomaly.WeightOffset,
+            Until:      now.Add(anomaly.Duration),
+        }
+        device.anomalyMutex.Unlock()
+        affected++
+    }
+    
+    log.Printf("Triggered correlated anomaly '%s' on %d device(s) for %v", name, affected, anomaly.Duration)
+    return affected, nil
+}
+
+// checkAnomalySchedule triggers scheduled anomalies whose HH:MM slot matches now
+func (dm *DeviceManager) checkAnomalySchedule(now time.Time) {
+    slot := now.Format("15:04")
+    day := now.Format("2006-01-02")
+    
+    var due []string
+    dm.ConfigMutex.Lock()
+    for name, anomaly := range dm.Anomalies {
+        for _, at := range anomaly.Schedule {
+            key := day + " " + at
+            if at == slot && dm.anomalyTriggers[name] != key {
+                dm.anomalyTriggers[name] = key
+                due = append(due, name)
+            }
+        }
+    }
+    dm.ConfigMutex.Unlock()
+    
+    for _, name := range due {
+        dm.TriggerAnomaly(name, now)
+    }
+}
+
+// runAnomalyScheduler periodically checks for scheduled correlated anomalies
+func (dm *DeviceManager) runAnomalyScheduler() {
+    ticker := time.NewTicker(15 * time.Second)
+    defer ticker.Stop()
+    
+    for now := range ticker.C {
+        dm.checkAnomalySchedule(now)
+    }
+}
+
+// activeAnomaly returns the device's anomaly shift if it is still within its window
+func (device *ConfiguredEndDevice) activeAnomaly(now time.Time) *AnomalyShift {
+    device.anomalyMutex.Lock()
+    defer device.anomalyMutex.Unlock()
+    
+    if device.anomaly == nil {
+        return nil
+    }
+    if now.After(device.anomaly.Until) {
+        log.Printf("Device %s: anomaly '%s' ended", device.ID, device.anomaly.Name)
+        device.anomaly = nil
+        return nil
+    }
+    return device.anomaly
+}
+
+// minMeasurementInterval is the shortest measurement interval a configuration can request
+const minMeasurementInterval = 100 * time.Millisecond
+
+// measurementInterval reads behavior.measurement_frequency_seconds, whole or
+// fractional (default 60), floored at minMeasurementInterval
+func measurementInterval(behaviorConfig map[string]interface{}) time.Duration {
+    interval := 60 * time.Second
+    if seconds, ok := toFloat64(behaviorConfig["measurement_frequency_seconds"]); ok && seconds > 0 {
+        interval = time.Duration(seconds * float64(time.Second))
+    }
+    if interval < minMeasurementInterval {
+        interval = minMeasurementInterval
+    }
+    return interval
+}
+
+// measurementJitter returns a random delay of up to a quarter of the interval
+func measurementJitter(interval time.Duration) time.Duration {
+    if spread := int64(interval / 4); spread > 0 {
+        return time.Duration(rand.Int63n(spread))
     }
+    return 0
+}
+
+// runDeviceSimulation runs the simulation for a device
+func (dm *DeviceManager) runDeviceSimulation(device *ConfiguredEndDevice) {
+    dm.DeviceMutex.RLock()
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    
+    // Load the replay dataset up front so problems are reported at startup
+    device.preloadDataset()
+    sourceTopic := device.mirrorSourceTopic()
+    dm.DeviceMutex.RUnlock()
     
     // Add some randomness to prevent all devices measuring at once
-    jitter := rand.Intn(measurementInterval / 4)
-    measurementInterval = measurementInterval + jitter
+    interval := measurementInterval(behaviorConfig)
+    jitter := measurementJitter(interval)
     
     // Create ticker for periodic measurements
-    ticker := time.NewTicker(time.Duration(measurementInterval) * time.Second)
+    baseInterval := interval + jitter
+    ticker := time.NewTicker(baseInterval)
     defer ticker.Stop()
+    schedule := &frequencySchedule{base: baseInterval, current: baseInterval}
+    
+    // Optionally flap between online and offline (disabled by default)
+    var flapTick <-chan time.Time
+    faultProbability, faultDuration := faultSettings(behaviorConfig)
+    flapProbability, flapInterval := flapSettings(behaviorConfig)
+    if flapProbability > 0 {
+        flapTicker := time.NewTicker(flapInterval)
+        defer flapTicker.Stop()
+        flapTick = flapTicker.C
+    }
+    
+    // Track a real device's measurements if configured
+    if sourceTopic != "" {
+        dm.addMirror(sourceTopic, device)
+        defer dm.removeMirror(sourceTopic, device)
+    }
     
     // Track uptime
+    dm.DeviceMutex.Lock()
     device.StartTime = time.Now()
+    dm.DeviceMutex.Unlock()
     
-    log.Printf("Started simulation for device %s with interval %d seconds", 
-        device.ID, measurementInterval)
+    log.Printf("Started simulation for device %s with interval %v", 
+        device.ID, baseInterval)
+    
+    // Optionally emit a first measurement right away instead of after a full interval
+    if emitOnStart, _ := behaviorConfig["emit_on_start"].(bool); emitOnStart {
+        stagger := jitter
+        if seconds, ok := toFloat64(behaviorConfig["start_stagger_seconds"]); ok && seconds >= 0 {
+            stagger = time.Duration(seconds * float64(time.Second))
+        }
+        select {
+        case <-time.After(stagger):
+            dm.emitMeasurement(device)
+            ticker.Reset(baseInterval)
+        case <-device.StopChan:
+            log.Printf("Stopping simulation for device %s", device.ID)
+            return
+        }
+    }
     
     // Main simulation loop
     for {
         select {
         case <-ticker.C:
-            // Update device uptime
-            device.UptimeSeconds = int64(time.Since(device.StartTime).Seconds())
-            
-            // Make sure we have a valid configuration
-            if device.ConfigVersion == "" {
-                log.Printf("Device %s: No configuration available, skipping measurement", device.ID)
+            // Scale the measurement rate by the time-of-day curve
+            multiplier := timeOfDayMultiplier(behaviorConfig, device.now(), "frequency")
+            if next, changed := schedule.update(multiplier); changed {
+                ticker.Reset(next)
+            }
+            if multiplier <= 0 {
                 continue
             }
             
-            // Check if measurements are suspended (e.g., during config update)
-            if device.UpdateStatus != nil && device.UpdateStatus.SuspendMeasure {
-                log.Printf("Device %s: Measurements suspended due to update", device.ID)
+            // Occasionally fail instead of measuring
+            if dm.checkFault(device, faultProbability, faultDuration) {
                 continue
             }
             
-            // Generate and send measurement
-            measurement := device.generateMeasurement()
-            dm.publishMeasurement(device, measurement)
+            gap := dm.emitMeasurement(device)
             
-            // Update statistics
-            device.MeasurementCount++
-            if payload, ok := measurement["payload"].(map[string]interface{}); ok {
-                if weight, ok := payload["weight_kg"].(float64); ok {
-                    device.TotalWeightMeasured += weight
+            // Keep the recording's spacing between replayed events, falling back to
+            // the base interval where there's none (e.g. when the recording wraps)
+            if respectTiming, _ := behaviorConfig["replay_respect_timing"].(bool); respectTiming && dm.replay != nil {
+                next := gap
+                if next <= 0 {
+                    next = baseInterval
                 }
+                ticker.Reset(next)
+                schedule.current = next
             }
         
+        case <-flapTick:
+            dm.checkFlap(device, flapProbability)
+        
         case <-device.StopChan:
             // Stop simulation
             log.Printf("Stopping simulation for device %s", device.ID)
@@ -950,500 +2476,3066 @@ func (dm *DeviceManager) runDeviceSimulation(device *ConfiguredEndDevice) {
     }
 }
 
-// generateMeasurement creates a measurement with parameters from active parameter set
-func (device *ConfiguredEndDevice) generateMeasurement() map[string]interface{} {
-    // Get base measurement parameters
-    var minWeight float64 = 0.1
-    var maxWeight float64 = 25.0
-    var precision float64 = 0.1
-    var units string = "kg"
-    var calibrationFactor float64 = 1.0
+// frequencySchedule tracks a device's measurement interval as the time-of-day
+// frequency multiplier changes
+type frequencySchedule struct {
+    base    time.Duration // Interval at a multiplier of 1.0
+    current time.Duration // Interval the ticker is running at
+}
+
+// update returns the interval for multiplier and whether it differs from the
+// ticker's current one. A multiplier of 0 or less pauses measuring at the base interval.
+func (s *frequencySchedule) update(multiplier float64) (time.Duration, bool) {
+    next := s.base
+    if multiplier > 0 {
+        next = time.Duration(float64(s.base) / multiplier)
+    }
+    if next == s.current {
+        return next, false
+    }
+    s.current = next
+    return next, true
+}
+
+// MeasureNow generates and publishes a measurement right away for one device, or for
+// every device when deviceID is "all", returning how many devices measured. A device
+// whose measurements are suspended by a config update is rejected; with "all" it is skipped.
+func (dm *DeviceManager) MeasureNow(deviceID string) (int, error) {
+    if deviceID == "" {
+        return 0, fmt.Errorf("missing device_id")
+    }
     
-    // Extract base measurement parameters
-    if measurementConfig, ok := device.DeviceConfig["measurement"].(map[string]interface{}); ok {
-        if min, ok := measurementConfig["min_weight_kg"].(float64); ok {
-            minWeight = min
-        }
-        if max, ok := measurementConfig["max_weight_kg"].(float64); ok {
-            maxWeight = max
-        }
-        if prec, ok := measurementConfig["precision"].(float64); ok {
-            precision = prec
-        }
-        if u, ok := measurementConfig["units"].(string); ok {
-            units = u
-        }
-        if cf, ok := measurementConfig["calibration_factor"].(float64); ok {
-            calibrationFactor = cf
+    dm.DeviceMutex.RLock()
+    var targets []*ConfiguredEndDevice
+    if deviceID == "all" {
+        for _, device := range dm.Devices {
+            targets = append(targets, device)
         }
+    } else if device, ok := dm.Devices[deviceID]; ok {
+        targets = append(targets, device)
     }
-    
-    // Generate weight value
-    precisionMultiplier := 1.0 / precision
-    rawValue := minWeight + rand.Float64()*(maxWeight-minWeight)
-    calibratedValue := rawValue * calibrationFactor
-    
-    // Round to specified precision
-    roundedValue := math.Round(calibratedValue*precisionMultiplier) / precisionMultiplier
-    
-    // Create base payload with weight
-    timestamp := time.Now()
-    payload := map[string]interface{}{
-        "weight_kg": roundedValue,
-        "units": units,
-        "timestamp_ms": timestamp.UnixNano() / int64(time.Millisecond),
+    suspended := make(map[*ConfiguredEndDevice]bool)
+    for _, device := range targets {
+        suspended[device] = device.UpdateStatus != nil && device.UpdateStatus.SuspendMeasure
     }
+    dm.DeviceMutex.RUnlock()
     
-    // Get active parameter set
-    activeParameterSetName, _ := device.DeviceConfig["active_parameter_set"].(string)
-    if activeParameterSetName == "" {
-        // Default to existing behavior if no active set
-        payload["parameter_set"] = "unknown"
-        return createMeasurementEvent(device, timestamp, payload)
+    if len(targets) == 0 && deviceID != "all" {
+        return 0, fmt.Errorf("device %s not found", deviceID)
+    }
+    if deviceID != "all" && suspended[targets[0]] {
+        return 0, fmt.Errorf("device %s: measurements suspended during config update", deviceID)
     }
     
-    // Record which parameter set was used
-    payload["parameter_set"] = activeParameterSetName
+    measured := 0
+    for _, device := range targets {
+        if suspended[device] {
+            log.Printf("Device %s: measurements suspended during config update, skipping measure_now", device.ID)
+            continue
+        }
+        dm.emitMeasurement(device)
+        measured++
+    }
+    return measured, nil
+}
+
+// emitMeasurement generates and publishes one measurement, updating device statistics.
+// When replaying a recording it returns the recorded gap to the following event.
+func (dm *DeviceManager) emitMeasurement(device *ConfiguredEndDevice) time.Duration {
+    // Update device uptime; statistics are read by HTTP handlers under DeviceMutex
+    dm.DeviceMutex.Lock()
+    device.UptimeSeconds = int64(time.Since(device.StartTime).Seconds())
+    status := device.Status
+    configVersion := device.ConfigVersion
+    suspended := device.UpdateStatus != nil && device.UpdateStatus.SuspendMeasure
+    dm.DeviceMutex.Unlock()
+    
+    // Make sure we have a valid configuration
+    if configVersion == "" {
+        log.Printf("Device %s: No configuration available, skipping measurement", device.ID)
+        return 0
+    }
     
-    // Get parameter sets configuration
-    parameterSets, ok := device.DeviceConfig["parameter_sets"].(map[string]interface{})
-    if !ok {
-        // No parameter sets defined
-        return createMeasurementEvent(device, timestamp, payload)
+    // Check if measurements are suspended (e.g., during config update)
+    if suspended {
+        log.Printf("Device %s: Measurements suspended due to update", device.ID)
+        return 0
     }
     
-    // Get active parameter set
-    activeSet, ok := parameterSets[activeParameterSetName].(map[string]interface{})
-    if !ok {
-        // Parameter set not found
-        return createMeasurementEvent(device, timestamp, payload)
+    // Offline and faulted devices don't measure
+    if status == "offline" || status == "error" {
+        return 0
     }
     
-    // Get required parameters
-    requiredParams, _ := activeSet["required_parameters"].([]interface{})
-    paramDefs, _ := activeSet["parameter_definitions"].(map[string]interface{})
+    // Generate the measurement, or replay the next recorded one, under the read
+    // lock so a config push can't swap DeviceConfig midway; publish without it
+    var measurement map[string]interface{}
+    var gap time.Duration
+    dm.DeviceMutex.RLock()
+    if dm.replay != nil {
+        measurement, gap = device.nextReplayEvent(dm.replay)
+    } else {
+        measurement = device.generateMeasurement()
+    }
+    lowBattery := device.drainBattery(measurement)
+    dm.DeviceMutex.RUnlock()
+    dm.publishMeasurement(device, measurement)
+    if lowBattery {
+        dm.gateway.publishLowBattery(device, measurement)
+    }
     
-    // Generate values for each required parameter
-    for _, paramName := range requiredParams {
-        paramNameStr, ok := paramName.(string)
-        if !ok {
-            continue
-        }
-        
-        // Get parameter definition
-        paramDef, ok := paramDefs[paramNameStr].(map[string]interface{})
-        if !ok {
-            continue
+    // Update statistics
+    dm.DeviceMutex.Lock()
+    device.MeasurementCount++
+    if payload, ok := measurement["payload"].(map[string]interface{}); ok {
+        if weight, ok := payload["weight_kg"].(float64); ok {
+            device.TotalWeightMeasured += weight
         }
-        
-        // Generate value for this parameter
-        paramValue := generateParameterValue(paramNameStr, paramDef, device.ID)
-        payload[paramNameStr] = paramValue
     }
-
-    log.Printf("Generated measurement with parameter set: %s", payload["parameter_set"])
-    
-    // Create and return measurement event
-    return createMeasurementEvent(device, timestamp, payload)
+    dm.DeviceMutex.Unlock()
+    return gap
 }
 
-// createMeasurementEvent formats the final measurement event
-func createMeasurementEvent(device *ConfiguredEndDevice, timestamp time.Time, payload map[string]interface{}) map[string]interface{} {
-    return map[string]interface{}{
-        "gateway_id": device.GatewayID,
-        "device_id": device.ID,
-        "event_type": "measurement",
-        "type": "weight_measurement",
-        "timestamp": timestamp.Format(time.RFC3339),
-        "measurement_id": fmt.Sprintf("%s-%d", device.ID, timestamp.UnixNano()),
-        "payload": payload,
+// flapSettings reads behavior.flapping: probability (chance of toggling per check)
+// and interval_seconds (time between checks, default 30)
+func flapSettings(behavior map[string]interface{}) (float64, time.Duration) {
+    flapping, ok := behavior["flapping"].(map[string]interface{})
+    if !ok {
+        return 0, 0
+    }
+    probability, _ := toFloat64(flapping["probability"])
+    interval := 30 * time.Second
+    if seconds, ok := toFloat64(flapping["interval_seconds"]); ok && seconds > 0 {
+        interval = time.Duration(seconds * float64(time.Second))
     }
+    return probability, interval
 }
 
-// generateParameterValue creates a value for a parameter based on its definition
-func generateParameterValue(paramName string, paramDef map[string]interface{}, deviceID string) interface{} {
-    // Get parameter type
-    paramType, _ := paramDef["type"].(string)
+// checkFlap toggles the device between online and offline with the given probability,
+// returning whether the state changed
+func (dm *DeviceManager) checkFlap(device *ConfiguredEndDevice, probability float64) bool {
+    if device.random().Float64() >= probability {
+        return false
+    }
     
-    switch paramType {
-    case "string":
-        // Check if parameter has predefined options
+    dm.DeviceMutex.Lock()
+    previous := device.Status
+    if previous == "offline" {
+        device.Status = "online"
+    } else {
+        device.Status = "offline"
+    }
+    current := device.Status
+    dm.DeviceMutex.Unlock()
+    
+    dm.gateway.publishDeviceStatusChange(device, previous, current)
+    return true
+}
+
+// faultSettings reads behavior.fault_probability (chance of a fault per measurement)
+// and behavior.fault_duration_seconds (default 30)
+func faultSettings(behaviorConfig map[string]interface{}) (float64, time.Duration) {
+    probability, _ := toFloat64(behaviorConfig["fault_probability"])
+    duration := 30 * time.Second
+    if seconds, ok := toFloat64(behaviorConfig["fault_duration_seconds"]); ok && seconds > 0 {
+        duration = time.Duration(seconds * float64(time.Second))
+    }
+    return probability, duration
+}
+
+// checkFault starts a simulated fault with the given probability unless the device
+// is already faulted, returning whether one started
+func (dm *DeviceManager) checkFault(device *ConfiguredEndDevice, probability float64, duration time.Duration) bool {
+    if probability <= 0 || device.random().Float64() >= probability {
+        return false
+    }
+    dm.DeviceMutex.RLock()
+    faulted := !device.FaultUntil.IsZero()
+    dm.DeviceMutex.RUnlock()
+    if faulted {
+        return false
+    }
+    dm.injectFault(device, duration)
+    return true
+}
+
+// injectFault puts the device into the error state, where it stops measuring, and
+// restores its previous status after duration. A fault during a fault extends it.
+func (dm *DeviceManager) injectFault(device *ConfiguredEndDevice, duration time.Duration) time.Time {
+    dm.DeviceMutex.Lock()
+    previous := device.Status
+    if device.FaultUntil.IsZero() {
+        device.statusBeforeFault = previous
+    }
+    device.Status = "error"
+    until := time.Now().Add(duration)
+    device.FaultUntil = until
+    dm.DeviceMutex.Unlock()
+    
+    log.Printf("Device %s: simulated fault for %v", device.ID, duration)
+    if previous != "error" {
+        dm.gateway.publishDeviceStatusChange(device, previous, "error")
+    }
+    time.AfterFunc(duration, func() { dm.endFault(device, until) })
+    return until
+}
+
+// endFault recovers the device from the fault ending at until, unless a later fault extended it
+func (dm *DeviceManager) endFault(device *ConfiguredEndDevice, until time.Time) {
+    dm.DeviceMutex.Lock()
+    if !device.FaultUntil.Equal(until) {
+        dm.DeviceMutex.Unlock()
+        return
+    }
+    device.Status = device.statusBeforeFault
+    device.FaultUntil = time.Time{}
+    current := device.Status
+    _, present := dm.Devices[device.ID]
+    dm.DeviceMutex.Unlock()
+    
+    if present {
+        dm.gateway.publishDeviceStatusChange(device, "error", current)
+    }
+}
+
+// publishDeviceStatusChange emits a status_change event for a device
+func (g *Gateway) publishDeviceStatusChange(device *ConfiguredEndDevice, previous string, current string) {
+    log.Printf("Device %s: status changed from %s to %s", device.ID, previous, current)
+    if g.mqttClient == nil || !g.isMqttConnected.Load() {
+        return
+    }
+    
+    event := map[string]interface{}{
+        "gateway_id":      g.gatewayID,
+        "device_id":       device.ID,
+        "event_type":      "status_change",
+        "status":          current,
+        "previous_status": previous,
+        "timestamp":       time.Now().Format(time.RFC3339),
+    }
+    jsonData, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Error marshaling status change event: %v", err)
+        return
+    }
+    
+    topic := fmt.Sprintf("gateway/%s/device/%s/status", g.gatewayID, device.ID)
+    token := g.mqttClient.Publish(topic, 1, false, jsonData)
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing status change event: %v", token.Error())
+    }
+}
+
+// now returns the current time from the device clock
+func (device *ConfiguredEndDevice) now() time.Time {
+    if device.Clock != nil {
+        return device.Clock()
+    }
+    return time.Now()
+}
+
+// random returns the device's random source
+func (device *ConfiguredEndDevice) random() *rand.Rand {
+    if device.Rand != nil {
+        return device.Rand
+    }
+    return sharedRand
+}
+
+// lockedSource makes a rand.Source safe for concurrent use. Each device owns one,
+// so the lock is only contended when a device is measured from several goroutines.
+type lockedSource struct {
+    mu  sync.Mutex
+    src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.src.Seed(seed)
+}
+
+// newDeviceRand creates a random source for one device
+func newDeviceRand(seed int64) *rand.Rand {
+    return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// sharedRand backs devices created without their own random source
+var sharedRand = newDeviceRand(time.Now().UnixNano())
+
+// gatewayRandomSeed returns GATEWAY_RANDOM_SEED if set, otherwise a clock-based seed
+func gatewayRandomSeed() int64 {
+    if seed, err := strconv.ParseInt(os.Getenv("GATEWAY_RANDOM_SEED"), 10, 64); err == nil {
+        return seed
+    }
+    return time.Now().UnixNano()
+}
+
+// deviceRandomSeed derives a device's seed from GATEWAY_RANDOM_SEED and its ID, so a
+// fixed seed reproduces every device's sequence while devices still differ from each other
+func deviceRandomSeed(deviceID string) int64 {
+    hash := fnv.New64a()
+    hash.Write([]byte(deviceID))
+    return gatewayRandomSeed() ^ int64(hash.Sum64())
+}
+
+// timeOfDayMultiplier returns the hourly multiplier from behavior.time_of_day for the
+// given target ("weight" or "frequency"), or 1.0 when no curve applies
+func timeOfDayMultiplier(behavior map[string]interface{}, t time.Time, target string) float64 {
+    timeOfDay, ok := behavior["time_of_day"].(map[string]interface{})
+    if !ok {
+        return 1.0
+    }
+    
+    applyTo, _ := timeOfDay["apply_to"].(string)
+    if applyTo == "" {
+        applyTo = "weight"
+    }
+    if applyTo != target && applyTo != "both" {
+        return 1.0
+    }
+    
+    multipliers, ok := timeOfDay["multipliers"].([]interface{})
+    if !ok || len(multipliers) == 0 {
+        return 1.0
+    }
+    
+    // Spread the configured points evenly across the day (24 entries = one per hour)
+    index := t.Hour() * len(multipliers) / 24
+    if multiplier, ok := toFloat64(multipliers[index]); ok {
+        return multiplier
+    }
+    return 1.0
+}
+
+// calibrationDrift updates and returns the device's calibration factor drift at now:
+// behavior.drift_per_hour per hour of uptime, reset to zero every
+// behavior.recalibration_interval_hours (never, if unset)
+func (device *ConfiguredEndDevice) calibrationDrift(behaviorConfig map[string]interface{}, now time.Time) float64 {
+    perHour, ok := toFloat64(behaviorConfig["drift_per_hour"])
+    if !ok || perHour == 0 || device.StartTime.IsZero() {
+        return 0
+    }
+    
+    device.driftMutex.Lock()
+    defer device.driftMutex.Unlock()
+    
+    lastRecalibration := device.StartTime
+    if hours, ok := toFloat64(behaviorConfig["recalibration_interval_hours"]); ok && hours > 0 {
+        interval := time.Duration(hours * float64(time.Hour))
+        lastRecalibration = device.StartTime.Add(now.Sub(device.StartTime) / interval * interval)
+    }
+    if lastRecalibration.After(device.LastRecalibration) {
+        if !device.LastRecalibration.IsZero() {
+            log.Printf("Device %s: recalibrated, resetting drift of %.4f", device.ID, device.Drift)
+        }
+        device.LastRecalibration = lastRecalibration
+    }
+    
+    device.Drift = perHour * now.Sub(device.LastRecalibration).Hours()
+    return device.Drift
+}
+
+// sampleWeight draws a raw weight between minWeight and maxWeight from the measurement
+// config's distribution: "uniform" (default), "normal" (mean_weight_kg, stddev_weight_kg,
+// defaulting to the midpoint and a sixth of the range) or "exponential" (mean_weight_kg,
+// measured from minWeight). Samples outside the range are clamped.
+func sampleWeight(rng *rand.Rand, measurementConfig map[string]interface{}, minWeight, maxWeight float64) float64 {
+    mean := (minWeight + maxWeight) / 2
+    if m, ok := toFloat64(measurementConfig["mean_weight_kg"]); ok {
+        mean = m
+    }
+    
+    var value float64
+    switch distribution, _ := measurementConfig["distribution"].(string); distribution {
+    case "normal":
+        stddev := (maxWeight - minWeight) / 6
+        if sd, ok := toFloat64(measurementConfig["stddev_weight_kg"]); ok && sd >= 0 {
+            stddev = sd
+        }
+        value = mean + rng.NormFloat64()*stddev
+    case "exponential":
+        if mean <= minWeight {
+            mean = (minWeight + maxWeight) / 2
+        }
+        value = minWeight + rng.ExpFloat64()*(mean-minWeight)
+    case "", "uniform":
+        return minWeight + rng.Float64()*(maxWeight-minWeight)
+    default:
+        log.Printf("Unknown weight distribution %q, using uniform", distribution)
+        return minWeight + rng.Float64()*(maxWeight-minWeight)
+    }
+    return math.Max(minWeight, math.Min(maxWeight, value))
+}
+
+// generateTemperatureMeasurement creates a temperature_sensor reading between
+// measurement.min_temperature_c and max_temperature_c (default 15-30)
+func (device *ConfiguredEndDevice) generateTemperatureMeasurement() map[string]interface{} {
+    minTemperature, maxTemperature, precision := 15.0, 30.0, 0.1
+    if measurementConfig, ok := device.DeviceConfig["measurement"].(map[string]interface{}); ok {
+        if min, ok := toFloat64(measurementConfig["min_temperature_c"]); ok {
+            minTemperature = min
+        }
+        if max, ok := toFloat64(measurementConfig["max_temperature_c"]); ok {
+            maxTemperature = max
+        }
+        if prec, ok := toFloat64(measurementConfig["precision"]); ok && prec > 0 {
+            precision = prec
+        }
+    }
+    
+    timestamp := device.now()
+    precisionMultiplier := 1.0 / precision
+    value := minTemperature + device.random().Float64()*(maxTemperature-minTemperature)
+    
+    // Apply the device's additive zero offset and Gaussian sensor noise
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    if offset, ok := toFloat64(behaviorConfig["zero_offset"]); ok {
+        value += offset
+    }
+    if stddev, ok := toFloat64(behaviorConfig["noise_stddev"]); ok && stddev > 0 {
+        value += device.random().NormFloat64() * stddev
+    }
+    
+    parameterSet, _ := device.DeviceConfig["active_parameter_set"].(string)
+    if parameterSet == "" {
+        parameterSet = "unknown"
+    }
+    payload := map[string]interface{}{
+        "temperature_c": math.Round(value*precisionMultiplier) / precisionMultiplier,
+        "units":         "C",
+        "timestamp_ms":  timestamp.UnixNano() / int64(time.Millisecond),
+        "parameter_set": parameterSet,
+    }
+    return createMeasurementEvent(device, timestamp, payload)
+}
+
+// generateMeasurement creates a measurement with parameters from active parameter set
+func (device *ConfiguredEndDevice) generateMeasurement() map[string]interface{} {
+    if device.Type == "temperature_sensor" {
+        return device.generateTemperatureMeasurement()
+    }
+    
+    // Get base measurement parameters
+    var minWeight float64 = 0.1
+    var maxWeight float64 = 25.0
+    var precision float64 = 0.1
+    var units string = "kg"
+    var calibrationFactor float64 = 1.0
+    
+    // Extract base measurement parameters
+    measurementConfig, _ := device.DeviceConfig["measurement"].(map[string]interface{})
+    if measurementConfig != nil {
+        if min, ok := toFloat64(measurementConfig["min_weight_kg"]); ok {
+            minWeight = min
+        }
+        if max, ok := toFloat64(measurementConfig["max_weight_kg"]); ok {
+            maxWeight = max
+        }
+        if prec, ok := toFloat64(measurementConfig["precision"]); ok {
+            precision = prec
+        }
+        if u, ok := measurementConfig["units"].(string); ok {
+            units = u
+        }
+        if cf, ok := toFloat64(measurementConfig["calibration_factor"]); ok {
+            calibrationFactor = cf
+        }
+        // A per-unit precision (e.g. precision_by_unit: {g: 1, kg: 0.01}) wins over the global one
+        if byUnit, ok := measurementConfig["precision_by_unit"].(map[string]interface{}); ok {
+            if prec, ok := toFloat64(byUnit[units]); ok && prec > 0 {
+                precision = prec
+            }
+        }
+    }
+    
+    // Generate weight value, replaying the configured dataset if there is one
+    timestamp := device.now()
+    precisionMultiplier := 1.0 / precision
+    rawValue, fromMirror := device.latestMirrorValue()
+    if !fromMirror {
+        var fromDataset bool
+        if rawValue, fromDataset = device.nextDatasetValue(); !fromDataset {
+            rawValue = sampleWeight(device.random(), measurementConfig, minWeight, maxWeight)
+        }
+    }
+    
+    // Apply the calibration factor, drifting with uptime if configured
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    calibratedValue := rawValue * (calibrationFactor + device.calibrationDrift(behaviorConfig, timestamp))
+    
+    // Apply the device's additive zero offset and Gaussian sensor noise
+    if offset, ok := toFloat64(behaviorConfig["zero_offset"]); ok {
+        calibratedValue += offset
+    }
+    if stddev, ok := toFloat64(behaviorConfig["noise_stddev"]); ok && stddev > 0 {
+        calibratedValue += device.random().NormFloat64() * stddev
+    }
+    
+    // Apply the time-of-day curve
+    calibratedValue *= timeOfDayMultiplier(behaviorConfig, timestamp, "weight")
+    
+    // Apply correlated anomaly shift if one is active
+    if shift := device.activeAnomaly(timestamp); shift != nil {
+        calibratedValue = calibratedValue*shift.Multiplier + shift.Offset
+    }
+    
+    // Round to specified precision
+    roundedValue := math.Round(calibratedValue*precisionMultiplier) / precisionMultiplier
+    
+    // Create base payload with weight
+    payload := map[string]interface{}{
+        "weight_kg": roundedValue,
+        "units": units,
+        "timestamp_ms": timestamp.UnixNano() / int64(time.Millisecond),
+    }
+    
+    // Get active parameter set
+    activeParameterSetName, _ := device.DeviceConfig["active_parameter_set"].(string)
+    if activeParameterSetName == "" {
+        // Default to existing behavior if no active set
+        payload["parameter_set"] = "unknown"
+        return createMeasurementEvent(device, timestamp, payload)
+    }
+    
+    // Record which parameter set was used
+    payload["parameter_set"] = activeParameterSetName
+    
+    // Get parameter sets configuration
+    parameterSets, ok := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+    if !ok {
+        // No parameter sets defined
+        return createMeasurementEvent(device, timestamp, payload)
+    }
+    
+    // Get active parameter set
+    activeSet, ok := parameterSets[activeParameterSetName].(map[string]interface{})
+    if !ok {
+        // Parameter set not found
+        return createMeasurementEvent(device, timestamp, payload)
+    }
+    
+    // Get required parameters
+    requiredParams, _ := activeSet["required_parameters"].([]interface{})
+    paramDefs, _ := activeSet["parameter_definitions"].(map[string]interface{})
+    
+    // Generate values for each required parameter
+    for _, paramName := range requiredParams {
+        paramNameStr, ok := paramName.(string)
+        if !ok {
+            continue
+        }
+        
+        // Get parameter definition
+        paramDef, ok := paramDefs[paramNameStr].(map[string]interface{})
+        if !ok {
+            continue
+        }
+        
+        // Generate value for this parameter
+        paramValue := generateParameterValue(paramNameStr, paramDef, device, device.random())
+        payload[paramNameStr] = paramValue
+    }
+
+    log.Printf("Generated measurement with parameter set: %s", payload["parameter_set"])
+    
+    // Create and return measurement event
+    return createMeasurementEvent(device, timestamp, payload)
+}
+
+// mirrorSourceTopic returns the measurement topic the device mirrors (behavior.mirror.source_topic).
+// Mirrored weights replace generated ones; noise_stddev and zero_offset still apply.
+func (device *ConfiguredEndDevice) mirrorSourceTopic() string {
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    mirrorConfig, _ := behaviorConfig["mirror"].(map[string]interface{})
+    topic, _ := mirrorConfig["source_topic"].(string)
+    return topic
+}
+
+// latestMirrorValue returns the last weight received from the device's mirror source
+func (device *ConfiguredEndDevice) latestMirrorValue() (float64, bool) {
+    device.mirrorMutex.Lock()
+    defer device.mirrorMutex.Unlock()
+    return device.mirrorValue, device.hasMirrorValue
+}
+
+// setMirrorValue records a weight received from the device's mirror source
+func (device *ConfiguredEndDevice) setMirrorValue(value float64) {
+    device.mirrorMutex.Lock()
+    defer device.mirrorMutex.Unlock()
+    device.mirrorValue = value
+    device.hasMirrorValue = true
+}
+
+// addMirror registers a device as a mirror of sourceTopic, subscribing on first use
+func (dm *DeviceManager) addMirror(sourceTopic string, device *ConfiguredEndDevice) {
+    dm.mirrorMutex.Lock()
+    devices, subscribed := dm.mirrors[sourceTopic]
+    if !subscribed {
+        devices = make(map[string]*ConfiguredEndDevice)
+        dm.mirrors[sourceTopic] = devices
+    }
+    devices[device.ID] = device
+    dm.mirrorMutex.Unlock()
+    
+    log.Printf("Device %s mirroring measurements from %s", device.ID, sourceTopic)
+    if !subscribed {
+        dm.subscribeMirror(sourceTopic)
+    }
+}
+
+// removeMirror unregisters a mirroring device, unsubscribing when it was the last one
+func (dm *DeviceManager) removeMirror(sourceTopic string, device *ConfiguredEndDevice) {
+    dm.mirrorMutex.Lock()
+    devices := dm.mirrors[sourceTopic]
+    delete(devices, device.ID)
+    last := len(devices) == 0
+    if last {
+        delete(dm.mirrors, sourceTopic)
+    }
+    dm.mirrorMutex.Unlock()
+    
+    if last && dm.gateway.isMqttConnected.Load() && dm.gateway.mqttClient != nil {
+        dm.gateway.mqttClient.Unsubscribe(sourceTopic).Wait()
+    }
+}
+
+// subscribeMirror subscribes to a mirror source topic
+func (dm *DeviceManager) subscribeMirror(sourceTopic string) {
+    if !dm.gateway.isMqttConnected.Load() || dm.gateway.mqttClient == nil {
+        log.Printf("MQTT not connected, mirror subscription to %s deferred until connected", sourceTopic)
+        return
+    }
+    token := dm.gateway.mqttClient.Subscribe(sourceTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+        dm.handleMirrorMessage(sourceTopic, msg)
+    })
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error subscribing to mirror source %s: %v", sourceTopic, token.Error())
+    }
+}
+
+// resubscribeMirrors restores all mirror subscriptions after (re)connecting
+func (dm *DeviceManager) resubscribeMirrors() {
+    dm.mirrorMutex.Lock()
+    topics := make([]string, 0, len(dm.mirrors))
+    for topic := range dm.mirrors {
+        topics = append(topics, topic)
+    }
+    dm.mirrorMutex.Unlock()
+    
+    for _, topic := range topics {
+        dm.subscribeMirror(topic)
+    }
+}
+
+// handleMirrorMessage feeds the weight of a real measurement to the devices mirroring it.
+// The weight is read from payload.weight_kg, or a top-level weight_kg.
+func (dm *DeviceManager) handleMirrorMessage(sourceTopic string, msg mqtt.Message) {
+    var measurement map[string]interface{}
+    if err := json.Unmarshal(msg.Payload(), &measurement); err != nil {
+        log.Printf("Ignoring invalid mirror measurement on %s: %v", msg.Topic(), err)
+        return
+    }
+    weight, ok := toFloat64(measurement["weight_kg"])
+    if payload, isMap := measurement["payload"].(map[string]interface{}); isMap && !ok {
+        weight, ok = toFloat64(payload["weight_kg"])
+    }
+    if !ok {
+        log.Printf("Ignoring mirror measurement on %s without weight_kg", msg.Topic())
+        return
+    }
+    
+    dm.mirrorMutex.Lock()
+    defer dm.mirrorMutex.Unlock()
+    for _, device := range dm.mirrors[sourceTopic] {
+        device.setMirrorValue(weight)
+    }
+}
+
+// ReplayRecording holds measurement events recorded from a real gateway
+type ReplayRecording struct {
+    Path   string                   // File the events were loaded from
+    Events []map[string]interface{} // Events in file order
+}
+
+// newReplayRecordingFromEnv loads REPLAY_FILE, a newline-delimited JSON file of
+// measurement events, returning nil when unset or unreadable
+func newReplayRecordingFromEnv() *ReplayRecording {
+    path := os.Getenv("REPLAY_FILE")
+    if path == "" {
+        return nil
+    }
+    recording, err := loadReplayRecording(path)
+    if err != nil {
+        log.Printf("Error loading replay file %s, generating measurements instead: %v", path, err)
+        return nil
+    }
+    log.Printf("Replaying %d recorded measurement(s) from %s", len(recording.Events), path)
+    return recording
+}
+
+// loadReplayRecording parses a newline-delimited JSON file, skipping blank lines
+func loadReplayRecording(path string) (*ReplayRecording, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    
+    recording := &ReplayRecording{Path: path}
+    for i, line := range strings.Split(string(data), "\n") {
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+        var event map[string]interface{}
+        if err := json.Unmarshal([]byte(line), &event); err != nil {
+            return nil, fmt.Errorf("line %d: %v", i+1, err)
+        }
+        recording.Events = append(recording.Events, event)
+    }
+    if len(recording.Events) == 0 {
+        return nil, fmt.Errorf("no events in %s", path)
+    }
+    return recording, nil
+}
+
+// replayEventTime returns when a recorded event happened, from its timestamp or payload.timestamp_ms
+func replayEventTime(event map[string]interface{}) (time.Time, bool) {
+    if timestamp, ok := event["timestamp"].(string); ok {
+        if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+            return t, true
+        }
+    }
+    payload, _ := event["payload"].(map[string]interface{})
+    if ms, ok := toFloat64(payload["timestamp_ms"]); ok {
+        return time.UnixMilli(int64(ms)), true
+    }
+    return time.Time{}, false
+}
+
+// nextReplayEvent returns the device's next recorded event, rewritten as coming from
+// this device now, and starts over at the end of the recording. It also returns
+// the recorded gap to the following event (0 if unknown or when wrapping around).
+func (device *ConfiguredEndDevice) nextReplayEvent(recording *ReplayRecording) (map[string]interface{}, time.Duration) {
+    device.datasetMutex.Lock()
+    index := device.replayIndex % len(recording.Events)
+    device.replayIndex = index + 1
+    device.datasetMutex.Unlock()
+    next := recording.Events[(index+1)%len(recording.Events)]
+    
+    event := deepCopyValue(recording.Events[index]).(map[string]interface{})
+    var gap time.Duration
+    if current, ok := replayEventTime(event); ok {
+        if following, ok := replayEventTime(next); ok && following.After(current) {
+            gap = following.Sub(current)
+        }
+    }
+    
+    now := device.now()
+    event["gateway_id"] = device.GatewayID
+    event["device_id"] = device.ID
+    event["timestamp"] = now.Format(time.RFC3339)
+    event["measurement_id"] = fmt.Sprintf("%s-%d", device.ID, now.UnixNano())
+    event["sequence"] = device.nextSequence()
+    if _, ok := event["event_type"]; !ok {
+        event["event_type"] = "measurement"
+    }
+    return event, gap
+}
+
+// preloadDataset loads the configured dataset file without consuming a value
+func (device *ConfiguredEndDevice) preloadDataset() {
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    datasetConfig, _ := behaviorConfig["dataset"].(map[string]interface{})
+    if path, _ := datasetConfig["file"].(string); path != "" {
+        if _, err := loadDataset(path); err != nil {
+            log.Printf("Device %s: failed to load dataset %s: %v", device.ID, path, err)
+        }
+    }
+}
+
+// nextDatasetValue returns the next weight from the device's behavior.dataset, if any.
+// Options: file (CSV or JSON), mode ("sequential" or "sample") and on_exhausted
+// ("cycle" to start over, "random" to fall back to random generation).
+func (device *ConfiguredEndDevice) nextDatasetValue() (float64, bool) {
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    datasetConfig, ok := behaviorConfig["dataset"].(map[string]interface{})
+    if !ok {
+        return 0, false
+    }
+    path, _ := datasetConfig["file"].(string)
+    if path == "" {
+        return 0, false
+    }
+    
+    device.datasetMutex.Lock()
+    defer device.datasetMutex.Unlock()
+    
+    // Load (or reload after a config change) the dataset
+    if device.dataset == nil || device.dataset.Path != path {
+        dataset, err := loadDataset(path)
+        if err != nil {
+            log.Printf("Device %s: failed to load dataset %s, using random values: %v", device.ID, path, err)
+            return 0, false
+        }
+        device.dataset = dataset
+        device.datasetIndex = 0
+    }
+    
+    values := device.dataset.Values
+    if len(values) == 0 {
+        return 0, false
+    }
+    
+    if mode, _ := datasetConfig["mode"].(string); mode == "sample" {
+        return values[device.random().Intn(len(values))], true
+    }
+    
+    if device.datasetIndex >= len(values) {
+        if onExhausted, _ := datasetConfig["on_exhausted"].(string); onExhausted == "random" {
+            return 0, false
+        }
+        device.datasetIndex = 0
+    }
+    value := values[device.datasetIndex]
+    device.datasetIndex++
+    return value, true
+}
+
+// loadDataset reads weight values from a CSV or JSON file, caching the result.
+// CSV files use the weight_kg column (or the first column); JSON files hold an
+// array of numbers or of objects with a weight_kg field.
+func loadDataset(path string) (*MeasurementDataset, error) {
+    datasetCacheMutex.Lock()
+    defer datasetCacheMutex.Unlock()
+    
+    if dataset, ok := datasetCache[path]; ok {
+        return dataset, nil
+    }
+    
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    
+    var values []float64
+    if strings.EqualFold(filepath.Ext(path), ".json") {
+        values, err = parseJSONDataset(data)
+    } else {
+        values, err = parseCSVDataset(data)
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    dataset := &MeasurementDataset{Path: path, Values: values}
+    datasetCache[path] = dataset
+    log.Printf("Loaded %d dataset value(s) from %s", len(values), path)
+    return dataset, nil
+}
+
+// parseJSONDataset parses an array of numbers or of objects with weight_kg
+func parseJSONDataset(data []byte) ([]float64, error) {
+    var items []interface{}
+    if err := json.Unmarshal(data, &items); err != nil {
+        return nil, fmt.Errorf("invalid JSON dataset: %v", err)
+    }
+    
+    values := make([]float64, 0, len(items))
+    for _, item := range items {
+        if object, ok := item.(map[string]interface{}); ok {
+            item = object["weight_kg"]
+        }
+        if value, ok := toFloat64(item); ok {
+            values = append(values, value)
+        }
+    }
+    return values, nil
+}
+
+// parseCSVDataset parses a CSV file, skipping a header row if present
+func parseCSVDataset(data []byte) ([]float64, error) {
+    records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+    if err != nil {
+        return nil, fmt.Errorf("invalid CSV dataset: %v", err)
+    }
+    
+    column := 0
+    values := make([]float64, 0, len(records))
+    for i, record := range records {
+        if i == 0 {
+            for j, name := range record {
+                if strings.TrimSpace(name) == "weight_kg" {
+                    column = j
+                }
+            }
+        }
+        if column >= len(record) {
+            continue
+        }
+        value, err := strconv.ParseFloat(strings.TrimSpace(record[column]), 64)
+        if err != nil {
+            continue // header or malformed row
+        }
+        values = append(values, value)
+    }
+    return values, nil
+}
+
+// createMeasurementEvent formats the final measurement event
+func createMeasurementEvent(device *ConfiguredEndDevice, timestamp time.Time, payload map[string]interface{}) map[string]interface{} {
+    return map[string]interface{}{
+        "gateway_id": device.GatewayID,
+        "device_id": device.ID,
+        "event_type": "measurement",
+        "type": measurementType(device),
+        "timestamp": timestamp.Format(time.RFC3339),
+        "measurement_id": fmt.Sprintf("%s-%d", device.ID, timestamp.UnixNano()),
+        "sequence": device.nextSequence(),
+        "config_version": device.ConfigVersion, // Config the measurement was generated under
+        "payload": payload,
+    }
+}
+
+// measurementType returns the measurement event type for the device, defaulting to a weight measurement
+func measurementType(device *ConfiguredEndDevice) string {
+    if measurementType, ok := measurementTypes[device.Type]; ok {
+        return measurementType
+    }
+    return "weight_measurement"
+}
+
+// nextSequence assigns the next per-device measurement sequence number
+func (device *ConfiguredEndDevice) nextSequence() int64 {
+    device.sequenceMutex.Lock()
+    defer device.sequenceMutex.Unlock()
+    device.sequence++
+    return device.sequence
+}
+
+// previousSentSequence returns the last published sequence number
+func (device *ConfiguredEndDevice) previousSentSequence() int64 {
+    device.sequenceMutex.Lock()
+    defer device.sequenceMutex.Unlock()
+    return device.lastSentSequence
+}
+
+// markSequenceSent records a sequence number as published
+func (device *ConfiguredEndDevice) markSequenceSent(sequence int64) {
+    device.sequenceMutex.Lock()
+    defer device.sequenceMutex.Unlock()
+    if sequence > device.lastSentSequence {
+        device.lastSentSequence = sequence
+    }
+}
+
+// EncryptedPayload is the envelope for an AES-GCM encrypted measurement
+type EncryptedPayload struct {
+    Encrypted  bool   `json:"encrypted"`
+    Algorithm  string `json:"alg"`
+    KeyID      string `json:"key_id"`
+    IV         string `json:"iv"`         // Base64 nonce
+    Ciphertext string `json:"ciphertext"` // Base64 ciphertext with GCM tag
+}
+
+// measurementEncryptionKey reads the optional AES key (base64, 16/24/32 bytes) from
+// MEASUREMENT_ENCRYPTION_KEY and its ID from MEASUREMENT_ENCRYPTION_KEY_ID
+func measurementEncryptionKey() ([]byte, string, error) {
+    encoded := os.Getenv("MEASUREMENT_ENCRYPTION_KEY")
+    if encoded == "" {
+        return nil, "", nil
+    }
+    key, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, "", fmt.Errorf("invalid base64 key: %v", err)
+    }
+    if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+        return nil, "", fmt.Errorf("key must be 16, 24 or 32 bytes, got %d", len(key))
+    }
+    keyID := os.Getenv("MEASUREMENT_ENCRYPTION_KEY_ID")
+    if keyID == "" {
+        keyID = "default"
+    }
+    return key, keyID, nil
+}
+
+// encryptPayload seals data with AES-GCM and wraps it in an EncryptedPayload envelope
+func encryptPayload(data []byte, key []byte, keyID string) ([]byte, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := cryptorand.Read(nonce); err != nil {
+        return nil, err
+    }
+    
+    return json.Marshal(EncryptedPayload{
+        Encrypted:  true,
+        Algorithm:  "AES-GCM",
+        KeyID:      keyID,
+        IV:         base64.StdEncoding.EncodeToString(nonce),
+        Ciphertext: base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, data, nil)),
+    })
+}
+
+// measurementTopic returns the publish topic for a device's measurements. A parameter
+// set may declare its own "topic" template with {gateway_id}, {device_id},
+// {device_type} and {parameter_set} placeholders; otherwise the unified device topic is used.
+func measurementTopic(device *ConfiguredEndDevice) string {
+    defaultTopic := fmt.Sprintf("gateway/%s/device/%s/measurement", device.GatewayID, device.ID)
+    
+    activeSetName, _ := device.DeviceConfig["active_parameter_set"].(string)
+    parameterSets, _ := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+    activeSet, _ := parameterSets[activeSetName].(map[string]interface{})
+    template, _ := activeSet["topic"].(string)
+    if template == "" {
+        return defaultTopic
+    }
+    
+    return strings.NewReplacer(
+        "{gateway_id}", device.GatewayID,
+        "{device_id}", device.ID,
+        "{device_type}", device.Type,
+        "{parameter_set}", activeSetName,
+    ).Replace(template)
+}
+
+// measurementRetryBackoff is the delay before the first measurement publish retry, doubled per retry
+var measurementRetryBackoff = 500 * time.Millisecond
+
+// DeliveryGuarantee controls how a measurement is published
+type DeliveryGuarantee struct {
+    QoS     byte
+    Retain  bool
+    Retries int // Extra publish attempts after a failure
+}
+
+// measurementDelivery returns the delivery guarantees of the device's active parameter
+// set, declared as e.g. "delivery: {qos: 1, retain: false, retries: 3}"
+func measurementDelivery(device *ConfiguredEndDevice) DeliveryGuarantee {
+    // Parameter sets without a delivery section use GATEWAY_PUBLISH_QOS
+    delivery := DeliveryGuarantee{QoS: publishQoS()}
+    
+    activeSetName, _ := device.DeviceConfig["active_parameter_set"].(string)
+    parameterSets, _ := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+    activeSet, _ := parameterSets[activeSetName].(map[string]interface{})
+    config, ok := activeSet["delivery"].(map[string]interface{})
+    if !ok {
+        return delivery
+    }
+    
+    if qos, ok := toFloat64(config["qos"]); ok && qos >= 0 && qos <= 2 {
+        delivery.QoS = byte(qos)
+    }
+    if retain, ok := config["retain"].(bool); ok {
+        delivery.Retain = retain
+    }
+    if retries, ok := toFloat64(config["retries"]); ok && retries > 0 {
+        delivery.Retries = int(retries)
+    }
+    return delivery
+}
+
+// Batch grouping modes for MEASUREMENT_BATCH_GROUP
+const (
+    BatchGroupDevice       = "device"
+    BatchGroupParameterSet = "parameter_set"
+)
+
+// bufferedPublish is an MQTT message held until the broker is reachable again
+type bufferedPublish struct {
+    Topic   string
+    QoS     byte
+    Retain  bool
+    Payload []byte
+}
+
+// offlineBuffer is a bounded ring of measurements that could not be published,
+// dropping the oldest when full
+type offlineBuffer struct {
+    mu       sync.Mutex
+    entries  []bufferedPublish // Ring storage, len = capacity
+    start    int               // Index of the oldest entry
+    count    int               // Number of buffered entries
+    dropped  int               // Entries dropped since the last drain
+    flushing bool              // A flush is publishing the buffer; new messages queue behind it
+}
+
+// newOfflineBufferFromEnv reads MEASUREMENT_BUFFER_SIZE (default 0 = drop
+// measurements while disconnected)
+func newOfflineBufferFromEnv() *offlineBuffer {
+    size := 0
+    if value := os.Getenv("MEASUREMENT_BUFFER_SIZE"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+            size = n
+        } else {
+            log.Printf("Invalid MEASUREMENT_BUFFER_SIZE %q, buffering disabled", value)
+        }
+    }
+    if size == 0 {
+        return nil
+    }
+    return newOfflineBuffer(size)
+}
+
+// newOfflineBuffer creates a buffer holding up to capacity messages
+func newOfflineBuffer(capacity int) *offlineBuffer {
+    return &offlineBuffer{entries: make([]bufferedPublish, capacity)}
+}
+
+// add appends messages, overwriting the oldest when the buffer is full
+func (b *offlineBuffer) add(messages ...bufferedPublish) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for _, message := range messages {
+        b.addLocked(message)
+    }
+}
+
+// addLocked appends a message; the caller must hold mu
+func (b *offlineBuffer) addLocked(message bufferedPublish) {
+    if b.count == len(b.entries) {
+        b.start = (b.start + 1) % len(b.entries)
+        b.count--
+        b.dropped++
+    }
+    b.entries[(b.start+b.count)%len(b.entries)] = message
+    b.count++
+}
+
+// hold buffers a message instead of it being published while disconnected, or
+// while a flush is still publishing older messages so they go out in order.
+// It reports whether the message was buffered.
+func (b *offlineBuffer) hold(message bufferedPublish, connected bool) bool {
+    if b == nil {
+        return false
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if connected && !b.flushing {
+        return false
+    }
+    b.addLocked(message)
+    return true
+}
+
+// drain empties the buffer, returning its messages oldest first and how many
+// were dropped since the last drain
+func (b *offlineBuffer) drain() ([]bufferedPublish, int) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.drainLocked()
+}
+
+// drainLocked empties the buffer; the caller must hold mu
+func (b *offlineBuffer) drainLocked() ([]bufferedPublish, int) {
+    messages := make([]bufferedPublish, b.count)
+    for i := range messages {
+        messages[i] = b.entries[(b.start+i)%len(b.entries)]
+    }
+    dropped := b.dropped
+    b.start, b.count, b.dropped = 0, 0, 0
+    return messages, dropped
+}
+
+// startFlush marks a flush as running, returning false if one already is
+func (b *offlineBuffer) startFlush() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.flushing {
+        return false
+    }
+    b.flushing = true
+    return true
+}
+
+// nextFlush drains the buffer for the running flush, ending the flush once the
+// buffer is empty so new messages are published directly again
+func (b *offlineBuffer) nextFlush() ([]bufferedPublish, int) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.count == 0 {
+        b.flushing = false
+    }
+    return b.drainLocked()
+}
+
+// requeue puts unsent messages back ahead of anything buffered since they were
+// drained and ends the running flush, if any
+func (b *offlineBuffer) requeue(messages []bufferedPublish) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    dropped := b.dropped
+    newer, _ := b.drainLocked()
+    for _, message := range messages {
+        b.addLocked(message)
+    }
+    for _, message := range newer {
+        b.addLocked(message)
+    }
+    b.dropped += dropped
+    b.flushing = false
+}
+
+// Len returns the number of buffered messages
+func (b *offlineBuffer) Len() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.count
+}
+
+// flushOfflineBuffer publishes buffered measurements oldest first unless a flush
+// is already running. It is slow with a large buffer, so run it in a goroutine.
+func (dm *DeviceManager) flushOfflineBuffer() {
+    if dm.offline == nil || !dm.offline.startFlush() {
+        return
+    }
+    dm.publishBufferedMeasurements()
+}
+
+// publishBufferedMeasurements publishes the buffer of a running flush until it is
+// empty, including measurements held back while it runs. A failed publish puts
+// the rest back for the next reconnect.
+func (dm *DeviceManager) publishBufferedMeasurements() {
+    flushed := 0
+    for {
+        messages, dropped := dm.offline.nextFlush()
+        if dropped > 0 {
+            log.Printf("Measurement buffer was full while disconnected, dropped %d oldest measurements", dropped)
+        }
+        if len(messages) == 0 {
+            break
+        }
+        for i, message := range messages {
+            token := dm.gateway.mqttClient.Publish(message.Topic, message.QoS, message.Retain, message.Payload)
+            token.Wait()
+            if token.Error() != nil {
+                log.Printf("Error flushing buffered measurements, %d kept for the next reconnect: %v", len(messages)-i, token.Error())
+                dm.offline.requeue(messages[i:])
+                return
+            }
+            flushed++
+        }
+    }
+    if flushed > 0 {
+        log.Printf("Flushed %d buffered measurements", flushed)
+    }
+}
+
+// measurementBatcher collects measurements into batches, one per device or per
+// parameter set, which are published when full or when the flush interval passes
+type measurementBatcher struct {
+    mu       sync.Mutex
+    size     int                          // Measurements per batch
+    interval time.Duration                // How often partial batches are flushed
+    groupBy  string                       // BatchGroupDevice or BatchGroupParameterSet
+    batches  map[string]*measurementBatch // Open batches by topic
+}
+
+// measurementBatch is a group of measurements published as one message
+type measurementBatch struct {
+    Topic        string
+    Key          string // Device ID or parameter set name
+    Measurements []map[string]interface{}
+}
+
+// newMeasurementBatcherFromEnv reads MEASUREMENT_BATCH_SIZE (0 or unset = no batching),
+// MEASUREMENT_BATCH_INTERVAL_SECONDS (default 10) and MEASUREMENT_BATCH_GROUP
+// ("device", the default, or "parameter_set")
+func newMeasurementBatcherFromEnv() *measurementBatcher {
+    size, err := strconv.Atoi(os.Getenv("MEASUREMENT_BATCH_SIZE"))
+    if err != nil || size <= 0 {
+        return nil
+    }
+    interval := 10 * time.Second
+    if seconds, err := strconv.Atoi(os.Getenv("MEASUREMENT_BATCH_INTERVAL_SECONDS")); err == nil && seconds > 0 {
+        interval = time.Duration(seconds) * time.Second
+    }
+    groupBy := BatchGroupDevice
+    if os.Getenv("MEASUREMENT_BATCH_GROUP") == BatchGroupParameterSet {
+        groupBy = BatchGroupParameterSet
+    }
+    log.Printf("Measurement batching enabled: %d per batch by %s, flushed every %v", size, groupBy, interval)
+    return newMeasurementBatcher(size, interval, groupBy)
+}
+
+// newMeasurementBatcher creates a batcher publishing batches of size measurements
+func newMeasurementBatcher(size int, interval time.Duration, groupBy string) *measurementBatcher {
+    return &measurementBatcher{
+        size:     size,
+        interval: interval,
+        groupBy:  groupBy,
+        batches:  make(map[string]*measurementBatch),
+    }
+}
+
+// batchTopic returns the topic and grouping key of a measurement's batch. Per-set
+// batches use the parameter set's "batch_topic" template ({gateway_id} and
+// {parameter_set} placeholders) or gateway/{gateway_id}/parameter_set/{parameter_set}/batch.
+func (b *measurementBatcher) batchTopic(device *ConfiguredEndDevice, measurement map[string]interface{}) (string, string) {
+    if b.groupBy != BatchGroupParameterSet {
+        return measurementTopic(device) + "/batch", device.ID
+    }
+    
+    payload, _ := measurement["payload"].(map[string]interface{})
+    setName, _ := payload["parameter_set"].(string)
+    if setName == "" {
+        setName = "unknown"
+    }
+    parameterSets, _ := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+    set, _ := parameterSets[setName].(map[string]interface{})
+    template, _ := set["batch_topic"].(string)
+    if template == "" {
+        template = "gateway/{gateway_id}/parameter_set/{parameter_set}/batch"
+    }
+    return strings.NewReplacer("{gateway_id}", device.GatewayID, "{parameter_set}", setName).Replace(template), setName
+}
+
+// add queues a measurement, returning its batch once it's full
+func (b *measurementBatcher) add(device *ConfiguredEndDevice, measurement map[string]interface{}) *measurementBatch {
+    topic, key := b.batchTopic(device, measurement)
+    
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    batch := b.batches[topic]
+    if batch == nil {
+        batch = &measurementBatch{Topic: topic, Key: key}
+        b.batches[topic] = batch
+    }
+    batch.Measurements = append(batch.Measurements, measurement)
+    if len(batch.Measurements) < b.size {
+        return nil
+    }
+    delete(b.batches, topic)
+    return batch
+}
+
+// drain removes and returns all open batches
+func (b *measurementBatcher) drain() []*measurementBatch {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    batches := make([]*measurementBatch, 0, len(b.batches))
+    for topic, batch := range b.batches {
+        batches = append(batches, batch)
+        delete(b.batches, topic)
+    }
+    return batches
+}
+
+// runBatchFlusher periodically publishes partially filled batches
+func (dm *DeviceManager) runBatchFlusher() {
+    ticker := time.NewTicker(dm.batcher.interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        dm.flushBatches()
+    }
+}
+
+// flushBatches publishes all open batches
+func (dm *DeviceManager) flushBatches() {
+    for _, batch := range dm.batcher.drain() {
+        dm.publishBatch(batch)
+    }
+}
+
+// publishBatch sends a batch of measurements as a single message
+func (dm *DeviceManager) publishBatch(batch *measurementBatch) {
+    connected := dm.gateway.isMqttConnected.Load() && dm.gateway.mqttClient != nil
+    if !connected && dm.offline == nil {
+        log.Printf("Cannot publish batch of %d measurements: MQTT not connected", len(batch.Measurements))
+        return
+    }
+    
+    jsonData, err := json.Marshal(map[string]interface{}{
+        "gateway_id":   dm.gateway.gatewayID,
+        "group_by":     dm.batcher.groupBy,
+        "group":        batch.Key,
+        "count":        len(batch.Measurements),
+        "measurements": batch.Measurements,
+        "timestamp":    time.Now().Format(time.RFC3339),
+    })
+    if err != nil {
+        log.Printf("Error marshaling measurement batch: %v", err)
+        return
+    }
+    
+    // Encrypt end-to-end if a key is configured
+    if key, keyID, err := measurementEncryptionKey(); err != nil {
+        log.Printf("Error loading measurement encryption key: %v", err)
+        return
+    } else if key != nil {
+        if jsonData, err = encryptPayload(jsonData, key, keyID); err != nil {
+            log.Printf("Error encrypting measurement batch: %v", err)
+            return
+        }
+    }
+    
+    // Batches mix parameter sets, so they use GATEWAY_PUBLISH_QOS rather than a set's delivery
+    qos := publishQoS()
+    if dm.offline.hold(bufferedPublish{Topic: batch.Topic, QoS: qos, Payload: jsonData}, connected) {
+        log.Printf("Buffered batch of %d measurements until MQTT is connected and older ones are sent", len(batch.Measurements))
+        return
+    }
+    
+    token := dm.gateway.mqttClient.Publish(batch.Topic, qos, false, jsonData)
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing measurement batch to %s: %v", batch.Topic, token.Error())
+        // Allow a later attempt to publish the same measurements
+        for _, measurement := range batch.Measurements {
+            if measurementID, _ := measurement["measurement_id"].(string); measurementID != "" && dm.dedup != nil {
+                dm.dedup.Forget(measurementID)
+            }
+        }
+        return
+    }
+    
+    log.Printf("Published batch of %d measurements to %s", len(batch.Measurements), batch.Topic)
+}
+
+// drainBattery applies behavior.battery_drain_per_measurement (percentage points, battery
+// simulation is off when unset) and adds battery_pct to the measurement payload. It
+// returns true once, when the level first reaches behavior.battery_low_threshold_pct (default 20).
+func (device *ConfiguredEndDevice) drainBattery(measurement map[string]interface{}) bool {
+    behaviorConfig, _ := device.DeviceConfig["behavior"].(map[string]interface{})
+    drain, ok := toFloat64(behaviorConfig["battery_drain_per_measurement"])
+    payload, hasPayload := measurement["payload"].(map[string]interface{})
+    if !ok || drain <= 0 || !hasPayload {
+        return false
+    }
+    threshold := 20.0
+    if pct, ok := toFloat64(behaviorConfig["battery_low_threshold_pct"]); ok {
+        threshold = pct
+    }
+    
+    device.batteryMutex.Lock()
+    defer device.batteryMutex.Unlock()
+    
+    device.batteryDrained = math.Min(100, device.batteryDrained+drain)
+    level := math.Round((100-device.batteryDrained)*100) / 100
+    payload["battery_pct"] = level
+    
+    if level > threshold || device.lowBatteryReported {
+        return false
+    }
+    device.lowBatteryReported = true
+    return true
+}
+
+// publishLowBattery emits a low_battery event on the device's measurement topic
+func (g *Gateway) publishLowBattery(device *ConfiguredEndDevice, measurement map[string]interface{}) {
+    payload, _ := measurement["payload"].(map[string]interface{})
+    log.Printf("Device %s: low battery (%v%%)", device.ID, payload["battery_pct"])
+    if g.mqttClient == nil || !g.isMqttConnected.Load() {
+        return
+    }
+    
+    event := map[string]interface{}{
+        "gateway_id":  device.GatewayID,
+        "device_id":   device.ID,
+        "event_type":  "low_battery",
+        "battery_pct": payload["battery_pct"],
+        "timestamp":   time.Now().Format(time.RFC3339),
+    }
+    jsonData, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Error marshaling low battery event: %v", err)
+        return
+    }
+    
+    token := g.mqttClient.Publish(measurementTopic(device), 1, false, jsonData)
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing low battery event: %v", token.Error())
+    }
+}
+
+// publishSequenceGap emits a sequence_gap diagnostic event for missing sequence numbers
+func (g *Gateway) publishSequenceGap(device *ConfiguredEndDevice, gapStart int64, gapEnd int64) {
+    log.Printf("Device %s: sequence gap detected, missing %d-%d", device.ID, gapStart, gapEnd)
+    
+    event := map[string]interface{}{
+        "gateway_id":    g.gatewayID,
+        "device_id":     device.ID,
+        "event_type":    "sequence_gap",
+        "gap_start":     gapStart,
+        "gap_end":       gapEnd,
+        "missing_count": gapEnd - gapStart + 1,
+        "timestamp":     time.Now().Format(time.RFC3339),
+    }
+    jsonData, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Error marshaling sequence gap event: %v", err)
+        return
+    }
+    
+    topic := fmt.Sprintf("gateway/%s/device/%s/diagnostic", g.gatewayID, device.ID)
+    token := g.mqttClient.Publish(topic, 0, false, jsonData)
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing sequence gap event: %v", token.Error())
+    }
+}
+
+// formatTimezone caches the location resolved from GATEWAY_TIMEZONE
+var formatTimezone struct {
+    sync.Mutex
+    name     string
+    location *time.Location
+}
+
+// formatLocation returns the timezone for date and time format tokens, read from
+// GATEWAY_TIMEZONE (an IANA name such as "Asia/Singapore"; default local time).
+// The zone is only loaded again when the variable changes.
+func formatLocation() *time.Location {
+    name := os.Getenv("GATEWAY_TIMEZONE")
+    
+    formatTimezone.Lock()
+    defer formatTimezone.Unlock()
+    if formatTimezone.location != nil && formatTimezone.name == name {
+        return formatTimezone.location
+    }
+    
+    location := time.Local
+    if name != "" {
+        loaded, err := time.LoadLocation(name)
+        if err != nil {
+            log.Printf("Invalid GATEWAY_TIMEZONE %q, using local time: %v", name, err)
+        } else {
+            location = loaded
+        }
+    }
+    formatTimezone.name = name
+    formatTimezone.location = location
+    return location
+}
+
+// nextBatchCounter returns the device's next batch counter, restarting at 1 each day
+func (device *ConfiguredEndDevice) nextBatchCounter(day string) int {
+    device.sequenceMutex.Lock()
+    defer device.sequenceMutex.Unlock()
+    
+    if device.batchDay != day {
+        device.batchDay = day
+        device.batchNext = 1
+    }
+    value := device.batchNext
+    device.batchNext++
+    return value
+}
+
+// nextFormatSequence returns the device's next {SEQ} value, starting at 1
+func (device *ConfiguredEndDevice) nextFormatSequence() int64 {
+    device.sequenceMutex.Lock()
+    defer device.sequenceMutex.Unlock()
+    device.formatSequence++
+    return device.formatSequence
+}
+
+// formatContext is what format tokens are expanded from
+type formatContext struct {
+    device *ConfiguredEndDevice
+    now    time.Time // In the configured timezone
+    rng    *rand.Rand
+}
+
+// formatToken is a placeholder in a string parameter's format
+type formatToken struct {
+    Token  string
+    Expand func(ctx formatContext) string
+}
+
+// formatTokens lists the supported format placeholders
+var formatTokens = []formatToken{
+    {"{YYYYMMDD}", func(ctx formatContext) string { return ctx.now.Format("20060102") }},
+    {"{HHMM}", func(ctx formatContext) string { return ctx.now.Format("1504") }},
+    {"{DEVICE_ID}", func(ctx formatContext) string { return ctx.device.ID }},
+    {"{SEQ}", func(ctx formatContext) string { return strconv.FormatInt(ctx.device.nextFormatSequence(), 10) }},
+    {"{UUID}", func(ctx formatContext) string { return randomUUID(ctx.rng) }},
+    // Batch numbers combine the device number, the quarter-hour slot and a
+    // per-device counter, so they never repeat within a device-day
+    {"{###}", func(ctx formatContext) string {
+        slot := ctx.now.Hour()*4 + ctx.now.Minute()/15
+        counter := ctx.device.nextBatchCounter(ctx.now.Format("20060102"))
+        return fmt.Sprintf("%03d%02d%04d", deviceIndex(ctx.device.ID)%1000, slot, counter%10000)
+    }},
+}
+
+// expandFormatTokens replaces each token present in format. Tokens with counters
+// advance once per call, however often they appear.
+func expandFormatTokens(format string, ctx formatContext) string {
+    for _, token := range formatTokens {
+        if strings.Contains(format, token.Token) {
+            format = strings.Replace(format, token.Token, token.Expand(ctx), -1)
+        }
+    }
+    return format
+}
+
+// randomUUID returns a version 4 UUID drawn from rng
+func randomUUID(rng *rand.Rand) string {
+    var b [16]byte
+    binary.BigEndian.PutUint64(b[:8], rng.Uint64())
+    binary.BigEndian.PutUint64(b[8:], rng.Uint64())
+    b[6] = b[6]&0x0f | 0x40 // Version 4
+    b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// generateParameterValue creates a value for a parameter based on its definition
+func generateParameterValue(paramName string, paramDef map[string]interface{}, device *ConfiguredEndDevice, rng *rand.Rand) interface{} {
+    // Get parameter type
+    paramType, _ := paramDef["type"].(string)
+    
+    switch paramType {
+    case "string":
+        // Check if parameter has predefined options
         if options, ok := paramDef["options"].([]interface{}); ok && len(options) > 0 {
             // Return random option
-            return options[rand.Intn(len(options))]
+            return options[rng.Intn(len(options))]
+        }
+        
+        // Check if parameter has a format
+        if format, ok := paramDef["format"].(string); ok {
+            return expandFormatTokens(format, formatContext{
+                device: device,
+                now:    time.Now().In(formatLocation()),
+                rng:    rng,
+            })
+        }
+        
+        // Return default if provided
+        if defaultVal, ok := paramDef["default"].(string); ok {
+            return defaultVal
+        }
+        
+        // Fallback
+        return paramName
+    
+    case "number", "float":
+        // Check if parameter has min/max bounds
+        min := 0.0
+        max := 100.0
+        
+        if minVal, ok := toFloat64(paramDef["min"]); ok {
+            min = minVal
+        }
+        if maxVal, ok := toFloat64(paramDef["max"]); ok {
+            max = maxVal
+        }
+        
+        // Generate random value in range
+        value := min + rng.Float64()*(max-min)
+        
+        // Round to precision if specified
+        if precision, ok := toFloat64(paramDef["precision"]); ok && precision > 0 {
+            precMult := 1.0 / precision
+            value = math.Round(value*precMult) / precMult
+        }
+        
+        return value
+        
+    case "integer", "int":
+        // Check if parameter has min/max bounds
+        min := 0
+        max := 100
+        
+        if minVal, ok := toInt(paramDef["min"]); ok {
+            min = minVal
+        }
+        if maxVal, ok := toInt(paramDef["max"]); ok {
+            max = maxVal
+        }
+        
+        // Generate random integer in range
+        return min + rng.Intn(max-min+1)
+    
+    case "boolean", "bool":
+        // True with true_probability (default 0.5)
+        probability := 0.5
+        if p, ok := toFloat64(paramDef["true_probability"]); ok && p >= 0 && p <= 1 {
+            probability = p
+        }
+        return rng.Float64() < probability
+    
+    case "object":
+        // Generate each property from its own definition, in name order so seeded
+        // devices stay reproducible
+        properties, _ := paramDef["properties"].(map[string]interface{})
+        names := make([]string, 0, len(properties))
+        for name := range properties {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        value := make(map[string]interface{}, len(properties))
+        for _, name := range names {
+            propertyDef, _ := properties[name].(map[string]interface{})
+            value[name] = generateParameterValue(name, propertyDef, device, rng)
+        }
+        return value
+    
+    case "array":
+        // Generate between min_length and max_length items from the items definition
+        minLength := 1
+        if n, ok := toInt(paramDef["min_length"]); ok && n >= 0 {
+            minLength = n
+        }
+        maxLength := minLength
+        if n, ok := toInt(paramDef["max_length"]); ok && n >= minLength {
+            maxLength = n
+        }
+        itemDef, _ := paramDef["items"].(map[string]interface{})
+        length := minLength + rng.Intn(maxLength-minLength+1)
+        value := make([]interface{}, length)
+        for i := range value {
+            value[i] = generateParameterValue(paramName, itemDef, device, rng)
+        }
+        return value
+    
+    default:
+        // For unknown types, return default or null
+        if defaultVal, ok := paramDef["default"]; ok {
+            return defaultVal
+        }
+        return nil
+    }
+}
+
+// Schema validation modes
+const (
+    SchemaValidationWarn = "warn" // Log invalid measurements and publish them anyway
+    SchemaValidationFail = "fail" // Drop invalid measurements
+)
+
+// schemaRegistryRetryInterval is how long an unreachable registry is left alone
+// before the next fetch attempt
+var schemaRegistryRetryInterval = 30 * time.Second
+
+// SchemaRegistry fetches JSON Schemas for measurements from a central registry and
+// caches them. Schemas are looked up at {url}/schemas/{event_type}/{parameter_set},
+// falling back to {url}/schemas/{event_type}; a 404 means no schema applies.
+type SchemaRegistry struct {
+    baseURL       string
+    failOnInvalid bool          // Drop invalid measurements instead of warning
+    ttl           time.Duration // How long fetched schemas are cached
+    client        *http.Client
+    
+    mu      sync.Mutex
+    cache   map[string]cachedSchema // Schema lookups by key (guarded by mu)
+    fetches singleflight.Group      // In-flight fetches by key, shared by concurrent lookups
+}
+
+// cachedSchema is a registry lookup result; schema is nil when the registry has
+// no schema for the key or could not be reached
+type cachedSchema struct {
+    schema    *jsonschema.Schema
+    expiresAt time.Time
+}
+
+// newSchemaRegistryFromEnv reads SCHEMA_REGISTRY_URL (unset = no validation),
+// SCHEMA_VALIDATION_MODE ("warn", the default, or "fail") and
+// SCHEMA_REGISTRY_CACHE_SECONDS (default 300)
+func newSchemaRegistryFromEnv() *SchemaRegistry {
+    baseURL := os.Getenv("SCHEMA_REGISTRY_URL")
+    if baseURL == "" {
+        return nil
+    }
+    ttl := 5 * time.Minute
+    if seconds, err := strconv.Atoi(os.Getenv("SCHEMA_REGISTRY_CACHE_SECONDS")); err == nil && seconds > 0 {
+        ttl = time.Duration(seconds) * time.Second
+    }
+    mode := SchemaValidationWarn
+    if os.Getenv("SCHEMA_VALIDATION_MODE") == SchemaValidationFail {
+        mode = SchemaValidationFail
+    }
+    log.Printf("Measurement schema validation enabled: registry %s, mode %s, cached for %v", baseURL, mode, ttl)
+    return newSchemaRegistry(baseURL, mode == SchemaValidationFail, ttl)
+}
+
+// newSchemaRegistry creates a registry client for the given base URL
+func newSchemaRegistry(baseURL string, failOnInvalid bool, ttl time.Duration) *SchemaRegistry {
+    return &SchemaRegistry{
+        baseURL:       strings.TrimRight(baseURL, "/"),
+        failOnInvalid: failOnInvalid,
+        ttl:           ttl,
+        client:        &http.Client{Timeout: 5 * time.Second},
+        cache:         make(map[string]cachedSchema),
+    }
+}
+
+// Validate checks a measurement against the schema for its event type and the
+// device's active parameter set. Measurements without a schema, or whose schema
+// can't be fetched, pass.
+func (r *SchemaRegistry) Validate(device *ConfiguredEndDevice, measurement map[string]interface{}) error {
+    eventType, _ := measurement["event_type"].(string)
+    parameterSet, _ := device.DeviceConfig["active_parameter_set"].(string)
+    
+    schema := r.schemaFor(eventType, parameterSet)
+    if schema == nil {
+        return nil
+    }
+    
+    // The validator works on decoded JSON, not on Go values like int64
+    jsonData, err := json.Marshal(measurement)
+    if err != nil {
+        return err
+    }
+    decoder := json.NewDecoder(bytes.NewReader(jsonData))
+    decoder.UseNumber()
+    var document interface{}
+    if err := decoder.Decode(&document); err != nil {
+        return err
+    }
+    return schema.Validate(document)
+}
+
+// schemaFor returns the most specific schema for an event type and parameter set
+func (r *SchemaRegistry) schemaFor(eventType string, parameterSet string) *jsonschema.Schema {
+    if eventType == "" {
+        eventType = "measurement"
+    }
+    
+    if parameterSet != "" {
+        if schema := r.lookup(eventType + "/" + parameterSet); schema != nil {
+            return schema
+        }
+    }
+    return r.lookup(eventType)
+}
+
+// lookup returns the cached schema for a key, fetching it when missing or
+// expired. Fetches happen outside mu, so a slow registry only delays the devices
+// waiting for that key, and concurrent lookups of a key share one fetch.
+func (r *SchemaRegistry) lookup(key string) *jsonschema.Schema {
+    r.mu.Lock()
+    cached, ok := r.cache[key]
+    r.mu.Unlock()
+    if ok && time.Now().Before(cached.expiresAt) {
+        return cached.schema
+    }
+    
+    result, _, _ := r.fetches.Do(key, func() (interface{}, error) {
+        schema, err := r.fetch(key)
+        entry := cachedSchema{schema: schema, expiresAt: time.Now().Add(r.ttl)}
+        if err != nil {
+            // Keep publishing without validation until the registry is back
+            log.Printf("Warning: schema registry unavailable for %s, skipping validation: %v", key, err)
+            entry = cachedSchema{expiresAt: time.Now().Add(schemaRegistryRetryInterval)}
+        }
+        r.mu.Lock()
+        r.cache[key] = entry
+        r.mu.Unlock()
+        return entry.schema, nil
+    })
+    return result.(*jsonschema.Schema)
+}
+
+// fetch downloads and compiles the schema for a key, returning nil without an
+// error when the registry has none
+func (r *SchemaRegistry) fetch(key string) (*jsonschema.Schema, error) {
+    url := fmt.Sprintf("%s/schemas/%s", r.baseURL, key)
+    resp, err := r.client.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("registry returned status %d", resp.StatusCode)
+    }
+    
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    compiler := jsonschema.NewCompiler()
+    if err := compiler.AddResource(url, bytes.NewReader(body)); err != nil {
+        return nil, fmt.Errorf("invalid schema %s: %w", key, err)
+    }
+    schema, err := compiler.Compile(url)
+    if err != nil {
+        return nil, fmt.Errorf("invalid schema %s: %w", key, err)
+    }
+    log.Printf("Loaded measurement schema %s from registry", key)
+    return schema, nil
+}
+
+// measurementWriter receives measurement JSON lines in MEASUREMENT_STDOUT mode
+var (
+    measurementWriter      io.Writer = os.Stdout
+    measurementWriterMutex sync.Mutex
+)
+
+// measurementStdoutMode reports whether measurements are written to stdout
+// (MEASUREMENT_STDOUT=true) and whether MQTT publishing is skipped
+// (MEASUREMENT_STDOUT_ONLY=true). Logs go to stderr, so stdout stays parseable.
+func measurementStdoutMode() (enabled bool, only bool) {
+    enabled = os.Getenv("MEASUREMENT_STDOUT") == "true"
+    return enabled, enabled && os.Getenv("MEASUREMENT_STDOUT_ONLY") == "true"
+}
+
+// writeMeasurementLine writes a measurement as a single JSON line to measurementWriter
+func writeMeasurementLine(measurement map[string]interface{}) {
+    jsonData, err := json.Marshal(measurement)
+    if err != nil {
+        log.Printf("Error marshaling measurement for stdout: %v", err)
+        return
+    }
+    
+    measurementWriterMutex.Lock()
+    defer measurementWriterMutex.Unlock()
+    if _, err := measurementWriter.Write(append(jsonData, '\n')); err != nil {
+        log.Printf("Error writing measurement to stdout: %v", err)
+    }
+}
+
+// publishMeasurement sends a measurement via MQTT
+func (dm *DeviceManager) publishMeasurement(device *ConfiguredEndDevice, measurement map[string]interface{}) {
+    // Resolve everything that depends on the device's config up front, since a
+    // config push may swap it while the publish is in flight
+    var schemaErr error
+    dm.DeviceMutex.RLock()
+    if dm.schemas != nil {
+        schemaErr = dm.schemas.Validate(device, measurement)
+    }
+    topic := measurementTopic(device)
+    delivery := measurementDelivery(device)
+    paramDefs, _ := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+    dm.DeviceMutex.RUnlock()
+    
+    // Check the measurement against the registry's contract for its parameter set
+    if schemaErr != nil {
+        if dm.schemas.failOnInvalid {
+            log.Printf("Dropping measurement from device %s: %v", device.ID, schemaErr)
+            return
+        }
+        log.Printf("Warning: measurement from device %s does not match schema: %v", device.ID, schemaErr)
+    }
+    
+    // Debug output for piping into jq without a broker
+    if toStdout, stdoutOnly := measurementStdoutMode(); toStdout {
+        writeMeasurementLine(measurement)
+        if stdoutOnly {
+            return
+        }
+    }
+    
+    // Only publish if connected to MQTT, else buffer for the reconnect if enabled
+    connected := dm.gateway.isMqttConnected.Load() && dm.gateway.mqttClient != nil
+    if !connected && dm.offline == nil {
+        log.Printf("Cannot publish measurement: MQTT not connected")
+        return
+    }
+    
+    // Link the measurement to the last one sent so the backend can spot gaps
+    sequence, hasSequence := measurement["sequence"].(int64)
+    previousSequence := device.previousSentSequence()
+    if hasSequence {
+        measurement["previous_sequence"] = previousSequence
+    }
+    
+    // Convert to JSON
+    jsonData, err := json.Marshal(measurement)
+    if err != nil {
+        log.Printf("Error marshaling measurement: %v", err)
+        return
+    }
+    
+    // Skip measurements that were already published within the dedup window
+    measurementID, _ := measurement["measurement_id"].(string)
+    if measurementID != "" && dm.dedup != nil && !dm.dedup.Reserve(measurementID, time.Now()) {
+        log.Printf("Skipping duplicate measurement %s from device %s", measurementID, device.ID)
+        return
+    }
+    
+    // Collect into a batch instead of publishing individually. Queued measurements
+    // count as sent, so a lost batch shows up as a gap in previous_sequence.
+    if dm.batcher != nil {
+        if hasSequence {
+            device.markSequenceSent(sequence)
+        }
+        if batch := dm.batcher.add(device, measurement); batch != nil {
+            dm.publishBatch(batch)
+        }
+        return
+    }
+    
+    // Encrypt end-to-end if a key is configured
+    if key, keyID, err := measurementEncryptionKey(); err != nil {
+        log.Printf("Error loading measurement encryption key: %v", err)
+        return
+    } else if key != nil {
+        if jsonData, err = encryptPayload(jsonData, key, keyID); err != nil {
+            log.Printf("Error encrypting measurement: %v", err)
+            return
+        }
+    }
+    
+    // Buffered measurements count as sent, like batched ones
+    if dm.offline.hold(bufferedPublish{Topic: topic, QoS: delivery.QoS, Retain: delivery.Retain, Payload: jsonData}, connected) {
+        if hasSequence {
+            device.markSequenceSent(sequence)
+        }
+        log.Printf("Buffered measurement from device %s until MQTT is connected and older ones are sent", device.ID)
+        return
+    }
+    
+    // Publish to MQTT with the active parameter set's delivery guarantees
+    token := dm.gateway.mqttClient.Publish(topic, delivery.QoS, delivery.Retain, jsonData)
+    token.Wait()
+    backoff := measurementRetryBackoff
+    for attempt := 1; token.Error() != nil && attempt <= delivery.Retries; attempt++ {
+        log.Printf("Error publishing measurement from device %s (retry %d/%d): %v",
+            device.ID, attempt, delivery.Retries, token.Error())
+        time.Sleep(backoff)
+        backoff *= 2
+        token = dm.gateway.mqttClient.Publish(topic, delivery.QoS, delivery.Retain, jsonData)
+        token.Wait()
+    }
+    
+    if token.Error() != nil {
+        log.Printf("Error publishing measurement: %v", token.Error())
+        // Allow a later attempt to publish the same measurement
+        if measurementID != "" && dm.dedup != nil {
+            dm.dedup.Forget(measurementID)
+        }
+    } else {
+        if hasSequence {
+            if sequence > previousSequence+1 {
+                dm.gateway.publishSequenceGap(device, previousSequence+1, sequence-1)
+            }
+            device.markSequenceSent(sequence)
+        }
+        
+        payload, _ := measurement["payload"].(map[string]interface{})
+        if payload != nil {
+            weight, _ := payload["weight_kg"].(float64)
+            parameterSet, _ := payload["parameter_set"].(string)
+            
+            // Build log message with parameters
+            logMsg := fmt.Sprintf("Published measurement from device %s: %.2f kg (parameter set: %s", 
+                device.ID, weight, parameterSet)
+            
+            // Add actual parameter values
+            paramValues := []string{}
+            
+            // Get required parameters from the device's configuration
+            if paramDefs != nil {
+                if activeSet, ok := paramDefs[parameterSet].(map[string]interface{}); ok {
+                    if required, ok := activeSet["required_parameters"].([]interface{}); ok {
+                        for _, param := range required {
+                            paramName, ok := param.(string)
+                            if !ok {
+                                continue
+                            }
+                            
+                            if value, exists := payload[paramName]; exists {
+                                paramValues = append(paramValues, fmt.Sprintf("%s: %v", paramName, value))
+                            }
+                        }
+                    }
+                }
+            }
+            
+            // Add parameters to log message
+            if len(paramValues) > 0 {
+                logMsg += ", " + strings.Join(paramValues, ", ")
+            }
+            
+            logMsg += ")"
+            log.Printf(logMsg)
         }
+    }
+}
+
+// sendMeasurementToGateway sends measurement to gateway's HTTP endpoint
+func (dm *DeviceManager) sendMeasurementToGateway(device *ConfiguredEndDevice, measurement map[string]interface{}) {
+    // In a real device, this would make an HTTP POST to the gateway
+    // For simulation, we just log it
+    payload, _ := measurement["payload"].(map[string]interface{})
+    if payload != nil {
+        weight, _ := payload["weight_kg"].(float64)
+        log.Printf("Device %s sent measurement to gateway HTTP endpoint: %.2f kg", 
+            device.ID, weight)
+    }
+}
+
+// fileExists checks if a file exists
+func fileExists(filename string) bool {
+    info, err := os.Stat(filename)
+    if os.IsNotExist(err) {
+        return false
+    }
+    return !info.IsDir()
+}
+
+// startHTTPServer initializes and starts the HTTP server
+func (g *Gateway) startHTTPServer() {
+    g.mtx.HandleFunc("/status", g.handleStatusRequest)
+    g.mtx.HandleFunc("/health", handleHealthRequest)
+    g.mtx.HandleFunc("/ready", g.handleReadyRequest)
+    g.mtx.HandleFunc("/reset", g.handleResetRequest)
+    g.mtx.HandleFunc("/config", g.handleConfigRequest)
+    g.mtx.HandleFunc("/config/export", g.handleConfigExportRequest)
+    g.mtx.HandleFunc("/config/history", g.handleConfigHistoryRequest)
+    g.mtx.HandleFunc("/config/diff", g.handleConfigDiffRequest)
+    g.mtx.HandleFunc("/devices", g.handleDevicesRequest)
+    g.mtx.HandleFunc("/devices/removed", g.handleRemovedDevicesRequest)
+    g.mtx.HandleFunc("/devices/", g.handleDeviceRequest)
+    g.mtx.HandleFunc("/measurement", g.handleMeasurementRequest)
+    g.mtx.Handle("/metrics", newMetricsHandler(g))
+    
+    port := os.Getenv("GATEWAY_PORT")
+    if port == "" {
+        port = "6000"
+    }
+    
+    log.Printf("Starting HTTP server on port %s", port)
+    if err := http.ListenAndServe(":"+port, &g.mtx); err != nil {
+        log.Fatalf("HTTP server failed: %v", err)
+    }
+}
+
+// newMetricsHandler serves gateway and device gauges in the Prometheus format
+func newMetricsHandler(g *Gateway) http.Handler {
+    registry := prometheus.NewRegistry()
+    registry.MustRegister(newGatewayCollector(g))
+    return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// gatewayCollector reads device statistics at scrape time, so devices added or
+// removed by UpdateDeviceConfig are reflected without registering or deleting series
+type gatewayCollector struct {
+    gateway          *Gateway
+    measurementCount *prometheus.Desc
+    totalWeight      *prometheus.Desc
+    uptime           *prometheus.Desc
+    deviceCount      *prometheus.Desc
+    mqttConnected    *prometheus.Desc
+}
+
+// newGatewayCollector creates the collector behind /metrics
+func newGatewayCollector(gateway *Gateway) *gatewayCollector {
+    deviceLabels := []string{"device_id", "parameter_set"}
+    return &gatewayCollector{
+        gateway: gateway,
+        measurementCount: prometheus.NewDesc("gateway_device_measurement_count",
+            "Measurements taken by the device.", deviceLabels, nil),
+        totalWeight: prometheus.NewDesc("gateway_device_total_weight_kg",
+            "Total weight measured by the device.", deviceLabels, nil),
+        uptime: prometheus.NewDesc("gateway_device_uptime_seconds",
+            "Seconds since the device simulation started.", deviceLabels, nil),
+        deviceCount: prometheus.NewDesc("gateway_device_count",
+            "Number of simulated devices.", nil, nil),
+        mqttConnected: prometheus.NewDesc("gateway_mqtt_connected",
+            "Whether the gateway is connected to the MQTT broker (1) or not (0).", nil, nil),
+    }
+}
+
+// Describe sends the descriptors of all gateway metrics
+func (c *gatewayCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- c.measurementCount
+    ch <- c.totalWeight
+    ch <- c.uptime
+    ch <- c.deviceCount
+    ch <- c.mqttConnected
+}
+
+// Collect sends the current gateway and device values
+func (c *gatewayCollector) Collect(ch chan<- prometheus.Metric) {
+    connected := 0.0
+    if c.gateway.isMqttConnected.Load() {
+        connected = 1.0
+    }
+    ch <- prometheus.MustNewConstMetric(c.mqttConnected, prometheus.GaugeValue, connected)
+    
+    deviceCount := 0
+    if dm := c.gateway.endDeviceManager; dm != nil {
+        dm.DeviceMutex.RLock()
+        defer dm.DeviceMutex.RUnlock()
         
-        // Check if parameter has a format
-        if format, ok := paramDef["format"].(string); ok {
-            // Handle special format tags
-            format = strings.Replace(format, "{YYYYMMDD}", time.Now().Format("20060102"), -1)
-            
-            // For batch numbers, use device ID to keep consistent numbering per device
-            deviceNum := 0
-            parts := strings.Split(deviceID, "-")
-            if len(parts) > 0 {
-                if num, err := strconv.Atoi(parts[len(parts)-1]); err == nil {
-                    deviceNum = num
-                }
+        deviceCount = len(dm.Devices)
+        for _, device := range dm.Devices {
+            parameterSet, _ := device.DeviceConfig["active_parameter_set"].(string)
+            uptime := 0.0
+            if !device.StartTime.IsZero() {
+                uptime = time.Since(device.StartTime).Seconds()
             }
-            
-            // Generate a deterministic batch number based on device ID and date
-            batchNum := (deviceNum * 100) + (time.Now().Hour() * 4) + (time.Now().Minute() / 15)
-            format = strings.Replace(format, "{###}", fmt.Sprintf("%03d", batchNum%1000), -1)
-            
-            return format
+            ch <- prometheus.MustNewConstMetric(c.measurementCount, prometheus.GaugeValue,
+                float64(device.MeasurementCount), device.ID, parameterSet)
+            ch <- prometheus.MustNewConstMetric(c.totalWeight, prometheus.GaugeValue,
+                device.TotalWeightMeasured, device.ID, parameterSet)
+            ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue,
+                uptime, device.ID, parameterSet)
         }
-        
-        // Return default if provided
-        if defaultVal, ok := paramDef["default"].(string); ok {
-            return defaultVal
+    }
+    ch <- prometheus.MustNewConstMetric(c.deviceCount, prometheus.GaugeValue, float64(deviceCount))
+}
+
+// handleStatusRequest handles HTTP status endpoint
+func (g *Gateway) handleStatusRequest(w http.ResponseWriter, r *http.Request) {
+    // Monitoring scripts can ask for a structured representation
+    if strings.Contains(r.Header.Get("Accept"), "application/json") {
+        g.writeStatusJSON(w)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "text/plain")
+    
+    fmt.Fprintf(w, "Gateway Simulator Status\n")
+    fmt.Fprintf(w, "======================\n\n")
+    fmt.Fprintf(w, "Gateway ID: %s\n", g.gatewayID)
+    fmt.Fprintf(w, "MQTT Broker: %s\n", g.brokerAddress)
+    fmt.Fprintf(w, "Certificates: %s\n", map[bool]string{true: "FOUND", false: "NOT FOUND"}[g.hasCertificates.Load()])
+    fmt.Fprintf(w, "MQTT Connected: %s\n", map[bool]string{true: "YES", false: "NO"}[g.isMqttConnected.Load()])
+    
+    // Add container information
+    fmt.Fprintf(w, "\nContainer Information:\n")
+    fmt.Fprintf(w, "Container ID: %s\n", os.Getenv("HOSTNAME"))
+    fmt.Fprintf(w, "API URL: %s\n", setupApiUrl())
+    
+    // Show certificate details if present
+    if g.hasCertificates.Load() {
+        fmt.Fprintf(w, "\nCertificate Information:\n")
+        fmt.Fprintf(w, "Certificate Path: %s\n", CertPath)
+        fmt.Fprintf(w, "Private Key Path: %s\n", KeyPath)
+    }
+    
+    // Show how applying the stored configuration went
+    if initState := g.getDeviceManagerInitState(); initState.Attempts > 0 {
+        fmt.Fprintf(w, "\nDevice Manager Initialization: %s\n", map[bool]string{true: "OK", false: "FAILED"}[initState.Initialized])
+        fmt.Fprintf(w, "Attempts: %d\n", initState.Attempts)
+        if !initState.Initialized {
+            fmt.Fprintf(w, "Last Error: %s\n", initState.LastError)
+            fmt.Fprintf(w, "Last Attempt: %s\n", initState.LastAttempt.Format(time.RFC3339))
         }
-        
-        // Fallback
-        return paramName
+    }
     
-    case "number", "float":
-        // Check if parameter has min/max bounds
-        min := 0.0
-        max := 100.0
+    // Show device information if available
+    if g.endDeviceManager != nil {
+        counts, deviceCount := parameterSetCounts(g.endDeviceManager)
+        fmt.Fprintf(w, "\nEnd Devices:\n")
+        fmt.Fprintf(w, "Total Devices: %d\n", deviceCount)
         
-        if minVal, ok := paramDef["min"].(float64); ok {
-            min = minVal
+        if deviceCount > 0 {
+            fmt.Fprintf(w, "Parameter Sets in Use:\n")
+            for _, count := range counts {
+                fmt.Fprintf(w, "  - %s: %d device(s)\n", count.ParameterSet, count.Devices)
+            }
         }
-        if maxVal, ok := paramDef["max"].(float64); ok {
-            max = maxVal
+    }
+}
+
+// ParameterSetCount is the number of devices using a parameter set
+type ParameterSetCount struct {
+    ParameterSet string `json:"parameter_set"`
+    Devices      int    `json:"devices"`
+}
+
+// parameterSetCounts counts devices by active parameter set, sorted by name,
+// and returns the total number of devices
+func parameterSetCounts(dm *DeviceManager) ([]ParameterSetCount, int) {
+    dm.DeviceMutex.RLock()
+    defer dm.DeviceMutex.RUnlock()
+    
+    byName := make(map[string]int)
+    for _, device := range dm.Devices {
+        activeParameterSet := "unknown"
+        if setName, ok := device.DeviceConfig["active_parameter_set"].(string); ok {
+            activeParameterSet = setName
         }
-        
-        // Generate random value in range
-        value := min + rand.Float64()*(max-min)
-        
-        // Round to precision if specified
-        if precision, ok := paramDef["precision"].(float64); ok && precision > 0 {
-            precMult := 1.0 / precision
-            value = math.Round(value*precMult) / precMult
+        byName[activeParameterSet]++
+    }
+    
+    counts := make([]ParameterSetCount, 0, len(byName))
+    for name, devices := range byName {
+        counts = append(counts, ParameterSetCount{ParameterSet: name, Devices: devices})
+    }
+    sort.Slice(counts, func(i, j int) bool { return counts[i].ParameterSet < counts[j].ParameterSet })
+    return counts, len(dm.Devices)
+}
+
+// GatewayStatus is the JSON representation of /status
+type GatewayStatus struct {
+    GatewayID         string                  `json:"gateway_id"`
+    Broker            string                  `json:"broker"`
+    Certificates      bool                    `json:"certificates"`
+    MQTTConnected     bool                    `json:"mqtt_connected"`
+    ContainerID       string                  `json:"container_id"`
+    APIURL            string                  `json:"api_url"`
+    TotalDevices      int                     `json:"total_devices"`
+    Devices           []ParameterSetCount     `json:"devices"`
+    DeviceManagerInit *DeviceManagerInitState `json:"device_manager_init,omitempty"`
+}
+
+// writeStatusJSON writes the gateway status as JSON
+func (g *Gateway) writeStatusJSON(w http.ResponseWriter) {
+    status := GatewayStatus{
+        GatewayID:     g.gatewayID,
+        Broker:        g.brokerAddress,
+        Certificates:  g.hasCertificates.Load(),
+        MQTTConnected: g.isMqttConnected.Load(),
+        ContainerID:   os.Getenv("HOSTNAME"),
+        APIURL:        setupApiUrl(),
+        Devices:       []ParameterSetCount{},
+    }
+    if g.endDeviceManager != nil {
+        status.Devices, status.TotalDevices = parameterSetCounts(g.endDeviceManager)
+    }
+    if initState := g.getDeviceManagerInitState(); initState.Attempts > 0 {
+        status.DeviceManagerInit = &initState
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
+
+// handleHealthRequest handles HTTP health endpoint. It is a pure liveness check;
+// dependencies are reported by /ready.
+func handleHealthRequest(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, "healthy")
+}
+
+// setMqttConnected records the MQTT connection state
+func (g *Gateway) setMqttConnected(connected bool) {
+    g.isMqttConnected.Store(connected)
+}
+
+// readinessConditions reports each condition the gateway needs before it can serve traffic
+func (g *Gateway) readinessConditions() map[string]bool {
+    connected := g.isMqttConnected.Load()
+    g.gatewayStateMutex.RLock()
+    dm := g.endDeviceManager
+    g.gatewayStateMutex.RUnlock()
+    
+    conditions := map[string]bool{
+        "mqtt_connected":             connected,
+        "device_manager_initialized": dm != nil,
+        "config_applied":             false,
+    }
+    if dm != nil {
+        conditions["config_applied"] = dm.ConfigApplied()
+    }
+    return conditions
+}
+
+// handleReadyRequest handles HTTP readiness endpoint
+func (g *Gateway) handleReadyRequest(w http.ResponseWriter, r *http.Request) {
+    conditions := g.readinessConditions()
+    
+    unmet := []string{}
+    for name, met := range conditions {
+        if !met {
+            unmet = append(unmet, name)
         }
-        
-        return value
-        
-    case "integer", "int":
-        // Check if parameter has min/max bounds
-        min := 0
-        max := 100
-        
-        if minVal, ok := paramDef["min"].(int); ok {
-            min = minVal
+    }
+    sort.Strings(unmet)
+    
+    response := map[string]interface{}{
+        "ready":      len(unmet) == 0,
+        "conditions": conditions,
+        "unmet":      unmet,
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    if len(unmet) > 0 {
+        response["reason"] = "waiting for " + strings.Join(unmet, ", ")
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(response)
+}
+
+// handleResetRequest handles HTTP reset endpoint
+func (g *Gateway) handleResetRequest(w http.ResponseWriter, r *http.Request) {
+    log.Printf("Reset requested via HTTP")
+    
+    // Disconnect MQTT if connected
+    if g.isMqttConnected.Load() && g.mqttClient != nil {
+        g.mqttClient.Disconnect(250)
+    }
+    
+    // Try to reconnect if certificates are available
+    if g.hasCertificates.Load() {
+        g.eventChan <- Event{Type: EventCertificateFound, Time: time.Now()}
+    }
+    
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, "reset initiated")
+}
+
+// maxConfigPushBytes limits the size of a configuration pushed over HTTP
+const maxConfigPushBytes = 1 << 20
+
+// ConfigPush is a configuration POSTed over HTTP, applied on the event loop
+type ConfigPush struct {
+    YAML   string
+    Result chan ConfigPushResult // Buffered; receives the outcome once applied
+}
+
+// ConfigPushResult is the outcome of applying a ConfigPush
+type ConfigPushResult struct {
+    Apply ConfigApplyResult
+    Err   error
+}
+
+// handleConfigPush stores a YAML configuration POSTed to /config and applies it to
+// the devices through the event loop, as an MQTT config update would, returning
+// the new version hash
+func (g *Gateway) handleConfigPush(w http.ResponseWriter, r *http.Request) {
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigPushBytes))
+    if err != nil {
+        log.Printf("Rejected configuration push from %s: %v", r.RemoteAddr, err)
+        http.Error(w, "Could not read request body", http.StatusBadRequest)
+        return
+    }
+    
+    var configMap map[string]interface{}
+    if err := yaml.Unmarshal(body, &configMap); err != nil || configMap == nil {
+        log.Printf("Rejected configuration push from %s: body is not a YAML mapping", r.RemoteAddr)
+        http.Error(w, "Body must be a YAML configuration", http.StatusBadRequest)
+        return
+    }
+    
+    log.Printf("Configuration pushed over HTTP from %s (%d bytes)", r.RemoteAddr, len(body))
+    push := ConfigPush{YAML: string(body), Result: make(chan ConfigPushResult, 1)}
+    select {
+    case g.eventChan <- Event{Type: EventConfigUpdate, Data: push, Time: time.Now()}:
+    case <-g.shutdown:
+        http.Error(w, "Gateway is shutting down", http.StatusServiceUnavailable)
+        return
+    case <-r.Context().Done():
+        return
+    }
+    
+    var outcome ConfigPushResult
+    select {
+    case outcome = <-push.Result:
+    case <-g.shutdown:
+        http.Error(w, "Gateway is shutting down", http.StatusServiceUnavailable)
+        return
+    case <-r.Context().Done():
+        log.Printf("Configuration push from %s abandoned before it was applied", r.RemoteAddr)
+        return
+    }
+    result, err := outcome.Apply, outcome.Err
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Configuration rejected: %v", err), http.StatusUnprocessableEntity)
+        return
+    }
+    config := g.getConfig()
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "status":          "stored",
+        "config_version":  result.Version,
+        "updated_at":      config.UpdatedAt.Format(time.RFC3339),
+        "devices_updated": result.Updated,
+        "devices_failed":  len(result.Failed),
+    })
+}
+
+// handleConfigRequest handles HTTP config requests from end devices
+func (g *Gateway) handleConfigRequest(w http.ResponseWriter, r *http.Request) {
+    // POST pushes a new configuration without going through the broker
+    if r.Method == http.MethodPost {
+        g.handleConfigPush(w, r)
+        return
+    }
+    
+    // Only allow GET requests for end devices (or HEAD for version checking)
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    // Get the current configuration
+    config := g.getConfig()
+    
+    // Extract requesting device ID from query parameters
+    deviceID := r.URL.Query().Get("device_id")
+    
+    // Check if we have a configuration
+    if config.YAML == "" {
+        http.Error(w, "No configuration available", http.StatusNotFound)
+        return
+    }
+    
+    // The version hash doubles as the ETag for conditional requests
+    version := configVersionHash(config.YAML)
+    etag := `"` + version + `"`
+    w.Header().Set("ETag", etag)
+    w.Header().Set("X-Config-Version", version)
+    w.Header().Set("X-Config-Updated", config.UpdatedAt.Format(time.RFC3339))
+    
+    // Polling devices that already have this version don't need the body again
+    if etagMatches(r.Header.Get("If-None-Match"), etag) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    
+    // For HEAD requests, just return version info
+    if r.Method == http.MethodHead {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+    
+    // Set appropriate content type and send the YAML config
+    w.Header().Set("Content-Type", "application/x-yaml")
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, "%s", config.YAML)
+    
+    // Log which device requested configuration
+    if deviceID != "" {
+        log.Printf("Served configuration to device %s (IP: %s)", deviceID, r.RemoteAddr)
+    } else {
+        log.Printf("Served configuration to end device (IP: %s)", r.RemoteAddr)
+    }
+}
+
+// etagMatches reports whether an If-None-Match header lists etag (weak
+// comparison, as GET and HEAD allow) or is "*"
+func etagMatches(ifNoneMatch string, etag string) bool {
+    for _, candidate := range strings.Split(ifNoneMatch, ",") {
+        candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+        if candidate == "*" || candidate == etag {
+            return true
         }
-        if maxVal, ok := paramDef["max"].(int); ok {
-            max = maxVal
+    }
+    return false
+}
+
+// handleConfigExportRequest returns a zip bundle of the raw gateway config and,
+// with ?devices=true, each device's effective configuration
+func (g *Gateway) handleConfigExportRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    config := g.getConfig()
+    if config.YAML == "" {
+        http.Error(w, "No configuration available", http.StatusNotFound)
+        return
+    }
+    
+    // Snapshot device configs before writing the response
+    deviceConfigs := make(map[string]map[string]interface{})
+    if r.URL.Query().Get("devices") == "true" && g.endDeviceManager != nil {
+        g.endDeviceManager.DeviceMutex.RLock()
+        for id, device := range g.endDeviceManager.Devices {
+            deviceConfigs[id] = device.DeviceConfig
         }
-        
-        // Generate random integer in range
-        return min + rand.Intn(max-min+1)
+        g.endDeviceManager.DeviceMutex.RUnlock()
+    }
+    
+    filename := fmt.Sprintf("%s-config-%s.zip", g.gatewayID, time.Now().Format("20060102-150405"))
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+    
+    archive := zip.NewWriter(w)
+    if err := writeZipFile(archive, "gateway.yaml", []byte(config.YAML)); err != nil {
+        log.Printf("Error writing config export: %v", err)
+        return
+    }
+    
+    ids := make([]string, 0, len(deviceConfigs))
+    for id := range deviceConfigs {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    for _, id := range ids {
+        data, err := yaml.Marshal(deviceConfigs[id])
+        if err != nil {
+            log.Printf("Error marshaling config for device %s: %v", id, err)
+            continue
+        }
+        if err := writeZipFile(archive, fmt.Sprintf("devices/%s.yaml", id), data); err != nil {
+            log.Printf("Error writing config export: %v", err)
+            return
+        }
+    }
+    
+    if err := archive.Close(); err != nil {
+        log.Printf("Error finalizing config export: %v", err)
+        return
+    }
+    log.Printf("Exported configuration bundle with %d device config(s) (IP: %s)", len(ids), r.RemoteAddr)
+}
+
+// handleConfigHistoryRequest lists the stored configuration versions that can be rolled back to, newest first
+func (g *Gateway) handleConfigHistoryRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    history := g.getConfigHistory()
+    currentVersion := ""
+    if config := g.getConfig(); config.YAML != "" {
+        currentVersion = configVersionHash(config.YAML)
+    }
     
-    default:
-        // For unknown types, return default or null
-        if defaultVal, ok := paramDef["default"]; ok {
-            return defaultVal
-        }
-        return nil
+    entries := make([]map[string]interface{}, 0, len(history))
+    for i := len(history) - 1; i >= 0; i-- {
+        entries = append(entries, map[string]interface{}{
+            "config_version": history[i].Version,
+            "stored_at":      history[i].StoredAt.Format(time.RFC3339),
+            "size_bytes":     len(history[i].YAML),
+            "current":        history[i].Version == currentVersion,
+        })
     }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "current_version": currentVersion,
+        "history":         entries,
+        "count":           len(entries),
+        "max_entries":     configHistorySize(),
+    })
 }
 
-// publishMeasurement sends a measurement via MQTT
-func (dm *DeviceManager) publishMeasurement(device *ConfiguredEndDevice, measurement map[string]interface{}) {
-    // Only publish if connected to MQTT
-    if !isMqttConnected || mqttClient == nil {
-        log.Printf("Cannot publish measurement: MQTT not connected")
+// ConfigChange is a key that differs between two configuration versions
+type ConfigChange struct {
+    Path   string      `json:"path"`
+    Change string      `json:"change"` // added, removed or changed
+    From   interface{} `json:"from,omitempty"`
+    To     interface{} `json:"to,omitempty"`
+}
+
+// handleConfigDiffRequest compares the parameter sets, measurement settings and
+// device count of two versions from the config history (?from=<hash>&to=<hash>)
+func (g *Gateway) handleConfigDiffRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
     
-    // Convert to JSON
-    jsonData, err := json.Marshal(measurement)
-    if err != nil {
-        log.Printf("Error marshaling measurement: %v", err)
+    query := r.URL.Query()
+    fromVersion, toVersion := query.Get("from"), query.Get("to")
+    if fromVersion == "" || toVersion == "" {
+        http.Error(w, "from and to config versions are required", http.StatusBadRequest)
         return
     }
     
-    // Create topic
-    topic := fmt.Sprintf("gateway/%s/device/%s/measurement", gatewayID, device.ID)
+    configs := make([]map[string]interface{}, 0, 2)
+    for _, version := range []string{fromVersion, toVersion} {
+        entry, ok := g.findConfigVersion(version)
+        if !ok {
+            http.Error(w, fmt.Sprintf("Config version %s is not in the history", version), http.StatusNotFound)
+            return
+        }
+        var config map[string]interface{}
+        if err := yaml.Unmarshal([]byte(entry.YAML), &config); err != nil {
+            http.Error(w, fmt.Sprintf("Config version %s could not be parsed: %v", version, err), http.StatusInternalServerError)
+            return
+        }
+        configs = append(configs, normalizeYAMLMap(config))
+    }
+    from, to := configs[0], configs[1]
     
-    // Publish to MQTT
-    token := mqttClient.Publish(topic, 0, false, jsonData)
-    token.Wait()
+    parameterSetChanges := []ConfigChange{}
+    diffConfigValues("parameter_sets", from["parameter_sets"], to["parameter_sets"], &parameterSetChanges)
+    measurementChanges := []ConfigChange{}
+    diffConfigValues("measurement", from["measurement"], to["measurement"], &measurementChanges)
     
-    if token.Error() != nil {
-        log.Printf("Error publishing measurement: %v", token.Error())
-    } else {
-        payload, _ := measurement["payload"].(map[string]interface{})
-        if payload != nil {
-            weight, _ := payload["weight_kg"].(float64)
-            parameterSet, _ := payload["parameter_set"].(string)
-            
-            // Build log message with parameters
-            logMsg := fmt.Sprintf("Published measurement from device %s: %.2f kg (parameter set: %s", 
-                device.ID, weight, parameterSet)
-            
-            // Add actual parameter values
-            paramValues := []string{}
-            
-            // Get required parameters from the device's configuration
-            if paramDefs, ok := device.DeviceConfig["parameter_sets"].(map[string]interface{}); ok {
-                if activeSet, ok := paramDefs[parameterSet].(map[string]interface{}); ok {
-                    if required, ok := activeSet["required_parameters"].([]interface{}); ok {
-                        for _, param := range required {
-                            paramName, ok := param.(string)
-                            if !ok {
-                                continue
-                            }
-                            
-                            if value, exists := payload[paramName]; exists {
-                                paramValues = append(paramValues, fmt.Sprintf("%s: %v", paramName, value))
-                            }
-                        }
-                    }
-                }
-            }
-            
-            // Add parameters to log message
-            if len(paramValues) > 0 {
-                logMsg += ", " + strings.Join(paramValues, ", ")
-            }
-            
-            logMsg += ")"
-            log.Printf(logMsg)
+    fromCount, toCount := configuredDeviceCount(from), configuredDeviceCount(to)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "from":           fromVersion,
+        "to":             toVersion,
+        "parameter_sets": parameterSetChanges,
+        "measurement":    measurementChanges,
+        "device_count": map[string]interface{}{
+            "from":    fromCount,
+            "to":      toCount,
+            "changed": fromCount != toCount,
+        },
+    })
+}
+
+// diffConfigValues appends the differences between two decoded config values,
+// descending into mappings so each change names the innermost key
+func diffConfigValues(path string, from interface{}, to interface{}, changes *[]ConfigChange) {
+    fromMap, fromIsMap := from.(map[string]interface{})
+    toMap, toIsMap := to.(map[string]interface{})
+    if !fromIsMap || !toIsMap {
+        switch {
+        case from == nil && to == nil:
+        case from == nil:
+            *changes = append(*changes, ConfigChange{Path: path, Change: "added", To: to})
+        case to == nil:
+            *changes = append(*changes, ConfigChange{Path: path, Change: "removed", From: from})
+        case !configValuesEqual(from, to):
+            *changes = append(*changes, ConfigChange{Path: path, Change: "changed", From: from, To: to})
         }
+        return
+    }
+    
+    keys := make(map[string]bool)
+    for key := range fromMap {
+        keys[key] = true
+    }
+    for key := range toMap {
+        keys[key] = true
+    }
+    sortedKeys := make([]string, 0, len(keys))
+    for key := range keys {
+        sortedKeys = append(sortedKeys, key)
+    }
+    sort.Strings(sortedKeys)
+    
+    for _, key := range sortedKeys {
+        diffConfigValues(path+"."+key, fromMap[key], toMap[key], changes)
     }
 }
 
-// sendMeasurementToGateway sends measurement to gateway's HTTP endpoint
-func (dm *DeviceManager) sendMeasurementToGateway(device *ConfiguredEndDevice, measurement map[string]interface{}) {
-    // In a real device, this would make an HTTP POST to the gateway
-    // For simulation, we just log it
-    payload, _ := measurement["payload"].(map[string]interface{})
-    if payload != nil {
-        weight, _ := payload["weight_kg"].(float64)
-        log.Printf("Device %s sent measurement to gateway HTTP endpoint: %.2f kg", 
-            device.ID, weight)
+// configValuesEqual compares two decoded config values, treating 1 and 1.0 as equal
+func configValuesEqual(a interface{}, b interface{}) bool {
+    if x, ok := toFloat64(a); ok {
+        if y, ok := toFloat64(b); ok {
+            return x == y
+        }
     }
+    return reflect.DeepEqual(a, b)
 }
 
-// fileExists checks if a file exists
-func fileExists(filename string) bool {
-    info, err := os.Stat(filename)
-    if os.IsNotExist(err) {
-        return false
+// configuredDeviceCount returns how many devices a gateway configuration runs
+func configuredDeviceCount(config map[string]interface{}) int {
+    devicesConfig, _ := config["devices"].(map[string]interface{})
+    total := 0
+    for _, count := range deviceTypeCounts(devicesConfig) {
+        total += count
     }
-    return !info.IsDir()
+    return total
 }
 
-// startHTTPServer initializes and starts the HTTP server
-func startHTTPServer() {
-    mtx.HandleFunc("/status", handleStatusRequest)
-    mtx.HandleFunc("/health", handleHealthRequest)
-    mtx.HandleFunc("/reset", handleResetRequest)
-    mtx.HandleFunc("/config", handleConfigRequest)
-    mtx.HandleFunc("/devices", handleDevicesRequest)
-    mtx.HandleFunc("/measurement", handleMeasurementRequest)
-    
-    port := os.Getenv("GATEWAY_PORT")
-    if port == "" {
-        port = "6000"
-    }
-    
-    log.Printf("Starting HTTP server on port %s", port)
-    if err := http.ListenAndServe(":"+port, &mtx); err != nil {
-        log.Fatalf("HTTP server failed: %v", err)
+// writeZipFile adds a single file to a zip archive
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+    f, err := archive.Create(name)
+    if err != nil {
+        return err
     }
+    _, err = f.Write(data)
+    return err
 }
 
-// handleStatusRequest handles HTTP status endpoint
-func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "text/plain")
-    
-    fmt.Fprintf(w, "Gateway Simulator Status\n")
-    fmt.Fprintf(w, "======================\n\n")
-    fmt.Fprintf(w, "Gateway ID: %s\n", gatewayID)
-    fmt.Fprintf(w, "MQTT Broker: %s\n", brokerAddress)
-    fmt.Fprintf(w, "Certificates: %s\n", map[bool]string{true: "FOUND", false: "NOT FOUND"}[hasCertificates])
-    fmt.Fprintf(w, "MQTT Connected: %s\n", map[bool]string{true: "YES", false: "NO"}[isMqttConnected])
+// handleRemovedDevicesRequest handles the HTTP removed devices endpoint
+func (g *Gateway) handleRemovedDevicesRequest(w http.ResponseWriter, r *http.Request) {
+    if g.endDeviceManager == nil {
+        http.Error(w, "End device manager not initialized", http.StatusInternalServerError)
+        return
+    }
     
-    // Add container information
-    fmt.Fprintf(w, "\nContainer Information:\n")
-    fmt.Fprintf(w, "Container ID: %s\n", os.Getenv("HOSTNAME"))
-    fmt.Fprintf(w, "API URL: %s\n", setupApiUrl())
+    removed := g.endDeviceManager.RemovedDevices(time.Now())
     
-    // Show certificate details if present
-    if hasCertificates {
-        fmt.Fprintf(w, "\nCertificate Information:\n")
-        fmt.Fprintf(w, "Certificate Path: %s\n", CertPath)
-        fmt.Fprintf(w, "Private Key Path: %s\n", KeyPath)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "removed_devices":   removed,
+        "count":             len(removed),
+        "retention_seconds": int(g.endDeviceManager.tombstoneTTL.Seconds()),
+    })
+}
+
+// handleDevicesRequest handles HTTP devices endpoint
+func (g *Gateway) handleDevicesRequest(w http.ResponseWriter, r *http.Request) {
+    if g.endDeviceManager == nil {
+        http.Error(w, "End device manager not initialized", http.StatusInternalServerError)
+        return
     }
     
-    // Show device information if available
-    if endDeviceManager != nil {
-        deviceCount := len(endDeviceManager.Devices)
-        fmt.Fprintf(w, "\nEnd Devices:\n")
-        fmt.Fprintf(w, "Total Devices: %d\n", deviceCount)
+    w.Header().Set("Content-Type", "application/json")
+    
+    // Build device status list
+    devices := []map[string]interface{}{}
+    
+    g.endDeviceManager.DeviceMutex.RLock()
+    for id, device := range g.endDeviceManager.Devices {
+        // Get active parameter set name
+        activeParameterSet := "unknown"
+        if setName, ok := device.DeviceConfig["active_parameter_set"].(string); ok {
+            activeParameterSet = setName
+        }
         
-        if deviceCount > 0 {
-            // Count devices by parameter set
-            paramSetCounts := make(map[string]int)
-            for _, device := range endDeviceManager.Devices {
-                activeParameterSet := "unknown"
-                if setName, ok := device.DeviceConfig["active_parameter_set"].(string); ok {
-                    activeParameterSet = setName
-                }
-                paramSetCounts[activeParameterSet]++
-            }
-            
-            fmt.Fprintf(w, "Parameter Sets in Use:\n")
-            for setName, count := range paramSetCounts {
-                fmt.Fprintf(w, "  - %s: %d device(s)\n", setName, count)
-            }
+        // Calculate uptime
+        uptime := device.UptimeSeconds
+        if uptime == 0 && !device.StartTime.IsZero() {
+            uptime = int64(time.Since(device.StartTime).Seconds())
+        }
+        
+        deviceInfo := map[string]interface{}{
+            "id": id,
+            "type": device.Type,
+            "status": device.Status,
+            "parameter_set": activeParameterSet,
+            "measurement_count": device.MeasurementCount,
+            "total_weight": device.TotalWeightMeasured,
+            "uptime": uptime,
+        }
+        
+        if !device.LastMeasurement.IsZero() {
+            deviceInfo["last_measurement"] = device.LastMeasurement.Format(time.RFC3339)
+        }
+        
+        if device.UpdateStatus != nil && device.UpdateStatus.Failed {
+            deviceInfo["update_status"] = "error"
+            deviceInfo["update_error"] = device.UpdateStatus.StatusMessage
+        }
+        
+        if !device.LastConfigFetch.IsZero() {
+            deviceInfo["last_config_fetch"] = device.LastConfigFetch.Format(time.RFC3339)
         }
+        
+        devices = append(devices, deviceInfo)
     }
+    g.endDeviceManager.DeviceMutex.RUnlock()
+    
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "devices": devices,
+        "count":   len(devices),
+    })
 }
 
-// handleHealthRequest handles HTTP health endpoint
-func handleHealthRequest(w http.ResponseWriter, r *http.Request) {
-    w.WriteHeader(http.StatusOK)
-    fmt.Fprintf(w, "healthy")
+// DeviceDetail is the JSON representation of /devices/{id}
+type DeviceDetail struct {
+    ID                   string                 `json:"id"`
+    GatewayID            string                 `json:"gateway_id"`
+    Type                 string                 `json:"type"`
+    Status               string                 `json:"status"`
+    FirmwareVersion      string                 `json:"firmware_version"`
+    ConfigVersion        string                 `json:"config_version"`
+    HasDefaultConfig     bool                   `json:"has_default_config"`
+    LastConfigFetch      string                 `json:"last_config_fetch,omitempty"`
+    LastMeasurement      string                 `json:"last_measurement,omitempty"`
+    UptimeSeconds        int64                  `json:"uptime"`
+    MeasurementCount     int                    `json:"measurement_count"`
+    TotalWeight          float64                `json:"total_weight"`
+    Capabilities         map[string]bool        `json:"capabilities"`
+    DiagnosticInfo       map[string]interface{} `json:"diagnostic_info"`
+    UpdateStatus         *DeviceUpdateDetail    `json:"update_status,omitempty"`
+    ActiveParameterSet   interface{}            `json:"active_parameter_set"`
+    ParameterDefinitions map[string]interface{} `json:"parameter_definitions"`
+    DeviceConfig         map[string]interface{} `json:"device_config"`
 }
 
-// handleResetRequest handles HTTP reset endpoint
-func handleResetRequest(w http.ResponseWriter, r *http.Request) {
-    log.Printf("Reset requested via HTTP")
+// DeviceUpdateDetail is the JSON representation of a device's UpdateStatus
+type DeviceUpdateDetail struct {
+    InProgress     bool   `json:"in_progress"`
+    StartTime      string `json:"start_time,omitempty"`
+    SuspendMeasure bool   `json:"suspend_measure"`
+    StatusMessage  string `json:"status_message,omitempty"`
+    Failed         bool   `json:"failed"`
+}
+
+// deviceDetail returns a snapshot of a device's full state, reporting whether it exists
+func (dm *DeviceManager) deviceDetail(id string) (DeviceDetail, bool) {
+    dm.DeviceMutex.RLock()
+    defer dm.DeviceMutex.RUnlock()
     
-    // Disconnect MQTT if connected
-    if isMqttConnected && mqttClient != nil {
-        mqttClient.Disconnect(250)
+    device, ok := dm.Devices[id]
+    if !ok {
+        return DeviceDetail{}, false
     }
     
-    // Try to reconnect if certificates are available
-    if hasCertificates {
-        eventChan <- Event{Type: EventCertificateFound, Time: time.Now()}
+    uptime := device.UptimeSeconds
+    if uptime == 0 && !device.StartTime.IsZero() {
+        uptime = int64(time.Since(device.StartTime).Seconds())
     }
     
-    w.WriteHeader(http.StatusOK)
-    fmt.Fprintf(w, "reset initiated")
-}
-
-// handleConfigRequest handles HTTP config requests from end devices
-func handleConfigRequest(w http.ResponseWriter, r *http.Request) {
-    // Only allow GET requests for end devices (or HEAD for version checking)
-    if r.Method != http.MethodGet && r.Method != http.MethodHead {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+    // Copy the maps so encoding can't race with a config update
+    deviceConfig, _ := deepCopyValue(device.DeviceConfig).(map[string]interface{})
+    diagnostics, _ := deepCopyValue(device.DiagnosticInfo).(map[string]interface{})
+    capabilities := make(map[string]bool, len(device.Capabilities))
+    for name, enabled := range device.Capabilities {
+        capabilities[name] = enabled
     }
     
-    // Get the current configuration
-    config := getConfig()
+    detail := DeviceDetail{
+        ID:                   device.ID,
+        GatewayID:            device.GatewayID,
+        Type:                 device.Type,
+        Status:               device.Status,
+        FirmwareVersion:      device.FirmwareVersion,
+        ConfigVersion:        device.ConfigVersion,
+        HasDefaultConfig:     device.HasDefaultConfig,
+        UptimeSeconds:        uptime,
+        MeasurementCount:     device.MeasurementCount,
+        TotalWeight:          device.TotalWeightMeasured,
+        Capabilities:         capabilities,
+        DiagnosticInfo:       diagnostics,
+        ActiveParameterSet:   deviceConfig["active_parameter_set"],
+        ParameterDefinitions: activeParameterDefinitions(deviceConfig),
+        DeviceConfig:         deviceConfig,
+    }
+    if !device.LastConfigFetch.IsZero() {
+        detail.LastConfigFetch = device.LastConfigFetch.Format(time.RFC3339)
+    }
+    if !device.LastMeasurement.IsZero() {
+        detail.LastMeasurement = device.LastMeasurement.Format(time.RFC3339)
+    }
+    if update := device.UpdateStatus; update != nil {
+        detail.UpdateStatus = &DeviceUpdateDetail{
+            InProgress:     update.InProgress,
+            SuspendMeasure: update.SuspendMeasure,
+            StatusMessage:  update.StatusMessage,
+            Failed:         update.Failed,
+        }
+        if !update.StartTime.IsZero() {
+            detail.UpdateStatus.StartTime = update.StartTime.Format(time.RFC3339)
+        }
+    }
+    return detail, true
+}
+
+// activeParameterDefinitions returns the definitions of the active parameter set's
+// required parameters, i.e. the ones generateMeasurement fills in
+func activeParameterDefinitions(deviceConfig map[string]interface{}) map[string]interface{} {
+    definitions := make(map[string]interface{})
     
-    // Extract requesting device ID from query parameters
-    deviceID := r.URL.Query().Get("device_id")
+    activeSetName, _ := deviceConfig["active_parameter_set"].(string)
+    parameterSets, _ := deviceConfig["parameter_sets"].(map[string]interface{})
+    activeSet, ok := parameterSets[activeSetName].(map[string]interface{})
+    if !ok {
+        return definitions
+    }
     
-    // For HEAD requests, just check if config exists and return version info
-    if r.Method == http.MethodHead {
-        if config.YAML == "" {
-            http.Error(w, "No configuration available", http.StatusNotFound)
-            return
+    requiredParams, _ := activeSet["required_parameters"].([]interface{})
+    paramDefs, _ := activeSet["parameter_definitions"].(map[string]interface{})
+    for _, paramName := range requiredParams {
+        name, ok := paramName.(string)
+        if !ok {
+            continue
         }
-        
-        // Calculate config version hash
-        h := sha256.New()
-        h.Write([]byte(config.YAML))
-        version := fmt.Sprintf("%x", h.Sum(nil))[:8]
-        
-        // Set version header
-        w.Header().Set("X-Config-Version", version)
-        w.Header().Set("X-Config-Updated", config.UpdatedAt.Format(time.RFC3339))
-        w.WriteHeader(http.StatusOK)
+        if def, ok := paramDefs[name]; ok {
+            definitions[name] = def
+        }
+    }
+    return definitions
+}
+
+// handleDeviceRequest handles HTTP requests for a single device at /devices/{id}
+func (g *Gateway) handleDeviceRequest(w http.ResponseWriter, r *http.Request) {
+    if g.endDeviceManager == nil {
+        http.Error(w, "End device manager not initialized", http.StatusInternalServerError)
         return
     }
     
-    // Check if we have a configuration
-    if config.YAML == "" {
-        http.Error(w, "No configuration available", http.StatusNotFound)
+    deviceID := strings.TrimPrefix(r.URL.Path, "/devices/")
+    if id, action, ok := strings.Cut(deviceID, "/"); ok && action == "fault" {
+        g.handleDeviceFaultRequest(w, r, id)
+        return
+    }
+    if deviceID == "" || strings.Contains(deviceID, "/") {
+        http.NotFound(w, r)
         return
     }
     
-    // Set appropriate content type and send the YAML config
-    w.Header().Set("Content-Type", "application/x-yaml")
-    
-    // Calculate and set version header
-    h := sha256.New()
-    h.Write([]byte(config.YAML))
-    version := fmt.Sprintf("%x", h.Sum(nil))[:8]
-    w.Header().Set("X-Config-Version", version)
-    w.Header().Set("X-Config-Updated", config.UpdatedAt.Format(time.RFC3339))
-    
-    w.WriteHeader(http.StatusOK)
-    fmt.Fprintf(w, "%s", config.YAML)
-    
-    // Log which device requested configuration
-    if deviceID != "" {
-        log.Printf("Served configuration to device %s (IP: %s)", deviceID, r.RemoteAddr)
-    } else {
-        log.Printf("Served configuration to end device (IP: %s)", r.RemoteAddr)
+    switch r.Method {
+    case http.MethodGet:
+        detail, ok := g.endDeviceManager.deviceDetail(deviceID)
+        if !ok {
+            http.Error(w, fmt.Sprintf("Device %s not found", deviceID), http.StatusNotFound)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(detail)
+    case http.MethodDelete:
+        if !g.endDeviceManager.RemoveDevice(deviceID) {
+            http.Error(w, fmt.Sprintf("Device %s not found", deviceID), http.StatusNotFound)
+            return
+        }
+        
+        g.endDeviceManager.DeviceMutex.RLock()
+        remaining := len(g.endDeviceManager.Devices)
+        g.endDeviceManager.DeviceMutex.RUnlock()
+        
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "status":        "removed",
+            "device_id":     deviceID,
+            "total_devices": remaining,
+        })
+    default:
+        w.Header().Set("Allow", "GET, DELETE")
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
     }
 }
 
-// handleDevicesRequest handles HTTP devices endpoint
-func handleDevicesRequest(w http.ResponseWriter, r *http.Request) {
-    if endDeviceManager == nil {
-        http.Error(w, "End device manager not initialized", http.StatusInternalServerError)
+// handleDeviceFaultRequest forces a simulated fault on a device for the duration_seconds
+// in the optional JSON body, or the device's fault_duration_seconds
+func (g *Gateway) handleDeviceFaultRequest(w http.ResponseWriter, r *http.Request, deviceID string) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", "POST")
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
     
-    w.Header().Set("Content-Type", "application/json")
+    var request struct {
+        DurationSeconds float64 `json:"duration_seconds"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+            http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+            return
+        }
+    }
+    if request.DurationSeconds < 0 {
+        http.Error(w, "duration_seconds must not be negative", http.StatusBadRequest)
+        return
+    }
     
-    // Build device status list
-    devices := []map[string]interface{}{}
+    dm := g.endDeviceManager
+    dm.DeviceMutex.RLock()
+    device, ok := dm.Devices[deviceID]
+    var behaviorConfig map[string]interface{}
+    if ok {
+        behaviorConfig, _ = device.DeviceConfig["behavior"].(map[string]interface{})
+    }
+    dm.DeviceMutex.RUnlock()
+    if !ok {
+        http.Error(w, fmt.Sprintf("Device %s not found", deviceID), http.StatusNotFound)
+        return
+    }
     
-    endDeviceManager.DeviceMutex.RLock()
-    for id, device := range endDeviceManager.Devices {
-        // Get active parameter set name
-        activeParameterSet := "unknown"
-        if setName, ok := device.DeviceConfig["active_parameter_set"].(string); ok {
-            activeParameterSet = setName
-        }
-        
-        // Calculate uptime
-        uptime := device.UptimeSeconds
-        if uptime == 0 && !device.StartTime.IsZero() {
-            uptime = int64(time.Since(device.StartTime).Seconds())
-        }
-        
-        deviceInfo := map[string]interface{}{
-            "id": id,
-            "type": device.Type,
-            "status": device.Status,
-            "parameter_set": activeParameterSet,
-            "measurement_count": device.MeasurementCount,
-            "total_weight": device.TotalWeightMeasured,
-            "uptime": uptime,
-        }
-        
-        if !device.LastMeasurement.IsZero() {
-            deviceInfo["last_measurement"] = device.LastMeasurement.Format(time.RFC3339)
-        }
-        
-        if !device.LastConfigFetch.IsZero() {
-            deviceInfo["last_config_fetch"] = device.LastConfigFetch.Format(time.RFC3339)
-        }
-        
-        devices = append(devices, deviceInfo)
+    _, duration := faultSettings(behaviorConfig)
+    if request.DurationSeconds > 0 {
+        duration = time.Duration(request.DurationSeconds * float64(time.Second))
     }
-    endDeviceManager.DeviceMutex.RUnlock()
+    until := dm.injectFault(device, duration)
     
+    w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{
-        "devices": devices,
-        "count":   len(devices),
+        "status":           "fault_injected",
+        "device_id":        deviceID,
+        "duration_seconds": duration.Seconds(),
+        "until":            until.Format(time.RFC3339),
     })
 }
 
 // handleMeasurementRequest handles HTTP measurement endpoint
-func handleMeasurementRequest(w http.ResponseWriter, r *http.Request) {
+func (g *Gateway) handleMeasurementRequest(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
@@ -1463,16 +5555,24 @@ func handleMeasurementRequest(w http.ResponseWriter, r *http.Request) {
     
     log.Printf("Received measurement from device %s via HTTP", deviceID)
     
-    if isMqttConnected && mqttClient != nil {
-        measurement["gateway_id"] = gatewayID
+    // Forwarding shares the outbound concurrency limit with API posts
+    if !apiRequestLimiter.acquire() {
+        log.Printf("Concurrency limit reached, dropping measurement from device %s", deviceID)
+        http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+        return
+    }
+    defer apiRequestLimiter.release()
+    
+    if g.isMqttConnected.Load() && g.mqttClient != nil {
+        measurement["gateway_id"] = g.gatewayID
         jsonData, err := json.Marshal(measurement)
         if err != nil {
             http.Error(w, "Error encoding measurement", http.StatusInternalServerError)
             return
         }
         
-        topic := fmt.Sprintf("gateway/%s/device/%s/measurement", gatewayID, deviceID)
-        token := mqttClient.Publish(topic, 0, false, jsonData)
+        topic := fmt.Sprintf("gateway/%s/device/%s/measurement", g.gatewayID, deviceID)
+        token := g.mqttClient.Publish(topic, 0, false, jsonData)
         token.Wait()
         
         if token.Error() != nil {
@@ -1487,214 +5587,663 @@ func handleMeasurementRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 // mainEventLoop processes events and coordinates actions
-func mainEventLoop() {
+func (g *Gateway) mainEventLoop() {
     for {
-        event := <-eventChan
+        event := <-g.eventChan
         
-        switch event.Type {
-        case EventCertificateFound:
-            hasCertificates = true
-            handleCertificateFound()
-            
-        case EventCertificateRemoved:
-            hasCertificates = false
-            // Only disconnect if connected
-            if isMqttConnected && mqttClient != nil {
-                mqttClient.Disconnect(250)
-            }
-            
-        case EventMQTTConnected:
-            isMqttConnected = true
-            // Send connected status along with certificate info
-            sendStatusUpdate("connected", "Connected to MQTT broker", map[string]interface{}{
-                "certificate_status": "installed",
-                "session_id":         sessionID,
-            })
-
-            // Initialize device manager if not already done
-            if endDeviceManager == nil {
-                endDeviceManager = NewDeviceManager()
-                log.Printf("Device manager initialized")
-                
-                // If we already have a configuration, apply it
-                if config := getConfig(); config.YAML != "" {
-                    var configMap map[string]interface{}
-                    if err := yaml.Unmarshal([]byte(config.YAML), &configMap); err != nil {
-                        log.Printf("Error parsing existing configuration: %v", err)
-                    } else {
-                        if endDeviceManager.UpdateDeviceConfig(configMap) {
-                            log.Printf("Applied existing configuration to device manager")
-                        }
-                    }
-                }
-            }
+        g.eventLoopWatchdog.Begin(event.Type)
+        g.handleEvent(event)
+        g.eventLoopWatchdog.Done()
+    }
+}
 
-            // Request configuration after connection
-            time.Sleep(500 * time.Millisecond) // Small delay to ensure subscriptions are set up
-            requestConfig()
+// handleEvent processes a single event from the event loop
+func (g *Gateway) handleEvent(event Event) {
+    switch event.Type {
+    case EventCertificateFound:
+        g.hasCertificates.Store(true)
+        g.handleCertificateFound()
+        
+    case EventCertificateRemoved:
+        g.hasCertificates.Store(false)
+        // Only disconnect if connected
+        if g.isMqttConnected.Load() && g.mqttClient != nil {
+            g.mqttClient.Disconnect(250)
+        }
+        
+    case EventMQTTConnected:
+        g.setMqttConnected(true)
+        g.runConnectionHooks(TransitionConnected, event)
+        
+    case EventMQTTDisconnected:
+        g.setMqttConnected(false)
+        g.runConnectionHooks(TransitionDisconnected, event)
+        
+    case EventHeartbeatDue:
+        if g.isMqttConnected.Load() && g.mqttClient != nil {
+            g.sendHeartbeat()
+        }
+        
+    case EventMQTTMessage:
+        if msg, ok := event.Data.(mqtt.Message); ok {
+            g.handleMQTTMessage(msg)
+        }
+    
+    case EventConfigUpdate:
+        // HTTP pushes carry no update_id, so don't acknowledge them under a previous one
+        if push, ok := event.Data.(ConfigPush); ok {
+            log.Printf("Processing configuration pushed over HTTP")
+            result, err := g.storeConfig(push.YAML)
+            g.sendConfigAcknowledgment("", result, err)
+            push.Result <- ConfigPushResult{Apply: result, Err: err}
+            return
+        }
+        
+        if msg, ok := event.Data.(mqtt.Message); ok {
+            log.Printf("Processing configuration update")
             
-        case EventMQTTDisconnected:
-            isMqttConnected = false
-            // Send disconnection event to API
-            if data, ok := event.Data.(error); ok {
-                log.Printf("MQTT disconnected due to: %v", data)
-                sendStatusUpdate("disconnected", fmt.Sprintf("MQTT connection lost: %v", data), map[string]interface{}{
-                    "status": "offline",
-                    "error": data.Error(),
-                })
+            // The update is acknowledged under its own update_id, accepted or not;
+            // one without an update_id answers the pending request
+            updateID := configUpdateID(msg.Payload())
+            if updateID != "" {
+                log.Printf("Captured update_id from message: %s", updateID)
             } else {
-                sendStatusUpdate("disconnected", "MQTT connection lost", map[string]interface{}{
-                    "status": "offline",
-                })
+                updateID = g.currentUpdateID
             }
             
-        case EventHeartbeatDue:
-            if isMqttConnected && mqttClient != nil {
-                sendHeartbeat()
+            // Use the yaml_config field of a JSON payload, otherwise the raw payload
+            yamlConfig := string(msg.Payload())
+            var configData map[string]interface{}
+            if err := json.Unmarshal(msg.Payload(), &configData); err == nil {
+                if wrapped, ok := configData["yaml_config"].(string); ok {
+                    yamlConfig = wrapped
+                }
             }
             
-        case EventMQTTMessage:
-            if msg, ok := event.Data.(mqtt.Message); ok {
-                handleMQTTMessage(msg)
+            result, err := g.storeConfig(yamlConfig)
+            if err == nil {
+                g.currentUpdateID = updateID
             }
+            g.sendConfigAcknowledgment(updateID, result, err)
+        }
         
-        case EventConfigUpdate:
-            if msg, ok := event.Data.(mqtt.Message); ok {
-                log.Printf("Processing configuration update")
-                
-                // Try to parse as JSON first
-                var originalData map[string]interface{}
-                if err := json.Unmarshal(msg.Payload(), &originalData); err == nil {
-                    if updateID, ok := originalData["update_id"].(string); ok && updateID != "" {
-                        currentUpdateID = updateID
-                        log.Printf("Captured update_id from message: %s", updateID)
-                    }
-                }
+    case EventAPIDirective:
+        if directive, ok := event.Data.(ApiDirective); ok {
+            g.handleAPIDirective(directive)
+        }
+        
+    case EventShutdown:
+        g.beginShutdown()
+        g.runShutdownSequence()
+        log.Println("Gateway shutdown completed")
+        os.Exit(0)
+    }
+}
 
-                var configData map[string]interface{}
-                if err := json.Unmarshal(msg.Payload(), &configData); err == nil {
-                    // Check if there's a yaml_config field in the JSON
-                    if yamlConfig, ok := configData["yaml_config"].(string); ok {
-                        storeConfig(yamlConfig)
-                        sendConfigAcknowledgment("success")
-                        continue
-                    }
-                }
-                
-                // If not JSON or no yaml_config field, treat payload as raw YAML
-                yamlConfig := string(msg.Payload())
-                storeConfig(yamlConfig)
-                sendConfigAcknowledgment("success")
-            }
-            
-        case EventShutdown:
-            // Shutdown device manager if it exists
-            if endDeviceManager != nil {
-                endDeviceManager.DeviceMutex.Lock()
-                for id, device := range endDeviceManager.Devices {
-                    close(device.StopChan)
-                    log.Printf("Stopped device: %s", id)
-                }
-                endDeviceManager.DeviceMutex.Unlock()
-            }
-            // Publish disconnected before clean shutdown so IoT rule fires
-            sendStatusUpdate("shutdown", "Gateway shutting down", map[string]interface{}{
-                "status":     "disconnected",
-                "session_id": sessionID,
+// ConnectionTransition identifies an MQTT connection state change
+type ConnectionTransition string
+
+const (
+    TransitionConnected    ConnectionTransition = "connected"
+    TransitionDisconnected ConnectionTransition = "disconnected"
+)
+
+// ConnectionHook is a named action run by the event loop on a connection transition
+type ConnectionHook struct {
+    Name string
+    Run  func(event Event)
+}
+
+// registerConnectionHook adds a hook to run, in registration order, on the given transition
+func (g *Gateway) registerConnectionHook(transition ConnectionTransition, name string, run func(event Event)) {
+    g.connectionHooksMutex.Lock()
+    defer g.connectionHooksMutex.Unlock()
+    g.connectionHooks[transition] = append(g.connectionHooks[transition], ConnectionHook{Name: name, Run: run})
+}
+
+// runConnectionHooks runs every hook registered for a transition
+func (g *Gateway) runConnectionHooks(transition ConnectionTransition, event Event) {
+    g.connectionHooksMutex.RLock()
+    hooks := append([]ConnectionHook(nil), g.connectionHooks[transition]...)
+    g.connectionHooksMutex.RUnlock()
+    
+    for _, hook := range hooks {
+        log.Printf("Running %s hook: %s", transition, hook.Name)
+        hook.Run(event)
+    }
+}
+
+// DeviceManagerInitState tracks applying the stored configuration to a new device manager
+type DeviceManagerInitState struct {
+    Attempts    int       `json:"attempts"`
+    Initialized bool      `json:"initialized"`
+    LastError   string    `json:"last_error,omitempty"`
+    LastAttempt time.Time `json:"last_attempt"`
+}
+
+var (
+    // Delay before the first retry, doubled per attempt up to deviceManagerInitMaxBackoff
+    deviceManagerInitBackoff    = time.Second
+    deviceManagerInitMaxBackoff = 60 * time.Second
+)
+
+// deviceManagerInitAlertAttempts is the number of failed attempts that triggers an error status
+const deviceManagerInitAlertAttempts = 3
+
+// getDeviceManagerInitState returns a copy of the device manager initialization state
+func (g *Gateway) getDeviceManagerInitState() DeviceManagerInitState {
+    g.deviceManagerInitMutex.Lock()
+    defer g.deviceManagerInitMutex.Unlock()
+    return g.deviceManagerInit
+}
+
+// applyStoredConfig applies the stored gateway configuration, if any, to a device
+// manager. configMutex is held throughout so a newer config stored meanwhile is
+// applied after this one rather than overwritten by it.
+func (g *Gateway) applyStoredConfig(dm *DeviceManager) error {
+    g.configMutex.RLock()
+    defer g.configMutex.RUnlock()
+    
+    config := g.currentConfig
+    if config.YAML == "" {
+        return nil
+    }
+    
+    var configMap map[string]interface{}
+    if err := yaml.Unmarshal([]byte(config.YAML), &configMap); err != nil {
+        return fmt.Errorf("error parsing existing configuration: %v", err)
+    }
+    configMap = normalizeYAMLMap(configMap)
+    if dm.UpdateDeviceConfig(configMap).Updated > 0 {
+        log.Printf("Applied existing configuration to device manager")
+    }
+    return nil
+}
+
+// attemptDeviceManagerInit applies the stored configuration once, records the
+// outcome and reports the failure to the backend once it keeps happening
+func (g *Gateway) attemptDeviceManagerInit(dm *DeviceManager) bool {
+    err := g.applyStoredConfig(dm)
+    
+    g.deviceManagerInitMutex.Lock()
+    g.deviceManagerInit.Attempts++
+    g.deviceManagerInit.LastAttempt = time.Now()
+    g.deviceManagerInit.Initialized = err == nil
+    g.deviceManagerInit.LastError = ""
+    if err != nil {
+        g.deviceManagerInit.LastError = err.Error()
+    }
+    attempts := g.deviceManagerInit.Attempts
+    g.deviceManagerInitMutex.Unlock()
+    
+    if err == nil {
+        return true
+    }
+    
+    log.Printf("Device manager initialization attempt %d failed: %v", attempts, err)
+    if attempts == deviceManagerInitAlertAttempts {
+        g.sendStatusUpdate("error", fmt.Sprintf("Device manager failed to initialize after %d attempts: %v", attempts, err),
+            map[string]interface{}{"component": "device_manager"})
+    }
+    return false
+}
+
+// retryDeviceManagerInit retries device manager initialization with exponential
+// backoff until the stored configuration (possibly replaced by an update) applies
+func (g *Gateway) retryDeviceManagerInit(dm *DeviceManager) {
+    backoff := deviceManagerInitBackoff
+    for {
+        time.Sleep(backoff)
+        if g.attemptDeviceManagerInit(dm) {
+            log.Printf("Device manager initialized after %d attempts", g.getDeviceManagerInitState().Attempts)
+            return
+        }
+        if backoff *= 2; backoff > deviceManagerInitMaxBackoff {
+            backoff = deviceManagerInitMaxBackoff
+        }
+    }
+}
+
+// registerDefaultConnectionHooks registers the gateway's built-in connect/disconnect behavior
+func (g *Gateway) registerDefaultConnectionHooks() {
+    g.registerConnectionHook(TransitionConnected, "presence", func(event Event) {
+        // Override any retained Last Will from an earlier session
+        g.publishPresence("connected", "connected")
+    })
+    
+    g.registerConnectionHook(TransitionConnected, "status_update", func(event Event) {
+        // Send connected status along with certificate info
+        g.sendStatusUpdate("connected", "Connected to MQTT broker", map[string]interface{}{
+            "certificate_status": "installed",
+            "session_id":         g.sessionID,
+        })
+    })
+    
+    g.registerConnectionHook(TransitionConnected, "device_manager", func(event Event) {
+        // Initialize device manager if not already done
+        if g.endDeviceManager != nil {
+            return
+        }
+        dm := NewDeviceManager(g)
+        g.gatewayStateMutex.Lock()
+        g.endDeviceManager = dm
+        g.gatewayStateMutex.Unlock()
+        log.Printf("Device manager initialized")
+        go g.endDeviceManager.runAnomalyScheduler()
+        
+        // If we already have a configuration, apply it, retrying in the background
+        // so a bad stored config doesn't leave the gateway running with no devices
+        if !g.attemptDeviceManagerInit(g.endDeviceManager) {
+            go g.retryDeviceManagerInit(g.endDeviceManager)
+        }
+    })
+    
+    g.registerConnectionHook(TransitionConnected, "device_mirrors", func(event Event) {
+        // Restore subscriptions of devices mirroring real measurements
+        if g.endDeviceManager != nil {
+            g.endDeviceManager.resubscribeMirrors()
+        }
+    })
+    
+    g.registerConnectionHook(TransitionConnected, "measurement_buffer", func(event Event) {
+        // Publish measurements generated while disconnected, off the event loop
+        if g.endDeviceManager != nil {
+            go g.endDeviceManager.flushOfflineBuffer()
+        }
+    })
+    
+    g.registerConnectionHook(TransitionConnected, "capabilities", func(event Event) {
+        // Tell the backend what this gateway supports
+        g.sendCapabilities()
+    })
+    
+    g.registerConnectionHook(TransitionConnected, "request_config", func(event Event) {
+        // Request configuration after connection
+        time.Sleep(500 * time.Millisecond) // Small delay to ensure subscriptions are set up
+        g.requestConfig()
+    })
+    
+    g.registerConnectionHook(TransitionDisconnected, "status_update", func(event Event) {
+        // Send disconnection event to API
+        if data, ok := event.Data.(error); ok {
+            log.Printf("MQTT disconnected due to: %v", data)
+            g.sendStatusUpdate("disconnected", fmt.Sprintf("MQTT connection lost: %v", data), map[string]interface{}{
+                "status": "offline",
+                "error": data.Error(),
             })
-            if isMqttConnected && mqttClient != nil {
-                mqttClient.Disconnect(1000)
-            }
-            log.Println("Gateway shutdown completed")
-            os.Exit(0)
+        } else {
+            g.sendStatusUpdate("disconnected", "MQTT connection lost", map[string]interface{}{
+                "status": "offline",
+            })
+        }
+    })
+}
+
+// ShutdownPhase orders the steps of a graceful shutdown
+type ShutdownPhase int
+
+const (
+    ShutdownStopIntake        ShutdownPhase = iota // Stop producing new measurements
+    ShutdownDrain                                  // Wait for in-flight work
+    ShutdownFlushBuffers                           // Publish anything still buffered
+    ShutdownPersistState                           // Save state for the next start
+    ShutdownSendOfflineStatus                      // Tell the backend we are going away
+    ShutdownDisconnect                             // Close the MQTT connection
+)
+
+var shutdownPhaseNames = map[ShutdownPhase]string{
+    ShutdownStopIntake:        "stop_intake",
+    ShutdownDrain:             "drain",
+    ShutdownFlushBuffers:      "flush_buffers",
+    ShutdownPersistState:      "persist_state",
+    ShutdownSendOfflineStatus: "send_offline_status",
+    ShutdownDisconnect:        "disconnect",
+}
+
+func (phase ShutdownPhase) String() string {
+    if name, ok := shutdownPhaseNames[phase]; ok {
+        return name
+    }
+    return fmt.Sprintf("phase_%d", int(phase))
+}
+
+// defaultShutdownStepTimeout bounds a step registered without its own timeout
+const defaultShutdownStepTimeout = 5 * time.Second
+
+// ShutdownStep is a named cleanup action run in its phase, bounded by Timeout
+type ShutdownStep struct {
+    Phase   ShutdownPhase
+    Name    string
+    Timeout time.Duration
+    Run     func()
+}
+
+// registerShutdownStep adds a cleanup step; steps run by phase, then in registration order
+func (g *Gateway) registerShutdownStep(phase ShutdownPhase, name string, timeout time.Duration, run func()) {
+    if timeout <= 0 {
+        timeout = defaultShutdownStepTimeout
+    }
+    g.shutdownStepsMutex.Lock()
+    defer g.shutdownStepsMutex.Unlock()
+    g.shutdownSteps = append(g.shutdownSteps, ShutdownStep{Phase: phase, Name: name, Timeout: timeout, Run: run})
+}
+
+// runShutdownSequence runs every registered step in phase order. A step that exceeds
+// its timeout is abandoned so one stuck feature can't block the rest of the shutdown.
+func (g *Gateway) runShutdownSequence() {
+    g.shutdownStepsMutex.Lock()
+    steps := append([]ShutdownStep(nil), g.shutdownSteps...)
+    g.shutdownStepsMutex.Unlock()
+    sort.SliceStable(steps, func(i, j int) bool { return steps[i].Phase < steps[j].Phase })
+    
+    for _, step := range steps {
+        log.Printf("Shutdown %s: %s", step.Phase, step.Name)
+        done := make(chan struct{})
+        go func(run func()) {
+            defer close(done)
+            run()
+        }(step.Run)
+        
+        select {
+        case <-done:
+        case <-time.After(step.Timeout):
+            log.Printf("Shutdown step %s timed out after %v, continuing", step.Name, step.Timeout)
+        }
+    }
+}
+
+// registerDefaultShutdownSteps registers the gateway's built-in shutdown behavior
+func (g *Gateway) registerDefaultShutdownSteps() {
+    g.registerShutdownStep(ShutdownStopIntake, "stop_devices", 0, func() {
+        if g.endDeviceManager == nil {
+            return
+        }
+        g.endDeviceManager.DeviceMutex.Lock()
+        defer g.endDeviceManager.DeviceMutex.Unlock()
+        for id, device := range g.endDeviceManager.Devices {
+            device.stop()
+            log.Printf("Stopped device: %s", id)
+        }
+    })
+    
+    // Pending ack retries stop once shutdown begins; let their last attempt finish
+    g.registerShutdownStep(ShutdownDrain, "config_acks", 0, func() {
+        g.configAcks.Wait()
+    })
+    
+    g.registerShutdownStep(ShutdownFlushBuffers, "measurement_batches", 0, func() {
+        if g.endDeviceManager != nil && g.endDeviceManager.batcher != nil {
+            g.endDeviceManager.flushBatches()
+        }
+    })
+    
+    g.registerShutdownStep(ShutdownFlushBuffers, "device_stats", 0, func() {
+        if g.endDeviceManager == nil || g.endDeviceManager.stats == nil {
+            return
+        }
+        if err := g.endDeviceManager.saveStats(); err != nil {
+            log.Printf("Error saving device stats: %v", err)
+        }
+    })
+    
+    // Publish disconnected before clean shutdown so IoT rule fires
+    g.registerShutdownStep(ShutdownSendOfflineStatus, "status_update", 0, func() {
+        g.sendStatusUpdate("shutdown", "Gateway shutting down", map[string]interface{}{
+            "status":     "disconnected",
+            "session_id": g.sessionID,
+        })
+    })
+    
+    // A clean disconnect discards the Last Will, so retain the offline presence ourselves
+    g.registerShutdownStep(ShutdownSendOfflineStatus, "presence", 0, func() {
+        g.publishPresence("disconnected", "shutdown")
+    })
+    
+    g.registerShutdownStep(ShutdownDisconnect, "mqtt", 2*time.Second, func() {
+        if g.isMqttConnected.Load() && g.mqttClient != nil {
+            g.mqttClient.Disconnect(1000)
+        }
+    })
+}
+
+// EventLoopWatchdog detects when the main event loop is stuck processing a single event
+type EventLoopWatchdog struct {
+    Timeout      time.Duration // How long one event may take before it counts as a stall (0 disables)
+    ExitOnStall  bool          // Exit the process so an orchestrator can restart it
+    busySince    int64         // Unix nanos when the current event started, 0 when idle
+    busyEvent    int32         // Type of the event currently being processed
+    lastProgress int64         // Unix nanos when the last event finished
+    stallCount   int32         // Number of stalls detected
+    reported     int32         // Whether the current stall has been reported
+}
+
+// NewEventLoopWatchdog creates a watchdog from WATCHDOG_TIMEOUT_SECONDS and WATCHDOG_EXIT_ON_STALL
+func NewEventLoopWatchdog() *EventLoopWatchdog {
+    timeout := 60 * time.Second
+    if value := os.Getenv("WATCHDOG_TIMEOUT_SECONDS"); value != "" {
+        if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+            timeout = time.Duration(seconds * float64(time.Second))
+        } else {
+            log.Printf("Invalid WATCHDOG_TIMEOUT_SECONDS %q, using %v", value, timeout)
         }
     }
+    
+    return &EventLoopWatchdog{
+        Timeout:      timeout,
+        ExitOnStall:  os.Getenv("WATCHDOG_EXIT_ON_STALL") == "true",
+        lastProgress: time.Now().UnixNano(),
+    }
+}
+
+// Begin records that the event loop started processing an event
+func (w *EventLoopWatchdog) Begin(eventType EventType) {
+    atomic.StoreInt32(&w.busyEvent, int32(eventType))
+    atomic.StoreInt32(&w.reported, 0)
+    atomic.StoreInt64(&w.busySince, time.Now().UnixNano())
+}
+
+// Done records that the event loop finished processing an event
+func (w *EventLoopWatchdog) Done() {
+    atomic.StoreInt64(&w.busySince, 0)
+    atomic.StoreInt64(&w.lastProgress, time.Now().UnixNano())
+}
+
+// Check reports a stall if the current event has been running longer than the timeout.
+// It returns true the first time a given stall is detected.
+func (w *EventLoopWatchdog) Check(now time.Time) bool {
+    if w.Timeout <= 0 {
+        return false
+    }
+    
+    busySince := atomic.LoadInt64(&w.busySince)
+    if busySince == 0 {
+        return false
+    }
+    
+    stalledFor := now.Sub(time.Unix(0, busySince))
+    if stalledFor < w.Timeout || !atomic.CompareAndSwapInt32(&w.reported, 0, 1) {
+        return false
+    }
+    
+    atomic.AddInt32(&w.stallCount, 1)
+    lastProgress := time.Unix(0, atomic.LoadInt64(&w.lastProgress))
+    
+    stack := make([]byte, 1<<20)
+    stack = stack[:runtime.Stack(stack, true)]
+    log.Printf("WARNING: event loop stalled for %v on event type %d (last progress %s)",
+        stalledFor.Round(time.Millisecond), atomic.LoadInt32(&w.busyEvent), lastProgress.Format(time.RFC3339))
+    log.Printf("Goroutine dump:\n%s", stack)
+    
+    if w.ExitOnStall {
+        log.Printf("Exiting due to stalled event loop")
+        os.Exit(1)
+    }
+    return true
+}
+
+// Stalls returns the number of stalls detected so far
+func (w *EventLoopWatchdog) Stalls() int {
+    return int(atomic.LoadInt32(&w.stallCount))
+}
+
+// Run periodically checks the event loop for stalls
+func (w *EventLoopWatchdog) Run() {
+    if w.Timeout <= 0 {
+        log.Printf("Event loop watchdog disabled")
+        return
+    }
+    
+    interval := w.Timeout / 4
+    if interval < 10*time.Millisecond {
+        interval = 10 * time.Millisecond
+    }
+    log.Printf("Event loop watchdog started with timeout %v", w.Timeout)
+    
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for now := range ticker.C {
+        w.Check(now)
+    }
 }
 
 // handleCertificateFound handles certificate discovery
-func handleCertificateFound() {
+func (g *Gateway) handleCertificateFound() {
     log.Printf("Certificate found event - setting up MQTT connection")
     
     // Notify API about certificate discovery
-    sendStatusUpdate("certificate_found", "Certificates found, starting MQTT connection", map[string]interface{}{
+    g.sendStatusUpdate("certificate_found", "Certificates found, starting MQTT connection", map[string]interface{}{
         "certificate_status": "installed",
     })
     
     // Setup MQTT connection
-    setupMQTTClient()
+    if err := g.setupMQTTClient(); err != nil {
+        g.sendStatusUpdate("error", fmt.Sprintf("MQTT TLS setup failed: %v", err))
+    }
 }
 
-// setupMQTTClient creates and configures an MQTT client
-func setupMQTTClient() {
-    // Verify broker connectivity before attempting MQTT connection
-    testBrokerConnectivity()
+// newMQTTTLSConfig builds the client TLS config. The broker certificate is verified
+// against MQTT_CA_PATH (a PEM bundle) or the system roots; MQTT_TLS_INSECURE=true
+// skips verification entirely.
+func newMQTTTLSConfig(cert tls.Certificate) (*tls.Config, error) {
+    tlsConfig := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+    }
     
-    // Create TLS config if certificates exist
-    var tlsConfig *tls.Config
-    if hasCertificates {
-        cert, err := tls.LoadX509KeyPair(CertPath, KeyPath)
-        if err != nil {
-            log.Printf("WARNING: Error loading certificates: %v", err)
-            
-            // Check if certificate files exist and have proper permissions
-            checkCertificatePermissions()
-        } else {
-            tlsConfig = &tls.Config{
-                ClientCAs:          nil,
-                InsecureSkipVerify: true,
-                Certificates:       []tls.Certificate{cert},
-            }
-            log.Printf("TLS certificates loaded successfully")
+    if os.Getenv("MQTT_TLS_INSECURE") == "true" {
+        tlsConfig.InsecureSkipVerify = true
+        log.Printf("WARNING: MQTT TLS mode: insecure (broker certificate is NOT verified)")
+        return tlsConfig, nil
+    }
+    
+    caPath := os.Getenv("MQTT_CA_PATH")
+    if caPath == "" {
+        log.Printf("MQTT TLS mode: verified against system root CAs")
+        return tlsConfig, nil
+    }
+    
+    caPEM, err := os.ReadFile(caPath)
+    if err != nil {
+        return nil, fmt.Errorf("reading CA bundle %s: %w", caPath, err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(caPEM) {
+        return nil, fmt.Errorf("no certificates found in CA bundle %s", caPath)
+    }
+    tlsConfig.RootCAs = pool
+    log.Printf("MQTT TLS mode: verified against CA bundle %s", caPath)
+    return tlsConfig, nil
+}
+
+// mqttBrokerURL builds the broker URL for address ("host" or "host:port"). MQTT_PROTOCOL
+// wins when set; otherwise the scheme is ssl when a TLS config is present and tcp when not.
+// Addresses without a port get 8883 for TLS schemes and 1883 for plain TCP.
+func (g *Gateway) mqttBrokerURL(address string, tlsConfig *tls.Config) string {
+    scheme := os.Getenv("MQTT_PROTOCOL")
+    if scheme == "" {
+        scheme = "tcp"
+        if tlsConfig != nil {
+            scheme = "ssl"
         }
     }
+    g.mqttProtocol = scheme
     
-    // Extract broker details for logging
-    brokerHost := brokerAddress
-    brokerPort := "1883"
-    if strings.Contains(brokerAddress, ":") {
-        parts := strings.Split(brokerAddress, ":")
-        brokerHost = parts[0]
-        if len(parts) > 1 {
-            brokerPort = parts[1]
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        host = address
+        port = "1883"
+        if scheme == "ssl" || scheme == "tls" || scheme == "mqtts" {
+            port = "8883"
         }
     }
+    return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port))
+}
+
+// loadMQTTTLSConfig returns the TLS config for the certificate and key files, or
+// nil when the gateway has no certificates. Certificates that can't be used are an
+// error rather than a reason to fall back to plaintext.
+func (g *Gateway) loadMQTTTLSConfig(certPath string, keyPath string) (*tls.Config, error) {
+    if !g.hasCertificates.Load() {
+        return nil, nil
+    }
+    cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+    if err != nil {
+        // Check if certificate files exist and have proper permissions
+        checkCertificatePermissions()
+        return nil, fmt.Errorf("loading certificates: %w", err)
+    }
+    log.Printf("TLS certificates loaded successfully")
+    tlsConfig, err := newMQTTTLSConfig(cert)
+    if err != nil {
+        return nil, fmt.Errorf("configuring TLS: %w", err)
+    }
+    return tlsConfig, nil
+}
+
+// setupMQTTClient creates and configures an MQTT client. It refuses to connect
+// when the gateway has certificates that can't be turned into a TLS config.
+func (g *Gateway) setupMQTTClient() error {
+    // Create TLS config if certificates exist
+    tlsConfig, err := g.loadMQTTTLSConfig(CertPath, KeyPath)
+    if err != nil {
+        log.Printf("ERROR: Not connecting to MQTT without TLS: %v", err)
+        return err
+    }
+    
+    // Verify broker connectivity before attempting MQTT connection
+    g.testBrokerConnectivity()
+    
+    // Pick the scheme and port from the TLS setup unless MQTT_PROTOCOL overrides it
+    brokerURL := g.mqttBrokerURL(g.brokerAddress, tlsConfig)
+    log.Printf("MQTT broker URL: %s", brokerURL)
     
     // Setup MQTT options
     opts := mqtt.NewClientOptions()
-    opts.AddBroker(fmt.Sprintf("%s://%s", mqttProtocol, brokerAddress))
-    opts.SetClientID(gatewayID)
-
-    // Add Last Will and Testament
-    lwtTopic := fmt.Sprintf("gateway/%s/status", gatewayID)
-    lwtMessage := map[string]interface{}{
-        "status":     "disconnected",
-        "timestamp":  time.Now().Format(time.RFC3339),
-        "reason":     "connection_lost",
-        "session_id": sessionID,
-    }
-    lwtPayload, _ := json.Marshal(lwtMessage)
-    opts.SetWill(lwtTopic, string(lwtPayload), 0, false)
-    log.Printf("Last Will configured for topic: %s", lwtTopic)
+    opts.AddBroker(brokerURL)
+    opts.SetClientID(g.gatewayID)
+    applySessionOptions(opts)
+    g.applyLastWill(opts)
 
     opts.SetKeepAlive(10 * time.Second)
     opts.SetPingTimeout(10 * time.Second)
+    // Auto-reconnect uses the client's own backoff (1s, doubling); only its cap is
+    // configurable, so the initial delay and multiplier apply to connectWithRetry
     opts.SetAutoReconnect(true)
-    opts.SetMaxReconnectInterval(10 * time.Second)
+    opts.SetMaxReconnectInterval(reconnectBackoff.Max)
     opts.SetConnectTimeout(10 * time.Second)
     
     // Add connection handlers
     opts.SetOnConnectHandler(func(client mqtt.Client) {
-        log.Printf("MQTT connected successfully to %s", brokerAddress)
+        log.Printf("MQTT connected successfully to %s", g.brokerAddress)
 
         // Subscribe to control topic (only for local development)
         // In AWS, Step Functions handles gateway lifecycle directly
-        if !isAWSEnvironment() {
-            controlTopic := fmt.Sprintf("control/%s", gatewayID)
+        if !g.isAWSEnvironment() {
+            controlTopic := fmt.Sprintf("control/%s", g.gatewayID)
             log.Printf("Subscribing to control topic: %s", controlTopic)
 
             if token := client.Subscribe(controlTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
                 log.Printf("Received message on topic %s: %s", msg.Topic(), string(msg.Payload()))
-                eventChan <- Event{Type: EventMQTTMessage, Data: msg, Time: time.Now()}
+                g.eventChan <- Event{Type: EventMQTTMessage, Data: msg, Time: time.Now()}
             }); token.Wait() && token.Error() != nil {
                 log.Printf("Error subscribing to control topic: %v", token.Error())
             }
@@ -1703,33 +6252,36 @@ func setupMQTTClient() {
         }
 
         // Subscribe to shadow delta topic (for AWS config updates)
-        shadowDeltaTopic := fmt.Sprintf("$aws/things/%s/shadow/name/configuration/update/delta", gatewayID)
+        shadowDeltaTopic := fmt.Sprintf("$aws/things/%s/shadow/name/configuration/update/delta", g.gatewayID)
         log.Printf("Subscribing to shadow delta topic: %s", shadowDeltaTopic)
 
         if token := client.Subscribe(shadowDeltaTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
             log.Printf("Received shadow delta on topic %s", msg.Topic())
-            handleShadowDelta(msg)
+            g.handleShadowDelta(msg)
         }); token.Wait() && token.Error() != nil {
             log.Printf("Error subscribing to shadow delta topic: %v", token.Error())
         }
 
         // Subscribe to config update topic (for direct config delivery)
-        configTopic := fmt.Sprintf("gateway/%s/config/update", gatewayID)
+        configTopic := fmt.Sprintf("gateway/%s/config/update", g.gatewayID)
         log.Printf("Subscribing to config topic: %s", configTopic)
 
         if token := client.Subscribe(configTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
             log.Printf("Received config update on topic %s", msg.Topic())
-            eventChan <- Event{Type: EventConfigUpdate, Data: msg, Time: time.Now()}
+            if payloadTooLarge(msg) {
+                return
+            }
+            g.eventChan <- Event{Type: EventConfigUpdate, Data: msg, Time: time.Now()}
         }); token.Wait() && token.Error() != nil {
             log.Printf("Error subscribing to config topic: %v", token.Error())
         }
 
-        eventChan <- Event{Type: EventMQTTConnected, Time: time.Now()}
+        g.eventChan <- Event{Type: EventMQTTConnected, Time: time.Now()}
     })
     
     opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
         log.Printf("MQTT connection lost: %v", err)
-        eventChan <- Event{Type: EventMQTTDisconnected, Data: err, Time: time.Now()}
+        g.eventChan <- Event{Type: EventMQTTDisconnected, Data: err, Time: time.Now()}
     })
     
     // Add default handler for unexpected messages
@@ -1746,11 +6298,116 @@ func setupMQTTClient() {
     }
     
     // Create client and connect
-    log.Printf("Attempting MQTT connection to %s:%s", brokerHost, brokerPort)
-    mqttClient = mqtt.NewClient(opts)
+    log.Printf("Attempting MQTT connection to %s", brokerURL)
+    g.mqttClient = mqtt.NewClient(opts)
     
     // Connect with retry logic
-    connectWithRetry(mqttClient, 3)
+    connectWithRetry(g.mqttClient, reconnectBackoff.MaxRetries)
+    return nil
+}
+
+// presenceTopic is where the gateway's retained connected/disconnected presence is kept
+func (g *Gateway) presenceTopic() string {
+    return fmt.Sprintf("gateway/%s/status", g.gatewayID)
+}
+
+// presencePayload is the retained presence message for a status and reason
+func (g *Gateway) presencePayload(status string, reason string) []byte {
+    payload, _ := json.Marshal(map[string]interface{}{
+        "gateway_id": g.gatewayID,
+        "status":     status,
+        "reason":     reason,
+        "timestamp":  time.Now().Format(time.RFC3339),
+        "session_id": g.sessionID,
+    })
+    return payload
+}
+
+// applyLastWill has the broker publish a retained disconnected presence, at QoS 1,
+// if the gateway goes away without a clean shutdown (e.g. it is killed)
+func (g *Gateway) applyLastWill(opts *mqtt.ClientOptions) {
+    opts.SetWill(g.presenceTopic(), string(g.presencePayload("disconnected", "connection_lost")), 1, true)
+    log.Printf("Last Will configured for topic: %s", g.presenceTopic())
+}
+
+// publishPresence replaces the retained presence, so a will left over from an
+// earlier session doesn't report a running gateway as disconnected. In AWS mode
+// the status updates published to the same topic do this instead.
+func (g *Gateway) publishPresence(status string, reason string) {
+    if g.isAWSEnvironment() || !g.isMqttConnected.Load() || g.mqttClient == nil {
+        return
+    }
+    token := g.mqttClient.Publish(g.presenceTopic(), 1, true, g.presencePayload(status, reason))
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing %s presence: %v", status, token.Error())
+    }
+}
+
+// applySessionOptions keeps the broker session across reconnects when
+// MQTT_PERSISTENT_SESSION=true, so queued QoS 1 messages are redelivered.
+// The client ID is the gateway ID, which is stable for a given gateway.
+func applySessionOptions(opts *mqtt.ClientOptions) {
+    if os.Getenv("MQTT_PERSISTENT_SESSION") != "true" {
+        return
+    }
+    opts.SetCleanSession(false)
+    opts.SetResumeSubs(true)
+    log.Printf("MQTT persistent session enabled for client %s", opts.ClientID)
+}
+
+// BackoffPolicy computes exponential reconnect delays
+type BackoffPolicy struct {
+    Initial    time.Duration // Delay after the first failed attempt
+    Max        time.Duration // Upper bound for any delay
+    Multiplier float64       // Growth factor per attempt
+    MaxRetries int           // Connection attempts made by connectWithRetry
+}
+
+var reconnectBackoff = newBackoffPolicyFromEnv()
+
+// newBackoffPolicyFromEnv reads MQTT_RECONNECT_INITIAL_SECONDS (default 1),
+// MQTT_RECONNECT_MAX_SECONDS (default 10), MQTT_RECONNECT_MULTIPLIER (default 2)
+// and MQTT_CONNECT_MAX_RETRIES (default 3)
+func newBackoffPolicyFromEnv() BackoffPolicy {
+    policy := BackoffPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, MaxRetries: 3}
+    if seconds, err := strconv.ParseFloat(os.Getenv("MQTT_RECONNECT_INITIAL_SECONDS"), 64); err == nil && seconds > 0 {
+        policy.Initial = time.Duration(seconds * float64(time.Second))
+    }
+    if seconds, err := strconv.ParseFloat(os.Getenv("MQTT_RECONNECT_MAX_SECONDS"), 64); err == nil && seconds > 0 {
+        policy.Max = time.Duration(seconds * float64(time.Second))
+    }
+    if multiplier, err := strconv.ParseFloat(os.Getenv("MQTT_RECONNECT_MULTIPLIER"), 64); err == nil && multiplier >= 1 {
+        policy.Multiplier = multiplier
+    }
+    if retries, err := strconv.Atoi(os.Getenv("MQTT_CONNECT_MAX_RETRIES")); err == nil && retries > 0 {
+        policy.MaxRetries = retries
+    }
+    if policy.Max < policy.Initial {
+        policy.Max = policy.Initial
+    }
+    return policy
+}
+
+// delay returns the backoff after the given failed attempt (1-based), without jitter
+func (policy BackoffPolicy) delay(attempt int) time.Duration {
+    delay := float64(policy.Initial) * math.Pow(policy.Multiplier, float64(attempt-1))
+    if delay > float64(policy.Max) {
+        return policy.Max
+    }
+    return time.Duration(delay)
+}
+
+// jittered adds up to 50% random jitter to the delay, still capped at Max
+func (policy BackoffPolicy) jittered(attempt int) time.Duration {
+    delay := policy.delay(attempt)
+    if delay > 0 {
+        delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+    }
+    if delay > policy.Max {
+        return policy.Max
+    }
+    return delay
 }
 
 // connectWithRetry attempts to connect to MQTT with retries
@@ -1766,176 +6423,590 @@ func connectWithRetry(client mqtt.Client, maxRetries int) {
         if !tokenSuccess {
             log.Printf("MQTT connection attempt %d timed out", attempt)
             err = fmt.Errorf("connection timeout")
-            time.Sleep(time.Duration(attempt) * time.Second)
-            continue
-        }
-        
-        if token.Error() != nil {
+        } else if token.Error() != nil {
             log.Printf("MQTT connection attempt %d failed: %v", attempt, token.Error())
             err = token.Error()
-            time.Sleep(time.Duration(attempt) * time.Second)
+        } else {
+            // Success
+            log.Printf("MQTT connection successful on attempt %d", attempt)
+            return
+        }
+        
+        if attempt < maxRetries {
+            delay := reconnectBackoff.jittered(attempt)
+            log.Printf("Retrying MQTT connection in %v", delay)
+            time.Sleep(delay)
+        }
+    }
+    
+    // All attempts failed
+    log.Printf("All MQTT connection attempts failed, last error: %v", err)
+}
+
+// testBrokerConnectivity tests if the broker is accessible
+func (g *Gateway) testBrokerConnectivity() {
+    host := g.brokerAddress
+    port := "1883"
+    
+    if strings.Contains(g.brokerAddress, ":") {
+        parts := strings.Split(g.brokerAddress, ":")
+        host = parts[0]
+        if len(parts) > 1 {
+            port = parts[1]
+        }
+    }
+    
+    // Try TCP connection to verify broker is reachable
+    address := host + ":" + port
+    log.Printf("Testing TCP connectivity to MQTT broker at %s", address)
+    
+    conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+    if err != nil {
+        log.Printf("WARNING: Cannot establish TCP connection to MQTT broker at %s: %v", address, err)
+        
+        // Print network configuration for debugging
+        printNetworkInfo()
+    } else {
+        conn.Close()
+        log.Printf("Successfully established TCP connection to MQTT broker at %s", address)
+    }
+}
+
+// checkCertificatePermissions checks certificates for correct permissions
+func checkCertificatePermissions() {
+    // Check certificate file
+    if certInfo, err := os.Stat(CertPath); err != nil {
+        log.Printf("Certificate file issue at %s: %v", CertPath, err)
+    } else {
+        mode := certInfo.Mode()
+        log.Printf("Certificate file exists with permissions: %v", mode)
+    }
+    
+    // Check key file
+    if keyInfo, err := os.Stat(KeyPath); err != nil {
+        log.Printf("Key file issue at %s: %v", KeyPath, err)
+    } else {
+        mode := keyInfo.Mode()
+        log.Printf("Key file exists with permissions: %v", mode)
+    }
+}
+
+// printNetworkInfo prints network configuration for debugging
+func printNetworkInfo() {
+    // Get interfaces
+    interfaces, err := net.Interfaces()
+    if err != nil {
+        log.Printf("Error getting network interfaces: %v", err)
+        return
+    }
+    
+    log.Printf("Network interfaces:")
+    for _, iface := range interfaces {
+        addrs, err := iface.Addrs()
+        if err != nil {
             continue
         }
-        
-        // Success
-        log.Printf("MQTT connection successful on attempt %d", attempt)
-        return
+        
+        for _, addr := range addrs {
+            log.Printf("  Interface %s: %s", iface.Name, addr.String())
+        }
+    }
+    
+    // Try to ping common Docker gateway addresses
+    log.Printf("Trying to ping common Docker addresses:")
+    hosts := []string{"172.28.1.2", "172.17.0.1", "172.17.0.2", "172.17.0.3"}
+    for _, host := range hosts {
+        cmd := exec.Command("ping", "-c", "1", "-W", "1", host)
+        if err := cmd.Run(); err == nil {
+            log.Printf("  Successfully pinged %s", host)
+        } else {
+            log.Printf("  Failed to ping %s", host)
+        }
+    }
+}
+
+// handleMQTTMessage processes messages received on MQTT topics
+func (g *Gateway) handleMQTTMessage(msg mqtt.Message) {
+    topic := msg.Topic()
+    
+    // Drop oversized payloads before parsing them
+    if payloadTooLarge(msg) {
+        return
+    }
+
+    // Check for configuration-related topics
+    if strings.Contains(topic, "/config/update") {
+        if updateID := configUpdateID(msg.Payload()); updateID != "" {
+            log.Printf("Extracted update_id from message: %s", updateID)
+        }
+        g.eventChan <- Event{Type: EventConfigUpdate, Data: msg, Time: time.Now()}
+        return
+    }
+
+    // Parse message
+    var command map[string]interface{}
+    if err := json.Unmarshal(msg.Payload(), &command); err != nil {
+        log.Printf("Error parsing MQTT message: %v", err)
+        return
+    }
+    
+    // Check command type
+    if cmdType, ok := command["type"].(string); ok {
+        log.Printf("Received command type: %s", cmdType)
+        
+        if handler, ok := commandHandlers[cmdType]; ok {
+            handler(g, command)
+        }
+    }
+}
+
+// maxPayloadBytes returns the largest MQTT payload the gateway will process,
+// from MQTT_MAX_PAYLOAD_BYTES (default 1 MiB, 0 or negative = unlimited)
+func maxPayloadBytes() int {
+    if value := os.Getenv("MQTT_MAX_PAYLOAD_BYTES"); value != "" {
+        if limit, err := strconv.Atoi(value); err == nil {
+            return limit
+        }
+        log.Printf("Invalid MQTT_MAX_PAYLOAD_BYTES %q, using default", value)
+    }
+    return 1024 * 1024
+}
+
+// payloadTooLarge logs and reports messages that exceed the payload limit
+func payloadTooLarge(msg mqtt.Message) bool {
+    limit := maxPayloadBytes()
+    if limit <= 0 || len(msg.Payload()) <= limit {
+        return false
+    }
+    log.Printf("Dropping oversized message on topic %s: %d bytes exceeds limit of %d",
+        msg.Topic(), len(msg.Payload()), limit)
+    return true
+}
+
+// commandHandlers maps the MQTT command types the gateway accepts to their handlers
+var commandHandlers = map[string]func(g *Gateway, command map[string]interface{}){
+    "acknowledge":       (*Gateway).handleAcknowledgeCommand,
+    "reset":             (*Gateway).handleResetCommand,
+    "delete":            (*Gateway).handleDeleteCommand,
+    "trigger_anomaly":   (*Gateway).handleTriggerAnomalyCommand,
+    "measure_now":       (*Gateway).handleMeasureNowCommand,
+    "set_parameter_set": (*Gateway).handleSetParameterSetCommand,
+    "rollback_config":   (*Gateway).handleRollbackConfigCommand,
+}
+
+// supportedCommandTypes returns the declared command types in sorted order
+func supportedCommandTypes() []string {
+    types := make([]string, 0, len(commandHandlers))
+    for cmdType := range commandHandlers {
+        types = append(types, cmdType)
+    }
+    sort.Strings(types)
+    return types
+}
+
+// handleAcknowledgeCommand sends certificate status and connection info
+func (g *Gateway) handleAcknowledgeCommand(command map[string]interface{}) {
+    log.Printf("Sending acknowledge event as requested")
+    certInfo := map[string]interface{}{
+        "certificate_status": "installed",
+        "tls_enabled": g.hasCertificates.Load(),
+        "timestamp": time.Now().Format(time.RFC3339),
+    }
+    g.sendStatusUpdate("online", "Gateway online and ready", certInfo)
+}
+
+// handleResetCommand resets the connection as requested by the backend
+func (g *Gateway) handleResetCommand(command map[string]interface{}) {
+    log.Printf("Resetting connection as requested")
+    g.resetConnection()
+}
+
+// handleDeleteCommand shuts the gateway down after the backend deletes it
+func (g *Gateway) handleDeleteCommand(command map[string]interface{}) {
+    log.Printf("Received delete command, shutting down")
+    // Send a final deletion notice
+    g.sendStatusUpdate("deleted", "Gateway received deletion command", map[string]interface{}{
+        "status": "deleted",
+    })
+    
+    // Allow time for message to be delivered
+    time.Sleep(500 * time.Millisecond)
+    
+    g.eventChan <- Event{Type: EventShutdown, Time: time.Now()}
+}
+
+// handleTriggerAnomalyCommand injects a correlated anomaly across a device group
+func (g *Gateway) handleTriggerAnomalyCommand(command map[string]interface{}) {
+    name, _ := command["name"].(string)
+    if g.endDeviceManager == nil {
+        log.Printf("Cannot trigger anomaly: device manager not initialized")
+        return
+    }
+    if _, err := g.endDeviceManager.TriggerAnomaly(name, time.Now()); err != nil {
+        log.Printf("Error triggering anomaly: %v", err)
+    }
+}
+
+// handleMeasureNowCommand makes the command's device_id, or "all" devices, measure immediately
+func (g *Gateway) handleMeasureNowCommand(command map[string]interface{}) {
+    deviceID, _ := command["device_id"].(string)
+    if g.endDeviceManager == nil {
+        log.Printf("Cannot measure now: device manager not initialized")
+        return
+    }
+    measured, err := g.endDeviceManager.MeasureNow(deviceID)
+    if err != nil {
+        log.Printf("Rejecting measure_now command: %v", err)
+        return
+    }
+    log.Printf("measure_now: triggered a measurement on %d device(s)", measured)
+}
+
+// handleSetParameterSetCommand switches the command's device_id to the parameter set set_name
+func (g *Gateway) handleSetParameterSetCommand(command map[string]interface{}) {
+    deviceID, _ := command["device_id"].(string)
+    setName, _ := command["set_name"].(string)
+    
+    err := fmt.Errorf("device manager not initialized")
+    if g.endDeviceManager != nil {
+        err = g.endDeviceManager.SetParameterSet(deviceID, setName)
+    }
+    if err != nil {
+        log.Printf("Error handling set_parameter_set command: %v", err)
+    }
+    g.sendCommandAcknowledgment("set_parameter_set", deviceID, err)
+}
+
+// handleRollbackConfigCommand re-applies the configuration with the command's config_version from the history
+func (g *Gateway) handleRollbackConfigCommand(command map[string]interface{}) {
+    version, _ := command["config_version"].(string)
+    updateID, _ := command["update_id"].(string)
+    result, err := g.rollbackConfig(version)
+    
+    // The rolled back config is acknowledged like a delivered one, under the
+    // command's update_id rather than the update it replaced
+    if err == nil {
+        g.currentUpdateID = updateID
+    }
+    g.sendConfigAcknowledgment(updateID, result, err)
+    
+    if err != nil {
+        log.Printf("Error handling rollback_config command: %v", err)
+    } else if len(result.Failed) > 0 {
+        err = fmt.Errorf("%d device(s) could not apply config version %s", len(result.Failed), version)
+    }
+    g.sendCommandAcknowledgment("rollback_config", "", err)
+}
+
+// sendCommandAcknowledgment reports the outcome of a device command to the backend
+func (g *Gateway) sendCommandAcknowledgment(commandType string, deviceID string, commandErr error) {
+    if !g.isMqttConnected.Load() || g.mqttClient == nil {
+        log.Printf("Cannot send %s acknowledgment: MQTT not connected", commandType)
+        return
+    }
+    
+    payload := map[string]interface{}{
+        "gateway_id": g.gatewayID,
+        "device_id":  deviceID,
+        "command":    commandType,
+        "status":     "success",
+        "timestamp":  time.Now().Format(time.RFC3339),
+    }
+    if commandErr != nil {
+        payload["status"] = "failure"
+        payload["error"] = commandErr.Error()
+    }
+    jsonData, err := json.Marshal(payload)
+    if err != nil {
+        log.Printf("Error marshaling command acknowledgment: %v", err)
+        return
+    }
+    
+    topic := fmt.Sprintf("gateway/%s/command/ack", g.gatewayID)
+    token := g.mqttClient.Publish(topic, 1, false, jsonData)
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing command acknowledgment: %v", token.Error())
+    }
+}
+
+// supportedDeviceTypes lists the device types the simulator can run
+var supportedDeviceTypes = []string{"scale", "temperature_sensor"}
+
+// deviceTypePrefixes maps each device type to the prefix of its device IDs
+var deviceTypePrefixes = map[string]string{
+    "scale":              "scale",
+    "temperature_sensor": "temp",
+}
+
+// measurementTypes maps each device type to the "type" of its measurement events
+var measurementTypes = map[string]string{
+    "scale":              "weight_measurement",
+    "temperature_sensor": "temperature_measurement",
+}
+
+// buildCapabilitiesPayload describes what this gateway supports so the backend
+// can tailor its configuration
+func (g *Gateway) buildCapabilitiesPayload(config map[string]interface{}) map[string]interface{} {
+    parameterSets := []string{}
+    if sets, ok := config["parameter_sets"].(map[string]interface{}); ok {
+        for name := range sets {
+            parameterSets = append(parameterSets, name)
+        }
+    }
+    sort.Strings(parameterSets)
+    
+    deviceCapabilities := []string{}
+    firmwareVersions := map[string]bool{}
+    if devicesConfig, ok := config["devices"].(map[string]interface{}); ok {
+        if capabilities, ok := devicesConfig["capabilities"].(map[string]interface{}); ok {
+            for name := range capabilities {
+                deviceCapabilities = append(deviceCapabilities, name)
+            }
+        }
+        if firmware, ok := devicesConfig["firmware_version"].(string); ok && firmware != "" {
+            firmwareVersions[firmware] = true
+        }
     }
+    sort.Strings(deviceCapabilities)
     
-    // All attempts failed
-    log.Printf("All MQTT connection attempts failed, last error: %v", err)
+    // Include the firmware actually running on simulated devices
+    if g.endDeviceManager != nil {
+        g.endDeviceManager.DeviceMutex.RLock()
+        for _, device := range g.endDeviceManager.Devices {
+            firmwareVersions[device.FirmwareVersion] = true
+        }
+        g.endDeviceManager.DeviceMutex.RUnlock()
+    }
+    if len(firmwareVersions) == 0 {
+        firmwareVersions["v1.2.3"] = true // Default firmware for new devices
+    }
+    versions := make([]string, 0, len(firmwareVersions))
+    for version := range firmwareVersions {
+        versions = append(versions, version)
+    }
+    sort.Strings(versions)
+    
+    return map[string]interface{}{
+        "device_types":        supportedDeviceTypes,
+        "parameter_sets":      parameterSets,
+        "device_capabilities": deviceCapabilities,
+        "firmware_versions":   versions,
+        "command_types":       supportedCommandTypes(),
+        "heartbeat_schemas":   supportedHeartbeatSchemas,
+        "timestamp":           time.Now().Format(time.RFC3339),
+    }
 }
 
-// testBrokerConnectivity tests if the broker is accessible
-func testBrokerConnectivity() {
-    host := brokerAddress
-    port := "1883"
-    
-    if strings.Contains(brokerAddress, ":") {
-        parts := strings.Split(brokerAddress, ":")
-        host = parts[0]
-        if len(parts) > 1 {
-            port = parts[1]
+// sendCapabilities reports the gateway's capabilities to the backend, which
+// also registers the gateway with it
+func (g *Gateway) sendCapabilities() error {
+    var configMap map[string]interface{}
+    if config := g.getConfig(); config.YAML != "" {
+        if err := yaml.Unmarshal([]byte(config.YAML), &configMap); err != nil {
+            log.Printf("Error parsing configuration for capabilities: %v", err)
         }
+        configMap = normalizeYAMLMap(configMap)
     }
-    
-    // Try TCP connection to verify broker is reachable
-    address := fmt.Sprintf("%s:%s", host, port)
-    log.Printf("Testing TCP connectivity to MQTT broker at %s", address)
-    
-    conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+    payload := g.buildCapabilitiesPayload(configMap)
+    if cluster := clusterFromConfig(configMap); cluster != nil {
+        payload["cluster"] = cluster
+    }
+    resp, err := g.sendEventToAPI(g.gatewayID, "capabilities", payload)
     if err != nil {
-        log.Printf("WARNING: Cannot establish TCP connection to MQTT broker at %s: %v", address, err)
-        
-        // Print network configuration for debugging
-        printNetworkInfo()
-    } else {
-        conn.Close()
-        log.Printf("Successfully established TCP connection to MQTT broker at %s", address)
+        return err
+    }
+    atomic.StoreInt32(&g.registered, 1)
+    
+    // Adopt the heartbeat schema the backend asks for
+    if resp != nil && resp.HeartbeatSchema > 0 {
+        g.setNegotiatedHeartbeatSchema(resp.HeartbeatSchema)
     }
+    return nil
 }
 
-// checkCertificatePermissions checks certificates for correct permissions
-func checkCertificatePermissions() {
-    // Check certificate file
-    if certInfo, err := os.Stat(CertPath); err != nil {
-        log.Printf("Certificate file issue at %s: %v", CertPath, err)
-    } else {
-        mode := certInfo.Mode()
-        log.Printf("Certificate file exists with permissions: %v", mode)
+// registrationBackoff paces self-registration retries while the backend is unreachable
+var registrationBackoff = newRegistrationBackoffFromEnv()
+
+// newRegistrationBackoffFromEnv reads REGISTRATION_RETRY_INITIAL_SECONDS (default 2),
+// REGISTRATION_RETRY_MAX_SECONDS (default 60) and REGISTRATION_MAX_ATTEMPTS
+// (default 0, retry until the backend acknowledges)
+func newRegistrationBackoffFromEnv() BackoffPolicy {
+    policy := BackoffPolicy{Initial: 2 * time.Second, Max: 60 * time.Second, Multiplier: 2}
+    if seconds, err := strconv.ParseFloat(os.Getenv("REGISTRATION_RETRY_INITIAL_SECONDS"), 64); err == nil && seconds > 0 {
+        policy.Initial = time.Duration(seconds * float64(time.Second))
     }
-    
-    // Check key file
-    if keyInfo, err := os.Stat(KeyPath); err != nil {
-        log.Printf("Key file issue at %s: %v", KeyPath, err)
-    } else {
-        mode := keyInfo.Mode()
-        log.Printf("Key file exists with permissions: %v", mode)
+    if seconds, err := strconv.ParseFloat(os.Getenv("REGISTRATION_RETRY_MAX_SECONDS"), 64); err == nil && seconds > 0 {
+        policy.Max = time.Duration(seconds * float64(time.Second))
     }
+    if attempts, err := strconv.Atoi(os.Getenv("REGISTRATION_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+        policy.MaxRetries = attempts
+    }
+    if policy.Max < policy.Initial {
+        policy.Max = policy.Initial
+    }
+    return policy
 }
 
-// printNetworkInfo prints network configuration for debugging
-func printNetworkInfo() {
-    // Get interfaces
-    interfaces, err := net.Interfaces()
-    if err != nil {
-        log.Printf("Error getting network interfaces: %v", err)
-        return
+// isRegistered reports whether the backend has acknowledged the gateway
+func (g *Gateway) isRegistered() bool {
+    return atomic.LoadInt32(&g.registered) == 1
+}
+
+// registerWithBackend sends the capabilities event with backoff until the backend
+// acknowledges it, so the backend learns of the gateway even while MQTT is down.
+// It stops retrying once shutdown begins.
+func (g *Gateway) registerWithBackend() {
+    for attempt := 1; !g.isRegistered(); attempt++ {
+        err := g.sendCapabilities()
+        if err == nil {
+            log.Printf("Registered with backend after %d attempt(s)", attempt)
+            return
+        }
+        if registrationBackoff.MaxRetries > 0 && attempt >= registrationBackoff.MaxRetries {
+            log.Printf("Giving up on backend registration after %d attempts: %v", attempt, err)
+            return
+        }
+        delay := registrationBackoff.jittered(attempt)
+        log.Printf("Backend registration attempt %d failed: %v, retrying in %v", attempt, err, delay)
+        select {
+        case <-time.After(delay):
+        case <-g.shutdown:
+            log.Printf("Stopping backend registration: gateway is shutting down")
+            return
+        }
     }
-    
-    log.Printf("Network interfaces:")
-    for _, iface := range interfaces {
-        addrs, err := iface.Addrs()
-        if err != nil {
-            continue
+}
+
+// ClusterInfo places the gateway in a logical cluster (e.g. by region or customer)
+type ClusterInfo struct {
+    Name   string            `json:"name"`
+    Labels map[string]string `json:"labels,omitempty"`
+}
+
+// gatewayCluster returns the cluster from the stored configuration or the environment,
+// or nil if the gateway isn't in a cluster
+func (g *Gateway) gatewayCluster() *ClusterInfo {
+    var configMap map[string]interface{}
+    if config := g.getConfig(); config.YAML != "" {
+        if err := yaml.Unmarshal([]byte(config.YAML), &configMap); err == nil {
+            configMap = normalizeYAMLMap(configMap)
         }
-        
-        for _, addr := range addrs {
-            log.Printf("  Interface %s: %s", iface.Name, addr.String())
+    }
+    return clusterFromConfig(configMap)
+}
+
+// clusterFromConfig reads the config's "cluster" key, either a name or
+// {name, labels}, falling back to GATEWAY_CLUSTER and GATEWAY_CLUSTER_LABELS
+// ("region=eu-west,customer=acme")
+func clusterFromConfig(config map[string]interface{}) *ClusterInfo {
+    cluster := &ClusterInfo{Name: os.Getenv("GATEWAY_CLUSTER")}
+    for _, pair := range strings.Split(os.Getenv("GATEWAY_CLUSTER_LABELS"), ",") {
+        if key, value, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(key) != "" {
+            if cluster.Labels == nil {
+                cluster.Labels = make(map[string]string)
+            }
+            cluster.Labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
         }
     }
     
-    // Try to ping common Docker gateway addresses
-    log.Printf("Trying to ping common Docker addresses:")
-    hosts := []string{"172.28.1.2", "172.17.0.1", "172.17.0.2", "172.17.0.3"}
-    for _, host := range hosts {
-        cmd := exec.Command("ping", "-c", "1", "-W", "1", host)
-        if err := cmd.Run(); err == nil {
-            log.Printf("  Successfully pinged %s", host)
-        } else {
-            log.Printf("  Failed to ping %s", host)
+    switch value := config["cluster"].(type) {
+    case string:
+        cluster.Name = value
+    case map[string]interface{}:
+        if name, ok := value["name"].(string); ok {
+            cluster.Name = name
         }
+        if labels, ok := value["labels"].(map[string]interface{}); ok {
+            cluster.Labels = make(map[string]string, len(labels))
+            for key, label := range labels {
+                cluster.Labels[key] = fmt.Sprintf("%v", label)
+            }
+        }
+    }
+    
+    if cluster.Name == "" {
+        return nil
     }
+    return cluster
 }
 
-// handleMQTTMessage processes messages received on MQTT topics
-func handleMQTTMessage(msg mqtt.Message) {
-    topic := msg.Topic()
+// Heartbeat schema versions: 1 carries gateway fields only, 2 adds device statistics
+const (
+    HeartbeatSchemaBasic       = 1
+    HeartbeatSchemaDeviceStats = 2
+)
 
-    // Check for configuration-related topics
-    if strings.Contains(topic, "/config/update") {
-        // Try to extract update_id from message
-        var configData map[string]interface{}
-        if err := json.Unmarshal(msg.Payload(), &configData); err == nil {
-            if updateID, ok := configData["update_id"].(string); ok {
-                currentUpdateID = updateID
-                log.Printf("Extracted update_id from message: %s", currentUpdateID)
+// supportedHeartbeatSchemas is advertised in the capabilities event
+var supportedHeartbeatSchemas = []int{HeartbeatSchemaBasic, HeartbeatSchemaDeviceStats}
+
+// setNegotiatedHeartbeatSchema records the backend's heartbeat schema, capped at the newest supported
+func (g *Gateway) setNegotiatedHeartbeatSchema(schema int) {
+    if schema > HeartbeatSchemaDeviceStats {
+        schema = HeartbeatSchemaDeviceStats
+    }
+    atomic.StoreInt32(&g.negotiatedHeartbeatSchema, int32(schema))
+    log.Printf("Using heartbeat schema %d", schema)
+}
+
+// heartbeatSchema returns the heartbeat schema to send: the configuration's
+// heartbeat_schema if set, else the negotiated one, else the newest
+func (g *Gateway) heartbeatSchema() int {
+    if config := g.getConfig(); config.YAML != "" {
+        var configMap map[string]interface{}
+        if err := yaml.Unmarshal([]byte(config.YAML), &configMap); err == nil {
+            if schema, ok := toInt(configMap["heartbeat_schema"]); ok && schema > 0 {
+                return schema
             }
         }
-        eventChan <- Event{Type: EventConfigUpdate, Data: msg, Time: time.Now()}
-        return
     }
+    if schema := atomic.LoadInt32(&g.negotiatedHeartbeatSchema); schema > 0 {
+        return int(schema)
+    }
+    return HeartbeatSchemaDeviceStats
+}
 
-    // Parse message
-    var command map[string]interface{}
-    if err := json.Unmarshal(msg.Payload(), &command); err != nil {
-        log.Printf("Error parsing MQTT message: %v", err)
+// resetConnection disconnects from MQTT and reconnects if certificates are available
+func (g *Gateway) resetConnection() {
+    if g.isMqttConnected.Load() && g.mqttClient != nil {
+        g.mqttClient.Disconnect(250)
+    }
+    if g.hasCertificates.Load() {
+        if err := g.setupMQTTClient(); err != nil {
+            g.sendStatusUpdate("error", fmt.Sprintf("MQTT TLS setup failed: %v", err))
+        }
+    }
+}
+
+// sendHeartbeat sends a heartbeat to both MQTT and API
+func (g *Gateway) sendHeartbeat() {
+    heartbeatData := g.buildHeartbeatPayload(g.heartbeatSchema())
+    
+    // Convert to JSON for MQTT
+    jsonData, err := json.Marshal(heartbeatData)
+    if err != nil {
+        log.Printf("Error marshaling heartbeat data: %v", err)
         return
     }
     
-    // Check command type
-    if cmdType, ok := command["type"].(string); ok {
-        log.Printf("Received command type: %s", cmdType)
-        
-        switch cmdType {
-        case "acknowledge":
-            // Send certificate status and connection info
-            log.Printf("Sending acknowledge event as requested")
-            certInfo := map[string]interface{}{
-                "certificate_status": "installed",
-                "tls_enabled": hasCertificates,
-                "timestamp": time.Now().Format(time.RFC3339),
-            }
-            sendStatusUpdate("online", "Gateway online and ready", certInfo)
-            
-        case "reset":
-            // Backend wants us to reset connection
-            log.Printf("Resetting connection as requested")
-            if isMqttConnected && mqttClient != nil {
-                mqttClient.Disconnect(250)
-            }
-            if hasCertificates {
-                setupMQTTClient()
-            }
-            
-        case "delete":
-            // Backend wants to delete this gateway
-            log.Printf("Received delete command, shutting down")
-            // Send a final deletion notice
-            sendStatusUpdate("deleted", "Gateway received deletion command", map[string]interface{}{
-                "status": "deleted",
-            })
-            
-            // Allow time for message to be delivered
-            time.Sleep(500 * time.Millisecond)
-            
-            eventChan <- Event{Type: EventShutdown, Time: time.Now()}
+    // Send to MQTT
+    if g.isMqttConnected.Load() && g.mqttClient != nil {
+        topic := fmt.Sprintf("gateway/%s/heartbeat", g.gatewayID)
+        token := g.mqttClient.Publish(topic, publishQoS(), false, jsonData)
+        token.Wait()
+        if token.Error() != nil {
+            log.Printf("Error publishing heartbeat: %v", token.Error())
+        } else {
+            log.Printf("Published heartbeat to MQTT topic: %s", topic)
         }
     }
+    
+    // Send to API
+    g.sendEventToAPI(g.gatewayID, "heartbeat", heartbeatData)
 }
 
-// sendHeartbeat sends a heartbeat to both MQTT and API
-func sendHeartbeat() {
+// buildHeartbeatPayload assembles the heartbeat fields for a schema version
+func (g *Gateway) buildHeartbeatPayload(schema int) map[string]interface{} {
     timeStr := time.Now().Format(time.RFC3339)
     uptime := getUptime()
     
@@ -1945,7 +7016,7 @@ func sendHeartbeat() {
         "uptime": uptime,
         "memory": "75MB",
         "cpu": "5%",
-        "tls_enabled": fmt.Sprintf("%v", hasCertificates),
+        "tls_enabled": fmt.Sprintf("%v", g.hasCertificates.Load()),
         "status": "online",
         "certificate_status": map[string]string{
             "status": "installed",
@@ -1953,51 +7024,51 @@ func sendHeartbeat() {
         },
     }
     
+    // Older backends don't know the schema version or device statistics
+    if schema < HeartbeatSchemaDeviceStats {
+        return heartbeatData
+    }
+    heartbeatData["schema_version"] = schema
+    if cluster := g.gatewayCluster(); cluster != nil {
+        heartbeatData["cluster"] = cluster
+    }
+    
     // Add device statistics if available
-    if endDeviceManager != nil {
-        endDeviceManager.DeviceMutex.RLock()
-        heartbeatData["device_count"] = len(endDeviceManager.Devices)
+    if g.endDeviceManager != nil {
+        g.endDeviceManager.DeviceMutex.RLock()
+        heartbeatData["device_count"] = len(g.endDeviceManager.Devices)
         
         // Count total measurements
         totalMeasurements := 0
         totalWeight := 0.0
-        for _, device := range endDeviceManager.Devices {
+        statuses := make(map[string]int)
+        for _, device := range g.endDeviceManager.Devices {
             totalMeasurements += device.MeasurementCount
             totalWeight += device.TotalWeightMeasured
+            statuses[device.Status]++
         }
         heartbeatData["total_measurements"] = totalMeasurements
         heartbeatData["total_weight_kg"] = math.Round(totalWeight*100) / 100
+        heartbeatData["device_statuses"] = statuses
         
-        endDeviceManager.DeviceMutex.RUnlock()
-    }
-    
-    // Convert to JSON for MQTT
-    jsonData, err := json.Marshal(heartbeatData)
-    if err != nil {
-        log.Printf("Error marshaling heartbeat data: %v", err)
-        return
-    }
-    
-    // Send to MQTT
-    if isMqttConnected && mqttClient != nil {
-        topic := fmt.Sprintf("gateway/%s/heartbeat", gatewayID)
-        token := mqttClient.Publish(topic, 0, false, jsonData)
-        token.Wait()
-        log.Printf("Published heartbeat to MQTT topic: %s", topic)
+        g.endDeviceManager.DeviceMutex.RUnlock()
     }
     
-    // Send to API
-    sendEventToAPI(gatewayID, "heartbeat", heartbeatData)
+    return heartbeatData
 }
 
 // sendStatusUpdate sends a status update to the API
-func sendStatusUpdate(status string, message string, additionalData ...map[string]interface{}) {
+func (g *Gateway) sendStatusUpdate(status string, message string, additionalData ...map[string]interface{}) {
     payload := map[string]interface{}{
         "status": status,
         "message": message,
         "timestamp": time.Now().Format(time.RFC3339),
     }
 
+    if cluster := g.gatewayCluster(); cluster != nil {
+        payload["cluster"] = cluster
+    }
+
     // Merge additional data if provided
     if len(additionalData) > 0 && additionalData[0] != nil {
         for k, v := range additionalData[0] {
@@ -2005,14 +7076,15 @@ func sendStatusUpdate(status string, message string, additionalData ...map[strin
         }
     }
 
-    // In AWS mode, publish status to MQTT (AWS IoT Rules will handle it)
-    if isAWSEnvironment() && isMqttConnected && mqttClient != nil {
+    // In AWS mode, publish status to MQTT (AWS IoT Rules will handle it), retained
+    // so the latest status replaces the Last Will
+    if g.isAWSEnvironment() && g.isMqttConnected.Load() && g.mqttClient != nil {
         jsonData, err := json.Marshal(payload)
         if err != nil {
             log.Printf("Error marshaling status update: %v", err)
         } else {
-            topic := fmt.Sprintf("gateway/%s/status", gatewayID)
-            token := mqttClient.Publish(topic, 0, false, jsonData)
+            topic := fmt.Sprintf("gateway/%s/status", g.gatewayID)
+            token := g.mqttClient.Publish(topic, 1, true, jsonData)
             token.Wait()
             if token.Error() != nil {
                 log.Printf("Error publishing status update: %v", token.Error())
@@ -2022,8 +7094,53 @@ func sendStatusUpdate(status string, message string, additionalData ...map[strin
         }
     }
 
+    // Publish to the severity-based status hierarchy
+    g.publishStatusLevel(status, payload)
+
     // For local mode, send to API via HTTP
-    sendEventToAPI(gatewayID, "status", payload)
+    g.sendEventToAPI(g.gatewayID, "status", payload)
+}
+
+// statusLevels maps gateway status strings to severity levels
+var statusLevels = map[string]string{
+    "online":            "info",
+    "connected":         "info",
+    "certificate_found": "info",
+    "shutdown":          "warning",
+    "disconnected":      "warning",
+    "deleted":           "warning",
+    "error":             "error",
+    "failed":            "error",
+}
+
+// statusLevel returns the severity level for a status, defaulting to info
+func statusLevel(status string) string {
+    if level, ok := statusLevels[status]; ok {
+        return level
+    }
+    return "info"
+}
+
+// publishStatusLevel publishes a status to gateway/<id>/status/<level>, retaining the latest
+func (g *Gateway) publishStatusLevel(status string, payload map[string]interface{}) {
+    if !g.isMqttConnected.Load() || g.mqttClient == nil {
+        return
+    }
+
+    jsonData, err := json.Marshal(payload)
+    if err != nil {
+        log.Printf("Error marshaling status update: %v", err)
+        return
+    }
+
+    topic := fmt.Sprintf("gateway/%s/status/%s", g.gatewayID, statusLevel(status))
+    token := g.mqttClient.Publish(topic, 0, true, jsonData)
+    token.Wait()
+    if token.Error() != nil {
+        log.Printf("Error publishing status to %s: %v", topic, token.Error())
+    } else {
+        log.Printf("Published status '%s' to MQTT topic: %s", status, topic)
+    }
 }
 
 // GatewayInfo represents information about a gateway from API responses
@@ -2035,15 +7152,122 @@ type GatewayInfo struct {
 
 // ApiResponse represents a response from the API
 type ApiResponse struct {
-    Status  string     `json:"status"`
-    Gateway GatewayInfo `json:"gateway"`
+    Status     string         `json:"status"`
+    Gateway    GatewayInfo    `json:"gateway"`
+    Directives []ApiDirective `json:"directives,omitempty"`
+    
+    // Heartbeat schema the backend expects, returned for capabilities events
+    HeartbeatSchema int `json:"heartbeat_schema,omitempty"`
+}
+
+// ApiDirective is an instruction the backend embeds in an API response
+type ApiDirective struct {
+    Type            string  `json:"type"`                       // reset, request_config, adjust_heartbeat_interval
+    IntervalSeconds float64 `json:"interval_seconds,omitempty"` // For adjust_heartbeat_interval
+}
+
+// Supported API response directives
+const (
+    DirectiveReset                   = "reset"
+    DirectiveRequestConfig           = "request_config"
+    DirectiveAdjustHeartbeatInterval = "adjust_heartbeat_interval"
+)
+
+// dispatchAPIDirectives forwards supported directives from an API response into the event loop
+func (g *Gateway) dispatchAPIDirectives(directives []ApiDirective) {
+    for _, directive := range directives {
+        switch directive.Type {
+        case DirectiveReset, DirectiveRequestConfig, DirectiveAdjustHeartbeatInterval:
+            // Don't block: sendEventToAPI may be running inside the event loop itself
+            select {
+            case g.eventChan <- Event{Type: EventAPIDirective, Data: directive, Time: time.Now()}:
+                log.Printf("Queued API directive: %s", directive.Type)
+            default:
+                log.Printf("Event queue full, dropping API directive: %s", directive.Type)
+            }
+        default:
+            log.Printf("Ignoring unsupported API directive: %s", directive.Type)
+        }
+    }
+}
+
+// handleAPIDirective executes a directive received from the API
+func (g *Gateway) handleAPIDirective(directive ApiDirective) {
+    log.Printf("Handling API directive: %s", directive.Type)
+    
+    switch directive.Type {
+    case DirectiveReset:
+        g.resetConnection()
+    case DirectiveRequestConfig:
+        g.requestConfig()
+    case DirectiveAdjustHeartbeatInterval:
+        if directive.IntervalSeconds <= 0 {
+            log.Printf("Ignoring invalid heartbeat interval: %v", directive.IntervalSeconds)
+            return
+        }
+        interval := time.Duration(directive.IntervalSeconds * float64(time.Second))
+        select {
+        case g.heartbeatIntervalChan <- interval:
+        default:
+            log.Printf("Heartbeat interval change already pending, dropping %v", interval)
+        }
+    }
+}
+
+// apiLimiter bounds the number of concurrent outbound requests, either queuing
+// callers until a slot frees up or dropping the request when saturated
+type apiLimiter struct {
+    slots chan struct{}
+    drop  bool
+}
+
+// apiRequestLimiter limits API posts and forwarded measurements (nil = unlimited)
+var apiRequestLimiter = newAPILimiterFromEnv()
+
+// newAPILimiterFromEnv reads API_MAX_CONCURRENT_REQUESTS (0 or unset = unlimited) and
+// API_CONCURRENCY_POLICY ("queue", the default, or "drop")
+func newAPILimiterFromEnv() *apiLimiter {
+    limit, err := strconv.Atoi(os.Getenv("API_MAX_CONCURRENT_REQUESTS"))
+    if err != nil || limit <= 0 {
+        return nil
+    }
+    return newAPILimiter(limit, os.Getenv("API_CONCURRENCY_POLICY") == "drop")
+}
+
+// newAPILimiter creates a limiter allowing limit concurrent requests
+func newAPILimiter(limit int, drop bool) *apiLimiter {
+    return &apiLimiter{slots: make(chan struct{}, limit), drop: drop}
+}
+
+// acquire takes a request slot, returning false if the request should be dropped
+func (l *apiLimiter) acquire() bool {
+    if l == nil {
+        return true
+    }
+    if l.drop {
+        select {
+        case l.slots <- struct{}{}:
+            return true
+        default:
+            return false
+        }
+    }
+    l.slots <- struct{}{}
+    return true
+}
+
+// release frees a slot taken by acquire
+func (l *apiLimiter) release() {
+    if l != nil {
+        <-l.slots
+    }
 }
 
 // sendEventToAPI sends an event to the API
-func sendEventToAPI(gatewayID string, eventType string, payload interface{}) (*ApiResponse, error) {
+func (g *Gateway) sendEventToAPI(gatewayID string, eventType string, payload interface{}) (*ApiResponse, error) {
     // In AWS, all events flow through MQTT → IoT Rules → Step Functions
     // HTTP calls to API are not needed (and no API endpoint exists for gateway events)
-    if isAWSEnvironment() {
+    if g.isAWSEnvironment() {
         log.Printf("AWS environment: %s event sent via MQTT topic only", eventType)
         return nil, nil
     }
@@ -2051,13 +7275,8 @@ func sendEventToAPI(gatewayID string, eventType string, payload interface{}) (*A
     // Local environment: send HTTP request to FastAPI backend
     apiURL := setupApiUrl()
 
-    // Create event
-    event := MQTTEvent{
-        GatewayID: gatewayID,
-        EventType: eventType,
-        Payload:   payload,
-        Timestamp: time.Now().Format(time.RFC3339),
-    }
+    // Create event in the body format the backend expects
+    event := buildAPIEventBody(gatewayID, eventType, payload, time.Now().Format(time.RFC3339))
 
     // Convert to JSON
     jsonData, err := json.Marshal(event)
@@ -2066,6 +7285,13 @@ func sendEventToAPI(gatewayID string, eventType string, payload interface{}) (*A
         return nil, err
     }
 
+    // Bound concurrent requests to the backend
+    if !apiRequestLimiter.acquire() {
+        log.Printf("API concurrency limit reached, dropping %s event", eventType)
+        return nil, fmt.Errorf("API concurrency limit reached")
+    }
+    defer apiRequestLimiter.release()
+    
     // Send to API
     url := fmt.Sprintf("%s/api/mqtt/events", apiURL)
     log.Printf("Sending %s event to API: %s", eventType, url)
@@ -2088,6 +7314,7 @@ func sendEventToAPI(gatewayID string, eventType string, payload interface{}) (*A
         // Parse response body
         var apiResp ApiResponse
         if err := json.NewDecoder(resp.Body).Decode(&apiResp); err == nil {
+            g.dispatchAPIDirectives(apiResp.Directives)
             return &apiResp, nil
         } else {
             log.Printf("Warning: Could not parse API response: %v", err)
@@ -2101,6 +7328,84 @@ func sendEventToAPI(gatewayID string, eventType string, payload interface{}) (*A
     }
 }
 
+// buildAPIEventBody shapes an API event according to API_EVENT_FORMAT:
+// "envelope" (default MQTTEvent), "flat" (payload fields at the top level) or
+// "template" (JSON from API_EVENT_TEMPLATE with {gateway_id}, {event_type},
+// {timestamp} and {payload} placeholders)
+func buildAPIEventBody(gatewayID string, eventType string, payload interface{}, timestamp string) interface{} {
+    switch os.Getenv("API_EVENT_FORMAT") {
+    case "flat":
+        body := map[string]interface{}{}
+        if fields, ok := payload.(map[string]interface{}); ok {
+            for k, v := range fields {
+                body[k] = v
+            }
+        } else if payload != nil {
+            body["payload"] = payload
+        }
+        body["gateway_id"] = gatewayID
+        body["event_type"] = eventType
+        if _, ok := body["timestamp"]; !ok {
+            body["timestamp"] = timestamp
+        }
+        return body
+        
+    case "template":
+        var template interface{}
+        if err := json.Unmarshal([]byte(os.Getenv("API_EVENT_TEMPLATE")), &template); err != nil {
+            log.Printf("Invalid API_EVENT_TEMPLATE, using default envelope: %v", err)
+            break
+        }
+        values := map[string]interface{}{
+            "gateway_id": gatewayID,
+            "event_type": eventType,
+            "timestamp":  timestamp,
+            "payload":    payload,
+        }
+        return renderEventTemplate(template, values)
+    }
+    
+    return MQTTEvent{
+        GatewayID: gatewayID,
+        EventType: eventType,
+        Payload:   payload,
+        Timestamp: timestamp,
+    }
+}
+
+// renderEventTemplate replaces {name} placeholders in a decoded JSON template.
+// A string that is exactly a placeholder is replaced by the value itself.
+func renderEventTemplate(template interface{}, values map[string]interface{}) interface{} {
+    switch t := template.(type) {
+    case map[string]interface{}:
+        result := make(map[string]interface{}, len(t))
+        for k, v := range t {
+            result[k] = renderEventTemplate(v, values)
+        }
+        return result
+    case []interface{}:
+        result := make([]interface{}, len(t))
+        for i, v := range t {
+            result[i] = renderEventTemplate(v, values)
+        }
+        return result
+    case string:
+        if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+            if value, ok := values[t[1:len(t)-1]]; ok {
+                return value
+            }
+        }
+        for name, value := range values {
+            if str, ok := value.(string); ok {
+                t = strings.ReplaceAll(t, "{"+name+"}", str)
+            }
+        }
+        return t
+    default:
+        return template
+    }
+}
+
 // getUptime returns the uptime as a string
 func getUptime() string {
     uptime := os.Getenv("UPTIME")
@@ -2111,9 +7416,45 @@ func getUptime() string {
 }
 
 // isAWSEnvironment detects if running in AWS environment
-func isAWSEnvironment() bool {
+func (g *Gateway) isAWSEnvironment() bool {
     // AWS IoT Core endpoints always contain "amazonaws.com"
-    return strings.Contains(brokerAddress, "amazonaws.com")
+    return strings.Contains(g.brokerAddress, "amazonaws.com")
+}
+
+// toFloat64 converts a YAML/JSON decoded number, or a numeric string, to float64
+func toFloat64(value interface{}) (float64, bool) {
+    switch v := value.(type) {
+    case float64:
+        return v, true
+    case float32:
+        return float64(v), true
+    case int:
+        return float64(v), true
+    case int64:
+        return float64(v), true
+    case int32:
+        return float64(v), true
+    case uint64:
+        return float64(v), true
+    case json.Number:
+        f, err := v.Float64()
+        return f, err == nil
+    case string:
+        f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+        return f, err == nil
+    default:
+        return 0, false
+    }
+}
+
+// toInt converts a YAML/JSON decoded number, or a numeric string, to int,
+// rounding fractional values
+func toInt(value interface{}) (int, bool) {
+    f, ok := toFloat64(value)
+    if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+        return 0, false
+    }
+    return int(math.Round(f)), true
 }
 
 // min returns the minimum of two integers
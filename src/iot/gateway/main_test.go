@@ -0,0 +1,3978 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    mqtt "github.com/eclipse/paho.mqtt.golang"
+    "gopkg.in/yaml.v3"
+)
+
+// mockToken is a completed mqtt.Token
+type mockToken struct {
+    err error
+}
+
+func (t *mockToken) Wait() bool                     { return true }
+func (t *mockToken) WaitTimeout(time.Duration) bool { return true }
+func (t *mockToken) Done() <-chan struct{} {
+    ch := make(chan struct{})
+    close(ch)
+    return ch
+}
+func (t *mockToken) Error() error { return t.err }
+
+// publishedMessage records a single Publish call
+type publishedMessage struct {
+    Topic   string
+    QoS     byte
+    Retain  bool
+    Payload []byte
+}
+
+// mockClient is an in-memory mqtt.Client that records published messages and subscriptions
+type mockClient struct {
+    mu            sync.Mutex
+    connected     bool
+    published     []publishedMessage
+    publishErr    error
+    failPublishes int // Number of upcoming publishes that fail with errPublishFailed
+    subscriptions map[string]mqtt.MessageHandler
+}
+
+var errPublishFailed = errors.New("publish failed")
+
+func newMockClient() *mockClient {
+    return &mockClient{connected: true, subscriptions: make(map[string]mqtt.MessageHandler)}
+}
+
+func (c *mockClient) IsConnected() bool      { return c.connected }
+func (c *mockClient) IsConnectionOpen() bool { return c.connected }
+func (c *mockClient) Connect() mqtt.Token    { c.connected = true; return &mockToken{} }
+func (c *mockClient) Disconnect(uint)        { c.connected = false }
+
+func (c *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    var data []byte
+    switch p := payload.(type) {
+    case []byte:
+        data = p
+    case string:
+        data = []byte(p)
+    }
+    c.published = append(c.published, publishedMessage{Topic: topic, QoS: qos, Retain: retained, Payload: data})
+    if c.failPublishes > 0 {
+        c.failPublishes--
+        return &mockToken{err: errPublishFailed}
+    }
+    return &mockToken{err: c.publishErr}
+}
+
+func (c *mockClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.subscriptions[topic] = callback
+    return &mockToken{}
+}
+
+func (c *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+    return &mockToken{}
+}
+
+func (c *mockClient) Unsubscribe(topics ...string) mqtt.Token {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, topic := range topics {
+        delete(c.subscriptions, topic)
+    }
+    return &mockToken{}
+}
+
+// deliver passes a message to the handler subscribed to topic, reporting whether one exists
+func (c *mockClient) deliver(topic string, payload []byte) bool {
+    c.mu.Lock()
+    handler := c.subscriptions[topic]
+    c.mu.Unlock()
+    if handler == nil {
+        return false
+    }
+    handler(c, &mockMessage{topic: topic, payload: payload})
+    return true
+}
+
+func (c *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+
+func (c *mockClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+func (c *mockClient) messages() []publishedMessage {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return append([]publishedMessage(nil), c.published...)
+}
+
+// mockMessage is a minimal mqtt.Message
+type mockMessage struct {
+    topic   string
+    payload []byte
+}
+
+func (m *mockMessage) Duplicate() bool   { return false }
+func (m *mockMessage) Qos() byte         { return 1 }
+func (m *mockMessage) Retained() bool    { return false }
+func (m *mockMessage) Topic() string     { return m.topic }
+func (m *mockMessage) MessageID() uint16 { return 1 }
+func (m *mockMessage) Payload() []byte   { return m.payload }
+func (m *mockMessage) Ack()              {}
+
+// newTestDevice builds a device with a fixed measurement range and no running simulation
+func newTestDevice(id string, parameterSet string) *ConfiguredEndDevice {
+    return &ConfiguredEndDevice{
+        ID:             id,
+        GatewayID:      "gw-test",
+        Type:           "scale",
+        Status:         "online",
+        StopChan:       make(chan bool),
+        Capabilities:   make(map[string]bool),
+        DiagnosticInfo: make(map[string]interface{}),
+        ConfigVersion:  "testver1",
+        DeviceConfig: map[string]interface{}{
+            "measurement": map[string]interface{}{
+                "min_weight_kg": 10.0,
+                "max_weight_kg": 10.0,
+                "precision":     0.1,
+            },
+            "active_parameter_set": parameterSet,
+        },
+    }
+}
+
+func weightOf(t *testing.T, measurement map[string]interface{}) float64 {
+    t.Helper()
+    payload, ok := measurement["payload"].(map[string]interface{})
+    if !ok {
+        t.Fatalf("measurement has no payload: %v", measurement)
+    }
+    weight, ok := payload["weight_kg"].(float64)
+    if !ok {
+        t.Fatalf("measurement has no weight_kg: %v", payload)
+    }
+    return weight
+}
+
+func TestTriggerAnomalyAffectsDeviceGroup(t *testing.T) {
+    dm := NewDeviceManager(NewGateway())
+    dm.Devices["scale-gw-1"] = newTestDevice("scale-gw-1", "waste")
+    dm.Devices["scale-gw-2"] = newTestDevice("scale-gw-2", "waste")
+    dm.Devices["scale-gw-3"] = newTestDevice("scale-gw-3", "recyclables")
+
+    dm.loadAnomalies(map[string]interface{}{
+        "anomalies": []interface{}{
+            map[string]interface{}{
+                "name":              "site_spike",
+                "group":             map[string]interface{}{"parameter_set": "waste"},
+                "weight_multiplier": 3,
+                "weight_offset":     5.0,
+                "duration_seconds":  30,
+            },
+        },
+    })
+
+    now := time.Now()
+    affected, err := dm.TriggerAnomaly("site_spike", now)
+    if err != nil {
+        t.Fatalf("TriggerAnomaly returned error: %v", err)
+    }
+    if affected != 2 {
+        t.Fatalf("expected 2 affected devices, got %d", affected)
+    }
+
+    for _, id := range []string{"scale-gw-1", "scale-gw-2"} {
+        if got := weightOf(t, dm.Devices[id].generateMeasurement()); got != 35.0 {
+            t.Errorf("device %s: expected anomalous weight 35.0, got %v", id, got)
+        }
+    }
+    if got := weightOf(t, dm.Devices["scale-gw-3"].generateMeasurement()); got != 10.0 {
+        t.Errorf("device outside group should be unaffected, got %v", got)
+    }
+
+    // Once the window has passed the devices return to normal
+    if shift := dm.Devices["scale-gw-1"].activeAnomaly(now.Add(31 * time.Second)); shift != nil {
+        t.Errorf("expected anomaly to expire after its window")
+    }
+}
+
+func TestAnomalyScheduleTriggersOncePerSlot(t *testing.T) {
+    dm := NewDeviceManager(NewGateway())
+    dm.Devices["scale-gw-1"] = newTestDevice("scale-gw-1", "waste")
+    dm.loadAnomalies(map[string]interface{}{
+        "anomalies": []interface{}{
+            map[string]interface{}{
+                "name":             "nightly",
+                "duration_seconds": 60,
+                "schedule":         []interface{}{"02:30"},
+            },
+        },
+    })
+
+    at := time.Date(2026, 1, 1, 2, 30, 10, 0, time.Local)
+    dm.checkAnomalySchedule(at)
+    first := dm.Devices["scale-gw-1"].activeAnomaly(at)
+    if first == nil {
+        t.Fatalf("expected scheduled anomaly to be active")
+    }
+
+    dm.checkAnomalySchedule(at.Add(20 * time.Second))
+    if again := dm.Devices["scale-gw-1"].activeAnomaly(at); again.Until != first.Until {
+        t.Errorf("scheduled anomaly should only trigger once per slot")
+    }
+}
+
+// useTestAPI points API calls at a local test server for the duration of the test
+func useTestAPI(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+    t.Helper()
+    if handler == nil {
+        handler = func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(http.StatusOK)
+            w.Write([]byte(`{"status":"ok"}`))
+        }
+    }
+    server := httptest.NewServer(handler)
+    t.Cleanup(server.Close)
+    t.Setenv("API_URL", server.URL)
+    return server
+}
+
+// newTestGateway creates a gateway connected through a mock MQTT client
+func newTestGateway() (*Gateway, *mockClient) {
+    client := newMockClient()
+    g := NewGateway()
+    g.gatewayID = "gw-test"
+    g.mqttClient = client
+    g.isMqttConnected.Store(true)
+    return g, client
+}
+
+func TestSendStatusUpdatePublishesErrorLevelRetained(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+
+    g.sendStatusUpdate("error", "Something broke")
+
+    var found *publishedMessage
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/status/error" {
+            m := msg
+            found = &m
+        }
+    }
+    if found == nil {
+        t.Fatalf("expected publish to error status subtopic, got %+v", client.messages())
+    }
+    if !found.Retain {
+        t.Errorf("expected status level publish to be retained")
+    }
+    if statusLevel("connected") != "info" || statusLevel("shutdown") != "warning" {
+        t.Errorf("unexpected status level mapping")
+    }
+}
+
+func TestFirmwareGatedCapabilitiesAndParameterSets(t *testing.T) {
+    config := map[string]interface{}{
+        "parameter_sets": map[string]interface{}{
+            "airline": map[string]interface{}{"min_firmware": "v2.0.0"},
+            "waste":   map[string]interface{}{},
+        },
+        "devices": map[string]interface{}{
+            "parameter_set_mappings": map[string]interface{}{
+                "scale-gw-1": "airline",
+            },
+            "capabilities": map[string]interface{}{
+                "tare":             map[string]interface{}{"min_firmware": "v1.3.0"},
+                "auto_calibration": map[string]interface{}{"min_firmware": "1.2"},
+                "display":          true,
+            },
+        },
+    }
+
+    capabilities := resolveCapabilities("scale-gw-1", "v1.2.3", config)
+    if capabilities["tare"] {
+        t.Errorf("device below min_firmware should not receive gated capability")
+    }
+    if !capabilities["auto_calibration"] || !capabilities["display"] {
+        t.Errorf("expected ungated capabilities to be enabled, got %v", capabilities)
+    }
+
+    deviceConfig := getDeviceConfig("scale-gw-1", "scale", "v1.2.3", config)
+    if got := deviceConfig["active_parameter_set"]; got != "waste" {
+        t.Errorf("expected fallback to waste for old firmware, got %v", got)
+    }
+    deviceConfig = getDeviceConfig("scale-gw-1", "scale", "v2.1.0", config)
+    if got := deviceConfig["active_parameter_set"]; got != "airline" {
+        t.Errorf("expected airline for new firmware, got %v", got)
+    }
+}
+
+func TestCompareVersions(t *testing.T) {
+    cases := []struct {
+        a, b string
+        want int
+    }{
+        {"v1.2.3", "v1.2.3", 0},
+        {"v1.2.3", "1.3", -1},
+        {"v1.10.0", "v1.9.9", 1},
+        {"v2.0.0-beta", "v2.0", 0},
+    }
+    for _, c := range cases {
+        if got := compareVersions(c.a, c.b); got != c.want {
+            t.Errorf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+        }
+    }
+}
+
+func TestAPIResponseDirectiveTriggersEvent(t *testing.T) {
+    g := NewGateway()
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(`{"status":"ok","directives":[{"type":"request_config"},{"type":"unknown"}]}`))
+    })
+
+    resp, err := g.sendEventToAPI("gw-test", "heartbeat", map[string]interface{}{})
+    if err != nil || resp == nil {
+        t.Fatalf("sendEventToAPI failed: %v", err)
+    }
+
+    select {
+    case event := <-g.eventChan:
+        directive, ok := event.Data.(ApiDirective)
+        if event.Type != EventAPIDirective || !ok || directive.Type != DirectiveRequestConfig {
+            t.Fatalf("expected request_config directive event, got %+v", event)
+        }
+    case <-time.After(time.Second):
+        t.Fatalf("expected directive event to be queued")
+    }
+
+    select {
+    case event := <-g.eventChan:
+        t.Fatalf("unsupported directive should not be queued, got %+v", event)
+    default:
+    }
+}
+
+func TestAdjustHeartbeatIntervalDirective(t *testing.T) {
+    g := NewGateway()
+    g.handleAPIDirective(ApiDirective{Type: DirectiveAdjustHeartbeatInterval, IntervalSeconds: 30})
+    select {
+    case interval := <-g.heartbeatIntervalChan:
+        if interval != 30*time.Second {
+            t.Fatalf("expected 30s heartbeat interval, got %v", interval)
+        }
+    default:
+        t.Fatalf("expected heartbeat interval change to be queued")
+    }
+}
+
+const danglingMappingConfig = `
+parameter_sets:
+  waste:
+    required_parameters: []
+devices:
+  count: 1
+  parameter_set_mappings:
+    scale-gw-1: wastee
+`
+
+func TestValidateParameterSetReferencesFindsDanglingMapping(t *testing.T) {
+    var configMap map[string]interface{}
+    if err := yaml.Unmarshal([]byte(danglingMappingConfig), &configMap); err != nil {
+        t.Fatalf("failed to parse config: %v", err)
+    }
+    problems := validateParameterSetReferences(configMap)
+    if len(problems) != 1 || !strings.Contains(problems[0], "wastee") {
+        t.Fatalf("expected one problem naming the missing set, got %v", problems)
+    }
+}
+
+func TestStoreConfigStrictRejectsDanglingMapping(t *testing.T) {
+    g := NewGateway()
+    g.currentConfig = Config{YAML: "devices: {count: 1}"}
+
+    t.Setenv("CONFIG_STRICT_VALIDATION", "true")
+    g.storeConfig(danglingMappingConfig)
+    if g.getConfig().YAML != "devices: {count: 1}" {
+        t.Fatalf("strict validation should keep the previous config")
+    }
+
+    t.Setenv("CONFIG_STRICT_VALIDATION", "false")
+    g.storeConfig(danglingMappingConfig)
+    if g.getConfig().YAML != danglingMappingConfig {
+        t.Fatalf("non-strict validation should store the config with warnings")
+    }
+}
+
+func TestInvalidConfigsAreRejectedAndAcknowledged(t *testing.T) {
+    useTestAPI(t, nil)
+    const previous = "parameter_sets: {waste: {}}\ndevices: {count: 1}\n"
+    cases := map[string]struct {
+        config string
+        strict bool
+        want   string
+    }{
+        "missing devices":        {"parameter_sets: {waste: {}}\n", false, "missing devices section"},
+        "missing parameter sets": {"devices: {count: 2}\n", false, "missing parameter_sets section"},
+        "devices not a mapping":  {"parameter_sets: {}\ndevices: 3\n", false, "devices must be a mapping"},
+        "inverted weight bounds": {"parameter_sets: {}\ndevices: {}\nmeasurement: {min_weight_kg: 50, max_weight_kg: 5}\n", false, "min_weight_kg (50) must be below max_weight_kg (5)"},
+        "zero precision":         {"parameter_sets: {}\ndevices: {}\nmeasurement: {precision: 0}\n", false, "precision must be positive"},
+        "invalid yaml":           {"devices: [unclosed\n", false, "invalid YAML"},
+        "dangling mapping":       {danglingMappingConfig, true, `unknown parameter set "wastee"`},
+    }
+    for name, c := range cases {
+        t.Run(name, func(t *testing.T) {
+            t.Setenv("CONFIG_STRICT_VALIDATION", fmt.Sprint(c.strict))
+            g, client := newTestGateway()
+            g.currentConfig = Config{YAML: previous}
+
+            g.handleEvent(Event{Type: EventConfigUpdate, Data: &mockMessage{topic: "gateway/gw-test/config/update", payload: []byte(c.config)}})
+            g.configAcks.Wait()
+
+            if g.getConfig().YAML != previous {
+                t.Errorf("expected the previous config to be kept, got %q", g.getConfig().YAML)
+            }
+            var ack map[string]interface{}
+            for _, msg := range client.messages() {
+                if msg.Topic == "gateway/gw-test/config/delivered" {
+                    json.Unmarshal(msg.Payload, &ack)
+                }
+            }
+            if ack["status"] != "rejected" || !strings.Contains(fmt.Sprint(ack["error"]), c.want) {
+                t.Errorf("expected a rejected ack mentioning %q, got %v", c.want, ack)
+            }
+            if ack["config_version"] != configVersionHash(previous) {
+                t.Errorf("expected the ack to report the version still in use, got %v", ack["config_version"])
+            }
+        })
+    }
+
+    // A valid config is stored and acknowledged as before
+    g, client := newTestGateway()
+    valid := "parameter_sets: {waste: {}}\ndevices: {count: 1}\nmeasurement: {min_weight_kg: 1, max_weight_kg: 5, precision: 0.1}\n"
+    g.handleEvent(Event{Type: EventConfigUpdate, Data: &mockMessage{topic: "gateway/gw-test/config/update", payload: []byte(valid)}})
+    g.configAcks.Wait()
+    if g.getConfig().YAML != valid {
+        t.Errorf("expected the valid config to be stored")
+    }
+    messages := client.messages()
+    if len(messages) == 0 || !strings.Contains(string(messages[len(messages)-1].Payload), `"status":"success"`) {
+        t.Errorf("expected a success ack, got %v", messages)
+    }
+}
+
+func TestRejectedUpdateIsAcknowledgedUnderItsOwnID(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    update := func(updateID string, yamlConfig string) map[string]interface{} {
+        payload, _ := json.Marshal(map[string]interface{}{"update_id": updateID, "yaml_config": yamlConfig})
+        g.handleMQTTMessage(&mockMessage{topic: "gateway/gw-test/config/update", payload: payload})
+        g.handleEvent(<-g.eventChan)
+        g.configAcks.Wait()
+        var ack map[string]interface{}
+        messages := client.messages()
+        json.Unmarshal(messages[len(messages)-1].Payload, &ack)
+        return ack
+    }
+
+    if ack := update("update-1", "parameter_sets: {}\ndevices: {count: 1}\n"); ack["status"] != "success" || ack["update_id"] != "update-1" {
+        t.Fatalf("expected update-1 to be accepted, got %v", ack)
+    }
+    if ack := update("update-2", "devices: {count: 1}\n"); ack["status"] != "rejected" || ack["update_id"] != "update-2" {
+        t.Errorf("expected update-2 to be rejected under its own id, got %v", ack)
+    }
+    if g.currentUpdateID != "update-1" {
+        t.Errorf("expected the rejected update not to replace the current one, got %s", g.currentUpdateID)
+    }
+}
+
+func TestPartiallyAppliedConfigIsReportedInAck(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    for _, id := range []string{"scale-gw-1", "scale-gw-2"} {
+        device := newTestDevice(id, "waste")
+        dm.Devices[id] = device
+    }
+    g.endDeviceManager = dm
+
+    // scale-gw-2 is mapped to a set that doesn't exist, so only scale-gw-1 takes the config
+    config := `
+parameter_sets:
+  waste:
+    required_parameters: []
+devices:
+  count: 2
+  parameter_set_mappings:
+    scale-gw-1: waste
+    scale-gw-2: wastee
+`
+    g.handleEvent(Event{Type: EventConfigUpdate, Data: &mockMessage{topic: "gateway/gw-test/config/update", payload: []byte(config)}})
+    g.configAcks.Wait()
+
+    var ack map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/config/delivered" {
+            json.Unmarshal(msg.Payload, &ack)
+        }
+    }
+    if ack["status"] != "partial_failure" {
+        t.Fatalf("expected a partial_failure ack, got %v", ack)
+    }
+    if ack["config_version"] != configVersionHash(config) {
+        t.Errorf("expected the new config version, got %v", ack["config_version"])
+    }
+    if ack["devices_total"] != 2.0 || ack["devices_updated"] != 1.0 || ack["devices_failed"] != 1.0 {
+        t.Errorf("expected 1 of 2 devices updated and 1 failed, got %v", ack)
+    }
+    deviceErrors, _ := ack["device_errors"].(map[string]interface{})
+    if len(deviceErrors) != 1 || !strings.Contains(fmt.Sprint(deviceErrors["scale-gw-2"]), "wastee") {
+        t.Errorf("expected only scale-gw-2 to be reported, got %v", ack["device_errors"])
+    }
+}
+
+func TestRollbackConfigRestoresPreviousVersion(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+    g.endDeviceManager = dm
+    g.currentUpdateID = "update-2"
+
+    // A narrow range at whole-kg precision always yields kg
+    configWithWeight := func(kg int) string {
+        return fmt.Sprintf("parameter_sets: {waste: {}}\ndevices: {count: 1}\nmeasurement: {min_weight_kg: %d, max_weight_kg: %d.01, precision: 1}\n", kg, kg)
+    }
+    first, second := configWithWeight(10), configWithWeight(20)
+    for _, config := range []string{first, second} {
+        if _, err := g.storeConfig(config); err != nil {
+            t.Fatalf("storeConfig failed: %v", err)
+        }
+    }
+    if got := weightOf(t, device.generateMeasurement()); got != 20.0 {
+        t.Fatalf("expected the second config's weight 20.0, got %v", got)
+    }
+
+    recorder := httptest.NewRecorder()
+    g.handleConfigHistoryRequest(recorder, httptest.NewRequest(http.MethodGet, "/config/history", nil))
+    var history struct {
+        CurrentVersion string `json:"current_version"`
+        History        []struct {
+            Version string `json:"config_version"`
+        } `json:"history"`
+    }
+    if err := json.Unmarshal(recorder.Body.Bytes(), &history); err != nil {
+        t.Fatalf("invalid history response: %v", err)
+    }
+    if len(history.History) != 2 || history.History[0].Version != configVersionHash(second) || history.History[1].Version != configVersionHash(first) {
+        t.Fatalf("expected both versions newest first, got %s", recorder.Body.String())
+    }
+
+    g.handleMQTTMessage(&mockMessage{
+        topic:   "gateway/gw-test/command",
+        payload: []byte(fmt.Sprintf(`{"type": "rollback_config", "config_version": %q, "update_id": "rollback-1"}`, configVersionHash(first))),
+    })
+    g.configAcks.Wait()
+    
+    // The rollback is also acknowledged as a config delivery, not under the stale update
+    var delivered map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/config/delivered" {
+            json.Unmarshal(msg.Payload, &delivered)
+        }
+    }
+    if delivered["status"] != "success" || delivered["update_id"] != "rollback-1" || delivered["config_version"] != configVersionHash(first) {
+        t.Errorf("expected a config ack for the rolled back version, got %v", delivered)
+    }
+
+    if g.getConfig().YAML != first {
+        t.Fatalf("expected the first config to be current after rollback")
+    }
+    if got := weightOf(t, device.generateMeasurement()); got != 10.0 {
+        t.Errorf("expected the first config's weight 10.0 after rollback, got %v", got)
+    }
+    if history := g.getConfigHistory(); len(history) != 2 || history[1].Version != configVersionHash(first) {
+        t.Errorf("expected the rolled back version to become the newest entry, got %+v", history)
+    }
+
+    // Unknown versions are rejected and leave the config alone
+    g.handleRollbackConfigCommand(map[string]interface{}{"config_version": "deadbeef"})
+    g.configAcks.Wait()
+    var ack map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/command/ack" {
+            json.Unmarshal(msg.Payload, &ack)
+        }
+    }
+    if ack["command"] != "rollback_config" || ack["status"] != "failure" || g.getConfig().YAML != first {
+        t.Errorf("expected a failed rollback ack for an unknown version, got %v", ack)
+    }
+}
+
+func TestConfigHistoryIsBounded(t *testing.T) {
+    t.Setenv("CONFIG_HISTORY_SIZE", "2")
+    g := NewGateway()
+    for i := 1; i <= 3; i++ {
+        g.storeConfig(fmt.Sprintf("parameter_sets: {}\ndevices: {count: %d}\n", i))
+    }
+    history := g.getConfigHistory()
+    if len(history) != 2 || history[0].Version != configVersionHash("parameter_sets: {}\ndevices: {count: 2}\n") {
+        t.Errorf("expected the two newest configs, got %+v", history)
+    }
+}
+
+func TestConfigDiffShowsChangedAndAddedKeys(t *testing.T) {
+    g := NewGateway()
+    first := `
+parameter_sets:
+  waste:
+    required_parameters: []
+devices:
+  count: 2
+measurement:
+  min_weight_kg: 1
+  max_weight_kg: 50
+  calibration_factor: 1.0
+`
+    second := `
+parameter_sets:
+  waste:
+    required_parameters: []
+  recyclables:
+    required_parameters: []
+devices:
+  count: 3
+measurement:
+  min_weight_kg: 1.0
+  max_weight_kg: 50
+  calibration_factor: 1.05
+`
+    for _, config := range []string{first, second} {
+        if _, err := g.storeConfig(config); err != nil {
+            t.Fatalf("storeConfig failed: %v", err)
+        }
+    }
+
+    url := fmt.Sprintf("/config/diff?from=%s&to=%s", configVersionHash(first), configVersionHash(second))
+    recorder := httptest.NewRecorder()
+    g.handleConfigDiffRequest(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    var diff struct {
+        ParameterSets []ConfigChange `json:"parameter_sets"`
+        Measurement   []ConfigChange `json:"measurement"`
+        DeviceCount   struct {
+            From    int  `json:"from"`
+            To      int  `json:"to"`
+            Changed bool `json:"changed"`
+        } `json:"device_count"`
+    }
+    if err := json.Unmarshal(recorder.Body.Bytes(), &diff); err != nil {
+        t.Fatalf("invalid diff response: %v", err)
+    }
+
+    if len(diff.ParameterSets) != 1 || diff.ParameterSets[0].Path != "parameter_sets.recyclables" || diff.ParameterSets[0].Change != "added" {
+        t.Errorf("expected the recyclables set to be added, got %+v", diff.ParameterSets)
+    }
+    // min_weight_kg 1 -> 1.0 is not a change
+    if len(diff.Measurement) != 1 {
+        t.Fatalf("expected only calibration_factor to change, got %+v", diff.Measurement)
+    }
+    change := diff.Measurement[0]
+    if change.Path != "measurement.calibration_factor" || change.Change != "changed" || change.From != 1.0 || change.To != 1.05 {
+        t.Errorf("expected calibration_factor 1.0 -> 1.05, got %+v", change)
+    }
+    if diff.DeviceCount.From != 2 || diff.DeviceCount.To != 3 || !diff.DeviceCount.Changed {
+        t.Errorf("expected device count 2 -> 3, got %+v", diff.DeviceCount)
+    }
+
+    recorder = httptest.NewRecorder()
+    g.handleConfigDiffRequest(recorder, httptest.NewRequest(http.MethodGet, "/config/diff?from=deadbeef&to="+configVersionHash(second), nil))
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("expected 404 for a version outside the history, got %d", recorder.Code)
+    }
+}
+
+func TestConfigAcknowledgmentRetriesUntilPublished(t *testing.T) {
+    g, client := newTestGateway()
+    previousBackoff := configAckBackoff
+    t.Cleanup(func() { configAckBackoff = previousBackoff })
+    g.currentConfig = Config{YAML: "devices: {count: 1}"}
+    configAckBackoff = time.Millisecond
+    t.Setenv("CONFIG_ACK_QOS", "1")
+    t.Setenv("CONFIG_ACK_MAX_ATTEMPTS", "5")
+
+    // The first two publishes fail, the third succeeds and no further attempts follow
+    client.failPublishes = 2
+    g.sendConfigAcknowledgment("update-1", ConfigApplyResult{}, nil)
+    g.configAcks.Wait()
+
+    messages := client.messages()
+    if len(messages) != 3 {
+        t.Fatalf("expected 3 publish attempts, got %d", len(messages))
+    }
+    for _, msg := range messages {
+        if msg.Topic != "gateway/gw-test/config/delivered" || msg.QoS != 1 {
+            t.Fatalf("unexpected ack publish %s at QoS %d", msg.Topic, msg.QoS)
+        }
+    }
+    var payload map[string]interface{}
+    if err := json.Unmarshal(messages[2].Payload, &payload); err != nil {
+        t.Fatalf("invalid ack payload: %v", err)
+    }
+    if payload["config_version"] != configVersionHash("devices: {count: 1}") {
+        t.Fatalf("expected config_version hash in ack, got %v", payload["config_version"])
+    }
+}
+
+func TestConfigAcknowledgmentStopsAtMaxAttempts(t *testing.T) {
+    g, client := newTestGateway()
+    previousBackoff := configAckBackoff
+    t.Cleanup(func() { configAckBackoff = previousBackoff })
+    configAckBackoff = time.Millisecond
+    t.Setenv("CONFIG_ACK_MAX_ATTEMPTS", "3")
+
+    client.failPublishes = 10
+    g.sendConfigAcknowledgment("update-1", ConfigApplyResult{}, nil)
+    g.configAcks.Wait()
+
+    if got := len(client.messages()); got != 3 {
+        t.Fatalf("expected 3 attempts before giving up, got %d", got)
+    }
+}
+
+func TestConfigAcknowledgmentRetriesDoNotBlockEventLoop(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    previousBackoff := configAckBackoff
+    t.Cleanup(func() { configAckBackoff = previousBackoff })
+    configAckBackoff = time.Hour
+    t.Setenv("CONFIG_ACK_MAX_ATTEMPTS", "5")
+    client.failPublishes = 10
+
+    // The broker rejects the ack, but the config update returns without waiting out the backoff
+    handled := make(chan struct{})
+    go func() {
+        g.handleEvent(Event{Type: EventConfigUpdate, Data: &mockMessage{topic: "gateway/gw-test/config/update", payload: []byte("parameter_sets: {}\ndevices: {count: 1}\n")}})
+        close(handled)
+    }()
+    select {
+    case <-handled:
+    case <-time.After(2 * time.Second):
+        t.Fatalf("config update blocked on the ack retry backoff")
+    }
+
+    // Shutdown abandons the pending retry
+    acksDone := make(chan struct{})
+    go func() {
+        g.configAcks.Wait()
+        close(acksDone)
+    }()
+    g.beginShutdown()
+    select {
+    case <-acksDone:
+    case <-time.After(2 * time.Second):
+        t.Fatalf("ack retries kept running after shutdown began")
+    }
+    if got := len(client.messages()); got != 1 {
+        t.Errorf("expected a single attempt before shutdown, got %d", got)
+    }
+}
+
+func TestMQTTTLSConfigModes(t *testing.T) {
+    server := httptest.NewTLSServer(http.NotFoundHandler())
+    defer server.Close()
+    cert := server.TLS.Certificates[0]
+
+    t.Setenv("MQTT_TLS_INSECURE", "true")
+    t.Setenv("MQTT_CA_PATH", "")
+    tlsConfig, err := newMQTTTLSConfig(cert)
+    if err != nil || !tlsConfig.InsecureSkipVerify {
+        t.Fatalf("expected insecure mode, got %+v (err %v)", tlsConfig, err)
+    }
+
+    // Verification is on by default, using the system roots
+    t.Setenv("MQTT_TLS_INSECURE", "")
+    tlsConfig, err = newMQTTTLSConfig(cert)
+    if err != nil || tlsConfig.InsecureSkipVerify || tlsConfig.RootCAs != nil {
+        t.Fatalf("expected verification against system roots, got %+v (err %v)", tlsConfig, err)
+    }
+
+    caPath := filepath.Join(t.TempDir(), "ca.pem")
+    caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+    if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("MQTT_CA_PATH", caPath)
+    tlsConfig, err = newMQTTTLSConfig(cert)
+    if err != nil || tlsConfig.InsecureSkipVerify || tlsConfig.RootCAs == nil {
+        t.Fatalf("expected verification against the CA bundle, got %+v (err %v)", tlsConfig, err)
+    }
+
+    if err := os.WriteFile(caPath, []byte("not a certificate"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := newMQTTTLSConfig(cert); err == nil {
+        t.Fatalf("expected an error for a CA bundle without certificates")
+    }
+}
+
+func TestMQTTSetupFailsClosedOnBadCertificates(t *testing.T) {
+    useTestAPI(t, nil)
+    server := httptest.NewTLSServer(http.NotFoundHandler())
+    defer server.Close()
+    dir := t.TempDir()
+    certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    keyDER, err := x509.MarshalPKCS8PrivateKey(server.TLS.Certificates[0].PrivateKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+    os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+
+    g := NewGateway()
+    g.hasCertificates.Store(true)
+    t.Setenv("MQTT_TLS_INSECURE", "")
+    t.Setenv("MQTT_CA_PATH", "")
+    if tlsConfig, err := g.loadMQTTTLSConfig(certPath, keyPath); err != nil || tlsConfig == nil {
+        t.Fatalf("expected a TLS config for valid certificates, got %v (err %v)", tlsConfig, err)
+    }
+
+    // An unusable CA bundle or key pair is an error, never a nil (plaintext) config
+    caPath := filepath.Join(dir, "ca.pem")
+    os.WriteFile(caPath, []byte("not a certificate"), 0600)
+    t.Setenv("MQTT_CA_PATH", caPath)
+    if tlsConfig, err := g.loadMQTTTLSConfig(certPath, keyPath); err == nil || tlsConfig != nil {
+        t.Errorf("expected an error for a bad CA bundle, got %v", tlsConfig)
+    }
+    t.Setenv("MQTT_CA_PATH", "")
+    if _, err := g.loadMQTTTLSConfig(filepath.Join(dir, "missing.pem"), keyPath); err == nil {
+        t.Errorf("expected an error for a missing certificate")
+    }
+
+    // setupMQTTClient refuses to build a client instead of connecting over tcp://
+    if _, err := os.Stat(CertPath); err == nil {
+        t.Skipf("%s exists on this machine", CertPath)
+    }
+    g.brokerAddress = "127.0.0.1:1"
+    if err := g.setupMQTTClient(); err == nil || g.mqttClient != nil {
+        t.Errorf("expected setup to fail without a client, got err %v", err)
+    }
+}
+
+func TestMQTTBrokerURLUsesSSLWithTLSConfig(t *testing.T) {
+    g := NewGateway()
+    t.Setenv("MQTT_PROTOCOL", "")
+
+    tlsConfig := &tls.Config{}
+    cases := []struct {
+        address string
+        tls     *tls.Config
+        want    string
+    }{
+        {"broker.example.com", tlsConfig, "ssl://broker.example.com:8883"},
+        {"broker.example.com:9883", tlsConfig, "ssl://broker.example.com:9883"},
+        {"mqtt-broker:1883", nil, "tcp://mqtt-broker:1883"},
+        {"mqtt-broker", nil, "tcp://mqtt-broker:1883"},
+    }
+    for _, c := range cases {
+        if got := g.mqttBrokerURL(c.address, c.tls); got != c.want {
+            t.Errorf("mqttBrokerURL(%q) = %s, want %s", c.address, got, c.want)
+        }
+    }
+
+    // An explicit protocol overrides the TLS detection
+    t.Setenv("MQTT_PROTOCOL", "tcp")
+    if got := g.mqttBrokerURL("mqtt-broker:8883", tlsConfig); got != "tcp://mqtt-broker:8883" {
+        t.Errorf("expected MQTT_PROTOCOL to win, got %s", got)
+    }
+}
+
+func TestShutdownSequenceRunsPhasesInOrder(t *testing.T) {
+    g := NewGateway()
+
+    var mu sync.Mutex
+    var order []string
+    record := func(name string) func() {
+        return func() {
+            mu.Lock()
+            defer mu.Unlock()
+            order = append(order, name)
+        }
+    }
+
+    // Registered out of order; phases decide the sequence
+    g.registerShutdownStep(ShutdownDisconnect, "disconnect", 0, record("disconnect"))
+    g.registerShutdownStep(ShutdownFlushBuffers, "flush", 0, record("flush"))
+    g.registerShutdownStep(ShutdownDrain, "slow_drain", 50*time.Millisecond, func() { time.Sleep(time.Second) })
+    g.registerShutdownStep(ShutdownStopIntake, "stop", 0, record("stop"))
+    g.registerShutdownStep(ShutdownSendOfflineStatus, "status", 0, record("status"))
+    g.registerShutdownStep(ShutdownPersistState, "persist", 0, record("persist"))
+
+    start := time.Now()
+    g.runShutdownSequence()
+    if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+        t.Errorf("slow step should be bounded by its timeout, shutdown took %v", elapsed)
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+    want := []string{"stop", "flush", "persist", "status", "disconnect"}
+    if strings.Join(order, ",") != strings.Join(want, ",") {
+        t.Errorf("shutdown order = %v, want %v", order, want)
+    }
+}
+
+func TestBackoffPolicySequence(t *testing.T) {
+    t.Setenv("MQTT_RECONNECT_INITIAL_SECONDS", "0.5")
+    t.Setenv("MQTT_RECONNECT_MAX_SECONDS", "5")
+    t.Setenv("MQTT_RECONNECT_MULTIPLIER", "3")
+    t.Setenv("MQTT_CONNECT_MAX_RETRIES", "6")
+    policy := newBackoffPolicyFromEnv()
+    if policy.MaxRetries != 6 {
+        t.Errorf("MaxRetries = %d, want 6", policy.MaxRetries)
+    }
+
+    want := []time.Duration{500 * time.Millisecond, 1500 * time.Millisecond, 4500 * time.Millisecond, 5 * time.Second, 5 * time.Second}
+    for i, expected := range want {
+        attempt := i + 1
+        if got := policy.delay(attempt); got != expected {
+            t.Errorf("delay(%d) = %v, want %v", attempt, got, expected)
+        }
+        // Jitter adds at most half the delay and never exceeds the cap
+        for n := 0; n < 20; n++ {
+            jittered := policy.jittered(attempt)
+            if jittered < expected || jittered > expected+expected/2 || jittered > policy.Max {
+                t.Fatalf("jittered(%d) = %v out of range for %v", attempt, jittered, expected)
+            }
+        }
+    }
+}
+
+// runEventLoop handles the gateway's events until the test ends
+func runEventLoop(t *testing.T, g *Gateway) {
+    done := make(chan struct{})
+    stopped := make(chan struct{})
+    t.Cleanup(func() {
+        close(done)
+        <-stopped
+    })
+    go func() {
+        defer close(stopped)
+        for {
+            select {
+            case event := <-g.eventChan:
+                g.handleEvent(event)
+            case <-done:
+                return
+            }
+        }
+    }()
+}
+
+func TestConfigPushOverHTTP(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+    g.endDeviceManager = dm
+    g.currentUpdateID = "mqtt-update-1"
+    runEventLoop(t, g)
+
+    pushed := "parameter_sets:\n  waste: {}\ndevices:\n  count: 1\n"
+    recorder := httptest.NewRecorder()
+    g.handleConfigRequest(recorder, httptest.NewRequest(http.MethodPost, "/config", strings.NewReader(pushed)))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    var response map[string]interface{}
+    json.Unmarshal(recorder.Body.Bytes(), &response)
+    if response["config_version"] != configVersionHash(pushed) || g.getConfig().YAML != pushed {
+        t.Errorf("expected the pushed config to be stored with its version, got %v", response)
+    }
+    if device.ConfigVersion == "testver1" {
+        t.Errorf("expected the pushed config to be applied to the devices")
+    }
+    
+    // The push is acknowledged like an MQTT update, without the earlier update_id
+    g.configAcks.Wait()
+    var acks []map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/config/delivered" {
+            var ack map[string]interface{}
+            json.Unmarshal(msg.Payload, &ack)
+            acks = append(acks, ack)
+        }
+    }
+    if len(acks) != 1 || acks[0]["config_version"] != configVersionHash(pushed) || acks[0]["update_id"] != "" {
+        t.Errorf("expected one config/delivered ack for the push, got %v", acks)
+    }
+
+    for _, body := range []string{"", "just a string", "devices: [unclosed"} {
+        recorder := httptest.NewRecorder()
+        g.handleConfigRequest(recorder, httptest.NewRequest(http.MethodPost, "/config", strings.NewReader(body)))
+        if recorder.Code != http.StatusBadRequest {
+            t.Errorf("body %q: expected 400, got %d", body, recorder.Code)
+        }
+    }
+    if g.getConfig().YAML != pushed {
+        t.Errorf("rejected pushes should keep the stored config")
+    }
+}
+
+func TestConfigRequestETag(t *testing.T) {
+    g := NewGateway()
+    yamlConfig := "devices:\n  count: 2\n"
+    g.currentConfig = Config{YAML: yamlConfig, UpdatedAt: time.Now()}
+    etag := `"` + configVersionHash(yamlConfig) + `"`
+
+    recorder := httptest.NewRecorder()
+    g.handleConfigRequest(recorder, httptest.NewRequest(http.MethodGet, "/config?device_id=d1", nil))
+    if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != etag || recorder.Body.String() != yamlConfig {
+        t.Fatalf("expected full config with ETag %s, got %d %q", etag, recorder.Code, recorder.Header().Get("ETag"))
+    }
+
+    request := httptest.NewRequest(http.MethodGet, "/config?device_id=d1", nil)
+    request.Header.Set("If-None-Match", etag)
+    recorder = httptest.NewRecorder()
+    g.handleConfigRequest(recorder, request)
+    if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+        t.Errorf("matching ETag: expected empty 304, got %d %q", recorder.Code, recorder.Body.String())
+    }
+
+    request = httptest.NewRequest(http.MethodGet, "/config?device_id=d1", nil)
+    request.Header.Set("If-None-Match", `"stale123"`)
+    recorder = httptest.NewRecorder()
+    g.handleConfigRequest(recorder, request)
+    if recorder.Code != http.StatusOK || recorder.Body.String() != yamlConfig {
+        t.Errorf("mismatched ETag: expected full config, got %d %q", recorder.Code, recorder.Body.String())
+    }
+}
+
+func TestClusterMetadataInEvents(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    g.currentConfig = Config{}
+    t.Setenv("GATEWAY_CLUSTER", "eu-west")
+    t.Setenv("GATEWAY_CLUSTER_LABELS", "region=eu-west-1, customer=acme")
+
+    clusterOf := func(payload []byte) map[string]interface{} {
+        var decoded map[string]interface{}
+        json.Unmarshal(payload, &decoded)
+        cluster, _ := decoded["cluster"].(map[string]interface{})
+        return cluster
+    }
+
+    g.requestConfig()
+    g.sendStatusUpdate("online", "Gateway online")
+    for _, msg := range client.messages() {
+        cluster := clusterOf(msg.Payload)
+        labels, _ := cluster["labels"].(map[string]interface{})
+        if cluster["name"] != "eu-west" || labels["customer"] != "acme" {
+            t.Errorf("%s: expected cluster metadata, got %v", msg.Topic, cluster)
+        }
+    }
+    if len(client.messages()) < 2 {
+        t.Fatalf("expected config request and status messages, got %d", len(client.messages()))
+    }
+
+    // The configuration's cluster wins over the environment
+    g.currentConfig = Config{YAML: "cluster:\n  name: customer-acme\n  labels: {tier: gold}\n"}
+    heartbeat := g.buildHeartbeatPayload(HeartbeatSchemaDeviceStats)
+    if cluster, _ := heartbeat["cluster"].(*ClusterInfo); cluster == nil || cluster.Name != "customer-acme" || cluster.Labels["tier"] != "gold" {
+        t.Errorf("expected the configured cluster in the heartbeat, got %v", heartbeat["cluster"])
+    }
+
+    t.Setenv("GATEWAY_CLUSTER", "")
+    g.currentConfig = Config{}
+    if cluster := g.gatewayCluster(); cluster != nil {
+        t.Errorf("expected no cluster, got %+v", cluster)
+    }
+}
+
+func TestWatchdogDetectsStalledHandler(t *testing.T) {
+    watchdog := &EventLoopWatchdog{Timeout: 50 * time.Millisecond}
+    go watchdog.Run()
+
+    // Simulate a handler that blocks well past the timeout
+    watchdog.Begin(EventConfigUpdate)
+    deadline := time.Now().Add(2 * time.Second)
+    for watchdog.Stalls() == 0 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    watchdog.Done()
+
+    if watchdog.Stalls() != 1 {
+        t.Fatalf("expected exactly one stall to be reported, got %d", watchdog.Stalls())
+    }
+
+    // An idle loop is not a stall
+    if watchdog.Check(time.Now().Add(time.Hour)) {
+        t.Fatalf("idle event loop should not be reported as stalled")
+    }
+}
+
+func TestPublishMeasurementDeduplicatesWithinWindow(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    measurement := device.generateMeasurement()
+
+    dm.publishMeasurement(device, measurement)
+    dm.publishMeasurement(device, measurement)
+
+    if got := len(client.messages()); got != 1 {
+        t.Fatalf("expected a single publish for a duplicate measurement_id, got %d", got)
+    }
+}
+
+func TestMeasurementDedupWindowAndCapacity(t *testing.T) {
+    dedup := newMeasurementDedup(time.Minute, 2)
+    now := time.Now()
+
+    if !dedup.Reserve("a", now) || dedup.Reserve("a", now.Add(time.Second)) {
+        t.Fatalf("expected first reserve to succeed and the duplicate to be rejected")
+    }
+    if !dedup.Reserve("a", now.Add(2*time.Minute)) {
+        t.Fatalf("expected ID to be accepted again after the window")
+    }
+
+    dedup.Reserve("b", now.Add(2*time.Minute))
+    dedup.Reserve("c", now.Add(2*time.Minute))
+    if len(dedup.seen) > 2 {
+        t.Fatalf("expected dedup set to stay within capacity, has %d entries", len(dedup.seen))
+    }
+}
+
+func TestConnectionHookFiresOnTransition(t *testing.T) {
+    g := NewGateway()
+
+    var fired []string
+    g.registerConnectionHook(TransitionConnected, "test_connected", func(event Event) {
+        fired = append(fired, "connected")
+    })
+    g.registerConnectionHook(TransitionDisconnected, "test_disconnected", func(event Event) {
+        fired = append(fired, "disconnected")
+    })
+
+    g.handleEvent(Event{Type: EventMQTTConnected, Time: time.Now()})
+    if !g.isMqttConnected.Load() || len(fired) != 1 || fired[0] != "connected" {
+        t.Fatalf("expected connected hook to fire, got %v", fired)
+    }
+
+    g.handleEvent(Event{Type: EventMQTTDisconnected, Time: time.Now()})
+    if g.isMqttConnected.Load() || len(fired) != 2 || fired[1] != "disconnected" {
+        t.Fatalf("expected disconnected hook to fire, got %v", fired)
+    }
+}
+
+func TestMeasurementsBufferedWhileDisconnectedAreFlushedOnReconnect(t *testing.T) {
+    g, client := newTestGateway()
+    g.registerDefaultConnectionHooks()
+    dm := NewDeviceManager(g)
+    dm.offline = newOfflineBuffer(3)
+    g.endDeviceManager = dm
+    device := newTestDevice("scale-gw-1", "waste")
+
+    g.setMqttConnected(false)
+    var sequences []int64
+    for i := 0; i < 5; i++ {
+        measurement := device.generateMeasurement()
+        sequences = append(sequences, measurement["sequence"].(int64))
+        dm.publishMeasurement(device, measurement)
+    }
+    if published := measurementsPublished(client); published != 0 {
+        t.Fatalf("expected nothing published while disconnected, got %d", published)
+    }
+    if buffered := dm.offline.Len(); buffered != 3 {
+        t.Fatalf("expected the buffer to keep the newest 3 measurements, got %d", buffered)
+    }
+
+    // Run the reconnect hook that flushes the buffer in the background
+    g.setMqttConnected(true)
+    for _, hook := range g.connectionHooks[TransitionConnected] {
+        if hook.Name == "measurement_buffer" {
+            hook.Run(Event{Type: EventMQTTConnected, Time: time.Now()})
+        }
+    }
+    for deadline := time.Now().Add(2 * time.Second); measurementsPublished(client) < 3 && time.Now().Before(deadline); {
+        time.Sleep(5 * time.Millisecond)
+    }
+    var flushed []int64
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/device/scale-gw-1/measurement" {
+            var measurement map[string]interface{}
+            json.Unmarshal(msg.Payload, &measurement)
+            flushed = append(flushed, int64(measurement["sequence"].(float64)))
+        }
+    }
+    if !reflect.DeepEqual(flushed, sequences[2:]) {
+        t.Errorf("expected the newest measurements oldest first %v, got %v", sequences[2:], flushed)
+    }
+    if buffered := dm.offline.Len(); buffered != 0 {
+        t.Errorf("expected an empty buffer after the flush, got %d", buffered)
+    }
+}
+
+func TestLiveMeasurementsWaitForTheBufferFlush(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    dm.offline = newOfflineBuffer(10)
+    g.endDeviceManager = dm
+    device := newTestDevice("scale-gw-1", "waste")
+
+    g.setMqttConnected(false)
+    var sequences []int64
+    for i := 0; i < 2; i++ {
+        measurement := device.generateMeasurement()
+        sequences = append(sequences, measurement["sequence"].(int64))
+        dm.publishMeasurement(device, measurement)
+    }
+
+    // A measurement taken after the reconnect, while the flush is running, queues behind the buffer
+    g.setMqttConnected(true)
+    if !dm.offline.startFlush() {
+        t.Fatalf("expected the flush to start")
+    }
+    live := device.generateMeasurement()
+    sequences = append(sequences, live["sequence"].(int64))
+    dm.publishMeasurement(device, live)
+    if published := measurementsPublished(client); published != 0 {
+        t.Fatalf("expected the live measurement to wait for the flush, got %d published", published)
+    }
+    dm.publishBufferedMeasurements()
+
+    var published []int64
+    for _, msg := range client.messages() {
+        var measurement map[string]interface{}
+        json.Unmarshal(msg.Payload, &measurement)
+        published = append(published, int64(measurement["sequence"].(float64)))
+    }
+    if !reflect.DeepEqual(published, sequences) {
+        t.Errorf("expected measurements in order %v, got %v", sequences, published)
+    }
+
+    // Once the flush is done, measurements are published directly again
+    dm.publishMeasurement(device, device.generateMeasurement())
+    if dm.offline.Len() != 0 || measurementsPublished(client) != 4 {
+        t.Errorf("expected a direct publish after the flush, buffered %d", dm.offline.Len())
+    }
+}
+
+func TestOfflineBufferDisabledByDefault(t *testing.T) {
+    t.Setenv("MEASUREMENT_BUFFER_SIZE", "")
+    if buffer := newOfflineBufferFromEnv(); buffer != nil {
+        t.Errorf("expected no buffer by default")
+    }
+    t.Setenv("MEASUREMENT_BUFFER_SIZE", "50")
+    if buffer := newOfflineBufferFromEnv(); buffer == nil || len(buffer.entries) != 50 {
+        t.Errorf("expected a 50 message buffer")
+    }
+}
+
+func TestOfflineBufferRequeueKeepsOrder(t *testing.T) {
+    buffer := newOfflineBuffer(4)
+    buffer.add(bufferedPublish{Topic: "a"}, bufferedPublish{Topic: "b"})
+    unsent, _ := buffer.drain()
+    buffer.add(bufferedPublish{Topic: "c"})
+    buffer.requeue(unsent)
+    messages, dropped := buffer.drain()
+    var topics []string
+    for _, message := range messages {
+        topics = append(topics, message.Topic)
+    }
+    if !reflect.DeepEqual(topics, []string{"a", "b", "c"}) || dropped != 0 {
+        t.Errorf("expected requeued messages first, got %v (dropped %d)", topics, dropped)
+    }
+}
+
+func TestLastWillReportsOfflineAndIsOverridden(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    g.sessionID = "session-1"
+
+    opts := mqtt.NewClientOptions()
+    g.applyLastWill(opts)
+    if !opts.WillEnabled || opts.WillTopic != "gateway/gw-test/status" || opts.WillQos != 1 || !opts.WillRetained {
+        t.Fatalf("unexpected Last Will: enabled=%v topic=%s qos=%d retained=%v",
+            opts.WillEnabled, opts.WillTopic, opts.WillQos, opts.WillRetained)
+    }
+    var will map[string]interface{}
+    if err := json.Unmarshal(opts.WillPayload, &will); err != nil {
+        t.Fatalf("invalid will payload: %v", err)
+    }
+    if will["status"] != "disconnected" || will["gateway_id"] != "gw-test" || will["session_id"] != "session-1" {
+        t.Errorf("unexpected will payload %v", will)
+    }
+
+    // Connecting retains a connected presence over a leftover will, and a clean
+    // shutdown retains disconnected since the broker discards the will
+    g.registerDefaultConnectionHooks()
+    g.registerDefaultShutdownSteps()
+    for _, hook := range g.connectionHooks[TransitionConnected] {
+        if hook.Name == "presence" {
+            hook.Run(Event{Type: EventMQTTConnected, Time: time.Now()})
+        }
+    }
+    g.runShutdownSequence()
+
+    var presence []string
+    for _, msg := range client.messages() {
+        if msg.Topic != "gateway/gw-test/status" || !msg.Retain || msg.QoS != 1 {
+            continue
+        }
+        var payload map[string]interface{}
+        json.Unmarshal(msg.Payload, &payload)
+        presence = append(presence, fmt.Sprintf("%v/%v", payload["status"], payload["reason"]))
+    }
+    if want := []string{"connected/connected", "disconnected/shutdown"}; !reflect.DeepEqual(presence, want) {
+        t.Errorf("expected retained presence %v, got %v", want, presence)
+    }
+}
+
+func TestConfigExportContainsGatewayAndDeviceConfigs(t *testing.T) {
+    g := NewGateway()
+
+    rawConfig := "devices:\n  count: 1\n"
+    g.currentConfig = Config{YAML: rawConfig, UpdatedAt: time.Now()}
+    g.endDeviceManager = NewDeviceManager(g)
+    g.endDeviceManager.Devices["scale-gw-1"] = newTestDevice("scale-gw-1", "waste")
+
+    recorder := httptest.NewRecorder()
+    g.handleConfigExportRequest(recorder, httptest.NewRequest(http.MethodGet, "/config/export?devices=true", nil))
+
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d", recorder.Code)
+    }
+    if !strings.Contains(recorder.Header().Get("Content-Disposition"), "attachment") {
+        t.Errorf("expected attachment Content-Disposition, got %q", recorder.Header().Get("Content-Disposition"))
+    }
+
+    body := recorder.Body.Bytes()
+    archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+    if err != nil {
+        t.Fatalf("response is not a valid zip: %v", err)
+    }
+
+    files := map[string]string{}
+    for _, f := range archive.File {
+        rc, err := f.Open()
+        if err != nil {
+            t.Fatalf("failed to open %s: %v", f.Name, err)
+        }
+        data, _ := io.ReadAll(rc)
+        rc.Close()
+        files[f.Name] = string(data)
+    }
+
+    if files["gateway.yaml"] != rawConfig {
+        t.Errorf("gateway.yaml does not match raw config: %q", files["gateway.yaml"])
+    }
+    var deviceConfig map[string]interface{}
+    if err := yaml.Unmarshal([]byte(files["devices/scale-gw-1.yaml"]), &deviceConfig); err != nil {
+        t.Fatalf("device config is not valid YAML: %v", err)
+    }
+    if deviceConfig["active_parameter_set"] != "waste" {
+        t.Errorf("unexpected device config: %v", deviceConfig)
+    }
+}
+
+func TestTimeOfDayMultiplierAffectsWeight(t *testing.T) {
+    multipliers := make([]interface{}, 24)
+    for i := range multipliers {
+        multipliers[i] = 1.0
+    }
+    multipliers[14] = 2.5
+    multipliers[3] = 0.5
+
+    device := newTestDevice("scale-gw-1", "waste")
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "time_of_day": map[string]interface{}{"multipliers": multipliers},
+    }
+
+    clock := time.Date(2026, 3, 1, 14, 10, 0, 0, time.Local)
+    device.Clock = func() time.Time { return clock }
+    if got := weightOf(t, device.generateMeasurement()); got != 25.0 {
+        t.Errorf("expected afternoon weight 25.0, got %v", got)
+    }
+
+    clock = time.Date(2026, 3, 1, 3, 0, 0, 0, time.Local)
+    if got := weightOf(t, device.generateMeasurement()); got != 5.0 {
+        t.Errorf("expected night weight 5.0, got %v", got)
+    }
+
+    clock = time.Date(2026, 3, 1, 9, 0, 0, 0, time.Local)
+    if got := weightOf(t, device.generateMeasurement()); got != 10.0 {
+        t.Errorf("expected flat weight 10.0, got %v", got)
+    }
+
+    behavior := device.DeviceConfig["behavior"].(map[string]interface{})
+    if got := timeOfDayMultiplier(behavior, clock.Add(5*time.Hour), "frequency"); got != 1.0 {
+        t.Errorf("weight-only curve should not modulate frequency, got %v", got)
+    }
+}
+
+func TestFrequencyScheduleReturnsToBaseInterval(t *testing.T) {
+    multipliers := make([]interface{}, 24)
+    for i := range multipliers {
+        multipliers[i] = 1.0
+    }
+    multipliers[8] = 2.0
+    multipliers[9] = 0.0
+    behavior := map[string]interface{}{
+        "time_of_day": map[string]interface{}{"apply_to": "frequency", "multipliers": multipliers},
+    }
+
+    schedule := &frequencySchedule{base: 10 * time.Second, current: 10 * time.Second}
+    steps := []struct {
+        hour    int
+        want    time.Duration
+        changed bool
+    }{
+        {7, 10 * time.Second, false},
+        {8, 5 * time.Second, true},
+        {8, 5 * time.Second, false},
+        {10, 10 * time.Second, true}, // Back into a 1.0 window
+        {8, 5 * time.Second, true},
+        {9, 10 * time.Second, true}, // Paused at the base interval
+    }
+    for _, step := range steps {
+        multiplier := timeOfDayMultiplier(behavior, time.Date(2026, 3, 1, step.hour, 0, 0, 0, time.Local), "frequency")
+        got, changed := schedule.update(multiplier)
+        if got != step.want || changed != step.changed {
+            t.Errorf("hour %d: expected %v (reset %v), got %v (reset %v)", step.hour, step.want, step.changed, got, changed)
+        }
+    }
+}
+
+func TestGatewayIDFromFileIsStable(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state", "gateway_id")
+
+    first, err := gatewayIDFromFile(path)
+    if err != nil || first == "" {
+        t.Fatalf("first invocation failed: %q, %v", first, err)
+    }
+    second, err := gatewayIDFromFile(path)
+    if err != nil {
+        t.Fatalf("second invocation failed: %v", err)
+    }
+    if first != second {
+        t.Fatalf("expected stable ID across invocations, got %q and %q", first, second)
+    }
+}
+
+func TestSequenceGapProducesDiagnosticEvent(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+
+    dm.publishMeasurement(device, device.generateMeasurement()) // sequence 1
+    device.generateMeasurement()                                // sequence 2 dropped
+    device.generateMeasurement()                                // sequence 3 dropped
+    third := device.generateMeasurement()                       // sequence 4
+    dm.publishMeasurement(device, third)
+
+    if third["previous_sequence"] != int64(1) {
+        t.Errorf("expected previous_sequence 1, got %v", third["previous_sequence"])
+    }
+
+    var gap map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/device/scale-gw-1/diagnostic" {
+            if err := json.Unmarshal(msg.Payload, &gap); err != nil {
+                t.Fatalf("invalid gap payload: %v", err)
+            }
+        }
+    }
+    if gap == nil {
+        t.Fatalf("expected a sequence_gap event, got %+v", client.messages())
+    }
+    if gap["event_type"] != "sequence_gap" || gap["gap_start"] != 2.0 || gap["gap_end"] != 3.0 || gap["missing_count"] != 2.0 {
+        t.Errorf("unexpected gap event: %v", gap)
+    }
+}
+
+func TestFlatAPIEventFormat(t *testing.T) {
+    g := NewGateway()
+    var body map[string]interface{}
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(&body)
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(`{"status":"ok"}`))
+    })
+    t.Setenv("API_EVENT_FORMAT", "flat")
+
+    g.sendEventToAPI("gw-test", "heartbeat", map[string]interface{}{"uptime": "5s", "device_count": 3})
+
+    if body["gateway_id"] != "gw-test" || body["event_type"] != "heartbeat" {
+        t.Errorf("expected gateway_id and event_type at top level, got %v", body)
+    }
+    if body["uptime"] != "5s" || body["device_count"] != 3.0 {
+        t.Errorf("expected payload fields at top level, got %v", body)
+    }
+    if _, nested := body["payload"]; nested {
+        t.Errorf("flat mode should not nest the payload, got %v", body)
+    }
+}
+
+func TestTemplateAPIEventFormat(t *testing.T) {
+    t.Setenv("API_EVENT_FORMAT", "template")
+    t.Setenv("API_EVENT_TEMPLATE", `{"source":"gw:{gateway_id}","kind":"{event_type}","data":"{payload}"}`)
+
+    body, ok := buildAPIEventBody("gw-test", "status", map[string]interface{}{"status": "online"}, "now").(map[string]interface{})
+    if !ok {
+        t.Fatalf("expected templated map body")
+    }
+    data, _ := body["data"].(map[string]interface{})
+    if body["source"] != "gw:gw-test" || body["kind"] != "status" || data["status"] != "online" {
+        t.Errorf("unexpected templated body: %v", body)
+    }
+}
+
+const anchoredConfig = `
+base_behavior: &base
+  weight_range: {min: 5, max: 25}
+  interval: 30
+parameter_sets:
+  airline: &airline
+    unit: kg
+  waste: *airline
+devices:
+  behavior:
+    scale:
+      <<: *base
+      interval: 15
+  parameter_set_mappings:
+    scale-gw-1: waste
+`
+
+func TestAnchoredConfigIsApplied(t *testing.T) {
+    var configMap map[string]interface{}
+    if err := yaml.Unmarshal([]byte(anchoredConfig), &configMap); err != nil {
+        t.Fatalf("failed to parse config: %v", err)
+    }
+    configMap = normalizeYAMLMap(configMap)
+
+    deviceConfig := getDeviceConfig("scale-gw-1", "scale", "v1.0.0", configMap)
+    if got := deviceConfig["active_parameter_set"]; got != "waste" {
+        t.Errorf("expected aliased parameter set to be selected, got %v", got)
+    }
+    behavior, ok := deviceConfig["behavior"].(map[string]interface{})
+    if !ok {
+        t.Fatalf("expected merged behavior map, got %T", deviceConfig["behavior"])
+    }
+    if behavior["interval"] != 15 {
+        t.Errorf("expected local override of merged key, got %v", behavior["interval"])
+    }
+    if _, ok := behavior["weight_range"].(map[string]interface{}); !ok {
+        t.Errorf("expected anchored weight_range to be merged, got %v", behavior["weight_range"])
+    }
+}
+
+func TestNormalizeYAMLValueConvertsInterfaceKeys(t *testing.T) {
+    normalized := normalizeYAMLMap(map[string]interface{}{
+        "devices": map[interface{}]interface{}{
+            "count": 2,
+            "behavior": []interface{}{
+                map[interface{}]interface{}{1: "one"},
+            },
+        },
+    })
+    devices, ok := normalized["devices"].(map[string]interface{})
+    if !ok || devices["count"] != 2 {
+        t.Fatalf("expected devices to be map[string]interface{}, got %#v", normalized["devices"])
+    }
+    items := devices["behavior"].([]interface{})
+    if item, ok := items[0].(map[string]interface{}); !ok || item["1"] != "one" {
+        t.Errorf("expected nested keys to be stringified, got %#v", items[0])
+    }
+}
+
+// measurementsPublished counts measurement messages seen by the mock client
+func measurementsPublished(client *mockClient) int {
+    count := 0
+    for _, msg := range client.messages() {
+        if strings.HasSuffix(msg.Topic, "/measurement") {
+            count++
+        }
+    }
+    return count
+}
+
+func TestEmitOnStartPublishesImmediately(t *testing.T) {
+    for _, emitOnStart := range []bool{true, false} {
+        g, client := newTestGateway()
+        dm := NewDeviceManager(g)
+        device := newTestDevice("scale-gw-1", "waste")
+        device.DeviceConfig["behavior"] = map[string]interface{}{
+            "measurement_frequency_seconds": 60,
+            "emit_on_start":                 emitOnStart,
+            "start_stagger_seconds":         0,
+        }
+
+        go dm.runDeviceSimulation(device)
+        deadline := time.Now().Add(time.Second)
+        for measurementsPublished(client) == 0 && time.Now().Before(deadline) {
+            time.Sleep(10 * time.Millisecond)
+        }
+        close(device.StopChan)
+
+        published := measurementsPublished(client)
+        if emitOnStart && published != 1 {
+            t.Errorf("expected an immediate measurement with emit_on_start, got %d", published)
+        }
+        if !emitOnStart && published != 0 {
+            t.Errorf("expected no measurement before the first interval, got %d", published)
+        }
+    }
+}
+
+func TestFormatTokens(t *testing.T) {
+    location := time.FixedZone("test", 8*60*60)
+    now := time.Date(2026, 3, 14, 9, 5, 0, 0, location)
+    ctx := formatContext{device: newTestDevice("scale-gw-3", ""), now: now, rng: rand.New(rand.NewSource(1))}
+
+    cases := map[string]string{
+        "{YYYYMMDD}":                       "20260314",
+        "{HHMM}":                           "0905",
+        "{DEVICE_ID}":                      "scale-gw-3",
+        "SHP-{DEVICE_ID}-{YYYYMMDD}{HHMM}": "SHP-scale-gw-3-202603140905",
+        "no tokens":                        "no tokens",
+    }
+    for format, want := range cases {
+        if got := expandFormatTokens(format, ctx); got != want {
+            t.Errorf("%s: expected %s, got %s", format, want, got)
+        }
+    }
+
+    uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+    first, second := expandFormatTokens("{UUID}", ctx), expandFormatTokens("{UUID}", ctx)
+    if !uuidPattern.MatchString(first) || first == second {
+        t.Errorf("expected distinct version 4 UUIDs, got %s and %s", first, second)
+    }
+
+    // {SEQ} increases per device across calls, once per expansion
+    ctx.device = newTestDevice("scale-gw-seq", "")
+    if got := expandFormatTokens("{SEQ}/{SEQ}", ctx); got != "1/1" {
+        t.Errorf("expected the first sequence, got %s", got)
+    }
+    definition := map[string]interface{}{"type": "string", "format": "S{SEQ}"}
+    for _, want := range []string{"S2", "S3"} {
+        if got := generateParameterValue("shipment", definition, ctx.device, ctx.rng); got != want {
+            t.Errorf("expected %s, got %v", want, got)
+        }
+    }
+    if got := generateParameterValue("shipment", definition, newTestDevice("scale-gw-other", ""), ctx.rng); got != "S1" {
+        t.Errorf("expected devices to have separate sequences, got %v", got)
+    }
+}
+
+func TestBatchNumbersAreUniquePerDeviceDay(t *testing.T) {
+    t.Setenv("GATEWAY_TIMEZONE", "Asia/Singapore")
+    definition := map[string]interface{}{"type": "string", "format": "B{YYYYMMDD}-{###}"}
+    rng := rand.New(rand.NewSource(1))
+    device := newTestDevice("scale-gw-7", "")
+
+    // Two measurements in the same 15-minute window
+    first := generateParameterValue("batch_number", definition, device, rng).(string)
+    second := generateParameterValue("batch_number", definition, device, rng).(string)
+    if first == second {
+        t.Errorf("expected distinct batch numbers, got %s twice", first)
+    }
+    location, _ := time.LoadLocation("Asia/Singapore")
+    prefix := "B" + time.Now().In(location).Format("20060102") + "-007"
+    if !strings.HasPrefix(first, prefix) || len(first) != len(prefix)+6 {
+        t.Errorf("expected %s followed by the slot and counter, got %s", prefix, first)
+    }
+
+    // Another device numbered the same modulo the old 3-digit space doesn't collide
+    other := generateParameterValue("batch_number", definition, newTestDevice("scale-gw-107", ""), rng).(string)
+    if other == first || other == second {
+        t.Errorf("expected devices to have separate batch numbers, got %s", other)
+    }
+
+    // The counter restarts on a new day
+    counted := newTestDevice("scale-gw-8", "")
+    if counted.nextBatchCounter("20260101") != 1 || counted.nextBatchCounter("20260101") != 2 {
+        t.Error("expected the counter to increase within a day")
+    }
+    if got := counted.nextBatchCounter("20260102"); got != 1 {
+        t.Errorf("expected the counter to restart on a new day, got %d", got)
+    }
+}
+
+func TestFormatLocationIsResolvedOnce(t *testing.T) {
+    t.Setenv("GATEWAY_TIMEZONE", "Asia/Singapore")
+    first := formatLocation()
+    if first.String() != "Asia/Singapore" || formatLocation() != first {
+        t.Errorf("expected the cached Asia/Singapore location, got %v", first)
+    }
+    
+    t.Setenv("GATEWAY_TIMEZONE", "Europe/Berlin")
+    if got := formatLocation(); got.String() != "Europe/Berlin" {
+        t.Errorf("expected a changed timezone to be loaded, got %v", got)
+    }
+}
+
+func TestBooleanParameterTrueRate(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    for _, probability := range []float64{0, 0.1, 0.5, 0.9, 1} {
+        definition := map[string]interface{}{"type": "boolean", "true_probability": probability}
+        const samples = 10000
+        trues := 0
+        for i := 0; i < samples; i++ {
+            value, ok := generateParameterValue("contaminated", definition, newTestDevice("scale-gw-1", ""), rng).(bool)
+            if !ok {
+                t.Fatalf("expected a bool value")
+            }
+            if value {
+                trues++
+            }
+        }
+        if rate := float64(trues) / samples; math.Abs(rate-probability) > 0.02 {
+            t.Errorf("true_probability %v: observed true rate %v", probability, rate)
+        }
+    }
+
+    // Without true_probability the value still serializes as a JSON bool
+    data, _ := json.Marshal(map[string]interface{}{
+        "contaminated": generateParameterValue("contaminated", map[string]interface{}{"type": "boolean"}, newTestDevice("scale-gw-1", ""), rng),
+    })
+    if !bytes.Contains(data, []byte(`"contaminated":true`)) && !bytes.Contains(data, []byte(`"contaminated":false`)) {
+        t.Errorf("expected a JSON bool, got %s", data)
+    }
+}
+
+func TestObjectAndArrayParameters(t *testing.T) {
+    var definitions map[string]interface{}
+    err := yaml.Unmarshal([]byte(`
+vendor:
+  type: object
+  properties:
+    name:
+      type: string
+      options: [GreenCo, ReCycle]
+    code:
+      type: integer
+      min: 100
+      max: 999
+    address:
+      type: object
+      properties:
+        city:
+          type: string
+          default: Singapore
+material_tags:
+  type: array
+  min_length: 1
+  max_length: 4
+  items:
+    type: string
+    options: [paper, plastic, glass, metal]
+mystery:
+  type: array
+  min_length: 2
+  items:
+    type: widget
+    default: unknown
+`), &definitions)
+    if err != nil {
+        t.Fatalf("failed to parse definitions: %v", err)
+    }
+    rng := rand.New(rand.NewSource(1))
+
+    vendor, ok := generateParameterValue("vendor", definitions["vendor"].(map[string]interface{}), newTestDevice("scale-gw-1", ""), rng).(map[string]interface{})
+    if !ok {
+        t.Fatalf("expected an object value, got %T", vendor)
+    }
+    if name := vendor["name"]; name != "GreenCo" && name != "ReCycle" {
+        t.Errorf("unexpected vendor name %v", name)
+    }
+    if code, ok := vendor["code"].(int); !ok || code < 100 || code > 999 {
+        t.Errorf("unexpected vendor code %v", vendor["code"])
+    }
+    if address, _ := vendor["address"].(map[string]interface{}); address["city"] != "Singapore" {
+        t.Errorf("expected a nested object, got %v", vendor["address"])
+    }
+
+    lengths := make(map[int]bool)
+    for i := 0; i < 200; i++ {
+        tags, ok := generateParameterValue("material_tags", definitions["material_tags"].(map[string]interface{}), newTestDevice("scale-gw-1", ""), rng).([]interface{})
+        if !ok || len(tags) < 1 || len(tags) > 4 {
+            t.Fatalf("expected 1-4 tags, got %v", tags)
+        }
+        for _, tag := range tags {
+            if _, ok := tag.(string); !ok {
+                t.Fatalf("expected string tags, got %v", tags)
+            }
+        }
+        lengths[len(tags)] = true
+    }
+    if len(lengths) != 4 {
+        t.Errorf("expected every length from 1 to 4, got %v", lengths)
+    }
+
+    // Items of an unknown type use the default handling
+    mystery := generateParameterValue("mystery", definitions["mystery"].(map[string]interface{}), newTestDevice("scale-gw-1", ""), rng)
+    if !reflect.DeepEqual(mystery, []interface{}{"unknown", "unknown"}) {
+        t.Errorf("expected default item values, got %v", mystery)
+    }
+}
+
+func TestYAMLIntegerConfigValuesAreHonored(t *testing.T) {
+    var config map[string]interface{}
+    err := yaml.Unmarshal([]byte(`
+measurement:
+  min_weight_kg: 2
+  max_weight_kg: 2
+  precision: 1
+devices:
+  count: "3"
+  behavior:
+    scale:
+      measurement_frequency_seconds: 10
+`), &config)
+    if err != nil {
+        t.Fatalf("failed to parse config: %v", err)
+    }
+    deviceConfig := getDeviceConfig("scale-gw-1", "scale", "1.0.0", config)
+    behavior, _ := deviceConfig["behavior"].(map[string]interface{})
+    if interval := measurementInterval(behavior); interval != 10*time.Second {
+        t.Errorf("expected a 10s interval, got %v", interval)
+    }
+    device := newTestDevice("scale-gw-1", "")
+    device.DeviceConfig = deviceConfig
+    if weight := weightOf(t, device.generateMeasurement()); weight != 2 {
+        t.Errorf("expected integer weight bounds to be honored, got %v", weight)
+    }
+    devicesConfig := config["devices"].(map[string]interface{})
+    if counts := deviceTypeCounts(devicesConfig); counts["scale"] != 3 {
+        t.Errorf("expected a numeric string count to be honored, got %v", counts)
+    }
+
+    // JSON-decoded integer parameter bounds arrive as float64
+    var paramDef map[string]interface{}
+    json.Unmarshal([]byte(`{"type": "integer", "min": 7, "max": "7"}`), &paramDef)
+    if value := generateParameterValue("bin", paramDef, newTestDevice("scale-gw-1", ""), rand.New(rand.NewSource(1))); value != 7 {
+        t.Errorf("expected float64 and string bounds to be honored, got %v", value)
+    }
+
+    for _, value := range []interface{}{10, int64(10), 10.0, "10", " 10 "} {
+        if n, ok := toInt(value); !ok || n != 10 {
+            t.Errorf("toInt(%#v) = %v, %v", value, n, ok)
+        }
+    }
+    for _, value := range []interface{}{nil, "ten", true, []interface{}{1}} {
+        if _, ok := toFloat64(value); ok {
+            t.Errorf("expected %#v to be rejected", value)
+        }
+    }
+}
+
+func TestMeasurementIntervalHonorsFractionalSeconds(t *testing.T) {
+    cases := []struct {
+        frequency interface{}
+        want      time.Duration
+    }{
+        {0.5, 500 * time.Millisecond},
+        {1, time.Second},
+        {2.25, 2250 * time.Millisecond},
+        {0.01, minMeasurementInterval},
+        {nil, 60 * time.Second},
+        {-3, 60 * time.Second},
+    }
+    for _, c := range cases {
+        behavior := map[string]interface{}{"measurement_frequency_seconds": c.frequency}
+        interval := measurementInterval(behavior)
+        if interval != c.want {
+            t.Errorf("frequency %v: expected %v, got %v", c.frequency, c.want, interval)
+        }
+        // Small intervals must not make the jitter panic
+        for i := 0; i < 100; i++ {
+            if jitter := measurementJitter(interval); jitter < 0 || jitter >= interval/4 {
+                t.Fatalf("frequency %v: jitter %v outside [0, %v)", c.frequency, jitter, interval/4)
+            }
+        }
+    }
+    if jitter := measurementJitter(time.Nanosecond); jitter != 0 {
+        t.Errorf("expected no jitter for a tiny interval, got %v", jitter)
+    }
+
+    // A sub-second interval produces several measurements within a second
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    device.DeviceConfig["behavior"] = map[string]interface{}{"measurement_frequency_seconds": 0.1}
+    go dm.runDeviceSimulation(device)
+    deadline := time.Now().Add(2 * time.Second)
+    for measurementsPublished(client) < 3 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    close(device.StopChan)
+    if published := measurementsPublished(client); published < 3 {
+        t.Errorf("expected at least 3 measurements at a 0.1s interval, got %d", published)
+    }
+}
+
+func TestSeededDevicesProduceIdenticalWeights(t *testing.T) {
+    t.Setenv("GATEWAY_RANDOM_SEED", "42")
+    if deviceRandomSeed("scale-gw-1") != deviceRandomSeed("scale-gw-1") {
+        t.Fatal("expected a fixed seed to give a stable device seed")
+    }
+    if deviceRandomSeed("scale-gw-1") == deviceRandomSeed("scale-gw-2") {
+        t.Fatal("expected devices to get different seeds")
+    }
+
+    sequence := func(seed int64) []float64 {
+        device := newTestDevice("scale-gw-1", "")
+        device.DeviceConfig["measurement"].(map[string]interface{})["max_weight_kg"] = 50.0
+        device.DeviceConfig["behavior"] = map[string]interface{}{"noise_stddev": 0.5}
+        device.Rand = newDeviceRand(seed)
+        weights := []float64{}
+        for i := 0; i < 20; i++ {
+            weights = append(weights, weightOf(t, device.generateMeasurement()))
+        }
+        return weights
+    }
+    seed := deviceRandomSeed("scale-gw-1")
+    first, second := sequence(seed), sequence(seed)
+    if !reflect.DeepEqual(first, second) {
+        t.Fatalf("expected identical sequences, got %v and %v", first, second)
+    }
+    if reflect.DeepEqual(first, sequence(seed+1)) {
+        t.Fatal("expected a different seed to change the sequence")
+    }
+}
+
+func TestWeightDistributions(t *testing.T) {
+    rng := newDeviceRand(1)
+    sampleMean := func(config map[string]interface{}, minWeight, maxWeight float64) float64 {
+        sum := 0.0
+        for i := 0; i < 10000; i++ {
+            value := sampleWeight(rng, config, minWeight, maxWeight)
+            if value < minWeight || value > maxWeight {
+                t.Fatalf("%v: sample %v outside [%v, %v]", config["distribution"], value, minWeight, maxWeight)
+            }
+            sum += value
+        }
+        return sum / 10000
+    }
+
+    normal := map[string]interface{}{"distribution": "normal", "mean_weight_kg": 12.0, "stddev_weight_kg": 2.0}
+    if mean := sampleMean(normal, 0, 100); math.Abs(mean-12.0) > 0.1 {
+        t.Errorf("normal: expected mean near 12, got %v", mean)
+    }
+    exponential := map[string]interface{}{"distribution": "exponential", "mean_weight_kg": 5.0}
+    if mean := sampleMean(exponential, 1, 1000); math.Abs(mean-5.0) > 0.2 {
+        t.Errorf("exponential: expected mean near 5, got %v", mean)
+    }
+    for _, config := range []map[string]interface{}{nil, {"distribution": "uniform"}} {
+        if mean := sampleMean(config, 10, 20); math.Abs(mean-15.0) > 0.2 {
+            t.Errorf("uniform: expected mean near 15, got %v", mean)
+        }
+    }
+
+    // Samples beyond the range are clamped, then rounded to the precision
+    device := newTestDevice("scale-gw-1", "")
+    device.DeviceConfig["measurement"] = map[string]interface{}{
+        "min_weight_kg":    1.0,
+        "max_weight_kg":    2.0,
+        "precision":        0.1,
+        "distribution":     "normal",
+        "mean_weight_kg":   50.0,
+        "stddev_weight_kg": 1.0,
+    }
+    if got := weightOf(t, device.generateMeasurement()); got != 2.0 {
+        t.Errorf("expected clamped weight 2.0, got %v", got)
+    }
+}
+
+func TestCalibrationDriftResetsOnRecalibration(t *testing.T) {
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    now := start
+    device := newTestDevice("scale-gw-1", "")
+    device.StartTime = start
+    device.Clock = func() time.Time { return now }
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "drift_per_hour":               0.01,
+        "recalibration_interval_hours": 4,
+    }
+
+    // Drift grows every half hour until the 4-hour recalibration resets it
+    previous := -1.0
+    for step := 0; step < 8; step++ {
+        now = start.Add(time.Duration(step) * 30 * time.Minute)
+        weight := weightOf(t, device.generateMeasurement())
+        if device.Drift <= previous {
+            t.Fatalf("step %d: expected drift to grow past %v, got %v", step, previous, device.Drift)
+        }
+        if want := math.Round(10.0*(1+device.Drift)*10) / 10; weight != want {
+            t.Errorf("step %d: expected weight %v with drift %v, got %v", step, want, device.Drift, weight)
+        }
+        previous = device.Drift
+    }
+    if math.Abs(previous-0.035) > 1e-9 {
+        t.Errorf("expected 0.035 drift after 3.5 hours, got %v", previous)
+    }
+
+    now = start.Add(4*time.Hour + 30*time.Minute)
+    device.generateMeasurement()
+    if math.Abs(device.Drift-0.005) > 1e-9 {
+        t.Errorf("expected drift to restart after recalibration, got %v", device.Drift)
+    }
+    if !device.LastRecalibration.Equal(start.Add(4 * time.Hour)) {
+        t.Errorf("expected recalibration at 4h, got %v", device.LastRecalibration)
+    }
+}
+
+func TestReplayFilePublishesRecordedMeasurements(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "recorded.ndjson")
+    recorded := `{"gateway_id":"customer-gw","device_id":"scale-7","event_type":"measurement","timestamp":"2024-03-01T10:00:00Z","payload":{"weight_kg":1.5}}
+{"gateway_id":"customer-gw","device_id":"scale-7","event_type":"measurement","timestamp":"2024-03-01T10:00:02Z","payload":{"weight_kg":2.5}}
+
+{"gateway_id":"customer-gw","device_id":"scale-7","event_type":"measurement","timestamp":"2024-03-01T10:00:07Z","payload":{"weight_kg":3.5}}
+`
+    if err := os.WriteFile(path, []byte(recorded), 0644); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("REPLAY_FILE", path)
+
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+
+    gaps := []time.Duration{}
+    for i := 0; i < 4; i++ {
+        gaps = append(gaps, dm.emitMeasurement(device))
+    }
+
+    weights := []float64{}
+    for _, msg := range client.messages() {
+        var event map[string]interface{}
+        json.Unmarshal(msg.Payload, &event)
+        if event["gateway_id"] != "gw-test" || event["device_id"] != "scale-gw-1" {
+            t.Errorf("expected the event to be rewritten for this device, got %v", event)
+        }
+        weights = append(weights, event["payload"].(map[string]interface{})["weight_kg"].(float64))
+    }
+    // The recording loops at the end
+    if want := []float64{1.5, 2.5, 3.5, 1.5}; !reflect.DeepEqual(weights, want) {
+        t.Errorf("expected replayed weights %v, got %v", want, weights)
+    }
+    if want := []time.Duration{2 * time.Second, 5 * time.Second, 0, 2 * time.Second}; !reflect.DeepEqual(gaps, want) {
+        t.Errorf("expected recorded gaps %v, got %v", want, gaps)
+    }
+}
+
+func TestConcurrentReplayEmitsEachEventOnce(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "recorded.ndjson")
+    recorded := `{"timestamp":"2024-03-01T10:00:00Z","payload":{"weight_kg":1.5}}
+{"timestamp":"2024-03-01T10:00:02Z","payload":{"weight_kg":2.5}}
+`
+    if err := os.WriteFile(path, []byte(recorded), 0644); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("REPLAY_FILE", path)
+
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+
+    // The simulation loop and MeasureNow can replay at the same time
+    var wg sync.WaitGroup
+    for i := 0; i < 2; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 10; j++ {
+                dm.emitMeasurement(device)
+            }
+        }()
+    }
+    wg.Wait()
+
+    counts := map[float64]int{}
+    for _, msg := range client.messages() {
+        var event map[string]interface{}
+        json.Unmarshal(msg.Payload, &event)
+        counts[event["payload"].(map[string]interface{})["weight_kg"].(float64)]++
+    }
+    if counts[1.5] != 10 || counts[2.5] != 10 {
+        t.Errorf("expected the recording to be replayed evenly, got %v", counts)
+    }
+}
+
+func TestPrecisionByUnit(t *testing.T) {
+    device := newTestDevice("scale-gw-1", "")
+    measurement := map[string]interface{}{
+        "min_weight_kg":     1234.56,
+        "max_weight_kg":     1234.56,
+        "precision":         0.1,
+        "precision_by_unit": map[string]interface{}{"g": 10, "kg": 0.01},
+    }
+    device.DeviceConfig["measurement"] = measurement
+
+    for units, want := range map[string]float64{"g": 1230, "kg": 1234.56, "lb": 1234.6} {
+        measurement["units"] = units
+        if got := weightOf(t, device.generateMeasurement()); math.Abs(got-want) > 1e-9 {
+            t.Errorf("units %s: expected %v, got %v", units, want, got)
+        }
+    }
+}
+
+func TestDatasetValuesReplayInOrder(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "weights.csv")
+    if err := os.WriteFile(path, []byte("timestamp,weight_kg\nt1,12.5\nt2,7.25\nt3,19.0\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    device := newTestDevice("scale-gw-1", "")
+    device.DeviceConfig["measurement"] = map[string]interface{}{"precision": 0.01}
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "dataset": map[string]interface{}{"file": path, "on_exhausted": "random"},
+    }
+
+    for _, want := range []float64{12.5, 7.25, 19.0} {
+        if got := weightOf(t, device.generateMeasurement()); got != want {
+            t.Errorf("expected dataset value %v, got %v", want, got)
+        }
+    }
+
+    // Exhausted with on_exhausted=random falls back to the random range
+    if got := weightOf(t, device.generateMeasurement()); got < 0.1 || got > 25.0 {
+        t.Errorf("expected fallback random weight in default range, got %v", got)
+    }
+}
+
+func TestJSONDatasetCyclesByDefault(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "weights.json")
+    if err := os.WriteFile(path, []byte(`[3.5, {"weight_kg": 4.5}]`), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    device := newTestDevice("scale-gw-1", "")
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "dataset": map[string]interface{}{"file": path},
+    }
+
+    var got []float64
+    for i := 0; i < 3; i++ {
+        got = append(got, weightOf(t, device.generateMeasurement()))
+    }
+    if got[0] != 3.5 || got[1] != 4.5 || got[2] != 3.5 {
+        t.Errorf("expected dataset to cycle, got %v", got)
+    }
+}
+
+func TestApplySessionOptions(t *testing.T) {
+    opts := mqtt.NewClientOptions().SetClientID("gw-test")
+    applySessionOptions(opts)
+    if !opts.CleanSession {
+        t.Errorf("expected clean session by default")
+    }
+
+    t.Setenv("MQTT_PERSISTENT_SESSION", "true")
+    opts = mqtt.NewClientOptions().SetClientID("gw-test")
+    applySessionOptions(opts)
+    if opts.CleanSession || !opts.ResumeSubs {
+        t.Errorf("expected persistent session options, got clean=%v resume=%v", opts.CleanSession, opts.ResumeSubs)
+    }
+    if opts.ClientID != "gw-test" {
+        t.Errorf("persistent session must keep the stable client ID, got %q", opts.ClientID)
+    }
+}
+
+func TestCapabilitiesEventDeclaresCommandsAndParameterSets(t *testing.T) {
+    g := NewGateway()
+    var event MQTTEvent
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(&event)
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(`{"status":"ok"}`))
+    })
+    g.currentConfig = Config{YAML: `
+parameter_sets:
+  waste: {}
+  airline: {min_firmware: v2.0.0}
+devices:
+  firmware_version: v2.1.0
+  capabilities:
+    tare: true
+`}
+
+    g.sendCapabilities()
+
+    if event.EventType != "capabilities" {
+        t.Fatalf("expected capabilities event, got %+v", event)
+    }
+    payload, _ := event.Payload.(map[string]interface{})
+    commands := fmt.Sprint(payload["command_types"])
+    for _, command := range []string{"acknowledge", "delete", "reset", "trigger_anomaly"} {
+        if !strings.Contains(commands, command) {
+            t.Errorf("expected command type %s in %s", command, commands)
+        }
+    }
+    if got := fmt.Sprint(payload["parameter_sets"]); got != "[airline waste]" {
+        t.Errorf("unexpected parameter sets %s", got)
+    }
+    if got := fmt.Sprint(payload["firmware_versions"]); got != "[v2.1.0]" {
+        t.Errorf("unexpected firmware versions %s", got)
+    }
+    if got := fmt.Sprint(payload["device_types"]); got != "[scale temperature_sensor]" {
+        t.Errorf("unexpected device types %s", got)
+    }
+}
+
+func TestRegistrationRetriesUntilBackendAcknowledges(t *testing.T) {
+    g := NewGateway()
+    g.gatewayID = "gw-test"
+    attempts, failures := int32(0), int32(2)
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        var event MQTTEvent
+        json.NewDecoder(r.Body).Decode(&event)
+        if event.EventType != "capabilities" {
+            t.Errorf("expected capabilities event, got %q", event.EventType)
+        }
+        // The backend is down for the first few attempts
+        if atomic.AddInt32(&attempts, 1) <= atomic.LoadInt32(&failures) {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte(`{"status":"ok"}`))
+    })
+    previous := registrationBackoff
+    t.Cleanup(func() { registrationBackoff = previous })
+    registrationBackoff = BackoffPolicy{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2}
+
+    // No MQTT client is needed to register
+    g.registerWithBackend()
+
+    if got := atomic.LoadInt32(&attempts); got != 3 {
+        t.Fatalf("expected 3 registration attempts, got %d", got)
+    }
+    if !g.isRegistered() {
+        t.Fatal("expected gateway to be registered")
+    }
+
+    // Bounded retries give up while the backend stays down
+    g = NewGateway()
+    atomic.StoreInt32(&attempts, 0)
+    atomic.StoreInt32(&failures, 100)
+    registrationBackoff.MaxRetries = 2
+    g.registerWithBackend()
+    if got := atomic.LoadInt32(&attempts); got != 2 {
+        t.Fatalf("expected 2 attempts with REGISTRATION_MAX_ATTEMPTS=2, got %d", got)
+    }
+    if g.isRegistered() {
+        t.Fatal("expected gateway to stay unregistered")
+    }
+
+    // Shutdown interrupts the wait between attempts
+    g = NewGateway()
+    atomic.StoreInt32(&attempts, 0)
+    registrationBackoff = BackoffPolicy{Initial: time.Hour, Max: time.Hour, Multiplier: 2}
+    done := make(chan struct{})
+    go func() {
+        g.registerWithBackend()
+        close(done)
+    }()
+    g.beginShutdown()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("expected registration retries to stop on shutdown")
+    }
+}
+
+func TestHandleMQTTMessageDropsOversizedPayloads(t *testing.T) {
+    g := NewGateway()
+    t.Setenv("MQTT_MAX_PAYLOAD_BYTES", "128")
+    g.eventChan = make(chan Event, 2)
+
+    oversized := []byte(`{"yaml_config":"` + strings.Repeat("x", 200) + `"}`)
+    g.handleMQTTMessage(&mockMessage{topic: "gateway/gw-test/config/update", payload: oversized})
+    if len(g.eventChan) != 0 {
+        t.Fatalf("oversized config update should be dropped")
+    }
+
+    g.handleMQTTMessage(&mockMessage{topic: "gateway/gw-test/config/update", payload: []byte(`{"yaml_config":"devices: {}"}`)})
+    if len(g.eventChan) != 1 {
+        t.Fatalf("normal config update should be processed")
+    }
+}
+
+func TestFlappingRateAndStatusEvents(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+
+    const iterations = 5000
+    const probability = 0.2
+    flaps := 0
+    for i := 0; i < iterations; i++ {
+        if dm.checkFlap(device, probability) {
+            flaps++
+        }
+    }
+
+    rate := float64(flaps) / iterations
+    if rate < probability-0.03 || rate > probability+0.03 {
+        t.Errorf("expected flap rate near %.2f, got %.3f", probability, rate)
+    }
+
+    var events int
+    var last map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/device/scale-gw-1/status" {
+            events++
+            json.Unmarshal(msg.Payload, &last)
+        }
+    }
+    if events != flaps {
+        t.Errorf("expected one status_change event per flap, got %d events for %d flaps", events, flaps)
+    }
+    if last["event_type"] != "status_change" || last["status"] != device.Status {
+        t.Errorf("last event should reflect current status %s, got %v", device.Status, last)
+    }
+
+    if probability, _ := flapSettings(map[string]interface{}{}); probability != 0 {
+        t.Errorf("devices should be stable without flapping config")
+    }
+}
+
+func TestRemovedDeviceTombstones(t *testing.T) {
+    g := NewGateway()
+    t.Setenv("DEVICE_TOMBSTONE_RETENTION_SECONDS", "60")
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    device.MeasurementCount = 42
+    device.TotalWeightMeasured = 420.5
+    dm.Devices[device.ID] = device
+
+    dm.DeviceMutex.Lock()
+    dm.removeDevice(device.ID)
+    dm.DeviceMutex.Unlock()
+
+    g.endDeviceManager = dm
+
+    recorder := httptest.NewRecorder()
+    g.handleRemovedDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices/removed", nil))
+    var response struct {
+        RemovedDevices []DeviceTombstone `json:"removed_devices"`
+    }
+    if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+        t.Fatalf("invalid response: %v", err)
+    }
+    if len(response.RemovedDevices) != 1 {
+        t.Fatalf("expected one removed device, got %+v", response.RemovedDevices)
+    }
+    tombstone := response.RemovedDevices[0]
+    if tombstone.DeviceID != "scale-gw-1" || tombstone.MeasurementCount != 42 ||
+        tombstone.TotalWeightMeasured != 420.5 || tombstone.ParameterSet != "waste" {
+        t.Errorf("unexpected tombstone: %+v", tombstone)
+    }
+
+    if remaining := dm.RemovedDevices(time.Now().Add(61 * time.Second)); len(remaining) != 0 {
+        t.Errorf("expected tombstone to be evicted after retention, got %+v", remaining)
+    }
+}
+
+func TestTombstoneStoreIsBounded(t *testing.T) {
+    t.Setenv("DEVICE_TOMBSTONE_RETENTION_SECONDS", "60")
+    t.Setenv("DEVICE_TOMBSTONE_MAX", "2")
+    dm := NewDeviceManager(NewGateway())
+    now := time.Now()
+    for _, id := range []string{"scale-gw-1", "scale-gw-2", "scale-gw-3"} {
+        dm.recordTombstone(newTestDevice(id, "waste"), now)
+    }
+
+    removed := dm.RemovedDevices(now)
+    if len(removed) != 2 || removed[0].DeviceID != "scale-gw-2" || removed[1].DeviceID != "scale-gw-3" {
+        t.Errorf("expected the two newest tombstones, got %+v", removed)
+    }
+}
+
+func TestMeasurementTopicFollowsParameterSet(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    parameterSets := map[string]interface{}{
+        "waste":       map[string]interface{}{"topic": "waste/{gateway_id}/{device_id}/measurement"},
+        "recyclables": map[string]interface{}{"topic": "{parameter_set}/{gateway_id}/{device_type}/{device_id}"},
+        "airline":     map[string]interface{}{},
+    }
+
+    expected := map[string]string{
+        "waste":       "waste/gw-test/scale-gw-1/measurement",
+        "recyclables": "recyclables/gw-test/scale/scale-gw-1",
+        "airline":     "gateway/gw-test/device/scale-gw-1/measurement",
+    }
+    for set, want := range expected {
+        device := newTestDevice("scale-gw-1", set)
+        device.DeviceConfig["parameter_sets"] = parameterSets
+        before := len(client.messages())
+        dm.publishMeasurement(device, device.generateMeasurement())
+
+        messages := client.messages()
+        if len(messages) != before+1 {
+            t.Fatalf("expected one published measurement for %s, got %d", set, len(messages)-before)
+        }
+        if got := messages[len(messages)-1].Topic; got != want {
+            t.Errorf("parameter set %s: expected topic %s, got %s", set, want, got)
+        }
+    }
+}
+
+func TestPublishMeasurementEncryptsPayload(t *testing.T) {
+    key := bytes.Repeat([]byte{7}, 32)
+    t.Setenv("MEASUREMENT_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+    t.Setenv("MEASUREMENT_ENCRYPTION_KEY_ID", "k1")
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+
+    dm.publishMeasurement(device, device.generateMeasurement())
+
+    messages := client.messages()
+    if len(messages) != 1 {
+        t.Fatalf("expected one published message, got %d", len(messages))
+    }
+    var envelope EncryptedPayload
+    if err := json.Unmarshal(messages[0].Payload, &envelope); err != nil {
+        t.Fatalf("invalid envelope: %v", err)
+    }
+    if !envelope.Encrypted || envelope.KeyID != "k1" || bytes.Contains(messages[0].Payload, []byte("weight_kg")) {
+        t.Fatalf("expected an opaque encrypted envelope, got %s", messages[0].Payload)
+    }
+
+    nonce, _ := base64.StdEncoding.DecodeString(envelope.IV)
+    ciphertext, _ := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+    block, _ := aes.NewCipher(key)
+    gcm, _ := cipher.NewGCM(block)
+    plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+    if err != nil {
+        t.Fatalf("failed to decrypt: %v", err)
+    }
+    var measurement map[string]interface{}
+    json.Unmarshal(plaintext, &measurement)
+    if measurement["device_id"] != "scale-gw-1" || weightOf(t, measurement) != 10.0 {
+        t.Errorf("unexpected decrypted measurement: %v", measurement)
+    }
+}
+
+func TestReadyRequiresAllConditions(t *testing.T) {
+    g := NewGateway()
+
+    ready := func() (int, []interface{}) {
+        recorder := httptest.NewRecorder()
+        g.handleReadyRequest(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+        var body map[string]interface{}
+        json.NewDecoder(recorder.Body).Decode(&body)
+        unmet, _ := body["unmet"].([]interface{})
+        return recorder.Code, unmet
+    }
+
+    if code, unmet := ready(); code != http.StatusServiceUnavailable || len(unmet) != 3 {
+        t.Fatalf("expected 503 with all conditions unmet, got %d %v", code, unmet)
+    }
+
+    g.isMqttConnected.Store(true)
+    g.endDeviceManager = NewDeviceManager(g)
+    if code, unmet := ready(); code != http.StatusServiceUnavailable || fmt.Sprint(unmet) != "[config_applied]" {
+        t.Fatalf("expected 503 until a config is applied, got %d %v", code, unmet)
+    }
+
+    g.endDeviceManager.UpdateDeviceConfig(map[string]interface{}{})
+    if code, unmet := ready(); code != http.StatusOK || len(unmet) != 0 {
+        t.Fatalf("expected 200 once all conditions are met, got %d %v", code, unmet)
+    }
+}
+
+func TestReadyReasonAndConcurrentConnectionChanges(t *testing.T) {
+    g := NewGateway()
+
+    recorder := httptest.NewRecorder()
+    g.handleReadyRequest(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+    var body map[string]interface{}
+    json.NewDecoder(recorder.Body).Decode(&body)
+    if body["reason"] != "waiting for config_applied, device_manager_initialized, mqtt_connected" {
+        t.Errorf("unexpected reason: %v", body["reason"])
+    }
+
+    // Probes racing the event loop's connection updates must stay consistent
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 200; i++ {
+            g.setMqttConnected(i%2 == 0)
+        }
+    }()
+    for i := 0; i < 200; i++ {
+        recorder := httptest.NewRecorder()
+        g.handleReadyRequest(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+        if recorder.Code != http.StatusServiceUnavailable {
+            t.Fatalf("expected 503 without a device manager, got %d", recorder.Code)
+        }
+    }
+    <-done
+
+    recorder = httptest.NewRecorder()
+    handleHealthRequest(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+    if recorder.Code != http.StatusOK {
+        t.Errorf("expected /health to stay live while not ready, got %d", recorder.Code)
+    }
+}
+
+func TestStatusRequestWithConcurrentConnectionChanges(t *testing.T) {
+    g := NewGateway()
+
+    // Run with -race: the event loop and certificate watcher flip these while /status reads them
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 500; i++ {
+            g.setMqttConnected(i%2 == 0)
+            g.hasCertificates.Store(i%3 == 0)
+        }
+    }()
+    for i := 0; i < 500; i++ {
+        request := httptest.NewRequest(http.MethodGet, "/status", nil)
+        if i%2 == 0 {
+            request.Header.Set("Accept", "application/json")
+        }
+        recorder := httptest.NewRecorder()
+        g.handleStatusRequest(recorder, request)
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("expected 200, got %d", recorder.Code)
+        }
+    }
+    <-done
+
+    g.setMqttConnected(true)
+    recorder := httptest.NewRecorder()
+    g.handleStatusRequest(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+    if !strings.Contains(recorder.Body.String(), "MQTT Connected: YES") {
+        t.Errorf("expected connected status, got:\n%s", recorder.Body.String())
+    }
+}
+
+// sortedDeviceIDs lists the manager's device IDs in order
+func sortedDeviceIDs(dm *DeviceManager) []string {
+    dm.DeviceMutex.RLock()
+    defer dm.DeviceMutex.RUnlock()
+    ids := make([]string, 0, len(dm.Devices))
+    for id := range dm.Devices {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+func TestDeviceCountFromYAMLAndJSON(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    t.Cleanup(func() {
+        for _, id := range sortedDeviceIDs(dm) {
+            dm.RemoveDevice(id)
+        }
+    })
+    for _, count := range []int{3, 0, 12, 3} {
+        var fromYAML, fromJSON map[string]interface{}
+        if err := yaml.Unmarshal([]byte(fmt.Sprintf("devices:\n  count: %d\n", count)), &fromYAML); err != nil {
+            t.Fatalf("failed to parse YAML: %v", err)
+        }
+        if err := json.Unmarshal([]byte(fmt.Sprintf(`{"devices": {"count": %d}}`, count)), &fromJSON); err != nil {
+            t.Fatalf("failed to parse JSON: %v", err)
+        }
+        for source, config := range map[string]map[string]interface{}{"yaml": fromYAML, "json": fromJSON} {
+            dm.UpdateDeviceConfig(config)
+            if got := len(sortedDeviceIDs(dm)); got != count {
+                t.Errorf("%s count %d: expected %d devices, got %d", source, count, count, got)
+            }
+        }
+    }
+
+    // Leaving the count out still falls back to the default fleet
+    dm.UpdateDeviceConfig(map[string]interface{}{"devices": map[string]interface{}{}})
+    if got := len(sortedDeviceIDs(dm)); got != 5 {
+        t.Errorf("expected the default of 5 devices, got %d", got)
+    }
+}
+
+func TestNewDevicesDoNotModifyTheGatewayConfig(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    g.endDeviceManager = dm
+    waste := map[string]interface{}{"required_parameters": []interface{}{}}
+    config := map[string]interface{}{
+        "parameter_sets": map[string]interface{}{"waste": waste},
+        "devices":        map[string]interface{}{"count": 2},
+    }
+    
+    t.Cleanup(func() {
+        for _, id := range sortedDeviceIDs(dm) {
+            dm.RemoveDevice(id)
+        }
+    })
+    
+    result := dm.UpdateDeviceConfig(config)
+    if result.Updated != 2 {
+        t.Fatalf("expected both new devices to be configured, got %+v", result)
+    }
+    if _, ok := waste["enabled"]; ok {
+        t.Errorf("expected the shared parameter set to be left alone, got %v", waste)
+    }
+    for _, id := range sortedDeviceIDs(dm) {
+        device, _ := dm.deviceDetail(id)
+        sets, _ := device.DeviceConfig["parameter_sets"].(map[string]interface{})
+        if set, _ := sets["waste"].(map[string]interface{}); set == nil || set["enabled"] != true {
+            t.Errorf("expected %s to have its own activated parameter set, got %v", id, device.DeviceConfig)
+        }
+    }
+}
+
+func TestStoredConfigRetryNeverOverwritesNewerConfig(t *testing.T) {
+    useTestAPI(t, nil)
+    configWithWeight := func(kg int) string {
+        return fmt.Sprintf("parameter_sets: {waste: {}}\ndevices: {count: 1}\nmeasurement: {min_weight_kg: %d, max_weight_kg: %d.01, precision: 1}\n", kg, kg)
+    }
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-test-1", "waste")
+    dm.Devices[device.ID] = device
+    g.endDeviceManager = dm
+    g.currentConfig = Config{YAML: configWithWeight(10)}
+
+    // A device manager retry has read the older config and is waiting for the device lock
+    dm.DeviceMutex.Lock()
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        g.applyStoredConfig(dm)
+    }()
+    time.Sleep(20 * time.Millisecond)
+
+    // A newer config arrives meanwhile and must be applied after the retry, not before
+    go func() {
+        defer wg.Done()
+        g.storeConfig(configWithWeight(20))
+    }()
+    time.Sleep(20 * time.Millisecond)
+    dm.DeviceMutex.Unlock()
+    wg.Wait()
+
+    if got := weightOf(t, device.generateMeasurement()); got != 20.0 {
+        t.Fatalf("expected the newer config's weight 20.0, got %v", got)
+    }
+}
+
+func TestConfigPushesWhileDevicesPublish(t *testing.T) {
+    useTestAPI(t, nil)
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    g.endDeviceManager = dm
+    t.Cleanup(func() {
+        for _, id := range sortedDeviceIDs(dm) {
+            dm.RemoveDevice(id)
+        }
+    })
+    fleet := func(count int, maxWeight float64) map[string]interface{} {
+        return map[string]interface{}{
+            "measurement": map[string]interface{}{"min_weight_kg": 1.0, "max_weight_kg": maxWeight},
+            "parameter_sets": map[string]interface{}{
+                "waste": map[string]interface{}{
+                    "bin": map[string]interface{}{"type": "integer", "min": 1, "max": 9},
+                },
+            },
+            "devices": map[string]interface{}{
+                "count": count,
+                "behavior": map[string]interface{}{
+                    "scale": map[string]interface{}{"measurement_frequency_seconds": 0.1, "emit_on_start": true},
+                },
+            },
+        }
+    }
+
+    dm.UpdateDeviceConfig(fleet(4, 10))
+    stop := make(chan struct{})
+    var readers sync.WaitGroup
+    readers.Add(1)
+    go func() {
+        defer readers.Done()
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            recorder := httptest.NewRecorder()
+            g.handleDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+            dm.MeasureNow("all")
+        }
+    }()
+    for i := 0; i < 20; i++ {
+        dm.UpdateDeviceConfig(fleet(2+i%4, 10+float64(i)))
+        time.Sleep(10 * time.Millisecond)
+    }
+    close(stop)
+    readers.Wait()
+
+    if measurementsPublished(client) == 0 {
+        t.Error("expected devices to keep publishing during config pushes")
+    }
+    if got := len(sortedDeviceIDs(dm)); got != 2+19%4 {
+        t.Errorf("expected the last pushed fleet size, got %d devices", got)
+    }
+}
+
+func TestShrinkingFleetTwiceRemovesNewestDevices(t *testing.T) {
+    useTestAPI(t, nil)
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    t.Cleanup(func() {
+        for _, id := range sortedDeviceIDs(dm) {
+            dm.RemoveDevice(id)
+        }
+    })
+    fleet := func(count int) map[string]interface{} {
+        return map[string]interface{}{"devices": map[string]interface{}{"count": count}}
+    }
+
+    dm.UpdateDeviceConfig(fleet(12))
+    dm.DeviceMutex.RLock()
+    removed := dm.Devices["scale-gw-test-12"]
+    dm.DeviceMutex.RUnlock()
+
+    dm.UpdateDeviceConfig(fleet(2))
+    dm.UpdateDeviceConfig(fleet(2))
+    want := []string{"scale-gw-test-1", "scale-gw-test-2"}
+    if got := sortedDeviceIDs(dm); !reflect.DeepEqual(got, want) {
+        t.Fatalf("expected the lowest-numbered devices to remain, got %v", got)
+    }
+    select {
+    case <-removed.StopChan:
+    default:
+        t.Fatal("expected a removed device to be stopped")
+    }
+    // Stopping an already-stopped device is a no-op
+    removed.stop()
+
+    // Shutdown stops the remaining devices, and removing them afterwards
+    // (as the cleanup does) must not close their channels again
+    g.endDeviceManager = dm
+    g.registerDefaultShutdownSteps()
+    g.runShutdownSequence()
+}
+
+func TestMixedDeviceTypes(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    t.Cleanup(func() {
+        for _, id := range sortedDeviceIDs(dm) {
+            dm.RemoveDevice(id)
+        }
+    })
+    fleet := func(scales, sensors int) map[string]interface{} {
+        return map[string]interface{}{
+            "devices": map[string]interface{}{
+                "types": []interface{}{
+                    map[string]interface{}{"type": "scale", "count": scales},
+                    map[string]interface{}{"type": "temperature_sensor", "count": sensors},
+                },
+            },
+        }
+    }
+
+    dm.UpdateDeviceConfig(fleet(2, 3))
+    want := []string{"scale-gw-test-1", "scale-gw-test-2", "temp-gw-test-1", "temp-gw-test-2", "temp-gw-test-3"}
+    if got := sortedDeviceIDs(dm); !reflect.DeepEqual(got, want) {
+        t.Fatalf("expected devices %v, got %v", want, got)
+    }
+
+    dm.DeviceMutex.RLock()
+    sensor, scale := dm.Devices["temp-gw-test-1"], dm.Devices["scale-gw-test-1"]
+    dm.DeviceMutex.RUnlock()
+    if sensor.Type != "temperature_sensor" || scale.Type != "scale" {
+        t.Fatalf("unexpected device types %s and %s", sensor.Type, scale.Type)
+    }
+    measurement := sensor.generateMeasurement()
+    payload := measurement["payload"].(map[string]interface{})
+    if temperature, ok := payload["temperature_c"].(float64); !ok || temperature < 15 || temperature > 30 {
+        t.Errorf("expected a temperature reading, got %v", payload)
+    }
+    if _, ok := payload["weight_kg"]; ok || measurement["type"] != "temperature_measurement" {
+        t.Errorf("expected a temperature-only measurement, got %v", measurement)
+    }
+    if _, ok := scale.generateMeasurement()["payload"].(map[string]interface{})["weight_kg"]; !ok {
+        t.Error("expected scales to keep measuring weight")
+    }
+
+    // Shrinking one type leaves the other alone
+    dm.UpdateDeviceConfig(fleet(2, 1))
+    if got := len(sortedDeviceIDs(dm)); got != 3 {
+        t.Errorf("expected 3 devices after shrinking the sensors, got %d", got)
+    }
+}
+
+func TestDeviceStatsSurviveRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "stats.json")
+    t.Setenv("DEVICE_STATS_FILE", path)
+    t.Setenv("DEVICE_STATS_SAVE_INTERVAL_SECONDS", "3600")
+    config := map[string]interface{}{"devices": map[string]interface{}{"count": 2}}
+    start := func() *DeviceManager {
+        g, _ := newTestGateway()
+        dm := NewDeviceManager(g)
+        dm.UpdateDeviceConfig(config)
+        t.Cleanup(func() {
+            for _, id := range sortedDeviceIDs(dm) {
+                dm.RemoveDevice(id)
+            }
+        })
+        return dm
+    }
+
+    first := start()
+    first.DeviceMutex.Lock()
+    first.Devices["scale-gw-test-1"].MeasurementCount = 7
+    first.Devices["scale-gw-test-1"].TotalWeightMeasured = 81.5
+    first.Devices["scale-gw-test-2"].MeasurementCount = 3
+    first.DeviceMutex.Unlock()
+    if err := first.saveStats(); err != nil {
+        t.Fatalf("saving stats: %v", err)
+    }
+
+    second := start()
+    second.DeviceMutex.RLock()
+    restored := second.Devices["scale-gw-test-1"]
+    count, weight := restored.MeasurementCount, restored.TotalWeightMeasured
+    otherCount := second.Devices["scale-gw-test-2"].MeasurementCount
+    second.DeviceMutex.RUnlock()
+    if count != 7 || weight != 81.5 || otherCount != 3 {
+        t.Errorf("expected counters 7/81.5 and 3 to be restored, got %d/%v and %d", count, weight, otherCount)
+    }
+
+    // A corrupt file starts fresh instead of failing
+    if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    third := start()
+    third.DeviceMutex.RLock()
+    count = third.Devices["scale-gw-test-1"].MeasurementCount
+    third.DeviceMutex.RUnlock()
+    if count != 0 {
+        t.Errorf("expected fresh counters after a corrupt stats file, got %d", count)
+    }
+}
+
+func TestMeasureNowCommandPublishesImmediately(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    for _, id := range []string{"scale-gw-1", "scale-gw-2"} {
+        dm.Devices[id] = newTestDevice(id, "waste")
+    }
+    g.endDeviceManager = dm
+    command := func(deviceID string) {
+        payload := []byte(`{"type":"measure_now","device_id":"` + deviceID + `"}`)
+        g.handleMQTTMessage(&mockMessage{topic: "gateway/gw-test/command", payload: payload})
+    }
+
+    command("scale-gw-1")
+    if got := measurementsPublished(client); got != 1 {
+        t.Fatalf("expected 1 measurement after measure_now, got %d", got)
+    }
+    if dm.Devices["scale-gw-1"].MeasurementCount != 1 {
+        t.Errorf("expected measure_now to count the measurement")
+    }
+
+    // Suspended devices are rejected, or skipped when targeting all devices
+    dm.Devices["scale-gw-2"].UpdateStatus = &UpdateStatus{InProgress: true, SuspendMeasure: true}
+    command("scale-gw-2")
+    command("unknown")
+    if got := measurementsPublished(client); got != 1 {
+        t.Errorf("expected rejected commands not to publish, got %d measurements", got)
+    }
+    command("all")
+    if got := measurementsPublished(client); got != 2 {
+        t.Errorf("expected measure_now all to skip the suspended device, got %d measurements", got)
+    }
+}
+
+func TestSetParameterSetCommand(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    sets := map[string]interface{}{
+        "waste":       map[string]interface{}{},
+        "recyclables": map[string]interface{}{},
+    }
+    for _, id := range []string{"scale-gw-1", "scale-gw-2"} {
+        device := newTestDevice(id, "waste")
+        device.DeviceConfig["parameter_sets"] = sets
+        dm.Devices[id] = device
+    }
+    g.endDeviceManager = dm
+    command := func(deviceID string, setName string) map[string]interface{} {
+        payload := []byte(`{"type":"set_parameter_set","device_id":"` + deviceID + `","set_name":"` + setName + `"}`)
+        g.handleMQTTMessage(&mockMessage{topic: "gateway/gw-test/command", payload: payload})
+        var ack map[string]interface{}
+        for _, msg := range client.messages() {
+            if msg.Topic == "gateway/gw-test/command/ack" {
+                json.Unmarshal(msg.Payload, &ack)
+            }
+        }
+        return ack
+    }
+
+    if ack := command("scale-gw-1", "recyclables"); ack["status"] != "success" {
+        t.Fatalf("expected a success acknowledgment, got %v", ack)
+    }
+    measurement := dm.Devices["scale-gw-1"].generateMeasurement()
+    if got := measurement["payload"].(map[string]interface{})["parameter_set"]; got != "recyclables" {
+        t.Errorf("expected measurements to use the new set, got %v", got)
+    }
+    recorder := httptest.NewRecorder()
+    g.handleDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+    if !strings.Contains(recorder.Body.String(), `"parameter_set":"recyclables"`) {
+        t.Errorf("expected /devices to show the new set, got %s", recorder.Body.String())
+    }
+    // The other device keeps its set
+    if got := dm.Devices["scale-gw-2"].DeviceConfig["active_parameter_set"]; got != "waste" {
+        t.Errorf("expected scale-gw-2 to keep waste, got %v", got)
+    }
+
+    ack := command("scale-gw-1", "airline")
+    if ack["status"] != "failure" || !strings.Contains(fmt.Sprint(ack["error"]), "airline") {
+        t.Errorf("expected a failure acknowledgment naming the set, got %v", ack)
+    }
+    if got := dm.Devices["scale-gw-1"].DeviceConfig["active_parameter_set"]; got != "recyclables" {
+        t.Errorf("expected an unknown set to leave the device alone, got %v", got)
+    }
+}
+
+func TestParameterSetsAssignedRoundRobin(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    t.Cleanup(func() {
+        for _, id := range sortedDeviceIDs(dm) {
+            dm.RemoveDevice(id)
+        }
+    })
+    dm.UpdateDeviceConfig(map[string]interface{}{
+        "parameter_sets": map[string]interface{}{
+            "waste":       map[string]interface{}{},
+            "recyclables": map[string]interface{}{},
+            "airline":     map[string]interface{}{},
+        },
+        "devices": map[string]interface{}{"count": 6},
+    })
+
+    assigned := make(map[string][]string)
+    ids := sortedDeviceIDs(dm)
+    dm.DeviceMutex.RLock()
+    for _, id := range ids {
+        set, _ := dm.Devices[id].DeviceConfig["active_parameter_set"].(string)
+        assigned[set] = append(assigned[set], id)
+    }
+    dm.DeviceMutex.RUnlock()
+    want := map[string][]string{
+        "airline":     {"scale-gw-test-1", "scale-gw-test-4"},
+        "recyclables": {"scale-gw-test-2", "scale-gw-test-5"},
+        "waste":       {"scale-gw-test-3", "scale-gw-test-6"},
+    }
+    if !reflect.DeepEqual(assigned, want) {
+        t.Errorf("expected devices spread across all sets, got %v", assigned)
+    }
+}
+
+func TestUnknownMappedParameterSetFallsBackToDefault(t *testing.T) {
+    var logs bytes.Buffer
+    log.SetOutput(&logs)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+    config := map[string]interface{}{
+        "parameter_sets": map[string]interface{}{
+            "waste":       map[string]interface{}{},
+            "recyclables": map[string]interface{}{},
+        },
+        "devices": map[string]interface{}{
+            "default_parameter_set":  "recyclables",
+            "parameter_set_mappings": map[string]interface{}{"scale-gw-1": "wastee"},
+        },
+    }
+    deviceConfig := getDeviceConfig("scale-gw-1", "scale", "1.0.0", config)
+    if got := deviceConfig["active_parameter_set"]; got != "recyclables" {
+        t.Errorf("expected the default set, got %v", got)
+    }
+    if !strings.Contains(logs.String(), `device scale-gw-1 is mapped to unknown parameter set "wastee"`) {
+        t.Errorf("expected a warning naming the device and set, got %q", logs.String())
+    }
+    if err := validateDeviceConfig(deviceConfig); err != nil {
+        t.Errorf("expected the fallback config to be valid, got %v", err)
+    }
+
+    // Unmapped devices also use the default rather than an arbitrary set
+    if got := getDeviceConfig("scale-gw-2", "scale", "1.0.0", config)["active_parameter_set"]; got != "recyclables" {
+        t.Errorf("expected unmapped devices to use the default set, got %v", got)
+    }
+}
+
+func TestInvalidParameterSetMarksDeviceUpdateFailed(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+
+    g.endDeviceManager = dm
+
+    result := dm.UpdateDeviceConfig(map[string]interface{}{
+        "parameter_sets": map[string]interface{}{"waste": map[string]interface{}{}},
+        "devices": map[string]interface{}{
+            "count":                  1,
+            "parameter_set_mappings": map[string]interface{}{"scale-gw-1": "recyclables"},
+        },
+    })
+
+    if device.ConfigVersion != "testver1" {
+        t.Errorf("failed update should keep the old version, got %s", device.ConfigVersion)
+    }
+    if device.UpdateStatus == nil || !device.UpdateStatus.Failed || !strings.Contains(device.UpdateStatus.StatusMessage, "recyclables") {
+        t.Fatalf("expected an error update status naming the set, got %+v", device.UpdateStatus)
+    }
+    if got := device.DeviceConfig["active_parameter_set"]; got != "waste" {
+        t.Errorf("failed update should keep the old config, got parameter set %v", got)
+    }
+
+    recorder := httptest.NewRecorder()
+    g.handleDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+    if !strings.Contains(recorder.Body.String(), `"update_status":"error"`) {
+        t.Errorf("expected /devices to report the error, got %s", recorder.Body.String())
+    }
+
+    g.sendConfigAcknowledgment("update-1", result, nil)
+    g.configAcks.Wait()
+    var ack map[string]interface{}
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/config/delivered" {
+            json.Unmarshal(msg.Payload, &ack)
+        }
+    }
+    deviceErrors, _ := ack["device_errors"].(map[string]interface{})
+    if ack["status"] != "partial_failure" || deviceErrors["scale-gw-1"] == nil {
+        t.Errorf("expected ack to report the device error, got %v", ack)
+    }
+}
+
+func TestMeasurementCarriesConfigVersion(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    dm.Devices[device.ID] = device
+
+    before := createMeasurementEvent(device, time.Now(), map[string]interface{}{})
+    if before["config_version"] != "testver1" {
+        t.Fatalf("expected the current config version, got %v", before["config_version"])
+    }
+
+    dm.UpdateDeviceConfig(map[string]interface{}{
+        "parameter_sets": map[string]interface{}{"waste": map[string]interface{}{}},
+        "devices":        map[string]interface{}{"count": 1},
+    })
+
+    after := createMeasurementEvent(device, time.Now(), map[string]interface{}{})
+    if after["config_version"] == "testver1" || after["config_version"] != device.ConfigVersion {
+        t.Fatalf("expected the updated config version %s, got %v", device.ConfigVersion, after["config_version"])
+    }
+}
+
+func TestParallelConfigApplyKeepsLockShort(t *testing.T) {
+    g, _ := newTestGateway()
+    const fleet = 200
+    gatewayConfig := func() map[string]interface{} {
+        return map[string]interface{}{
+            "parameter_sets": map[string]interface{}{
+                "waste":       map[string]interface{}{"description": "General waste"},
+                "recyclables": map[string]interface{}{"description": "Recyclables"},
+            },
+            "devices": map[string]interface{}{
+                "count":                  fleet,
+                "parameter_set_mappings": map[string]interface{}{"scale-gw-test-1": "recyclables", "scale-gw-test-2": "waste"},
+                "overrides": map[string]interface{}{
+                    "scale-gw-test-3": map[string]interface{}{"measurement": map[string]interface{}{"precision": 0.5}},
+                },
+            },
+            "measurement": map[string]interface{}{"precision": 0.1},
+        }
+    }
+    newFleet := func() *DeviceManager {
+        dm := NewDeviceManager(g)
+        for i := 1; i <= fleet; i++ {
+            device := newTestDevice(fmt.Sprintf("scale-gw-test-%d", i), "")
+            dm.Devices[device.ID] = device
+        }
+        return dm
+    }
+
+    serial, parallel := newFleet(), newFleet()
+    t.Setenv("CONFIG_APPLY_WORKERS", "1")
+    serial.UpdateDeviceConfig(gatewayConfig())
+    t.Setenv("CONFIG_APPLY_WORKERS", "8")
+    start := time.Now()
+    parallel.UpdateDeviceConfig(gatewayConfig())
+    elapsed := time.Since(start)
+
+    // Parallel workers produce the same per-device versions as a single worker
+    for id, device := range parallel.Devices {
+        if device.ConfigVersion == "testver1" || device.ConfigVersion != serial.Devices[id].ConfigVersion {
+            t.Fatalf("device %s: version %s, serial %s", id, device.ConfigVersion, serial.Devices[id].ConfigVersion)
+        }
+    }
+    if got := parallel.Devices["scale-gw-test-1"].DeviceConfig["active_parameter_set"]; got != "recyclables" {
+        t.Errorf("expected mapped parameter set, got %v", got)
+    }
+    // Overrides stay on their own device
+    if got := parallel.Devices["scale-gw-test-4"].DeviceConfig["measurement"].(map[string]interface{})["precision"]; got != 0.1 {
+        t.Errorf("override leaked to another device: precision %v", got)
+    }
+
+    // Hashing and merging happen outside the lock, so it is held for a fraction of the update
+    parallel.DeviceMutex.RLock()
+    held := parallel.configLockHold
+    parallel.DeviceMutex.RUnlock()
+    if held <= 0 || held*2 > elapsed {
+        t.Errorf("device lock held for %v of a %v update", held, elapsed)
+    }
+}
+
+func TestParameterSetDeliveryGuarantees(t *testing.T) {
+    g, client := newTestGateway()
+    previousBackoff := measurementRetryBackoff
+    t.Cleanup(func() { measurementRetryBackoff = previousBackoff })
+    measurementRetryBackoff = time.Millisecond
+
+    parameterSets := map[string]interface{}{
+        "airline_luggage": map[string]interface{}{
+            "delivery": map[string]interface{}{"qos": 1, "retries": 2},
+        },
+        "waste": map[string]interface{}{},
+    }
+    luggage := newTestDevice("scale-gw-1", "airline_luggage")
+    luggage.DeviceConfig["parameter_sets"] = parameterSets
+    waste := newTestDevice("scale-gw-2", "waste")
+    waste.DeviceConfig["parameter_sets"] = parameterSets
+
+    dm := NewDeviceManager(g)
+    // The first luggage publish fails and is retried at the set's QoS
+    client.failPublishes = 1
+    dm.publishMeasurement(luggage, luggage.generateMeasurement())
+    dm.publishMeasurement(waste, waste.generateMeasurement())
+
+    var luggageQoS, wasteQoS []byte
+    for _, msg := range client.messages() {
+        switch {
+        case strings.Contains(msg.Topic, "scale-gw-1"):
+            luggageQoS = append(luggageQoS, msg.QoS)
+        case strings.Contains(msg.Topic, "scale-gw-2"):
+            wasteQoS = append(wasteQoS, msg.QoS)
+        }
+    }
+    if !bytes.Equal(luggageQoS, []byte{1, 1}) {
+        t.Errorf("expected a retried QoS 1 publish for the luggage set, got QoS %v", luggageQoS)
+    }
+    if !bytes.Equal(wasteQoS, []byte{0}) {
+        t.Errorf("expected one default QoS publish for the waste set, got QoS %v", wasteQoS)
+    }
+}
+
+func TestPublishQoSIsConfigurable(t *testing.T) {
+    useTestAPI(t, nil)
+    t.Setenv("GATEWAY_PUBLISH_QOS", "2")
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    parameterSets := map[string]interface{}{
+        "airline_luggage": map[string]interface{}{"delivery": map[string]interface{}{"qos": 1}},
+        "waste":           map[string]interface{}{},
+    }
+    waste := newTestDevice("scale-gw-1", "waste")
+    waste.DeviceConfig["parameter_sets"] = parameterSets
+    luggage := newTestDevice("scale-gw-2", "airline_luggage")
+    luggage.DeviceConfig["parameter_sets"] = parameterSets
+
+    dm.publishMeasurement(waste, waste.generateMeasurement())
+    dm.publishMeasurement(luggage, luggage.generateMeasurement())
+    g.sendHeartbeat()
+    g.requestConfigWithUpdateID("")
+
+    want := map[string]byte{
+        "gateway/gw-test/device/scale-gw-1/measurement": 2,
+        "gateway/gw-test/device/scale-gw-2/measurement": 1, // The set's delivery wins
+        "gateway/gw-test/heartbeat":                     2,
+        "gateway/gw-test/config/request":                2,
+    }
+    got := make(map[string]byte)
+    for _, msg := range client.messages() {
+        if _, ok := want[msg.Topic]; ok {
+            got[msg.Topic] = msg.QoS
+        }
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("expected publish QoS %v, got %v", want, got)
+    }
+    
+    // Batched measurements, published live or from the offline buffer
+    dm.batcher = newMeasurementBatcher(1, time.Hour, BatchGroupDevice)
+    dm.offline = newOfflineBuffer(10)
+    dm.emitMeasurement(waste)
+    g.isMqttConnected.Store(false)
+    dm.emitMeasurement(waste)
+    g.isMqttConnected.Store(true)
+    dm.flushOfflineBuffer()
+    var batchQoS []byte
+    for _, msg := range client.messages() {
+        if msg.Topic == "gateway/gw-test/device/scale-gw-1/measurement/batch" {
+            batchQoS = append(batchQoS, msg.QoS)
+        }
+    }
+    if !bytes.Equal(batchQoS, []byte{2, 2}) {
+        t.Errorf("expected both batches at GATEWAY_PUBLISH_QOS 2, got %v", batchQoS)
+    }
+    if qos := configAckQoS(); qos != 2 {
+        t.Errorf("expected config acks to follow GATEWAY_PUBLISH_QOS, got %d", qos)
+    }
+    t.Setenv("CONFIG_ACK_QOS", "0")
+    if qos := configAckQoS(); qos != 0 {
+        t.Errorf("expected CONFIG_ACK_QOS to win, got %d", qos)
+    }
+}
+
+func TestStatusRepresentations(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    for id, set := range map[string]string{"scale-gw-1": "waste", "scale-gw-2": "waste", "scale-gw-3": "recyclables"} {
+        dm.Devices[id] = newTestDevice(id, set)
+    }
+    g.endDeviceManager = dm
+
+    // Plain text stays the default
+    for _, accept := range []string{"", "text/plain"} {
+        recorder := httptest.NewRecorder()
+        request := httptest.NewRequest(http.MethodGet, "/status", nil)
+        request.Header.Set("Accept", accept)
+        g.handleStatusRequest(recorder, request)
+        if recorder.Header().Get("Content-Type") != "text/plain" || !strings.Contains(recorder.Body.String(), "Gateway ID: gw-test") {
+            t.Errorf("Accept %q: expected plain text status, got %q", accept, recorder.Body.String())
+        }
+        if !strings.Contains(recorder.Body.String(), "  - waste: 2 device(s)") {
+            t.Errorf("Accept %q: expected parameter set counts, got %q", accept, recorder.Body.String())
+        }
+    }
+
+    recorder := httptest.NewRecorder()
+    request := httptest.NewRequest(http.MethodGet, "/status", nil)
+    request.Header.Set("Accept", "application/json")
+    g.handleStatusRequest(recorder, request)
+    if recorder.Header().Get("Content-Type") != "application/json" {
+        t.Fatalf("expected JSON content type, got %q", recorder.Header().Get("Content-Type"))
+    }
+    var status GatewayStatus
+    if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+        t.Fatalf("invalid JSON status: %v", err)
+    }
+    want := []ParameterSetCount{{ParameterSet: "recyclables", Devices: 1}, {ParameterSet: "waste", Devices: 2}}
+    if status.GatewayID != "gw-test" || !status.MQTTConnected || status.TotalDevices != 3 || !reflect.DeepEqual(status.Devices, want) {
+        t.Errorf("unexpected JSON status: %+v", status)
+    }
+}
+
+func TestDeleteDeviceEndpoint(t *testing.T) {
+    g, _ := newTestGateway()
+    dm := NewDeviceManager(g)
+    for _, id := range []string{"scale-gw-test-1", "scale-gw-test-2", "scale-gw-test-3"} {
+        dm.Devices[id] = newTestDevice(id, "waste")
+    }
+    stopChan := dm.Devices["scale-gw-test-2"].StopChan
+    g.endDeviceManager = dm
+
+    recorder := httptest.NewRecorder()
+    g.handleDeviceRequest(recorder, httptest.NewRequest(http.MethodDelete, "/devices/scale-gw-test-2", nil))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    select {
+    case <-stopChan:
+    default:
+        t.Error("expected the device stop channel to be closed")
+    }
+
+    recorder = httptest.NewRecorder()
+    g.handleDeviceRequest(recorder, httptest.NewRequest(http.MethodDelete, "/devices/scale-gw-test-2", nil))
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("expected 404 for an unknown device, got %d", recorder.Code)
+    }
+
+    recorder = httptest.NewRecorder()
+    request := httptest.NewRequest(http.MethodGet, "/status", nil)
+    request.Header.Set("Accept", "application/json")
+    g.handleStatusRequest(recorder, request)
+    var status GatewayStatus
+    if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+        t.Fatalf("invalid JSON status: %v", err)
+    }
+    if status.TotalDevices != 2 || !reflect.DeepEqual(status.Devices, []ParameterSetCount{{ParameterSet: "waste", Devices: 2}}) {
+        t.Errorf("unexpected status after removal: %+v", status)
+    }
+
+    // Growing back to the original count must not reuse a running device's ID
+    dm.DeviceMutex.Lock()
+    if id := dm.nextDeviceID("scale", len(dm.Devices) + 1); id != "scale-gw-test-4" {
+        t.Errorf("expected next device ID scale-gw-test-4, got %s", id)
+    }
+    dm.DeviceMutex.Unlock()
+}
+
+func TestForcedFaultSuspendsMeasurements(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "measurement_frequency_seconds": 0.1,
+        "fault_duration_seconds":        0.4,
+    }
+    dm.Devices[device.ID] = device
+    g.endDeviceManager = dm
+
+    status := func() string {
+        dm.DeviceMutex.RLock()
+        defer dm.DeviceMutex.RUnlock()
+        return device.Status
+    }
+    waitFor := func(condition func() bool, what string) {
+        deadline := time.Now().Add(2 * time.Second)
+        for !condition() {
+            if time.Now().After(deadline) {
+                t.Fatalf("timed out waiting for %s", what)
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+
+    go dm.runDeviceSimulation(device)
+    defer close(device.StopChan)
+    waitFor(func() bool { return measurementsPublished(client) > 0 }, "first measurement")
+
+    recorder := httptest.NewRecorder()
+    g.handleDeviceRequest(recorder, httptest.NewRequest(http.MethodPost, "/devices/scale-gw-1/fault", nil))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    faultedAt := time.Now()
+    published := measurementsPublished(client)
+
+    // The fault shows up in /devices and the heartbeat while no measurements go out
+    recorder = httptest.NewRecorder()
+    g.handleDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+    if !strings.Contains(recorder.Body.String(), `"status":"error"`) {
+        t.Errorf("expected error status in /devices, got %s", recorder.Body.String())
+    }
+    statuses := g.buildHeartbeatPayload(HeartbeatSchemaDeviceStats)["device_statuses"].(map[string]int)
+    if statuses["error"] != 1 {
+        t.Errorf("expected one errored device in the heartbeat, got %v", statuses)
+    }
+    time.Sleep(250 * time.Millisecond)
+    if got := measurementsPublished(client); got != published {
+        t.Errorf("expected no measurements during the fault, got %d more", got-published)
+    }
+
+    waitFor(func() bool { return status() == "online" }, "recovery")
+    if elapsed := time.Since(faultedAt); elapsed < 400*time.Millisecond {
+        t.Errorf("expected the fault to last 400ms, recovered after %v", elapsed)
+    }
+    waitFor(func() bool { return measurementsPublished(client) > published }, "measurements to resume")
+
+    recorder = httptest.NewRecorder()
+    g.handleDeviceRequest(recorder, httptest.NewRequest(http.MethodPost, "/devices/missing/fault", nil))
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("expected 404 for an unknown device, got %d", recorder.Code)
+    }
+}
+
+func TestBatteryDrainsAndReportsLowBatteryOnce(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-1", "waste")
+    device.StartTime = time.Now()
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "battery_drain_per_measurement": 30,
+        "battery_low_threshold_pct":     20,
+    }
+    dm.Devices[device.ID] = device
+
+    for i := 0; i < 5; i++ {
+        dm.emitMeasurement(device)
+    }
+
+    levels := []float64{}
+    lowBatteryEvents := []map[string]interface{}{}
+    for _, msg := range client.messages() {
+        var event map[string]interface{}
+        json.Unmarshal(msg.Payload, &event)
+        switch event["event_type"] {
+        case "measurement":
+            levels = append(levels, event["payload"].(map[string]interface{})["battery_pct"].(float64))
+        case "low_battery":
+            if msg.Topic != "gateway/gw-test/device/scale-gw-1/measurement" {
+                t.Errorf("unexpected low battery topic %s", msg.Topic)
+            }
+            lowBatteryEvents = append(lowBatteryEvents, event)
+        }
+    }
+    if want := []float64{70, 40, 10, 0, 0}; !reflect.DeepEqual(levels, want) {
+        t.Errorf("expected battery levels %v, got %v", want, levels)
+    }
+    if len(lowBatteryEvents) != 1 || lowBatteryEvents[0]["battery_pct"] != 10.0 {
+        t.Errorf("expected one low battery event at 10%%, got %v", lowBatteryEvents)
+    }
+
+    // Without battery simulation the payload has no battery level
+    plain := newTestDevice("scale-gw-2", "waste")
+    measurement := plain.generateMeasurement()
+    if plain.drainBattery(measurement) {
+        t.Error("expected no low battery event without battery simulation")
+    }
+    if _, ok := measurement["payload"].(map[string]interface{})["battery_pct"]; ok {
+        t.Error("expected no battery_pct without battery simulation")
+    }
+}
+
+func TestDeviceDetailEndpoint(t *testing.T) {
+    g := NewGateway()
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-gw-test-1", "recyclables")
+    device.FirmwareVersion = "v2.0.0"
+    device.Capabilities["anomaly_injection"] = true
+    device.UpdateStatus = &UpdateStatus{Failed: true, StatusMessage: "bad config"}
+    device.DeviceConfig["parameter_sets"] = map[string]interface{}{
+        "recyclables": map[string]interface{}{
+            "required_parameters": []interface{}{"material_type"},
+            "parameter_definitions": map[string]interface{}{
+                "material_type": map[string]interface{}{"type": "string", "allowed_values": []interface{}{"paper", "glass"}},
+                "contamination": map[string]interface{}{"type": "float"},
+            },
+        },
+    }
+    dm.Devices[device.ID] = device
+    g.endDeviceManager = dm
+
+    recorder := httptest.NewRecorder()
+    g.handleDeviceRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices/scale-gw-test-1", nil))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    var detail DeviceDetail
+    if err := json.Unmarshal(recorder.Body.Bytes(), &detail); err != nil {
+        t.Fatalf("invalid JSON detail: %v", err)
+    }
+    if detail.FirmwareVersion != "v2.0.0" || detail.ConfigVersion != "testver1" || !detail.Capabilities["anomaly_injection"] {
+        t.Errorf("unexpected device fields: %+v", detail)
+    }
+    if detail.UpdateStatus == nil || !detail.UpdateStatus.Failed || detail.UpdateStatus.StatusMessage != "bad config" {
+        t.Errorf("unexpected update status: %+v", detail.UpdateStatus)
+    }
+    if detail.ActiveParameterSet != "recyclables" {
+        t.Errorf("expected raw active parameter set, got %v", detail.ActiveParameterSet)
+    }
+    if _, ok := detail.ParameterDefinitions["material_type"]; !ok || len(detail.ParameterDefinitions) != 1 {
+        t.Errorf("expected only the required parameter definitions, got %v", detail.ParameterDefinitions)
+    }
+    if _, ok := detail.DeviceConfig["measurement"]; !ok {
+        t.Errorf("expected the full device config, got %v", detail.DeviceConfig)
+    }
+
+    recorder = httptest.NewRecorder()
+    g.handleDeviceRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices/scale-gw-test-9", nil))
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("expected 404 for an unknown device, got %d", recorder.Code)
+    }
+}
+
+func TestSchemaRegistryValidatesMeasurements(t *testing.T) {
+    var fetches int32
+    registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&fetches, 1)
+        if r.URL.Path != "/schemas/measurement/waste" {
+            http.NotFound(w, r)
+            return
+        }
+        w.Write([]byte(`{
+            "type": "object",
+            "required": ["device_id", "payload"],
+            "properties": {
+                "payload": {
+                    "type": "object",
+                    "required": ["weight_kg"],
+                    "properties": {"weight_kg": {"type": "number", "maximum": 5}}
+                }
+            }
+        }`))
+    }))
+    t.Cleanup(registry.Close)
+
+    for _, failOnInvalid := range []bool{true, false} {
+        // Weights of 10 kg break the waste schema; recyclables has no schema
+        invalid := newTestDevice("scale-gw-test-1", "waste")
+        unchecked := newTestDevice("scale-gw-test-2", "recyclables")
+        g, client := newTestGateway()
+        dm := NewDeviceManager(g)
+        dm.schemas = newSchemaRegistry(registry.URL, failOnInvalid, time.Minute)
+
+        dm.emitMeasurement(invalid)
+        dm.emitMeasurement(invalid)
+        dm.emitMeasurement(unchecked)
+
+        want := 3
+        if failOnInvalid {
+            want = 1
+        }
+        if got := len(client.messages()); got != want {
+            t.Errorf("fail=%v: expected %d published measurements, got %d", failOnInvalid, want, got)
+        }
+    }
+    // waste, recyclables and the measurement fallback are each fetched once per registry
+    if got := atomic.LoadInt32(&fetches); got != 6 {
+        t.Errorf("expected cached schema lookups, got %d registry requests", got)
+    }
+
+    // An unreachable registry doesn't stop publishing
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    dm.schemas = newSchemaRegistry("http://127.0.0.1:1", true, time.Minute)
+    dm.emitMeasurement(newTestDevice("scale-gw-test-1", "waste"))
+    if got := len(client.messages()); got != 1 {
+        t.Errorf("expected measurement published while registry is down, got %d", got)
+    }
+}
+
+func TestSlowSchemaFetchOnlyBlocksItsKey(t *testing.T) {
+    release := make(chan struct{})
+    var slowFetches int32
+    registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/schemas/measurement/waste" {
+            atomic.AddInt32(&slowFetches, 1)
+            <-release
+        }
+        http.NotFound(w, r)
+    }))
+    t.Cleanup(registry.Close)
+    schemas := newSchemaRegistry(registry.URL, false, time.Minute)
+
+    // Several devices wait on the slow waste schema
+    var wg sync.WaitGroup
+    for i := 0; i < 3; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            schemas.schemaFor("measurement", "waste")
+        }()
+    }
+    time.Sleep(50 * time.Millisecond)
+
+    // Another parameter set's lookup isn't held up by them
+    done := make(chan struct{})
+    go func() {
+        schemas.schemaFor("measurement", "recyclables")
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatalf("lookup for another key blocked behind the slow fetch")
+    }
+
+    close(release)
+    wg.Wait()
+    if got := atomic.LoadInt32(&slowFetches); got != 1 {
+        t.Errorf("expected concurrent lookups to share one fetch, got %d", got)
+    }
+}
+
+func TestMeasurementStdoutMode(t *testing.T) {
+    g, client := newTestGateway()
+    t.Setenv("MEASUREMENT_STDOUT", "true")
+    t.Setenv("MEASUREMENT_STDOUT_ONLY", "true")
+    var out bytes.Buffer
+    prevWriter := measurementWriter
+    measurementWriter = &out
+    t.Cleanup(func() { measurementWriter = prevWriter })
+
+    dm := NewDeviceManager(g)
+    device := newTestDevice("scale-stdout", "waste")
+    dm.emitMeasurement(device)
+    dm.emitMeasurement(device)
+
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("expected 2 measurement lines, got %d: %q", len(lines), out.String())
+    }
+    for _, line := range lines {
+        var measurement map[string]interface{}
+        if err := json.Unmarshal([]byte(line), &measurement); err != nil {
+            t.Fatalf("line is not JSON: %q", line)
+        }
+        if measurement["device_id"] != "scale-stdout" || weightOf(t, measurement) != 10.0 {
+            t.Errorf("unexpected measurement %v", measurement)
+        }
+    }
+    if len(client.messages()) != 0 {
+        t.Errorf("expected no MQTT publishes in stdout-only mode, got %d", len(client.messages()))
+    }
+}
+
+func TestZeroOffsetAndNoise(t *testing.T) {
+    device := newTestDevice("scale-offset", "waste")
+    device.DeviceConfig["behavior"] = map[string]interface{}{"zero_offset": 2.5}
+    if weight := weightOf(t, device.generateMeasurement()); weight != 12.5 {
+        t.Errorf("expected offset reading 12.5, got %v", weight)
+    }
+
+    device = newTestDevice("scale-noise", "waste")
+    device.DeviceConfig["measurement"].(map[string]interface{})["precision"] = 0.001
+    device.DeviceConfig["behavior"] = map[string]interface{}{"noise_stddev": 0.5}
+    const samples = 2000
+    var sum, sumSquares float64
+    for i := 0; i < samples; i++ {
+        weight := weightOf(t, device.generateMeasurement())
+        sum += weight
+        sumSquares += weight * weight
+    }
+    mean := sum / samples
+    stddev := math.Sqrt(sumSquares/samples - mean*mean)
+    if math.Abs(mean-10.0) > 0.1 {
+        t.Errorf("expected noisy readings to average 10.0, got %v", mean)
+    }
+    if stddev < 0.4 || stddev > 0.6 {
+        t.Errorf("expected noise stddev near 0.5, got %v", stddev)
+    }
+}
+
+func TestMirrorDeviceTracksSourceMeasurements(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    sourceTopic := "gateway/gw-real/device/scale-real/measurement"
+    device := newTestDevice("scale-shadow", "waste")
+    device.DeviceConfig["behavior"] = map[string]interface{}{
+        "mirror": map[string]interface{}{"source_topic": sourceTopic},
+    }
+
+    dm.addMirror(device.mirrorSourceTopic(), device)
+    if !client.deliver(sourceTopic, []byte(`{"device_id":"scale-real","payload":{"weight_kg":17.3}}`)) {
+        t.Fatalf("expected a subscription to %s", sourceTopic)
+    }
+    if weight := weightOf(t, device.generateMeasurement()); weight != 17.3 {
+        t.Errorf("expected mirrored weight 17.3, got %v", weight)
+    }
+
+    dm.removeMirror(sourceTopic, device)
+    if client.deliver(sourceTopic, []byte(`{"payload":{"weight_kg":1}}`)) {
+        t.Error("expected the mirror subscription to be removed")
+    }
+}
+
+func TestAPIConcurrencyLimit(t *testing.T) {
+    g := NewGateway()
+    var current, peak int32
+    var mu sync.Mutex
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        current++
+        if current > peak {
+            peak = current
+        }
+        mu.Unlock()
+        time.Sleep(20 * time.Millisecond)
+        mu.Lock()
+        current--
+        mu.Unlock()
+        w.Write([]byte(`{"status":"ok"}`))
+    })
+    prevLimiter := apiRequestLimiter
+    apiRequestLimiter = newAPILimiter(2, false)
+    t.Cleanup(func() { apiRequestLimiter = prevLimiter })
+
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := g.sendEventToAPI("gw-test", "heartbeat", map[string]interface{}{}); err != nil {
+                t.Errorf("queued request failed: %v", err)
+            }
+        }()
+    }
+    wg.Wait()
+    if peak > 2 {
+        t.Errorf("expected at most 2 concurrent API posts, saw %d", peak)
+    }
+
+    // With the drop policy, requests beyond the limit fail immediately
+    apiRequestLimiter = newAPILimiter(1, true)
+    apiRequestLimiter.acquire()
+    if _, err := g.sendEventToAPI("gw-test", "heartbeat", map[string]interface{}{}); err == nil {
+        t.Error("expected request to be dropped while saturated")
+    }
+    apiRequestLimiter.release()
+}
+
+func TestHeartbeatFollowsNegotiatedSchema(t *testing.T) {
+    g, _ := newTestGateway()
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"status":"ok","heartbeat_schema":1}`))
+    })
+    g.endDeviceManager = NewDeviceManager(g)
+    g.endDeviceManager.Devices["scale-1"] = newTestDevice("scale-1", "waste")
+
+    // Newer backends get device statistics by default
+    heartbeat := g.buildHeartbeatPayload(g.heartbeatSchema())
+    if heartbeat["device_count"] != 1 || heartbeat["schema_version"] != HeartbeatSchemaDeviceStats {
+        t.Errorf("expected schema 2 heartbeat with device stats, got %v", heartbeat)
+    }
+
+    // An older backend negotiates the basic schema through the capabilities response
+    g.sendCapabilities()
+    if schema := g.heartbeatSchema(); schema != HeartbeatSchemaBasic {
+        t.Fatalf("expected negotiated schema 1, got %d", schema)
+    }
+    heartbeat = g.buildHeartbeatPayload(g.heartbeatSchema())
+    for _, field := range []string{"device_count", "total_measurements", "total_weight_kg", "schema_version"} {
+        if _, ok := heartbeat[field]; ok {
+            t.Errorf("schema 1 heartbeat should omit %s: %v", field, heartbeat)
+        }
+    }
+    if heartbeat["uptime"] == nil || heartbeat["status"] != "online" {
+        t.Errorf("schema 1 heartbeat is missing gateway fields: %v", heartbeat)
+    }
+}
+
+func TestDeviceManagerInitRetriesUntilConfigCorrected(t *testing.T) {
+    g, _ := newTestGateway()
+    var statusBodies []string
+    var mu sync.Mutex
+    useTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        mu.Lock()
+        statusBodies = append(statusBodies, string(body))
+        mu.Unlock()
+        w.Write([]byte(`{"status":"ok"}`))
+    })
+    previousBackoff := deviceManagerInitBackoff
+    t.Cleanup(func() { deviceManagerInitBackoff = previousBackoff })
+    deviceManagerInitBackoff = time.Millisecond
+    g.currentConfig = Config{YAML: "devices: [unterminated"}
+
+    dm := NewDeviceManager(g)
+    if g.attemptDeviceManagerInit(dm) {
+        t.Fatal("expected the bad configuration to fail")
+    }
+    done := make(chan struct{})
+    go func() {
+        g.retryDeviceManagerInit(dm)
+        close(done)
+    }()
+
+    // Let it fail past the alert threshold, then correct the configuration
+    deadline := time.Now().Add(2 * time.Second)
+    for g.getDeviceManagerInitState().Attempts < deviceManagerInitAlertAttempts && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    g.configMutex.Lock()
+    g.currentConfig = Config{YAML: "measurement: {min_weight_kg: 1}"}
+    g.configMutex.Unlock()
+
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("device manager initialization did not recover")
+    }
+    state := g.getDeviceManagerInitState()
+    if !state.Initialized || state.LastError != "" || state.Attempts <= deviceManagerInitAlertAttempts {
+        t.Errorf("unexpected init state %+v", state)
+    }
+    if !dm.ConfigApplied() {
+        t.Error("expected the corrected configuration to be applied")
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+    alerted := false
+    for _, body := range statusBodies {
+        if strings.Contains(body, "Device manager failed to initialize") {
+            alerted = true
+        }
+    }
+    if !alerted {
+        t.Error("expected an error status after repeated failures")
+    }
+}
+
+func TestMeasurementBatchingByParameterSet(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    dm.batcher = newMeasurementBatcher(2, time.Hour, BatchGroupParameterSet)
+
+    dm.emitMeasurement(newTestDevice("scale-1", "waste"))
+    dm.emitMeasurement(newTestDevice("scale-2", "recyclables"))
+    dm.emitMeasurement(newTestDevice("scale-3", "waste"))
+    dm.flushBatches()
+
+    batches := map[string][]interface{}{}
+    for _, msg := range client.messages() {
+        var batch map[string]interface{}
+        if err := json.Unmarshal(msg.Payload, &batch); err != nil {
+            t.Fatalf("invalid batch on %s: %v", msg.Topic, err)
+        }
+        batches[msg.Topic], _ = batch["measurements"].([]interface{})
+    }
+    want := map[string]int{
+        "gateway/gw-test/parameter_set/waste/batch":       2,
+        "gateway/gw-test/parameter_set/recyclables/batch": 1,
+    }
+    if len(batches) != len(want) {
+        t.Fatalf("expected %d batch messages, got %v", len(want), batches)
+    }
+    for topic, count := range want {
+        measurements := batches[topic]
+        if len(measurements) != count {
+            t.Errorf("expected %d measurements on %s, got %d", count, topic, len(measurements))
+        }
+        set := strings.Split(topic, "/")[3]
+        for _, m := range measurements {
+            payload := m.(map[string]interface{})["payload"].(map[string]interface{})
+            if payload["parameter_set"] != set {
+                t.Errorf("batch for %s contains a %v measurement", set, payload["parameter_set"])
+            }
+        }
+    }
+}
+
+func TestMeasurementBatchingByDevice(t *testing.T) {
+    g, client := newTestGateway()
+    dm := NewDeviceManager(g)
+    dm.batcher = newMeasurementBatcher(2, time.Hour, BatchGroupDevice)
+    device := newTestDevice("scale-1", "waste")
+
+    dm.emitMeasurement(device)
+    if len(client.messages()) != 0 {
+        t.Fatal("expected the first measurement to be held for the batch")
+    }
+    dm.emitMeasurement(device)
+
+    messages := client.messages()
+    if len(messages) != 1 || messages[0].Topic != "gateway/gw-test/device/scale-1/measurement/batch" {
+        t.Fatalf("expected one per-device batch, got %+v", messages)
+    }
+}
+
+func TestMetricsEndpointTracksDevices(t *testing.T) {
+    g, _ := newTestGateway()
+    g.endDeviceManager = NewDeviceManager(g)
+    first := newTestDevice("scale-1", "waste")
+    first.MeasurementCount = 4
+    first.TotalWeightMeasured = 42.5
+    g.endDeviceManager.Devices["scale-1"] = first
+    g.endDeviceManager.Devices["scale-2"] = newTestDevice("scale-2", "recyclables")
+
+    scrape := func() string {
+        recorder := httptest.NewRecorder()
+        newMetricsHandler(g).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+        return recorder.Body.String()
+    }
+
+    body := scrape()
+    for _, line := range []string{
+        `gateway_device_measurement_count{device_id="scale-1",parameter_set="waste"} 4`,
+        `gateway_device_total_weight_kg{device_id="scale-1",parameter_set="waste"} 42.5`,
+        `gateway_device_measurement_count{device_id="scale-2",parameter_set="recyclables"} 0`,
+        `gateway_device_count 2`,
+        `gateway_mqtt_connected 1`,
+    } {
+        if !strings.Contains(body, line+"\n") {
+            t.Errorf("metrics missing %q:\n%s", line, body)
+        }
+    }
+
+    g.endDeviceManager.DeviceMutex.Lock()
+    g.endDeviceManager.removeDevice("scale-2")
+    g.endDeviceManager.DeviceMutex.Unlock()
+
+    body = scrape()
+    if strings.Contains(body, `device_id="scale-2"`) || !strings.Contains(body, "gateway_device_count 1\n") {
+        t.Errorf("expected removed device to disappear from metrics:\n%s", body)
+    }
+}
+
+func TestGatewayServesDevicesWithoutGlobals(t *testing.T) {
+    first, second := NewGateway(), NewGateway()
+    first.endDeviceManager = NewDeviceManager(first)
+    first.endDeviceManager.Devices["scale-1"] = newTestDevice("scale-1", "waste")
+    second.endDeviceManager = NewDeviceManager(second)
+
+    count := func(g *Gateway) float64 {
+        recorder := httptest.NewRecorder()
+        g.handleDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("expected 200, got %d", recorder.Code)
+        }
+        var body map[string]interface{}
+        if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+            t.Fatalf("invalid JSON: %v", err)
+        }
+        return body["count"].(float64)
+    }
+    // Each instance only sees its own devices
+    if got := count(first); got != 1 {
+        t.Fatalf("expected 1 device on first gateway, got %v", got)
+    }
+    if got := count(second); got != 0 {
+        t.Fatalf("expected 0 devices on second gateway, got %v", got)
+    }
+
+    recorder := httptest.NewRecorder()
+    NewGateway().handleDevicesRequest(recorder, httptest.NewRequest(http.MethodGet, "/devices", nil))
+    if recorder.Code != http.StatusInternalServerError {
+        t.Fatalf("expected 500 without a device manager, got %d", recorder.Code)
+    }
+}
@@ -2,29 +2,57 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"gopkg.in/yaml.v3"
 )
 
 // Configuration structs
 type Config struct {
-	MQTT  MQTTConfig  `yaml:"mqtt"`
-	API   APIConfig   `yaml:"api"`
-	Rules []RuleConfig `yaml:"rules"`
+	MQTT         MQTTConfig         `yaml:"mqtt"`
+	API          APIConfig          `yaml:"api"`
+	Shutdown     ShutdownConfig     `yaml:"shutdown"`
+	HTTP         HTTPConfig         `yaml:"http"`
+	Webhook      WebhookConfig      `yaml:"webhook"`
+	Backpressure BackpressureConfig `yaml:"backpressure"`
+	Encryption   EncryptionConfig   `yaml:"encryption"`
+	Lambda       LambdaConfig       `yaml:"lambda"`
+	Rules        []RuleConfig       `yaml:"rules"`
 }
 
 type MQTTConfig struct {
@@ -33,12 +61,72 @@ type MQTTConfig struct {
 	ClientID string `yaml:"client_id"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+
+	// Additional brokers ("host:port" or URLs) tried in order on reconnect, after Host/Port
+	Brokers []string `yaml:"brokers"`
+
+	// Keep the broker session (subscriptions and queued QoS 1 messages) across reconnects
+	PersistentSession bool `yaml:"persistent_session"`
+
+	// Largest payload processed, in bytes (0 = 1 MiB default, negative = unlimited)
+	MaxPayloadBytes int `yaml:"max_payload_bytes"`
+	// Optional topic that receives a summary of dropped oversized messages
+	DeadLetterTopic string `yaml:"dead_letter_topic"`
+
+	// MQTT protocol version: 3 (3.1.1, the default) or 5
+	ProtocolVersion int `yaml:"protocol_version"`
 }
 
 type APIConfig struct {
 	BaseURL string `yaml:"base_url"`
 }
 
+type HTTPConfig struct {
+	Port int `yaml:"port"` // Port for the diagnostics server (0 disables it)
+}
+
+// WebhookConfig exposes an HTTP endpoint that feeds pushed messages through the
+// same rule matching as MQTT messages
+type WebhookConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	BindAddress string `yaml:"bind_address"` // Listening interface (default 127.0.0.1)
+	Port        int    `yaml:"port"`         // Listening port (default 8082)
+	Path        string `yaml:"path"`         // Endpoint path (default /webhook)
+	Token       string `yaml:"token"`        // Shared secret expected in the X-Webhook-Token header; WEBHOOK_TOKEN overrides it
+}
+
+// WebhookTokenHeader carries the webhook shared secret
+const WebhookTokenHeader = "X-Webhook-Token"
+
+// BackpressureConfig controls shedding load at the broker when a rule's
+// HTTP target can't keep up
+type BackpressureConfig struct {
+	Enabled              bool `yaml:"enabled"`
+	MaxInFlight          int  `yaml:"max_in_flight"`          // In-flight HTTP actions per rule that count as saturated
+	SaturationSeconds    int  `yaml:"saturation_seconds"`     // How long saturation must last before unsubscribing
+	ResumeInFlight       int  `yaml:"resume_in_flight"`       // Re-subscribe once in-flight actions drop to this level
+	CheckIntervalSeconds int  `yaml:"check_interval_seconds"` // How often saturation is checked
+}
+
+// EncryptionConfig holds the AES keys (base64) for decrypting gateway payloads, by key ID
+type EncryptionConfig struct {
+	Keys map[string]string `yaml:"keys"`
+}
+
+// LambdaConfig enables real AWS Lambda invocation for lambda actions.
+// Without a region, lambda actions are only logged (simulated).
+type LambdaConfig struct {
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id"`     // Optional static credentials; the default
+	SecretAccessKey string `yaml:"secret_access_key"` // AWS credential chain is used when empty
+	SessionToken    string `yaml:"session_token"`
+	Endpoint        string `yaml:"endpoint"` // Optional endpoint override (e.g. LocalStack)
+}
+
+type ShutdownConfig struct {
+	DrainTimeout int `yaml:"drain_timeout"` // Seconds to wait for in-flight actions
+}
+
 type RuleConfig struct {
 	Name         string        `yaml:"name"`
 	Description  string        `yaml:"description"`
@@ -47,19 +135,54 @@ type RuleConfig struct {
 	SQL          string        `yaml:"sql"`
 	Transform    string        `yaml:"transform"`
 	Actions      []ActionConfig `yaml:"actions"`
+
+	// Numeric fields converted to another unit before the actions run
+	UnitConversions []UnitConversionConfig `yaml:"unit_conversions"`
+}
+
+// UnitConversionConfig converts a numeric payload field between mass units (g, kg, lb)
+type UnitConversionConfig struct {
+	Field     string `yaml:"field"`      // Dotted path of the value, e.g. payload.weight_kg
+	From      string `yaml:"from"`       // Source unit; takes precedence over from_field
+	FromField string `yaml:"from_field"` // Dotted path holding the source unit, e.g. payload.units; updated to the target unit
+	To        string `yaml:"to"`         // Target unit
 }
 
 type ActionConfig struct {
-	Type      string                 `yaml:"type"`
-	URL       string                 `yaml:"url"`
-	Method    string                 `yaml:"method"`
-	Headers   map[string]string      `yaml:"headers"`
-	Timeout   int                    `yaml:"timeout"`
-	Function  string                 `yaml:"function"`
-	Topic     string                 `yaml:"topic"`
-	QoS       int                    `yaml:"qos"`
-	Retain    bool                   `yaml:"retain"`
-	Payload   map[string]interface{} `yaml:"payload"`
+	Type              string                 `yaml:"type"`
+	URL               string                 `yaml:"url"`
+	Method            string                 `yaml:"method"`
+	Headers           map[string]string      `yaml:"headers"`
+	Timeout           int                    `yaml:"timeout"`
+	MaxBodyBytes      int                    `yaml:"max_body_bytes"`       // Largest HTTP request body (0 = unlimited)
+	OnOversize        string                 `yaml:"on_oversize"`          // "skip" (default) or "truncate"
+	TruncateFields    []string               `yaml:"truncate_fields"`      // Payload fields shortened or dropped, in order
+	MaxRetries        int                    `yaml:"max_retries"`          // Extra attempts for failed or 5xx HTTP actions
+	RetryBackoffMs    int                    `yaml:"retry_backoff_ms"`     // Initial retry delay, doubled per retry (default 500)
+	RetryMaxBackoffMs int                    `yaml:"retry_max_backoff_ms"` // Longest retry delay (default 30000)
+	Function          string                 `yaml:"function"`
+	Topic             string                 `yaml:"topic"`
+	QoS               int                    `yaml:"qos"`
+	Retain            bool                   `yaml:"retain"`
+	Payload           map[string]interface{} `yaml:"payload"`
+	OnResult          string                 `yaml:"on_result"` // Topic for HTTP action outcomes
+	Targets           []RepublishTarget      `yaml:"targets"`   // Additional republish destinations
+
+	// MQTT 5 publish properties for republish actions (ignored over 3.1.1)
+	MessageExpirySeconds uint32            `yaml:"message_expiry_seconds"`
+	UserProperties       map[string]string `yaml:"user_properties"`
+}
+
+// RepublishTarget is one destination of a republish action
+type RepublishTarget struct {
+	Topic   string                 `yaml:"topic"`
+	QoS     int                    `yaml:"qos"`
+	Retain  bool                   `yaml:"retain"`
+	Payload map[string]interface{} `yaml:"payload"` // Optional payload template
+
+	// MQTT 5 publish properties (ignored over 3.1.1)
+	MessageExpirySeconds uint32            `yaml:"message_expiry_seconds"`
+	UserProperties       map[string]string `yaml:"user_properties"`
 }
 
 // Configuration message types
@@ -87,44 +210,86 @@ type Rule struct {
 	SQL          string
 	Transform    string
 	Actions      []ActionConfig
+
+	UnitConversions []UnitConversionConfig // Applied to the payload before actions
+
+	condition      sqlExpr   // Parsed WHERE clause of SQL, if any
+	inFlight       int64     // HTTP actions currently executing for this rule
+	saturatedSince time.Time // When the rule became saturated (guarded by BackpressureMutex)
+	shed           int32     // 1 while the rule's topic is unsubscribed (atomic, written under BackpressureMutex)
+	shedAt         time.Time // When the rule was shed (guarded by BackpressureMutex)
 }
 
-// MatchesTopic checks if a topic matches the rule's pattern
-func (r *Rule) MatchesTopic(topic string) bool {
-	// Handle direct match
-	if r.TopicPattern == topic {
-		return true
-	}
+// isShed reports whether the rule is currently shed by backpressure
+func (r *Rule) isShed() bool {
+	return atomic.LoadInt32(&r.shed) == 1
+}
 
-	// Handle wildcard '#' (multi-level)
-	if strings.HasSuffix(r.TopicPattern, "/#") {
-		prefix := strings.TrimSuffix(r.TopicPattern, "/#")
-		return strings.HasPrefix(topic, prefix)
+// setShed marks the rule as shed or resumed; callers hold BackpressureMutex
+func (r *Rule) setShed(shed bool) {
+	var v int32
+	if shed {
+		v = 1
 	}
+	atomic.StoreInt32(&r.shed, v)
+}
 
-	// Handle wildcard '+' (single-level)
-	if strings.Contains(r.TopicPattern, "+") {
-		patternParts := strings.Split(r.TopicPattern, "/")
-		topicParts := strings.Split(topic, "/")
+// MatchesTopic checks if a topic matches the rule's pattern
+func (r *Rule) MatchesTopic(topic string) bool {
+	return topicMatches(r.TopicPattern, topic)
+}
 
-		if len(patternParts) != len(topicParts) {
-			return false
-		}
+// validateTopicPattern checks that pattern is a valid MQTT topic filter: not empty,
+// '+' only as a whole level and '#' only as the whole final level
+func validateTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("topic pattern is empty")
+	}
 
-		for i := range patternParts {
-			if patternParts[i] != "+" && patternParts[i] != topicParts[i] {
-				return false
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") {
+			if level != "#" {
+				return fmt.Errorf("'#' must occupy a whole level in %q", pattern)
+			}
+			if i != len(levels)-1 {
+				return fmt.Errorf("'#' must be the final level in %q", pattern)
 			}
 		}
-		return true
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("'+' must occupy a whole level in %q", pattern)
+		}
 	}
+	return nil
+}
 
-	// Simple wildcard '#' for all topics
-	if r.TopicPattern == "#" {
-		return true
+// topicMatches applies MQTT topic filter semantics: '+' matches exactly one level
+// (which may be empty), '#' must be the last level and matches zero or more levels,
+// and filters starting with a wildcard don't match '$'-prefixed system topics.
+func topicMatches(pattern string, topic string) bool {
+	if pattern == "" || topic == "" {
+		return false
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(pattern, "+") || strings.HasPrefix(pattern, "#")) {
+		return false
 	}
 
-	return false
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range patternLevels {
+		if level == "#" {
+			// Only valid as the final level, where it also matches the parent level
+			return i == len(patternLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
 }
 
 // ShouldProcessMessage determines if a message should be processed by this rule
@@ -137,22 +302,327 @@ func (r *Rule) ShouldProcessMessage(topic string, payload map[string]interface{}
 		return false
 	}
 
-	// TODO: Add SQL query evaluation if needed
-	// This would be a more complex implementation to support filtering
+	// Apply the SQL WHERE clause, if any
+	if r.condition != nil && !r.condition.eval(payload) {
+		return false
+	}
 
 	return true
 }
 
+// sqlExpr is a parsed WHERE clause expression
+type sqlExpr interface {
+	eval(message map[string]interface{}) bool
+}
+
+// sqlLogical combines two expressions with AND or OR
+type sqlLogical struct {
+	op          string
+	left, right sqlExpr
+}
+
+func (e *sqlLogical) eval(message map[string]interface{}) bool {
+	if e.op == "AND" {
+		return e.left.eval(message) && e.right.eval(message)
+	}
+	return e.left.eval(message) || e.right.eval(message)
+}
+
+// sqlNot negates an expression
+type sqlNot struct {
+	expr sqlExpr
+}
+
+func (e *sqlNot) eval(message map[string]interface{}) bool {
+	return !e.expr.eval(message)
+}
+
+// sqlOperand is either a literal value or a dotted path into the message
+type sqlOperand struct {
+	path  string
+	value interface{}
+}
+
+// resolve returns the operand's value; paths are looked up in the message
+// (falling back to the path without a "payload." prefix)
+func (o sqlOperand) resolve(message map[string]interface{}) (interface{}, bool) {
+	if o.path == "" {
+		return o.value, true
+	}
+	if value, ok := lookupPath(message, o.path); ok {
+		return value, true
+	}
+	if strings.HasPrefix(o.path, "payload.") {
+		return lookupPath(message, strings.TrimPrefix(o.path, "payload."))
+	}
+	return nil, false
+}
+
+// sqlComparison compares two operands
+type sqlComparison struct {
+	op          string
+	left, right sqlOperand
+}
+
+func (e *sqlComparison) eval(message map[string]interface{}) bool {
+	left, ok := e.left.resolve(message)
+	if !ok {
+		return false
+	}
+	right, ok := e.right.resolve(message)
+	if !ok {
+		return false
+	}
+
+	// Numeric comparison when both sides are numbers
+	leftNumber, leftIsNumber := sqlNumber(left)
+	rightNumber, rightIsNumber := sqlNumber(right)
+	if leftIsNumber && rightIsNumber {
+		switch e.op {
+		case "=":
+			return leftNumber == rightNumber
+		case "!=":
+			return leftNumber != rightNumber
+		case "<":
+			return leftNumber < rightNumber
+		case "<=":
+			return leftNumber <= rightNumber
+		case ">":
+			return leftNumber > rightNumber
+		case ">=":
+			return leftNumber >= rightNumber
+		}
+		return false
+	}
+
+	// Otherwise compare string representations
+	leftString, rightString := fmt.Sprintf("%v", left), fmt.Sprintf("%v", right)
+	switch e.op {
+	case "=":
+		return leftString == rightString
+	case "!=":
+		return leftString != rightString
+	case "<":
+		return leftString < rightString
+	case "<=":
+		return leftString <= rightString
+	case ">":
+		return leftString > rightString
+	case ">=":
+		return leftString >= rightString
+	}
+	return false
+}
+
+// sqlNumber converts decoded JSON numbers to float64
+func sqlNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// sqlToken matches strings, numbers, identifiers/paths, operators and punctuation
+var sqlToken = regexp.MustCompile(`'(?:[^']|'')*'|"[^"]*"|[0-9]+(?:\.[0-9]+)?|[A-Za-z_$][A-Za-z0-9_.$]*|<=|>=|<>|!=|==|[=<>()*,-]|\S`)
+
+// parseSQLWhere parses a rule's SQL, e.g. "SELECT * WHERE payload.weight_kg > 10".
+// It returns nil when there is no WHERE clause. A bare expression without SELECT is
+// also accepted.
+func parseSQLWhere(sql string) (sqlExpr, error) {
+	tokens := sqlToken.FindAllString(strings.TrimSpace(sql), -1)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	if strings.EqualFold(tokens[0], "SELECT") {
+		where := -1
+		for i, token := range tokens {
+			if strings.EqualFold(token, "WHERE") {
+				where = i
+				break
+			}
+		}
+		if where < 0 {
+			return nil, nil
+		}
+		tokens = tokens[where+1:]
+	}
+
+	parser := &sqlParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.pos])
+	}
+	return expr, nil
+}
+
+// sqlParser is a recursive descent parser over WHERE clause tokens
+type sqlParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *sqlParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *sqlParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *sqlParser) parseOr() (sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlLogical{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseAnd() (sqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlLogical{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseNot() (sqlExpr, error) {
+	if strings.EqualFold(p.peek(), "NOT") {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlNot{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sqlParser) parsePrimary() (sqlExpr, error) {
+	if p.peek() == "(" {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return expr, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op {
+	case "==":
+		op = "="
+	case "<>":
+		op = "!="
+	case "=", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected comparison operator, got %q", op)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlComparison{op: op, left: left, right: right}, nil
+}
+
+func (p *sqlParser) parseOperand() (sqlOperand, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return sqlOperand{}, fmt.Errorf("unexpected end of expression")
+	case token == "-":
+		number, err := strconv.ParseFloat(p.next(), 64)
+		if err != nil {
+			return sqlOperand{}, fmt.Errorf("expected number after '-'")
+		}
+		return sqlOperand{value: -number}, nil
+	case token[0] == '\'' || token[0] == '"':
+		// An unterminated literal is tokenized as a lone quote
+		if len(token) < 2 || token[len(token)-1] != token[0] {
+			return sqlOperand{}, fmt.Errorf("unterminated string literal")
+		}
+		if token[0] == '\'' {
+			return sqlOperand{value: strings.ReplaceAll(token[1:len(token)-1], "''", "'")}, nil
+		}
+		return sqlOperand{value: token[1 : len(token)-1]}, nil
+	case token[0] >= '0' && token[0] <= '9':
+		number, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return sqlOperand{}, fmt.Errorf("invalid number %q", token)
+		}
+		return sqlOperand{value: number}, nil
+	case strings.EqualFold(token, "TRUE"):
+		return sqlOperand{value: true}, nil
+	case strings.EqualFold(token, "FALSE"):
+		return sqlOperand{value: false}, nil
+	case token[0] == '_' || token[0] == '$' || (token[0]|0x20 >= 'a' && token[0]|0x20 <= 'z'):
+		switch strings.ToUpper(token) {
+		case "AND", "OR", "NOT", "WHERE", "SELECT":
+			return sqlOperand{}, fmt.Errorf("unexpected keyword %s", token)
+		}
+		return sqlOperand{path: token}, nil
+	}
+	return sqlOperand{}, fmt.Errorf("unexpected %q", token)
+}
+
 // RulesEngine manages MQTT message processing rules
 type RulesEngine struct {
-	Config          Config
-	Rules           []*Rule
-	MQTTClient      mqtt.Client
-	RepublishClient mqtt.Client
-	ExitChan        chan struct{}
-	WaitGroup       sync.WaitGroup
-	ConfigStorage   map[string]string // Maps gateway_id to YAML config
-	ConfigMutex     sync.RWMutex      // Protects access to ConfigStorage
+	Config            Config
+	ConfigPath        string // File the configuration was loaded from
+	Rules             []*Rule
+	MQTTClient        mqtt.Client
+	RepublishClient   mqtt.Client
+	ExitChan          chan struct{}
+	WaitGroup         sync.WaitGroup
+	ConfigStorage     map[string]string // Maps gateway_id to YAML config
+	ConfigMutex       sync.RWMutex      // Protects access to ConfigStorage
+	RulesMutex        sync.RWMutex      // Protects Rules during hot-reload
+	ApplyMutex        sync.Mutex        // Serializes rule set applies (validate, swap, resubscribe)
+	BackpressureMutex sync.Mutex        // Protects rule saturation and shed state
+	HTTPServer        *http.Server      // Optional diagnostics server
+	WebhookServer     *http.Server      // Optional webhook input server
+	inFlight          int64             // Number of actions currently executing
+	metrics           engineMetrics     // Prometheus counters served on /metrics
+
+	lambdaOnce   sync.Once     // Guards lazy construction of lambdaClient
+	lambdaClient lambdaInvoker // AWS Lambda client, built on first use
+	lambdaErr    error         // Error from building lambdaClient
 }
 
 // NewRulesEngine creates a new RulesEngine
@@ -162,10 +632,45 @@ func NewRulesEngine(configPath string) (*RulesEngine, error) {
 		return nil, err
 	}
 
+	// Refuse to start with rules that a reload would reject
+	if err := validateRuleConfigs(config.Rules); err != nil {
+		return nil, fmt.Errorf("invalid rules: %v", err)
+	}
+
 	// Initialize rules from config
-	rules := make([]*Rule, 0, len(config.Rules))
-	for _, ruleConfig := range config.Rules {
+	rules := buildRules(config.Rules)
+
+	// Warn about rules that could process the same message twice
+	logRuleOverlaps(rules)
+
+	return &RulesEngine{
+		Config:        config,
+		ConfigPath:    configPath,
+		Rules:         rules,
+		ExitChan:      make(chan struct{}),
+		WaitGroup:     sync.WaitGroup{},
+		ConfigStorage: make(map[string]string),
+	}, nil
+}
+
+// buildRules creates the active rules from their configuration, skipping disabled ones
+func buildRules(configs []RuleConfig) []*Rule {
+	rules := make([]*Rule, 0, len(configs))
+	for _, ruleConfig := range configs {
 		if ruleConfig.Enabled {
+			if err := validateTopicPattern(ruleConfig.TopicPattern); err != nil {
+				log.Printf("Error: skipping rule %s: invalid topic_pattern: %v", ruleConfig.Name, err)
+				continue
+			}
+			condition, err := parseSQLWhere(ruleConfig.SQL)
+			if err != nil {
+				log.Printf("Disabling rule %s: invalid SQL %q: %v", ruleConfig.Name, ruleConfig.SQL, err)
+				continue
+			}
+			if err := validateUnitConversions(ruleConfig.UnitConversions); err != nil {
+				log.Printf("Disabling rule %s: invalid unit_conversions: %v", ruleConfig.Name, err)
+				continue
+			}
 			rule := &Rule{
 				Name:         ruleConfig.Name,
 				Description:  ruleConfig.Description,
@@ -174,18 +679,107 @@ func NewRulesEngine(configPath string) (*RulesEngine, error) {
 				SQL:          ruleConfig.SQL,
 				Transform:    ruleConfig.Transform,
 				Actions:      ruleConfig.Actions,
+				condition:    condition,
+
+				UnitConversions: ruleConfig.UnitConversions,
 			}
 			rules = append(rules, rule)
 		}
 	}
+	return rules
+}
+
+// logRuleOverlaps warns about every pair of overlapping rules
+func logRuleOverlaps(rules []*Rule) {
+	for _, overlap := range analyzeRuleOverlaps(rules) {
+		log.Printf("Warning: rules %s (%s) and %s (%s) overlap, e.g. on topic %s",
+			overlap.RuleA, overlap.PatternA, overlap.RuleB, overlap.PatternB, overlap.ExampleTopic)
+	}
+}
 
-	return &RulesEngine{
-		Config:        config,
-		Rules:         rules,
-		ExitChan:      make(chan struct{}),
-		WaitGroup:     sync.WaitGroup{},
-		ConfigStorage: make(map[string]string),
-	}, nil
+// RuleOverlap describes two rules whose topic patterns can match the same topic
+type RuleOverlap struct {
+	RuleA        string `json:"rule_a"`
+	PatternA     string `json:"pattern_a"`
+	RuleB        string `json:"rule_b"`
+	PatternB     string `json:"pattern_b"`
+	ExampleTopic string `json:"example_topic"`
+}
+
+// analyzeRuleOverlaps reports every pair of rules whose topic patterns overlap
+func analyzeRuleOverlaps(rules []*Rule) []RuleOverlap {
+	overlaps := []RuleOverlap{}
+	for i := 0; i < len(rules); i++ {
+		for j := i + 1; j < len(rules); j++ {
+			example, ok := patternsOverlap(rules[i].TopicPattern, rules[j].TopicPattern)
+			if !ok {
+				continue
+			}
+			overlaps = append(overlaps, RuleOverlap{
+				RuleA:        rules[i].Name,
+				PatternA:     rules[i].TopicPattern,
+				RuleB:        rules[j].Name,
+				PatternB:     rules[j].TopicPattern,
+				ExampleTopic: example,
+			})
+		}
+	}
+	return overlaps
+}
+
+// patternsOverlap checks whether some topic matches both patterns and returns
+// an example of such a topic ("any" stands for a free level)
+func patternsOverlap(a string, b string) (string, bool) {
+	partsA := strings.Split(a, "/")
+	partsB := strings.Split(b, "/")
+	example := []string{}
+
+	for i := 0; ; i++ {
+		doneA, doneB := i >= len(partsA), i >= len(partsB)
+		if doneA && doneB {
+			return strings.Join(example, "/"), true
+		}
+
+		// '#' matches the remaining levels of the other pattern, including none
+		if !doneA && partsA[i] == "#" {
+			if !doneB && partsB[i] != "#" {
+				example = append(example, exampleLevels(partsB[i:])...)
+			}
+			return strings.Join(example, "/"), true
+		}
+		if !doneB && partsB[i] == "#" {
+			if !doneA {
+				example = append(example, exampleLevels(partsA[i:])...)
+			}
+			return strings.Join(example, "/"), true
+		}
+		if doneA || doneB {
+			return "", false
+		}
+
+		switch {
+		case partsA[i] == partsB[i]:
+			example = append(example, exampleLevels(partsA[i:i+1])...)
+		case partsA[i] == "+":
+			example = append(example, partsB[i])
+		case partsB[i] == "+":
+			example = append(example, partsA[i])
+		default:
+			return "", false
+		}
+	}
+}
+
+// exampleLevels replaces wildcard levels with a placeholder
+func exampleLevels(levels []string) []string {
+	result := make([]string, 0, len(levels))
+	for _, level := range levels {
+		if level == "+" || level == "#" {
+			level = "any"
+		}
+		result = append(result, level)
+	}
+	return result
 }
 
 // Start starts the rules engine
@@ -204,6 +798,21 @@ func (engine *RulesEngine) Start() error {
 		}
 	}
 
+	// Start the diagnostics server if configured
+	if engine.Config.HTTP.Port > 0 {
+		engine.startHTTPServer()
+	}
+
+	// Accept messages pushed over HTTP if configured
+	if engine.Config.Webhook.Enabled {
+		engine.startWebhookServer()
+	}
+
+	// Shed load at the broker when HTTP targets can't keep up
+	if engine.Config.Backpressure.Enabled {
+		go engine.runBackpressureMonitor()
+	}
+
 	// Handle graceful shutdown
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -214,6 +823,23 @@ func (engine *RulesEngine) Start() error {
 		close(engine.ExitChan)
 	}()
 
+	// Reload rules from the config file on SIGHUP
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+
+	go func() {
+		for {
+			select {
+			case <-reloadChan:
+				log.Println("Received SIGHUP, reloading configuration")
+				engine.reloadConfig()
+			case <-engine.ExitChan:
+				return
+			}
+		}
+	}()
+
 	// Wait for exit signal
 	<-engine.ExitChan
 
@@ -227,6 +853,20 @@ func (engine *RulesEngine) Start() error {
 func (engine *RulesEngine) Shutdown() {
 	log.Println("Shutting down IoT Rules Engine")
 
+	// Stop intake first so no new actions are started while draining
+	engine.unsubscribeAll()
+	if engine.WebhookServer != nil {
+		engine.WebhookServer.Close()
+	}
+
+	// Give in-flight actions a bounded amount of time to finish
+	engine.drainActions(engine.drainTimeout())
+
+	// Stop the diagnostics server
+	if engine.HTTPServer != nil {
+		engine.HTTPServer.Close()
+	}
+
 	// Disconnect MQTT clients
 	if engine.MQTTClient != nil && engine.MQTTClient.IsConnected() {
 		engine.MQTTClient.Disconnect(250)
@@ -236,80 +876,655 @@ func (engine *RulesEngine) Shutdown() {
 		engine.RepublishClient.Disconnect(250)
 	}
 
-	// Wait for all goroutines to finish
-	engine.WaitGroup.Wait()
-
 	log.Println("IoT Rules Engine shutdown complete")
 }
 
-// needsRepublishClient checks if any rule needs to republish messages
-func (engine *RulesEngine) needsRepublishClient() bool {
-	for _, rule := range engine.Rules {
-		for _, action := range rule.Actions {
-			if action.Type == "republish" {
-				return true
-			}
+// startHTTPServer serves diagnostic endpoints on the configured port
+func (engine *RulesEngine) startHTTPServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/analyze", engine.handleAnalyzeRequest)
+	mux.HandleFunc("/stats", engine.handleStatsRequest)
+	mux.HandleFunc("/metrics", engine.handleMetricsRequest)
+
+	engine.HTTPServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", engine.Config.HTTP.Port),
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Starting diagnostics server on port %d", engine.Config.HTTP.Port)
+		if err := engine.HTTPServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Diagnostics server error: %v", err)
 		}
+	}()
+}
+
+// webhookPort returns the webhook server port
+func (engine *RulesEngine) webhookPort() int {
+	if port := engine.Config.Webhook.Port; port > 0 {
+		return port
 	}
-	return false
+	return 8082
 }
 
-// setupMQTTClient sets up the MQTT client
-func (engine *RulesEngine) setupMQTTClient() error {
-	log.Printf("Setting up MQTT client to connect to %s:%d", engine.Config.MQTT.Host, engine.Config.MQTT.Port)
+// webhookBindAddress returns the interface the webhook server listens on
+func (engine *RulesEngine) webhookBindAddress() string {
+	if address := engine.Config.Webhook.BindAddress; address != "" {
+		return address
+	}
+	return "127.0.0.1"
+}
 
-	// Create options
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", engine.Config.MQTT.Host, engine.Config.MQTT.Port))
-	
-	// Set client ID with uniqueness if not provided
-	clientID := engine.Config.MQTT.ClientID
-	if clientID == "" {
-		clientID = fmt.Sprintf("rules-engine-%d", time.Now().Unix())
+// webhookToken returns the shared secret webhook requests must present
+func (engine *RulesEngine) webhookToken() string {
+	if token := os.Getenv("WEBHOOK_TOKEN"); token != "" {
+		return token
 	}
-	opts.SetClientID(clientID)
-	
-	// Set credentials if provided
-	if engine.Config.MQTT.Username != "" && engine.Config.MQTT.Password != "" {
-		opts.SetUsername(engine.Config.MQTT.Username)
-		opts.SetPassword(engine.Config.MQTT.Password)
+	return engine.Config.Webhook.Token
+}
+
+// webhookPath returns the webhook endpoint path
+func (engine *RulesEngine) webhookPath() string {
+	path := engine.Config.Webhook.Path
+	if path == "" {
+		return "/webhook"
 	}
-	
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
+
+// startWebhookServer serves the webhook input endpoint on its own port. It
+// refuses to start without a shared secret.
+func (engine *RulesEngine) startWebhookServer() {
+	if engine.webhookToken() == "" {
+		log.Printf("Webhook input not started: set webhook.token or WEBHOOK_TOKEN")
+		return
+	}
+
+	address := net.JoinHostPort(engine.webhookBindAddress(), strconv.Itoa(engine.webhookPort()))
+	path := engine.webhookPath()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, engine.handleWebhookRequest)
+
+	engine.WebhookServer = &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Starting webhook input on %s at %s", address, path)
+		if err := engine.WebhookServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Webhook server error: %v", err)
+		}
+	}()
+}
+
+// WebhookMessage is the body accepted by the webhook endpoint
+type WebhookMessage struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// webhookMQTTMessage adapts a webhook message to mqtt.Message
+type webhookMQTTMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *webhookMQTTMessage) Duplicate() bool   { return false }
+func (m *webhookMQTTMessage) Qos() byte         { return 0 }
+func (m *webhookMQTTMessage) Retained() bool    { return false }
+func (m *webhookMQTTMessage) Topic() string     { return m.topic }
+func (m *webhookMQTTMessage) MessageID() uint16 { return 0 }
+func (m *webhookMQTTMessage) Payload() []byte   { return m.payload }
+func (m *webhookMQTTMessage) Ack()              {}
+
+// handleWebhookRequest injects a pushed {"topic", "payload"} message into the
+// MQTT message path so rules apply to it the same way
+func (engine *RulesEngine) handleWebhookRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := engine.webhookToken()
+	presented := r.Header.Get(WebhookTokenHeader)
+	if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		log.Printf("Rejected webhook request from %s: missing or invalid token", r.RemoteAddr)
+		http.Error(w, "Missing or invalid webhook token", http.StatusUnauthorized)
+		return
+	}
+
+	// The payload can't be bigger than its envelope, so bound the whole body
+	if limit := engine.maxPayloadBytes(); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+
+	var message WebhookMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid webhook body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if message.Topic == "" || strings.ContainsAny(message.Topic, "+#") {
+		http.Error(w, "Webhook body needs a topic without wildcards", http.StatusBadRequest)
+		return
+	}
+	if len(message.Payload) == 0 {
+		http.Error(w, "Webhook body needs a payload", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Received webhook message for topic %s from %s", message.Topic, r.RemoteAddr)
+	engine.messageHandler(engine.MQTTClient, &webhookMQTTMessage{topic: message.Topic, payload: message.Payload})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "accepted",
+		"topic":  message.Topic,
+	})
+}
+
+// handleAnalyzeRequest reports overlapping rules as JSON
+func (engine *RulesEngine) handleAnalyzeRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules := engine.activeRules()
+	overlaps := analyzeRuleOverlaps(rules)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rule_count":    len(rules),
+		"overlap_count": len(overlaps),
+		"overlaps":      overlaps,
+	})
+}
+
+// handleStatsRequest reports in-flight actions and per-rule shed state as JSON
+func (engine *RulesEngine) handleStatsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(engine.stats())
+}
+
+// stats collects engine statistics
+func (engine *RulesEngine) stats() map[string]interface{} {
+	engine.BackpressureMutex.Lock()
+	defer engine.BackpressureMutex.Unlock()
+
+	rules := []map[string]interface{}{}
+	shedCount := 0
+	for _, rule := range engine.activeRules() {
+		ruleStats := map[string]interface{}{
+			"name":          rule.Name,
+			"topic_pattern": rule.TopicPattern,
+			"in_flight":     atomic.LoadInt64(&rule.inFlight),
+			"shed":          rule.isShed(),
+		}
+		if rule.isShed() {
+			shedCount++
+			ruleStats["shed_since"] = rule.shedAt.Format(time.RFC3339)
+		}
+		rules = append(rules, ruleStats)
+	}
+
+	return map[string]interface{}{
+		"in_flight":  atomic.LoadInt64(&engine.inFlight),
+		"shed_rules": shedCount,
+		"rules":      rules,
+	}
+}
+
+// handleMetricsRequest serves the engine's metrics in the Prometheus text format
+func (engine *RulesEngine) handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	engine.metrics.writePrometheus(w)
+}
+
+// httpLatencyBuckets are the upper bounds (seconds) of the HTTP action latency histogram
+var httpLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// engineMetrics holds the counters and latency histogram exposed on /metrics.
+// The zero value is ready to use.
+type engineMetrics struct {
+	mu               sync.Mutex
+	messagesReceived map[string]uint64 // By matching topic pattern
+	ruleMatches      map[string]uint64 // By rule name
+	actionsExecuted  map[string]uint64 // By action type
+	actionFailures   map[string]uint64 // By action type
+	latencyBuckets   []uint64          // Observations per httpLatencyBuckets bound (non-cumulative)
+	latencySum       float64           // Total observed HTTP latency in seconds
+	latencyCount     uint64            // Number of observed HTTP actions
+}
+
+// increment adds one to a labeled counter, creating the map on first use
+func (m *engineMetrics) increment(counter *map[string]uint64, label string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if *counter == nil {
+		*counter = make(map[string]uint64)
+	}
+	(*counter)[label]++
+}
+
+// messageReceived counts a message received on a rule's topic pattern
+func (m *engineMetrics) messageReceived(pattern string) {
+	m.increment(&m.messagesReceived, pattern)
+}
+
+// ruleMatched counts a message matched by a rule
+func (m *engineMetrics) ruleMatched(rule string) {
+	m.increment(&m.ruleMatches, rule)
+}
+
+// actionExecuted counts an action started for a matched message
+func (m *engineMetrics) actionExecuted(actionType string) {
+	m.increment(&m.actionsExecuted, actionType)
+}
+
+// actionFailed counts an action that didn't complete successfully
+func (m *engineMetrics) actionFailed(actionType string) {
+	m.increment(&m.actionFailures, actionType)
+}
+
+// observeHTTPLatency records the duration of an HTTP action
+func (m *engineMetrics) observeHTTPLatency(latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latencyBuckets == nil {
+		m.latencyBuckets = make([]uint64, len(httpLatencyBuckets))
+	}
+	seconds := latency.Seconds()
+	for i, bound := range httpLatencyBuckets {
+		if seconds <= bound {
+			m.latencyBuckets[i]++
+			break
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+// prometheusLabelEscaper escapes label values for the text exposition format
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes all metrics in the Prometheus text exposition format
+func (m *engineMetrics) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeCounter := func(name string, help string, label string, values map[string]uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, prometheusLabelEscaper.Replace(key), values[key])
+		}
+	}
+	writeCounter("rules_engine_messages_received_total", "Messages received, by matching rule topic pattern.", "pattern", m.messagesReceived)
+	writeCounter("rules_engine_rule_matches_total", "Messages matched, by rule.", "rule", m.ruleMatches)
+	writeCounter("rules_engine_actions_total", "Actions executed, by type.", "type", m.actionsExecuted)
+	writeCounter("rules_engine_action_failures_total", "Failed actions, by type.", "type", m.actionFailures)
+
+	const histogram = "rules_engine_http_action_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of HTTP actions, including retries.\n# TYPE %s histogram\n", histogram, histogram)
+	var cumulative uint64
+	for i, bound := range httpLatencyBuckets {
+		if m.latencyBuckets != nil {
+			cumulative += m.latencyBuckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", histogram, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", histogram, m.latencyCount)
+	fmt.Fprintf(w, "%s_sum %s\n", histogram, strconv.FormatFloat(m.latencySum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", histogram, m.latencyCount)
+}
+
+// runBackpressureMonitor periodically checks rules for sustained saturation
+func (engine *RulesEngine) runBackpressureMonitor() {
+	interval := time.Duration(engine.Config.Backpressure.CheckIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			engine.checkBackpressure(now)
+		case <-engine.ExitChan:
+			return
+		}
+	}
+}
+
+// checkBackpressure unsubscribes from the topic of a rule that has been saturated for
+// longer than the configured period, and re-subscribes once its backlog clears
+func (engine *RulesEngine) checkBackpressure(now time.Time) {
+	cfg := engine.Config.Backpressure
+	maxInFlight := int64(cfg.MaxInFlight)
+	if maxInFlight <= 0 {
+		maxInFlight = 100
+	}
+	resumeInFlight := int64(cfg.ResumeInFlight)
+	if resumeInFlight < 0 || resumeInFlight >= maxInFlight {
+		resumeInFlight = maxInFlight / 2
+	}
+	saturation := time.Duration(cfg.SaturationSeconds) * time.Second
+
+	engine.BackpressureMutex.Lock()
+	defer engine.BackpressureMutex.Unlock()
+
+	rules := engine.activeRules()
+	for _, rule := range rules {
+		inFlight := atomic.LoadInt64(&rule.inFlight)
+
+		if rule.isShed() {
+			if inFlight <= resumeInFlight {
+				log.Printf("Rule %s backlog cleared (%d in flight), re-subscribing to %s", rule.Name, inFlight, rule.TopicPattern)
+				rule.setShed(false)
+				rule.saturatedSince = time.Time{}
+				engine.subscribeTopic(rule.TopicPattern)
+			}
+			continue
+		}
+
+		if inFlight < maxInFlight {
+			rule.saturatedSince = time.Time{}
+			continue
+		}
+		if rule.saturatedSince.IsZero() {
+			rule.saturatedSince = now
+		}
+		if now.Sub(rule.saturatedSince) < saturation {
+			continue
+		}
+
+		log.Printf("Rule %s saturated (%d in flight), unsubscribing from %s", rule.Name, inFlight, rule.TopicPattern)
+		rule.setShed(true)
+		rule.shedAt = now
+
+		// Keep the subscription if another active rule still needs the same pattern
+		shared := false
+		for _, other := range rules {
+			if other != rule && !other.isShed() && other.TopicPattern == rule.TopicPattern {
+				shared = true
+			}
+		}
+		if !shared {
+			engine.unsubscribeTopic(rule.TopicPattern)
+		}
+	}
+}
+
+// subscribeTopic subscribes the main client to a rule topic
+func (engine *RulesEngine) subscribeTopic(topic string) {
+	if engine.MQTTClient == nil || !engine.MQTTClient.IsConnected() {
+		return
+	}
+	token := engine.MQTTClient.Subscribe(topic, engine.subscriptionQoS(), engine.messageHandler)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error subscribing to topic %s: %v", topic, token.Error())
+	}
+}
+
+// unsubscribeTopic unsubscribes the main client from a rule topic
+func (engine *RulesEngine) unsubscribeTopic(topic string) {
+	if engine.MQTTClient == nil || !engine.MQTTClient.IsConnected() {
+		return
+	}
+	token := engine.MQTTClient.Unsubscribe(topic)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error unsubscribing from topic %s: %v", topic, token.Error())
+	}
+}
+
+// drainTimeout returns the configured drain timeout, defaulting to 10 seconds
+func (engine *RulesEngine) drainTimeout() time.Duration {
+	timeout := engine.Config.Shutdown.DrainTimeout
+	if timeout <= 0 {
+		timeout = 10
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// unsubscribeAll unsubscribes from every rule topic so the broker stops delivering messages
+func (engine *RulesEngine) unsubscribeAll() {
+	if engine.MQTTClient == nil || !engine.MQTTClient.IsConnected() {
+		return
+	}
+
+	topics := engine.subscriptionTopics()
+	if len(topics) == 0 {
+		return
+	}
+
+	patterns := make([]string, 0, len(topics))
+	for topic := range topics {
+		patterns = append(patterns, topic)
+	}
+
+	log.Printf("Unsubscribing from %d topic(s) before shutdown", len(patterns))
+	token := engine.MQTTClient.Unsubscribe(patterns...)
+	if !token.WaitTimeout(5*time.Second) {
+		log.Printf("Timed out unsubscribing from topics")
+	} else if token.Error() != nil {
+		log.Printf("Error unsubscribing from topics: %v", token.Error())
+	}
+}
+
+// drainActions waits up to timeout for in-flight actions and returns how many
+// completed and how many were abandoned
+func (engine *RulesEngine) drainActions(timeout time.Duration) (completed int64, abandoned int64) {
+	pending := atomic.LoadInt64(&engine.inFlight)
+	if pending == 0 {
+		log.Println("No in-flight actions to drain")
+		return 0, 0
+	}
+
+	log.Printf("Draining %d in-flight action(s) (timeout %v)", pending, timeout)
+
+	done := make(chan struct{})
+	go func() {
+		engine.WaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Drain timeout reached")
+	}
+
+	abandoned = atomic.LoadInt64(&engine.inFlight)
+	completed = pending - abandoned
+	if completed < 0 {
+		completed = 0
+	}
+
+	log.Printf("Drain finished: %d action(s) completed, %d abandoned", completed, abandoned)
+	return completed, abandoned
+}
+
+// beginAction registers an asynchronous action with the engine
+func (engine *RulesEngine) beginAction() {
+	engine.WaitGroup.Add(1)
+	atomic.AddInt64(&engine.inFlight, 1)
+}
+
+// endAction marks an asynchronous action as finished
+func (engine *RulesEngine) endAction() {
+	atomic.AddInt64(&engine.inFlight, -1)
+	engine.WaitGroup.Done()
+}
+
+// needsRepublishClient checks if any rule needs to republish messages
+func (engine *RulesEngine) needsRepublishClient() bool {
+	for _, rule := range engine.activeRules() {
+		for _, action := range rule.Actions {
+			if action.Type == "republish" || action.OnResult != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setupMQTTClient sets up the MQTT client
+func (engine *RulesEngine) setupMQTTClient() error {
+	log.Printf("Setting up MQTT client to connect to %s", strings.Join(engine.brokerURLs(), ", "))
+
+	// Create and connect client
+	if engine.useMQTTv5() {
+		client, err := engine.newMQTTv5Client(engine.clientID(), engine.Config.MQTT.PersistentSession)
+		if err != nil {
+			return err
+		}
+		client.onConnect = engine.onConnect
+		client.onConnectionLost = engine.onConnectionLost
+		client.defaultHandler = engine.defaultMessageHandler
+		engine.MQTTClient = client
+	} else {
+		engine.MQTTClient = mqtt.NewClient(engine.clientOptions())
+	}
+	token := engine.MQTTClient.Connect()
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("error connecting to MQTT broker: %v", token.Error())
+	}
+	
+	return nil
+}
+
+// clientOptions builds the options for the main (subscribing) MQTT client
+func (engine *RulesEngine) clientOptions() *mqtt.ClientOptions {
+	// Create options
+	opts := mqtt.NewClientOptions()
+	for _, broker := range engine.brokerURLs() {
+		opts.AddBroker(broker)
+	}
+
+	clientID := engine.clientID()
+	opts.SetClientID(clientID)
+
+	// Let the broker keep our session and redeliver queued messages after a reconnect
+	if engine.Config.MQTT.PersistentSession {
+		opts.SetCleanSession(false)
+		log.Printf("MQTT persistent session enabled for client %s", clientID)
+	}
+
+	// Set credentials if provided
+	if engine.Config.MQTT.Username != "" && engine.Config.MQTT.Password != "" {
+		opts.SetUsername(engine.Config.MQTT.Username)
+		opts.SetPassword(engine.Config.MQTT.Password)
+	}
+
 	// Set handlers
 	opts.SetOnConnectHandler(engine.onConnect)
 	opts.SetConnectionLostHandler(engine.onConnectionLost)
 	opts.SetDefaultPublishHandler(engine.defaultMessageHandler)
-	
+
 	// Set other options
 	opts.SetKeepAlive(60 * time.Second)
 	opts.SetPingTimeout(10 * time.Second)
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(10 * time.Second)
-	
-	// Create and connect client
-	engine.MQTTClient = mqtt.NewClient(opts)
-	token := engine.MQTTClient.Connect()
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("error connecting to MQTT broker: %v", token.Error())
+
+	return opts
+}
+
+// clientID returns the main client's ID, made unique if not configured.
+// Persistent sessions need an ID that is stable across restarts but not shared
+// with other instances, so it is derived from the hostname.
+func (engine *RulesEngine) clientID() string {
+	clientID := engine.Config.MQTT.ClientID
+	if clientID != "" {
+		return clientID
 	}
-	
-	return nil
+	if engine.Config.MQTT.PersistentSession {
+		if hostname, err := os.Hostname(); err == nil && hostname != "" {
+			clientID = fmt.Sprintf("rules-engine-%s", hostname)
+			log.Printf("Warning: persistent_session without client_id, using %s", clientID)
+			return clientID
+		}
+		log.Printf("Warning: persistent_session without client_id and no hostname, the session won't survive restarts")
+	}
+	return fmt.Sprintf("rules-engine-%d", time.Now().UnixNano())
+}
+
+// brokerURLs lists the configured brokers: Host/Port first, then Brokers, without duplicates.
+// Entries without a scheme use tcp://.
+func (engine *RulesEngine) brokerURLs() []string {
+	candidates := engine.Config.MQTT.Brokers
+	if engine.Config.MQTT.Host != "" {
+		primary := fmt.Sprintf("%s:%d", engine.Config.MQTT.Host, engine.Config.MQTT.Port)
+		candidates = append([]string{primary}, candidates...)
+	}
+
+	seen := make(map[string]bool, len(candidates))
+	urls := make([]string, 0, len(candidates))
+	for _, broker := range candidates {
+		broker = strings.TrimSpace(broker)
+		if broker == "" {
+			continue
+		}
+		if !strings.Contains(broker, "://") {
+			broker = "tcp://" + broker
+		}
+		if !seen[broker] {
+			seen[broker] = true
+			urls = append(urls, broker)
+		}
+	}
+	return urls
 }
 
 // setupRepublishClient sets up a separate MQTT client for republishing messages
 func (engine *RulesEngine) setupRepublishClient() error {
 	log.Println("Setting up MQTT client for republishing messages")
 
+	// Create and connect client
+	if engine.useMQTTv5() {
+		client, err := engine.newMQTTv5Client(engine.republishClientID(), false)
+		if err != nil {
+			return err
+		}
+		engine.RepublishClient = client
+	} else {
+		if engine.usesV5Properties() {
+			log.Println("Warning: republish actions set MQTT 5 properties, which are ignored over MQTT 3.1.1")
+		}
+		engine.RepublishClient = mqtt.NewClient(engine.republishClientOptions())
+	}
+	token := engine.RepublishClient.Connect()
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("error connecting republish client to MQTT broker: %v", token.Error())
+	}
+	
+	return nil
+}
+
+// republishClientOptions builds the options for the republishing MQTT client
+func (engine *RulesEngine) republishClientOptions() *mqtt.ClientOptions {
 	// Create options
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", engine.Config.MQTT.Host, engine.Config.MQTT.Port))
-	
-	// Set client ID with uniqueness
-	clientID := fmt.Sprintf("%s-republish", engine.Config.MQTT.ClientID)
-	if engine.Config.MQTT.ClientID == "" {
-		clientID = fmt.Sprintf("rules-engine-republish-%d", time.Now().Unix())
+	for _, broker := range engine.brokerURLs() {
+		opts.AddBroker(broker)
 	}
-	opts.SetClientID(clientID)
+	
+	opts.SetClientID(engine.republishClientID())
 	
 	// Set credentials if provided
 	if engine.Config.MQTT.Username != "" && engine.Config.MQTT.Password != "" {
@@ -323,26 +1538,324 @@ func (engine *RulesEngine) setupRepublishClient() error {
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(10 * time.Second)
 	
-	// Create and connect client
-	engine.RepublishClient = mqtt.NewClient(opts)
-	token := engine.RepublishClient.Connect()
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("error connecting republish client to MQTT broker: %v", token.Error())
+	return opts
+}
+
+// republishClientID returns the republishing client's ID, made unique if not configured
+func (engine *RulesEngine) republishClientID() string {
+	if engine.Config.MQTT.ClientID == "" {
+		return fmt.Sprintf("rules-engine-republish-%d", time.Now().Unix())
 	}
-	
-	return nil
+	return fmt.Sprintf("%s-republish", engine.Config.MQTT.ClientID)
 }
 
+// useMQTTv5 reports whether the engine connects with MQTT 5 instead of 3.1.1
+func (engine *RulesEngine) useMQTTv5() bool {
+	switch engine.Config.MQTT.ProtocolVersion {
+	case 5:
+		return true
+	case 0, 3, 4:
+		return false
+	default:
+		log.Printf("Warning: unsupported mqtt.protocol_version %d, using MQTT 3.1.1", engine.Config.MQTT.ProtocolVersion)
+		return false
+	}
+}
+
+// usesV5Properties reports whether any republish target sets MQTT 5 publish properties
+func (engine *RulesEngine) usesV5Properties() bool {
+	for _, rule := range engine.activeRules() {
+		for _, action := range rule.Actions {
+			for _, target := range republishTargets(action) {
+				if target.hasV5Properties() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// newMQTTv5Client builds an MQTT 5 client for the configured brokers
+func (engine *RulesEngine) newMQTTv5Client(clientID string, persistentSession bool) (*mqttV5Client, error) {
+	var servers []*url.URL
+	for _, broker := range engine.brokerURLs() {
+		server, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker URL %q: %v", broker, err)
+		}
+		servers = append(servers, server)
+	}
+
+	client := &mqttV5Client{handlers: make(map[string]mqtt.MessageHandler)}
+	client.config = autopaho.ClientConfig{
+		ServerUrls:                    servers,
+		KeepAlive:                     60,
+		CleanStartOnInitialConnection: !persistentSession,
+		ConnectRetryDelay:             10 * time.Second,
+		ConnectTimeout:                10 * time.Second,
+		OnConnectionUp:                client.connectionUp,
+		OnConnectError:                client.connectionDown,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           clientID,
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){client.route},
+			OnClientError:      client.connectionDown,
+			OnServerDisconnect: func(d *paho.Disconnect) { client.connectionDown(fmt.Errorf("server disconnect, reason code %d", d.ReasonCode)) },
+		},
+	}
+	// Keep the broker session (and queued messages) indefinitely when persistent
+	if persistentSession {
+		client.config.SessionExpiryInterval = math.MaxUint32
+		log.Printf("MQTT persistent session enabled for client %s", clientID)
+	}
+	if engine.Config.MQTT.Username != "" && engine.Config.MQTT.Password != "" {
+		client.config.ConnectUsername = engine.Config.MQTT.Username
+		client.config.ConnectPassword = []byte(engine.Config.MQTT.Password)
+	}
+	return client, nil
+}
+
+// mqttV5OperationTimeout bounds publish/subscribe calls on the MQTT 5 client
+const mqttV5OperationTimeout = 10 * time.Second
+
+// propertyPublisher is implemented by clients that can attach MQTT 5 publish properties
+type propertyPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload []byte, expirySeconds uint32, userProperties map[string]string) mqtt.Token
+}
+
+// mqttV5Client adapts paho's MQTT 5 connection manager to the mqtt.Client interface
+// used throughout the engine, so handlers work unchanged over either protocol
+type mqttV5Client struct {
+	config autopaho.ClientConfig
+
+	mu        sync.RWMutex
+	manager   *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	handlers  map[string]mqtt.MessageHandler // Topic filter -> handler
+	connected atomic.Bool
+
+	onConnect        mqtt.OnConnectHandler
+	onConnectionLost mqtt.ConnectionLostHandler
+	defaultHandler   mqtt.MessageHandler
+}
+
+func (c *mqttV5Client) IsConnected() bool      { return c.connected.Load() }
+func (c *mqttV5Client) IsConnectionOpen() bool { return c.connected.Load() }
+
+// OptionsReader is not supported over MQTT 5 and returns empty options
+func (c *mqttV5Client) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// Connect starts the connection manager and waits for the first connection attempt
+func (c *mqttV5Client) Connect() mqtt.Token {
+	ctx, cancel := context.WithCancel(context.Background())
+	manager, err := autopaho.NewConnection(ctx, c.config)
+	if err != nil {
+		cancel()
+		return &mqttV5Token{err: err}
+	}
+	c.mu.Lock()
+	c.manager, c.cancel = manager, cancel
+	c.mu.Unlock()
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, c.config.ConnectTimeout)
+	defer waitCancel()
+	if err := manager.AwaitConnection(waitCtx); err != nil {
+		cancel()
+		return &mqttV5Token{err: fmt.Errorf("MQTT 5 connection failed: %v", err)}
+	}
+	return &mqttV5Token{}
+}
+
+// Disconnect sends a DISCONNECT, waiting up to quiesce milliseconds, and stops reconnecting
+func (c *mqttV5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	manager, cancel := c.manager, c.cancel
+	c.mu.Unlock()
+	if manager == nil {
+		return
+	}
+	ctx, done := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer done()
+	if err := manager.Disconnect(ctx); err != nil {
+		log.Printf("Error disconnecting MQTT 5 client: %v", err)
+	}
+	c.connected.Store(false)
+	cancel()
+}
+
+func (c *mqttV5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	case bytes.Buffer:
+		data = p.Bytes()
+	default:
+		return &mqttV5Token{err: fmt.Errorf("unknown payload type %T", payload)}
+	}
+	return c.publish(&paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: data})
+}
+
+// PublishWithProperties publishes with a message expiry interval and user properties
+func (c *mqttV5Client) PublishWithProperties(topic string, qos byte, retained bool, payload []byte, expirySeconds uint32, userProperties map[string]string) mqtt.Token {
+	properties := &paho.PublishProperties{}
+	if expirySeconds > 0 {
+		properties.MessageExpiry = &expirySeconds
+	}
+	keys := make([]string, 0, len(userProperties))
+	for key := range userProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		properties.User.Add(key, userProperties[key])
+	}
+	return c.publish(&paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload, Properties: properties})
+}
+
+func (c *mqttV5Client) publish(packet *paho.Publish) mqtt.Token {
+	manager := c.connectionManager()
+	if manager == nil {
+		return &mqttV5Token{err: fmt.Errorf("not connected")}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5OperationTimeout)
+	defer cancel()
+	_, err := manager.Publish(ctx, packet)
+	return &mqttV5Token{err: err}
+}
+
+func (c *mqttV5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *mqttV5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	manager := c.connectionManager()
+	if manager == nil {
+		return &mqttV5Token{err: fmt.Errorf("not connected")}
+	}
+	subscribe := &paho.Subscribe{}
+	for topic, qos := range filters {
+		c.AddRoute(topic, callback)
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5OperationTimeout)
+	defer cancel()
+	_, err := manager.Subscribe(ctx, subscribe)
+	return &mqttV5Token{err: err}
+}
+
+func (c *mqttV5Client) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.handlers, topic)
+	}
+	manager := c.manager
+	c.mu.Unlock()
+	if manager == nil {
+		return &mqttV5Token{err: fmt.Errorf("not connected")}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5OperationTimeout)
+	defer cancel()
+	_, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	return &mqttV5Token{err: err}
+}
+
+// AddRoute sets the handler for messages matching topic (nil uses the default handler)
+func (c *mqttV5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[topic] = callback
+}
+
+func (c *mqttV5Client) connectionManager() *autopaho.ConnectionManager {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.manager
+}
+
+// connectionUp runs on every (re)connection, mirroring the v3 OnConnect handler
+func (c *mqttV5Client) connectionUp(manager *autopaho.ConnectionManager, _ *paho.Connack) {
+	c.mu.Lock()
+	c.manager = manager
+	c.mu.Unlock()
+	c.connected.Store(true)
+	if c.onConnect != nil {
+		c.onConnect(c)
+	}
+}
+
+// connectionDown reports a lost connection once, mirroring the v3 ConnectionLost handler
+func (c *mqttV5Client) connectionDown(err error) {
+	if c.connected.Swap(false) && c.onConnectionLost != nil {
+		c.onConnectionLost(c, err)
+	}
+}
+
+// route delivers a received message to every handler whose filter matches its topic
+func (c *mqttV5Client) route(received paho.PublishReceived) (bool, error) {
+	message := &mqttV5Message{packet: received.Packet}
+
+	var handlers []mqtt.MessageHandler
+	c.mu.RLock()
+	for filter, handler := range c.handlers {
+		if topicMatches(filter, received.Packet.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.RUnlock()
+
+	delivered := false
+	for _, handler := range handlers {
+		if handler != nil {
+			handler(c, message)
+			delivered = true
+		}
+	}
+	if !delivered && c.defaultHandler != nil {
+		c.defaultHandler(c, message)
+	}
+	return true, nil
+}
+
+// mqttV5Message adapts a received MQTT 5 publish to mqtt.Message
+type mqttV5Message struct {
+	packet *paho.Publish
+}
+
+func (m *mqttV5Message) Duplicate() bool   { return false }
+func (m *mqttV5Message) Qos() byte         { return m.packet.QoS }
+func (m *mqttV5Message) Retained() bool    { return m.packet.Retain }
+func (m *mqttV5Message) Topic() string     { return m.packet.Topic }
+func (m *mqttV5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m *mqttV5Message) Payload() []byte   { return m.packet.Payload }
+func (m *mqttV5Message) Ack()              {} // Acknowledged automatically by paho
+
+// mqttV5Token is an already-completed mqtt.Token; MQTT 5 operations block until done
+type mqttV5Token struct {
+	err error
+}
+
+func (t *mqttV5Token) Wait() bool                     { return true }
+func (t *mqttV5Token) WaitTimeout(time.Duration) bool { return true }
+func (t *mqttV5Token) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t *mqttV5Token) Error() error { return t.err }
+
 // onConnect is called when the MQTT client connects
 func (engine *RulesEngine) onConnect(client mqtt.Client) {
 	log.Println("Connected to MQTT broker")
 
-	// Get a unique set of topic patterns to subscribe to
-	topics := make(map[string]byte)
-	for _, rule := range engine.Rules {
-		if rule.Enabled {
-			topics[rule.TopicPattern] = 0 // QoS 0
-		}
+	// Get a unique set of topic patterns to subscribe to, leaving out patterns
+	// whose rules are all shed until their backlog clears
+	topics := engine.subscriptionTopics()
+	for topic := range engine.shedTopics() {
+		log.Printf("Skipping subscription to shed topic: %s", topic)
+		delete(topics, topic)
 	}
 
 	// Subscribe to each unique topic
@@ -353,6 +1866,276 @@ func (engine *RulesEngine) onConnect(client mqtt.Client) {
 			log.Printf("Error subscribing to topic %s: %v", topic, token.Error())
 		}
 	}
+
+	// Accept rule sets pushed by the backend
+	log.Printf("Subscribing to rules update topic: %s", RulesUpdateTopic)
+	token := client.Subscribe(RulesUpdateTopic, 1, engine.handleRulesUpdate)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error subscribing to topic %s: %v", RulesUpdateTopic, token.Error())
+	}
+}
+
+// activeRules returns a snapshot of the current rule set
+func (engine *RulesEngine) activeRules() []*Rule {
+	engine.RulesMutex.RLock()
+	defer engine.RulesMutex.RUnlock()
+	return engine.Rules
+}
+
+// Topics for pushing rule sets to the engine and reporting the outcome
+const (
+	RulesUpdateTopic       = "rules/update"
+	RulesUpdateStatusTopic = "rules/update/status"
+)
+
+// handleRulesUpdate parses a pushed rule set (YAML or JSON, either a list of rules
+// or an object with a "rules" list) and swaps it in if it is valid
+func (engine *RulesEngine) handleRulesUpdate(client mqtt.Client, msg mqtt.Message) {
+	payload := msg.Payload()
+	if limit := engine.maxPayloadBytes(); limit > 0 && len(payload) > limit {
+		log.Printf("Dropping oversized rules update: %d bytes exceeds limit of %d", len(payload), limit)
+		engine.deadLetter(msg.Topic(), len(payload), "payload_too_large")
+		return
+	}
+
+	configs, err := parseRuleConfigs(payload)
+	if err == nil {
+		err = engine.applyRules(configs)
+	}
+
+	status := map[string]interface{}{
+		"accepted":   err == nil,
+		"rule_count": len(engine.activeRules()),
+		"timestamp":  time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		log.Printf("Rejected rules update, keeping existing rules: %v", err)
+		status["error"] = err.Error()
+	}
+
+	if client != nil && client.IsConnected() {
+		statusJSON, _ := json.Marshal(status)
+		client.Publish(RulesUpdateStatusTopic, 1, false, statusJSON)
+	}
+}
+
+// parseRuleConfigs decodes a pushed rule set
+func parseRuleConfigs(data []byte) ([]RuleConfig, error) {
+	var wrapper struct {
+		Rules []RuleConfig `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &wrapper); err == nil && wrapper.Rules != nil {
+		return wrapper.Rules, nil
+	}
+
+	var configs []RuleConfig
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing rules: %v", err)
+	}
+	return configs, nil
+}
+
+// validateRuleConfigs checks a rule set before it is activated
+func validateRuleConfigs(configs []RuleConfig) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("rule set is empty")
+	}
+
+	// Collect every problem so one edit can fix the whole rule set
+	var problems []string
+	names := make(map[string]bool)
+	for i, rule := range configs {
+		if rule.Name == "" {
+			problems = append(problems, fmt.Sprintf("rule %d has no name", i))
+			continue
+		}
+		if names[rule.Name] {
+			problems = append(problems, fmt.Sprintf("duplicate rule name %s", rule.Name))
+			continue
+		}
+		names[rule.Name] = true
+
+		// Disabled rules are never built, so only their shape is checked
+		if rule.Enabled {
+			if err := validateTopicPattern(rule.TopicPattern); err != nil {
+				problems = append(problems, fmt.Sprintf("rule %s has invalid topic_pattern: %v", rule.Name, err))
+			}
+			if _, err := parseSQLWhere(rule.SQL); err != nil {
+				problems = append(problems, fmt.Sprintf("rule %s has invalid sql: %v", rule.Name, err))
+			}
+		}
+		for j, action := range rule.Actions {
+			switch action.Type {
+			case "http":
+				if action.URL == "" {
+					problems = append(problems, fmt.Sprintf("rule %s action %d: http action requires a url", rule.Name, j))
+				}
+			case "republish":
+				if len(republishTargets(action)) == 0 {
+					problems = append(problems, fmt.Sprintf("rule %s action %d: republish action requires a topic", rule.Name, j))
+				}
+			case "lambda", "function":
+			default:
+				problems = append(problems, fmt.Sprintf("rule %s action %d: unknown action type %q", rule.Name, j, action.Type))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applyRules validates and atomically swaps in a new rule set, then updates subscriptions
+func (engine *RulesEngine) applyRules(configs []RuleConfig) error {
+	// A SIGHUP reload and a rules/update message must not interleave their
+	// subscription diffs
+	engine.ApplyMutex.Lock()
+	defer engine.ApplyMutex.Unlock()
+
+	if err := validateRuleConfigs(configs); err != nil {
+		return err
+	}
+
+	rules := buildRules(configs)
+	logRuleOverlaps(rules)
+
+	// Shed topics are unsubscribed, and the new rules start out unshed
+	oldTopics := engine.subscriptionTopics()
+	for topic := range engine.shedTopics() {
+		delete(oldTopics, topic)
+	}
+	engine.RulesMutex.Lock()
+	oldRules := engine.Rules
+	engine.Rules = rules
+	engine.RulesMutex.Unlock()
+	newTopics := engine.subscriptionTopics()
+
+	added, removed, changed := diffRules(oldRules, rules)
+	log.Printf("Activated %d rule(s): added %v, removed %v, changed %v", len(rules), added, removed, changed)
+
+	client := engine.MQTTClient
+	if client == nil || !client.IsConnected() {
+		return nil
+	}
+
+	// Drop subscriptions no rule needs any more and add the new ones
+	var unused []string
+	for topic := range oldTopics {
+		if _, ok := newTopics[topic]; !ok {
+			unused = append(unused, topic)
+		}
+	}
+	if len(unused) > 0 {
+		token := client.Unsubscribe(unused...)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Error unsubscribing from %v: %v", unused, token.Error())
+		}
+	}
+	for topic, qos := range newTopics {
+		if _, ok := oldTopics[topic]; ok {
+			continue
+		}
+		log.Printf("Subscribing to topic: %s", topic)
+		token := client.Subscribe(topic, qos, engine.messageHandler)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Error subscribing to topic %s: %v", topic, token.Error())
+		}
+	}
+
+	// Republish actions need their own client
+	if engine.RepublishClient == nil && engine.needsRepublishClient() {
+		if err := engine.setupRepublishClient(); err != nil {
+			log.Printf("Error setting up republish client: %v", err)
+		}
+	}
+	return nil
+}
+
+// diffRules compares two rule sets by name, listing added, removed and changed rules
+func diffRules(oldRules []*Rule, newRules []*Rule) (added []string, removed []string, changed []string) {
+	previous := make(map[string]*Rule, len(oldRules))
+	for _, rule := range oldRules {
+		previous[rule.Name] = rule
+	}
+
+	for _, rule := range newRules {
+		old, existed := previous[rule.Name]
+		switch {
+		case !existed:
+			added = append(added, rule.Name)
+		case old.Description != rule.Description || old.TopicPattern != rule.TopicPattern || old.SQL != rule.SQL ||
+			old.Transform != rule.Transform || !reflect.DeepEqual(old.Actions, rule.Actions) ||
+			!reflect.DeepEqual(old.UnitConversions, rule.UnitConversions):
+			changed = append(changed, rule.Name)
+		}
+		delete(previous, rule.Name)
+	}
+	for _, rule := range oldRules {
+		if _, gone := previous[rule.Name]; gone {
+			removed = append(removed, rule.Name)
+		}
+	}
+	return added, removed, changed
+}
+
+// reloadConfig re-reads the rules from the config file and applies them, keeping
+// the current rules if the file is invalid. Other sections take effect on restart.
+func (engine *RulesEngine) reloadConfig() error {
+	config, err := loadConfig(engine.ConfigPath)
+	if err == nil {
+		err = engine.applyRules(config.Rules)
+	}
+	if err != nil {
+		log.Printf("Error reloading %s, keeping existing rules: %v", engine.ConfigPath, err)
+		return err
+	}
+
+	log.Printf("Reloaded rules from %s", engine.ConfigPath)
+	return nil
+}
+
+// subscriptionTopics returns the unique topic patterns of all enabled rules
+func (engine *RulesEngine) subscriptionTopics() map[string]byte {
+	topics := make(map[string]byte)
+	for _, rule := range engine.activeRules() {
+		if rule.Enabled {
+			topics[rule.TopicPattern] = engine.subscriptionQoS()
+		}
+	}
+	return topics
+}
+
+// shedTopics returns the topic patterns whose enabled rules are all shed
+func (engine *RulesEngine) shedTopics() map[string]bool {
+	shed := make(map[string]bool)
+	for _, rule := range engine.activeRules() {
+		if !rule.Enabled {
+			continue
+		}
+		if rule.isShed() {
+			if _, seen := shed[rule.TopicPattern]; !seen {
+				shed[rule.TopicPattern] = true
+			}
+		} else {
+			shed[rule.TopicPattern] = false
+		}
+	}
+	for topic, allShed := range shed {
+		if !allShed {
+			delete(shed, topic)
+		}
+	}
+	return shed
+}
+
+// subscriptionQoS is the QoS for rule topics: 1 with a persistent session, so the
+// broker queues messages while the engine is offline, 0 otherwise
+func (engine *RulesEngine) subscriptionQoS() byte {
+	if engine.Config.MQTT.PersistentSession {
+		return 1
+	}
+	return 0
 }
 
 // onConnectionLost is called when the MQTT connection is lost
@@ -378,6 +2161,13 @@ func (engine *RulesEngine) messageHandler(client mqtt.Client, msg mqtt.Message)
 	topic := msg.Topic()
 	payload := msg.Payload()
 
+	// Drop oversized payloads before parsing them
+	if limit := engine.maxPayloadBytes(); limit > 0 && len(payload) > limit {
+		log.Printf("Dropping oversized message on topic %s: %d bytes exceeds limit of %d", topic, len(payload), limit)
+		engine.deadLetter(topic, len(payload), "payload_too_large")
+		return
+	}
+
 	log.Printf("Received message on topic: %s", topic)
 
 	// Parse JSON payload
@@ -390,13 +2180,134 @@ func (engine *RulesEngine) messageHandler(client mqtt.Client, msg mqtt.Message)
 		}
 	}
 
-	// Check each rule
-	for _, rule := range engine.Rules {
-		if rule.ShouldProcessMessage(topic, payloadMap) {
-			log.Printf("Rule '%s' matched for topic: %s", rule.Name, topic)
-			
-			// Process the message with this rule
-			engine.processMessage(rule, topic, payloadMap)
+	// Decrypt end-to-end encrypted payloads
+	if encrypted, _ := payloadMap["encrypted"].(bool); encrypted {
+		decrypted, err := engine.decryptPayload(payload)
+		if err != nil {
+			log.Printf("Dropping encrypted message on topic %s: %v", topic, err)
+			return
+		}
+		payloadMap = decrypted
+	}
+
+	// Check each rule
+	rules := engine.activeRules()
+	engine.countReceived(rules, topic)
+	for _, rule := range rules {
+		// A shed rule stays idle even when another rule keeps its topic subscribed
+		if rule.isShed() {
+			continue
+		}
+		if rule.ShouldProcessMessage(topic, payloadMap) {
+			log.Printf("Rule '%s' matched for topic: %s", rule.Name, topic)
+			engine.metrics.ruleMatched(rule.Name)
+			
+			// Process the message with this rule
+			engine.processMessage(rule, topic, payloadMap)
+		}
+	}
+}
+
+// EncryptedPayload is the envelope for an AES-GCM encrypted gateway payload
+type EncryptedPayload struct {
+	Encrypted  bool   `json:"encrypted"`
+	Algorithm  string `json:"alg"`
+	KeyID      string `json:"key_id"`
+	IV         string `json:"iv"`         // Base64 nonce
+	Ciphertext string `json:"ciphertext"` // Base64 ciphertext with GCM tag
+}
+
+// decryptPayload opens an encrypted envelope with the configured key and decodes the JSON inside
+func (engine *RulesEngine) decryptPayload(data []byte) (map[string]interface{}, error) {
+	var envelope EncryptedPayload
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid encrypted envelope: %v", err)
+	}
+
+	encodedKey, ok := engine.Config.Encryption.Keys[envelope.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", envelope.KeyID)
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %v", envelope.KeyID, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(envelope.IV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IV: %v", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid IV length %d", len(nonce))
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, fmt.Errorf("decrypted payload is not JSON: %v", err)
+	}
+	return payload, nil
+}
+
+// maxPayloadBytes returns the configured payload limit, defaulting to 1 MiB
+func (engine *RulesEngine) maxPayloadBytes() int {
+	limit := engine.Config.MQTT.MaxPayloadBytes
+	if limit == 0 {
+		return 1024 * 1024
+	}
+	return limit
+}
+
+// deadLetter publishes a summary of a dropped message to the dead-letter topic, if configured
+func (engine *RulesEngine) deadLetter(topic string, size int, reason string) {
+	deadLetterTopic := engine.Config.MQTT.DeadLetterTopic
+	if deadLetterTopic == "" {
+		return
+	}
+
+	client := engine.RepublishClient
+	if client == nil || !client.IsConnected() {
+		client = engine.MQTTClient
+	}
+	if client == nil || !client.IsConnected() {
+		log.Printf("No MQTT client available for dead-letter topic %s", deadLetterTopic)
+		return
+	}
+
+	summary, _ := json.Marshal(map[string]interface{}{
+		"original_topic": topic,
+		"size_bytes":     size,
+		"reason":         reason,
+		"timestamp":      time.Now().Format(time.RFC3339),
+	})
+	token := client.Publish(deadLetterTopic, 1, false, summary)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error publishing to dead-letter topic %s: %v", deadLetterTopic, token.Error())
+	}
+}
+
+// countReceived counts a message once for each distinct rule topic pattern it matches
+func (engine *RulesEngine) countReceived(rules []*Rule, topic string) {
+	counted := make(map[string]bool)
+	for _, rule := range rules {
+		if !counted[rule.TopicPattern] && topicMatches(rule.TopicPattern, topic) {
+			counted[rule.TopicPattern] = true
+			engine.metrics.messageReceived(rule.TopicPattern)
 		}
 	}
 }
@@ -409,11 +2320,17 @@ func (engine *RulesEngine) processMessage(rule *Rule, topic string, payload map[
 		log.Printf("Transform '%s' not implemented yet, using original payload", rule.Transform)
 	}
 
+	// Normalize units before any action sees the payload
+	if len(rule.UnitConversions) > 0 {
+		processedPayload = convertUnits(processedPayload, rule.UnitConversions)
+	}
+
 	// Execute actions
 	for _, action := range rule.Actions {
+		engine.metrics.actionExecuted(action.Type)
 		switch action.Type {
 		case "http":
-			engine.executeHTTPAction(action, topic, processedPayload)
+			engine.executeRuleHTTPAction(rule, action, topic, processedPayload)
 		case "republish":
 			engine.executeRepublishAction(action, topic, processedPayload)
 		case "lambda":
@@ -422,162 +2339,621 @@ func (engine *RulesEngine) processMessage(rule *Rule, topic string, payload map[
 			engine.executeFunctionAction(action, topic, processedPayload)
 		default:
 			log.Printf("Unknown action type: %s", action.Type)
+			engine.metrics.actionFailed(action.Type)
 		}
 	}
 }
 
-// executeHTTPAction executes an HTTP action
-func (engine *RulesEngine) executeHTTPAction(action ActionConfig, topic string, payload map[string]interface{}) {
-	// Start a new goroutine for HTTP request to avoid blocking
-	engine.WaitGroup.Add(1)
-	go func() {
-		defer engine.WaitGroup.Done()
+// gramsPerUnit is the conversion table for unit_conversions, in grams per unit
+var gramsPerUnit = map[string]float64{
+	"g":  1,
+	"kg": 1000,
+	"lb": 453.59237,
+}
 
-		url := action.URL
-		method := action.Method
-		if method == "" {
-			method = "POST" // Default to POST
+// validateUnitConversions checks that every conversion names a field and known units
+func validateUnitConversions(conversions []UnitConversionConfig) error {
+	for _, conversion := range conversions {
+		if conversion.Field == "" {
+			return fmt.Errorf("conversion without a field")
 		}
-
-		// Prepare headers
-		headers := action.Headers
-		if headers == nil {
-			headers = map[string]string{
-				"Content-Type": "application/json",
-			}
+		if _, ok := gramsPerUnit[conversion.To]; !ok {
+			return fmt.Errorf("%s: unknown target unit %q", conversion.Field, conversion.To)
 		}
+		if conversion.From == "" && conversion.FromField == "" {
+			return fmt.Errorf("%s: needs a from unit or from_field", conversion.Field)
+		}
+		if _, ok := gramsPerUnit[conversion.From]; conversion.From != "" && !ok {
+			return fmt.Errorf("%s: unknown source unit %q", conversion.Field, conversion.From)
+		}
+	}
+	return nil
+}
 
-		// Prepare timeout
-		timeout := action.Timeout
-		if timeout == 0 {
-			timeout = 10 // Default to 10 seconds
+// convertUnits returns the payload with the configured fields converted. The
+// payload is shared by every matching rule, so changed maps are copied, not modified.
+func convertUnits(payload map[string]interface{}, conversions []UnitConversionConfig) map[string]interface{} {
+	for _, conversion := range conversions {
+		value, ok := lookupPath(payload, conversion.Field)
+		if !ok {
+			continue
+		}
+		number, ok := sqlNumber(value)
+		if !ok {
+			log.Printf("Skipping unit conversion of %s: %v is not a number", conversion.Field, value)
+			continue
 		}
 
-		// Extract gateway_id from topic if possible (expected format: gateway/{gateway_id}/...)
-		topicParts := strings.Split(topic, "/")
-		gatewayID := ""
-		eventType := ""
-		if len(topicParts) >= 2 && topicParts[0] == "gateway" {
-			gatewayID = topicParts[1]
+		from := conversion.From
+		if from == "" {
+			unit, _ := lookupPath(payload, conversion.FromField)
+			from, _ = unit.(string)
 		}
-		
-		// Extract event_type from topic if possible
-		if len(topicParts) >= 3 {
-			eventType = topicParts[2]
+		fromGrams, ok := gramsPerUnit[from]
+		if !ok {
+			log.Printf("Skipping unit conversion of %s: unknown source unit %q", conversion.Field, from)
+			continue
+		}
+
+		payload = withPath(payload, conversion.Field, number*fromGrams/gramsPerUnit[conversion.To])
+		if conversion.FromField != "" {
+			payload = withPath(payload, conversion.FromField, conversion.To)
 		}
+	}
+	return payload
+}
+
+// withPath returns a copy of data with the dotted path set to value, copying only
+// the maps along the path
+func withPath(data map[string]interface{}, path string, value interface{}) map[string]interface{} {
+	key, rest, nested := strings.Cut(path, ".")
+	result := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		result[k] = v
+	}
+	if !nested {
+		result[key] = value
+		return result
+	}
+	child, _ := data[key].(map[string]interface{})
+	result[key] = withPath(child, rest, value)
+	return result
+}
+
+// HTTPActionResult describes the outcome of an HTTP action
+type HTTPActionResult struct {
+	OriginalTopic string `json:"original_topic"`
+	CorrelationID string `json:"correlation_id"`
+	URL           string `json:"url"`
+	StatusCode    int    `json:"status_code,omitempty"`
+	Attempts      int    `json:"attempts"`
+	Success       bool   `json:"success"`
+	LatencyMs     int64  `json:"latency_ms"`
+	Error         string `json:"error,omitempty"`
+	Timestamp     string `json:"timestamp"`
+}
 
-		// Prepare the request payload
-		requestPayload := map[string]interface{}{
-			"topic":    topic,
-			"payload":  payload,
-			"timestamp": time.Now().Format(time.RFC3339),
+// correlationCounter makes correlation IDs unique within the process
+var correlationCounter uint64
+
+// newCorrelationID returns a unique ID linking an action to its result message
+func newCorrelationID() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&correlationCounter, 1))
+}
+
+// executeHTTPAction executes an HTTP action
+func (engine *RulesEngine) executeHTTPAction(action ActionConfig, topic string, payload map[string]interface{}) {
+	engine.executeRuleHTTPAction(nil, action, topic, payload)
+}
+
+// executeRuleHTTPAction executes an HTTP action, counting it against the rule's in-flight actions
+func (engine *RulesEngine) executeRuleHTTPAction(rule *Rule, action ActionConfig, topic string, payload map[string]interface{}) {
+	// Start a new goroutine for HTTP request to avoid blocking
+	engine.beginAction()
+	if rule != nil {
+		atomic.AddInt64(&rule.inFlight, 1)
+	}
+	go func() {
+		defer engine.endAction()
+		if rule != nil {
+			defer atomic.AddInt64(&rule.inFlight, -1)
 		}
 
-		// Add gateway_id and event_type for FastAPI backend compatibility
-		if gatewayID != "" {
-			requestPayload["gateway_id"] = gatewayID
+		start := time.Now()
+		result := engine.performHTTPAction(action, topic, payload, newCorrelationID())
+		engine.metrics.observeHTTPLatency(time.Since(start))
+		if !result.Success {
+			engine.metrics.actionFailed("http")
 		}
-		if eventType != "" {
-			requestPayload["event_type"] = eventType
+		if action.OnResult != "" {
+			engine.publishActionResult(action.OnResult, result)
 		}
+	}()
+}
+
+// performHTTPAction sends the HTTP request for an action and reports the outcome
+func (engine *RulesEngine) performHTTPAction(action ActionConfig, topic string, payload map[string]interface{}, correlationID string) (result HTTPActionResult) {
+	url := renderTemplate(action.URL, topic, payload)
+	result = HTTPActionResult{
+		OriginalTopic: topic,
+		CorrelationID: correlationID,
+		URL:           url,
+	}
+	start := time.Now()
+	defer func() {
+		result.LatencyMs = time.Since(start).Milliseconds()
+		result.Timestamp = time.Now().Format(time.RFC3339)
+	}()
+
+	method := action.Method
+	if method == "" {
+		method = "POST" // Default to POST
+	}
+
+	// Prepare headers, resolving any templated values for this message
+	headers := make(map[string]string, len(action.Headers))
+	for key, value := range action.Headers {
+		headers[key] = renderTemplate(value, topic, payload)
+	}
+	if len(headers) == 0 {
+		headers["Content-Type"] = "application/json"
+	}
+
+	// Prepare timeout
+	timeout := action.Timeout
+	if timeout == 0 {
+		timeout = 10 // Default to 10 seconds
+	}
+
+	// Extract gateway_id from topic if possible (expected format: gateway/{gateway_id}/...)
+	topicParts := strings.Split(topic, "/")
+	gatewayID := ""
+	eventType := ""
+	if len(topicParts) >= 2 && topicParts[0] == "gateway" {
+		gatewayID = topicParts[1]
+	}
+	
+	// Extract event_type from topic if possible
+	if len(topicParts) >= 3 {
+		eventType = topicParts[2]
+	}
+
+	// Prepare the request payload
+	requestPayload := map[string]interface{}{
+		"topic":    topic,
+		"payload":  payload,
+		"timestamp": time.Now().Format(time.RFC3339),
+	}
+
+	// Add gateway_id and event_type for FastAPI backend compatibility
+	if gatewayID != "" {
+		requestPayload["gateway_id"] = gatewayID
+	}
+	if eventType != "" {
+		requestPayload["event_type"] = eventType
+	}
+
+	// Convert to JSON
+	jsonPayload, err := json.Marshal(requestPayload)
+	if err != nil {
+		log.Printf("Error marshaling HTTP request payload: %v", err)
+		result.Error = err.Error()
+		return result
+	}
 
-		// Convert to JSON
-		jsonPayload, err := json.Marshal(requestPayload)
+	// Enforce the action's body size limit
+	if action.MaxBodyBytes > 0 && len(jsonPayload) > action.MaxBodyBytes {
+		jsonPayload, err = fitHTTPBody(action, requestPayload, len(jsonPayload))
 		if err != nil {
-			log.Printf("Error marshaling HTTP request payload: %v", err)
-			return
+			log.Printf("Warning: skipping HTTP %s request to %s: %v", method, url, err)
+			result.Error = err.Error()
+			return result
 		}
+	}
 
-		log.Printf("Executing HTTP %s request to %s", method, url)
+	// Create HTTP client with timeout
+	client := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+	}
 
-		// Create HTTP client with timeout
-		client := &http.Client{
-			Timeout: time.Duration(timeout) * time.Second,
+	// Retry network errors and 5xx responses with exponential backoff
+	attempts := 1 + action.MaxRetries
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			delay := retryBackoff(action, attempt-1)
+			log.Printf("Retrying HTTP %s request to %s in %v", method, url, delay)
+			time.Sleep(delay)
 		}
 
-		// Create request
-		req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonPayload))
-		if err != nil {
-			log.Printf("Error creating HTTP request: %v", err)
-			return
+		log.Printf("Executing HTTP %s request to %s (attempt %d of %d)", method, url, attempt, attempts)
+		result.Attempts = attempt
+		statusCode, err := sendHTTPRequest(client, method, url, headers, correlationID, jsonPayload)
+		result.StatusCode = statusCode
+		if err == nil {
+			log.Printf("HTTP request successful: %d", statusCode)
+			result.Success = true
+			result.Error = ""
+			return result
 		}
 
-		// Set headers
-		for key, value := range headers {
-			req.Header.Set(key, value)
+		result.Error = err.Error()
+		if statusCode != 0 && statusCode < 500 {
+			break // Client errors won't succeed on retry
 		}
+	}
+	return result
+}
 
-		// Execute request
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Error executing HTTP request: %v", err)
-			return
+// fitHTTPBody applies the action's on_oversize policy to a request body of size bytes.
+// With "truncate", each truncate_fields entry of the message payload is shortened
+// (strings) or removed (other values) until the body fits within max_body_bytes.
+func fitHTTPBody(action ActionConfig, requestPayload map[string]interface{}, size int) ([]byte, error) {
+	if action.OnOversize != "truncate" {
+		return nil, fmt.Errorf("request body of %d bytes exceeds max_body_bytes %d", size, action.MaxBodyBytes)
+	}
+
+	// Work on a copy so other actions still see the full payload
+	payload, _ := requestPayload["payload"].(map[string]interface{})
+	trimmed := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		trimmed[key] = value
+	}
+	requestPayload["payload"] = trimmed
+
+	for _, field := range action.TruncateFields {
+		value, exists := trimmed[field]
+		if !exists {
+			continue
 		}
-		defer resp.Body.Close()
 
-		// Check response
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			log.Printf("HTTP request successful: %d", resp.StatusCode)
+		// Cutting the excess from a string always fits, since escaping only adds bytes
+		keep := 0
+		if text, ok := value.(string); ok {
+			keep = len(text) - (size - action.MaxBodyBytes)
+			for keep > 0 && !utf8.RuneStart(text[keep]) {
+				keep--
+			}
+		}
+		if keep > 0 {
+			trimmed[field] = value.(string)[:keep]
 		} else {
-			body, _ := ioutil.ReadAll(resp.Body)
-			log.Printf("HTTP request failed: %d - %s", resp.StatusCode, string(body))
+			delete(trimmed, field)
 		}
-	}()
+
+		body, err := json.Marshal(requestPayload)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) <= action.MaxBodyBytes {
+			log.Printf("Truncated request body from %d to %d bytes", size, len(body))
+			return body, nil
+		}
+		size = len(body)
+	}
+	return nil, fmt.Errorf("request body of %d bytes still exceeds max_body_bytes %d after truncation", size, action.MaxBodyBytes)
+}
+
+// sendHTTPRequest sends one HTTP request, returning an error for failures and non-2xx responses
+func sendHTTPRequest(client *http.Client, method string, url string, headers map[string]string, correlationID string, body []byte) (int, error) {
+	// Create request
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		log.Printf("Error creating HTTP request: %v", err)
+		return 0, err
+	}
+
+	// Set headers
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("X-Correlation-ID", correlationID)
+
+	// Execute request
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error executing HTTP request: %v", err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Check response
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("HTTP request failed: %d - %s", resp.StatusCode, string(responseBody))
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryBackoff returns the delay before retry n (1-based): the base backoff doubled
+// for each earlier retry, plus up to 50% random jitter, capped at the maximum backoff
+func retryBackoff(action ActionConfig, retry int) time.Duration {
+	base := action.RetryBackoffMs
+	if base <= 0 {
+		base = 500 // Default to 500ms
+	}
+	maxBackoff := action.RetryMaxBackoffMs
+	if maxBackoff <= 0 {
+		maxBackoff = 30000 // Default to 30s
+	}
+	if maxBackoff < base {
+		maxBackoff = base
+	}
+	limit := time.Duration(maxBackoff) * time.Millisecond
+
+	// Double step by step so large retry counts can't overflow
+	delay := time.Duration(base) * time.Millisecond
+	for i := 1; i < retry && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	if delay > limit {
+		return limit
+	}
+	return delay
+}
+
+// publishActionResult republishes an HTTP action outcome to the configured result topic
+func (engine *RulesEngine) publishActionResult(resultTopic string, result HTTPActionResult) {
+	if engine.RepublishClient == nil || !engine.RepublishClient.IsConnected() {
+		log.Println("Republish client not available, dropping action result")
+		return
+	}
+
+	jsonPayload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error marshaling action result: %v", err)
+		return
+	}
+
+	topic := renderTemplate(resultTopic, result.OriginalTopic, nil)
+	token := engine.RepublishClient.Publish(topic, 0, false, jsonPayload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Error publishing action result to %s: %v", topic, token.Error())
+	} else {
+		log.Printf("Published action result to %s (correlation_id %s)", topic, result.CorrelationID)
+	}
 }
 
 // executeRepublishAction executes a republish action
 func (engine *RulesEngine) executeRepublishAction(action ActionConfig, originalTopic string, payload map[string]interface{}) {
 	if engine.RepublishClient == nil || !engine.RepublishClient.IsConnected() {
 		log.Println("Republish client not available")
+		engine.metrics.actionFailed("republish")
 		return
 	}
 
-	// Get target topic
-	targetTopic := action.Topic
-	if targetTopic == "" {
+	// The action's own topic is the first target, followed by any listed targets
+	targets := republishTargets(action)
+	if len(targets) == 0 {
 		log.Println("Republish action missing target topic")
+		engine.metrics.actionFailed("republish")
 		return
 	}
 
-	// Apply topic transformations
-	if strings.Contains(targetTopic, "{original_topic}") {
-		targetTopic = strings.Replace(targetTopic, "{original_topic}", originalTopic, -1)
+	published := 0
+	for _, target := range targets {
+		if engine.publishToTarget(target, originalTopic, payload) {
+			published++
+		}
+	}
+	if len(targets) > 1 {
+		log.Printf("Republished message to %d of %d target(s)", published, len(targets))
+	}
+	if published < len(targets) {
+		engine.metrics.actionFailed("republish")
+	}
+}
+
+// republishTargets lists the destinations of a republish action
+func republishTargets(action ActionConfig) []RepublishTarget {
+	var targets []RepublishTarget
+	if action.Topic != "" {
+		targets = append(targets, RepublishTarget{
+			Topic:                action.Topic,
+			QoS:                  action.QoS,
+			Retain:               action.Retain,
+			Payload:              action.Payload,
+			MessageExpirySeconds: action.MessageExpirySeconds,
+			UserProperties:       action.UserProperties,
+		})
 	}
+	for _, target := range action.Targets {
+		if target.Topic == "" {
+			log.Println("Skipping republish target without topic")
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// publishToTarget republishes a message to a single target, returning whether it succeeded
+func (engine *RulesEngine) publishToTarget(target RepublishTarget, originalTopic string, payload map[string]interface{}) bool {
+	// Apply topic transformations
+	targetTopic := renderTemplate(target.Topic, originalTopic, payload)
 
-	// Get QoS and retain flag
-	qos := byte(action.QoS)
-	retain := action.Retain
+	// Use the target's payload template if it has one
+	var message interface{} = payload
+	if target.Payload != nil {
+		message = renderPayloadTemplate(target.Payload, originalTopic, payload)
+	}
 
 	// Convert payload to JSON
-	jsonPayload, err := json.Marshal(payload)
+	jsonPayload, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Error marshaling republish payload: %v", err)
-		return
+		log.Printf("Error marshaling republish payload for %s: %v", targetTopic, err)
+		return false
 	}
 
-	log.Printf("Republishing message to topic: %s", targetTopic)
-	
-	// Publish message
-	token := engine.RepublishClient.Publish(targetTopic, qos, retain, jsonPayload)
+	log.Printf("Republishing message to topic: %s (qos %d, retain %v)", targetTopic, target.QoS, target.Retain)
+
+	// Publish message, with MQTT 5 properties when the client supports them
+	var token mqtt.Token
+	if publisher, ok := engine.RepublishClient.(propertyPublisher); ok && target.hasV5Properties() {
+		token = publisher.PublishWithProperties(targetTopic, byte(target.QoS), target.Retain, jsonPayload,
+			target.MessageExpirySeconds, target.UserProperties)
+	} else {
+		token = engine.RepublishClient.Publish(targetTopic, byte(target.QoS), target.Retain, jsonPayload)
+	}
 	token.Wait()
-	
+
 	if token.Error() != nil {
-		log.Printf("Error republishing message: %v", token.Error())
+		log.Printf("Error republishing message to %s: %v", targetTopic, token.Error())
+		return false
+	}
+	return true
+}
+
+// hasV5Properties reports whether the target sets any MQTT 5 publish properties
+func (target RepublishTarget) hasV5Properties() bool {
+	return target.MessageExpirySeconds > 0 || len(target.UserProperties) > 0
+}
+
+// renderPayloadTemplate renders a payload template. A string that is exactly one
+// placeholder keeps the referenced value's type ({payload} is the whole message);
+// other strings are rendered with renderTemplate.
+func renderPayloadTemplate(template interface{}, topic string, payload map[string]interface{}) interface{} {
+	switch t := template.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			result[key] = renderPayloadTemplate(value, topic, payload)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i, value := range t {
+			result[i] = renderPayloadTemplate(value, topic, payload)
+		}
+		return result
+	case string:
+		if match := templatePlaceholder.FindStringSubmatch(t); match != nil && match[0] == t {
+			if match[1] == "payload" {
+				return payload
+			}
+			if value, ok := lookupPath(payload, strings.TrimPrefix(match[1], "payload.")); ok {
+				return value
+			}
+		}
+		return renderTemplate(t, topic, payload)
+	default:
+		return template
+	}
+}
+
+// lambdaInvoker is the part of the AWS Lambda client used by lambda actions
+type lambdaInvoker interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// LambdaEvent is the event passed to an invoked Lambda function
+type LambdaEvent struct {
+	Topic   string                 `json:"topic"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// lambdaEnabled reports whether AWS is configured for real Lambda invocation
+func (engine *RulesEngine) lambdaEnabled() bool {
+	return engine.Config.Lambda.Region != ""
+}
+
+// lambdaInvocationClient returns the Lambda client, constructing it on first use
+func (engine *RulesEngine) lambdaInvocationClient() (lambdaInvoker, error) {
+	engine.lambdaOnce.Do(func() {
+		if engine.lambdaClient != nil {
+			return
+		}
+		engine.lambdaClient, engine.lambdaErr = newLambdaClient(engine.Config.Lambda)
+	})
+	return engine.lambdaClient, engine.lambdaErr
+}
+
+// newLambdaClient builds an AWS Lambda client from the configuration
+func newLambdaClient(config LambdaConfig) (*lambda.Client, error) {
+	options := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(config.Region)}
+	if config.AccessKeyID != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(config.AccessKeyID, config.SecretAccessKey, config.SessionToken)))
+	}
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %v", err)
 	}
+
+	return lambda.NewFromConfig(awsConfig, func(o *lambda.Options) {
+		if config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(config.Endpoint)
+		}
+	}), nil
 }
 
-// executeLambdaAction executes a Lambda action (simulated)
+// executeLambdaAction invokes the action's Lambda function with the topic and payload,
+// or simulates the invocation when AWS isn't configured
 func (engine *RulesEngine) executeLambdaAction(action ActionConfig, topic string, payload map[string]interface{}) {
-	// This is a simulation of Lambda execution since we're not in AWS
 	functionName := action.Function
 	if functionName == "" {
 		functionName = "unknown"
 	}
-	
-	log.Printf("Simulated Lambda invocation of '%s' for rule", functionName)
-	
-	// In a real AWS environment, this would invoke a Lambda function
-	// For now, we just log it
+
+	if !engine.lambdaEnabled() || action.Function == "" {
+		log.Printf("Simulated Lambda invocation of '%s' for rule", functionName)
+		return
+	}
+
+	// Invoke in a goroutine so the message handler isn't blocked
+	engine.beginAction()
+	go func() {
+		defer engine.endAction()
+		if !engine.invokeLambda(action, topic, payload) {
+			engine.metrics.actionFailed("lambda")
+		}
+	}()
+}
+
+// invokeLambda synchronously invokes a Lambda function, logs the outcome and reports success
+func (engine *RulesEngine) invokeLambda(action ActionConfig, topic string, payload map[string]interface{}) bool {
+	client, err := engine.lambdaInvocationClient()
+	if err != nil {
+		log.Printf("Error creating Lambda client: %v", err)
+		return false
+	}
+
+	event, err := json.Marshal(LambdaEvent{Topic: topic, Payload: payload})
+	if err != nil {
+		log.Printf("Error marshaling Lambda event for '%s': %v", action.Function, err)
+		return false
+	}
+
+	timeout := 30 * time.Second
+	if action.Timeout > 0 {
+		timeout = time.Duration(action.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output, err := client.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(action.Function),
+		Payload:      event,
+	})
+	if err != nil {
+		log.Printf("Error invoking Lambda '%s': %v", action.Function, err)
+		return false
+	}
+
+	if output.FunctionError != nil {
+		log.Printf("Lambda '%s' returned status %d with function error %s: %s",
+			action.Function, output.StatusCode, aws.ToString(output.FunctionError), string(output.Payload))
+		return false
+	}
+
+	log.Printf("Lambda '%s' invoked, status %d", action.Function, output.StatusCode)
+	return true
 }
 
 // executeFunctionAction executes a function action
@@ -606,15 +2982,13 @@ func (engine *RulesEngine) handleConfigRequest(topic string, payload map[string]
     gatewayID := parts[1]
     log.Printf("Received configuration request from gateway %s", gatewayID)
 
-    // Check if we have a configuration for this gateway
-    engine.ConfigMutex.RLock()
-    yamlConfig, exists := engine.ConfigStorage[gatewayID]
-    engine.ConfigMutex.RUnlock()
-
+    // Check if we have a configuration for this gateway, its cluster or all gateways
+    yamlConfig, scope, exists := engine.lookupConfig(gatewayID, clusterName(payload))
     if !exists {
         log.Printf("No configuration available for gateway %s", gatewayID)
         return
     }
+    log.Printf("Using %s configuration for gateway %s", scope, gatewayID)
 
     // Send configuration to gateway
     configTopic := fmt.Sprintf("gateway/%s/config/update", gatewayID)
@@ -668,8 +3042,14 @@ func (engine *RulesEngine) handleConfigRequest(topic string, payload map[string]
 
 // handleNewConfig processes a new configuration from the backend
 func (engine *RulesEngine) handleNewConfig(topic string, payload map[string]interface{}) {
-    gatewayID, ok := payload["gateway_id"].(string)
-    if !ok || gatewayID == "" {
+    // A config targets one gateway, a cluster (no gateway_id) or all gateways (gateway_id "*")
+    gatewayID, _ := payload["gateway_id"].(string)
+    if gatewayID == "" {
+        if cluster := clusterName(payload); cluster != "" {
+            gatewayID = clusterConfigKey(cluster)
+        }
+    }
+    if gatewayID == "" {
         log.Printf("Invalid config message: missing gateway_id")
         return
     }
@@ -699,6 +3079,109 @@ func (engine *RulesEngine) handleNewConfig(topic string, payload map[string]inte
     log.Printf("Configuration stored for gateway %s with update_id %s", gatewayID, updateID)
 }
 
+// WildcardConfigKey stores the configuration used by gateways without a more specific one
+const WildcardConfigKey = "*"
+
+// clusterConfigKey is the ConfigStorage key of a cluster-scoped configuration
+func clusterConfigKey(cluster string) string {
+	return "cluster:" + cluster
+}
+
+// clusterName reads a payload's "cluster", either a name or an object with a name
+func clusterName(payload map[string]interface{}) string {
+	switch cluster := payload["cluster"].(type) {
+	case string:
+		return cluster
+	case map[string]interface{}:
+		name, _ := cluster["name"].(string)
+		return name
+	}
+	return ""
+}
+
+// lookupConfig finds the configuration for a gateway: its own, then its cluster's,
+// then the wildcard. It returns the config, the scope it came from and whether one exists.
+func (engine *RulesEngine) lookupConfig(gatewayID, cluster string) (string, string, bool) {
+	engine.ConfigMutex.RLock()
+	defer engine.ConfigMutex.RUnlock()
+
+	if config, ok := engine.ConfigStorage[gatewayID]; ok {
+		return config, "gateway", true
+	}
+	if cluster != "" {
+		if config, ok := engine.ConfigStorage[clusterConfigKey(cluster)]; ok {
+			return config, "cluster " + cluster, true
+		}
+	}
+	if config, ok := engine.ConfigStorage[WildcardConfigKey]; ok {
+		return config, "wildcard", true
+	}
+	return "", "", false
+}
+
+// templatePlaceholder matches {name} placeholders in URLs, topics and headers
+var templatePlaceholder = regexp.MustCompile(`\{([A-Za-z0-9_.]+)\}`)
+
+// renderTemplate substitutes {placeholders} with values derived from the topic
+// and payload. Unknown placeholders are left untouched.
+func renderTemplate(template string, topic string, payload map[string]interface{}) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+
+	vars := topicVariables(topic)
+	return templatePlaceholder.ReplaceAllStringFunc(template, func(match string) string {
+		key := match[1 : len(match)-1]
+		if value, ok := vars[key]; ok {
+			return value
+		}
+		if value, ok := lookupPath(payload, strings.TrimPrefix(key, "payload.")); ok {
+			return fmt.Sprintf("%v", value)
+		}
+		return match
+	})
+}
+
+// topicVariables extracts template variables from a topic such as
+// gateway/{gateway_id}/device/{device_id}/... or api/command/{gateway_id}/device/{device_id}
+func topicVariables(topic string) map[string]string {
+	vars := map[string]string{
+		"original_topic": topic,
+		"topic":          topic,
+	}
+
+	parts := strings.Split(topic, "/")
+	if len(parts) >= 2 && parts[0] == "gateway" {
+		vars["gateway_id"] = parts[1]
+	}
+	if len(parts) >= 3 && parts[0] == "api" && parts[1] == "command" {
+		vars["gateway_id"] = parts[2]
+	}
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "device" {
+			vars["device_id"] = parts[i+1]
+		}
+	}
+
+	return vars
+}
+
+// lookupPath resolves a dotted path (e.g. "payload.weight_kg") against a decoded JSON map
+func lookupPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
 // loadConfig loads the configuration from a file
 func loadConfig(configPath string) (Config, error) {
 	var config Config
@@ -715,9 +3198,46 @@ func loadConfig(configPath string) (Config, error) {
 		return config, fmt.Errorf("error parsing config file: %v", err)
 	}
 
+	// Alias expansion can leave non-string-keyed maps in free-form payloads
+	for i := range config.Rules {
+		for j := range config.Rules[i].Actions {
+			action := &config.Rules[i].Actions[j]
+			if action.Payload != nil {
+				action.Payload = normalizeYAMLValue(action.Payload).(map[string]interface{})
+			}
+		}
+	}
+
 	return config, nil
 }
 
+// normalizeYAMLValue converts map[interface{}]interface{} values into
+// map[string]interface{}, recursively
+func normalizeYAMLValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprintf("%v", key)] = normalizeYAMLValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = normalizeYAMLValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeYAMLValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
 func main() {
 	// Parse command line flags
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
@@ -0,0 +1,1611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mockToken is a completed mqtt.Token
+type mockToken struct {
+	err error
+}
+
+func (t *mockToken) Wait() bool                     { return true }
+func (t *mockToken) WaitTimeout(time.Duration) bool { return true }
+func (t *mockToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t *mockToken) Error() error { return t.err }
+
+// publishedMessage records a single Publish call
+type publishedMessage struct {
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Payload []byte
+}
+
+// mockClient is an in-memory mqtt.Client that records calls
+type mockClient struct {
+	mu            sync.Mutex
+	connected     bool
+	published     []publishedMessage
+	subscribed    []string
+	subscribedQoS []byte
+	unsubscribed  []string
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{connected: true}
+}
+
+func (c *mockClient) IsConnected() bool      { return c.connected }
+func (c *mockClient) IsConnectionOpen() bool { return c.connected }
+func (c *mockClient) Connect() mqtt.Token    { c.connected = true; return &mockToken{} }
+func (c *mockClient) Disconnect(uint)        { c.connected = false }
+
+func (c *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+	c.published = append(c.published, publishedMessage{Topic: topic, QoS: qos, Retain: retained, Payload: data})
+	return &mockToken{}
+}
+
+func (c *mockClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = append(c.subscribed, topic)
+	c.subscribedQoS = append(c.subscribedQoS, qos)
+	return &mockToken{}
+}
+
+// subscribedTo reports whether Subscribe was called for a topic
+func (c *mockClient) subscribedTo(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, subscribed := range c.subscribed {
+		if subscribed == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic, qos := range filters {
+		c.Subscribe(topic, qos, callback)
+	}
+	return &mockToken{}
+}
+
+func (c *mockClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return &mockToken{}
+}
+
+func (c *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+
+func (c *mockClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+func (c *mockClient) messages() []publishedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]publishedMessage(nil), c.published...)
+}
+
+// mockMessage is a minimal mqtt.Message
+type mockMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *mockMessage) Duplicate() bool   { return false }
+func (m *mockMessage) Qos() byte         { return 1 }
+func (m *mockMessage) Retained() bool    { return false }
+func (m *mockMessage) Topic() string     { return m.topic }
+func (m *mockMessage) MessageID() uint16 { return 1 }
+func (m *mockMessage) Payload() []byte   { return m.payload }
+func (m *mockMessage) Ack()              {}
+
+// newTestEngine builds a RulesEngine without loading a config file
+func newTestEngine(config Config, rules ...*Rule) *RulesEngine {
+	return &RulesEngine{
+		Config:        config,
+		Rules:         rules,
+		ExitChan:      make(chan struct{}),
+		ConfigStorage: make(map[string]string),
+	}
+}
+
+func TestShutdownDrainsInFlightActions(t *testing.T) {
+	var delivered int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&delivered, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	rule := &Rule{Name: "measurements", TopicPattern: "gateway/+/device/+/measurement", Enabled: true}
+	engine := newTestEngine(Config{Shutdown: ShutdownConfig{DrainTimeout: 2}}, rule)
+	client := newMockClient()
+	engine.MQTTClient = client
+
+	action := ActionConfig{Type: "http", URL: server.URL}
+	engine.executeHTTPAction(action, "gateway/gw1/device/d1/measurement", map[string]interface{}{"weight_kg": 1.0})
+	engine.executeHTTPAction(action, "gateway/gw1/device/d2/measurement", map[string]interface{}{"weight_kg": 2.0})
+
+	engine.Shutdown()
+
+	if got := atomic.LoadInt32(&delivered); got != 2 {
+		t.Fatalf("expected 2 delivered actions after drain, got %d", got)
+	}
+	if len(client.unsubscribed) != 1 || client.unsubscribed[0] != rule.TopicPattern {
+		t.Fatalf("expected unsubscribe from %q before drain, got %v", rule.TopicPattern, client.unsubscribed)
+	}
+	if client.IsConnected() {
+		t.Fatalf("expected client to be disconnected after shutdown")
+	}
+}
+
+func TestDrainActionsAbandonsAfterTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	engine := newTestEngine(Config{})
+	engine.executeHTTPAction(ActionConfig{Type: "http", URL: server.URL}, "gateway/gw1/heartbeat", map[string]interface{}{})
+
+	// Wait for the request to be in flight
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&engine.inFlight) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	completed, abandoned := engine.drainActions(100 * time.Millisecond)
+	if completed != 0 || abandoned != 1 {
+		t.Fatalf("expected 0 completed and 1 abandoned, got %d and %d", completed, abandoned)
+	}
+}
+
+func TestHTTPActionTemplatedHeaders(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.Header.Get("X-Device-ID")] = r.Header.Clone()
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	engine := newTestEngine(Config{})
+	action := ActionConfig{
+		Type: "http",
+		URL:  server.URL,
+		Headers: map[string]string{
+			"Content-Type":    "application/json",
+			"X-Device-ID":     "{device_id}",
+			"X-Gateway-ID":    "{gateway_id}",
+			"X-Parameter-Set": "{parameter_set}",
+			"X-Static":        "fixed-value",
+		},
+	}
+
+	engine.executeHTTPAction(action, "gateway/gw1/device/d1/measurement", map[string]interface{}{"parameter_set": "waste"})
+	engine.executeHTTPAction(action, "gateway/gw1/device/d2/measurement", map[string]interface{}{"parameter_set": "recyclables"})
+	engine.WaitGroup.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]string{"d1": "waste", "d2": "recyclables"}
+	for device, set := range expected {
+		headers, ok := received[device]
+		if !ok {
+			t.Fatalf("no request received with X-Device-ID %s (got %v)", device, received)
+		}
+		if got := headers.Get("X-Parameter-Set"); got != set {
+			t.Errorf("device %s: expected X-Parameter-Set %q, got %q", device, set, got)
+		}
+		if got := headers.Get("X-Gateway-ID"); got != "gw1" {
+			t.Errorf("device %s: expected X-Gateway-ID gw1, got %q", device, got)
+		}
+		if got := headers.Get("X-Static"); got != "fixed-value" {
+			t.Errorf("device %s: static header changed to %q", device, got)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	payload := map[string]interface{}{"meta": map[string]interface{}{"site": "north"}}
+	got := renderTemplate("monitoring/{gateway_id}/{meta.site}/{missing}/{original_topic}", "gateway/gw1/heartbeat", payload)
+	want := "monitoring/gw1/north/{missing}/gateway/gw1/heartbeat"
+	if got != want {
+		t.Fatalf("renderTemplate = %q, want %q", got, want)
+	}
+}
+
+func TestHTTPActionPublishesResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	engine := newTestEngine(Config{})
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	engine.executeHTTPAction(ActionConfig{Type: "http", URL: server.URL + "/ok", OnResult: "results/{gateway_id}"},
+		"gateway/gw1/heartbeat", map[string]interface{}{})
+	engine.executeHTTPAction(ActionConfig{Type: "http", URL: server.URL + "/fail", OnResult: "results/{gateway_id}"},
+		"gateway/gw2/heartbeat", map[string]interface{}{})
+	engine.WaitGroup.Wait()
+
+	results := map[string]HTTPActionResult{}
+	for _, msg := range client.messages() {
+		var result HTTPActionResult
+		if err := json.Unmarshal(msg.Payload, &result); err != nil {
+			t.Fatalf("invalid result payload on %s: %v", msg.Topic, err)
+		}
+		results[msg.Topic] = result
+	}
+
+	ok, found := results["results/gw1"]
+	if !found || !ok.Success || ok.StatusCode != http.StatusCreated || ok.OriginalTopic != "gateway/gw1/heartbeat" || ok.CorrelationID == "" {
+		t.Errorf("unexpected success result: %+v (found %v)", ok, found)
+	}
+	failed, found := results["results/gw2"]
+	if !found || failed.Success || failed.StatusCode != http.StatusInternalServerError || failed.Error == "" {
+		t.Errorf("unexpected failure result: %+v (found %v)", failed, found)
+	}
+	if ok.CorrelationID == failed.CorrelationID {
+		t.Errorf("expected distinct correlation IDs")
+	}
+}
+
+func TestLoadConfigWithAnchors(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	data := `
+defaults: &defaults
+  source: gateway
+  tags: {site: hq}
+rules:
+  - name: first
+    topic_pattern: gateway/+/heartbeat
+    enabled: true
+    actions:
+      - type: republish
+        topic: out/first
+        payload: *defaults
+  - name: second
+    topic_pattern: gateway/+/status
+    enabled: true
+    actions:
+      - type: republish
+        topic: out/second
+        payload:
+          <<: *defaults
+          source: status
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if len(config.Rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(config.Rules))
+	}
+	first := config.Rules[0].Actions[0].Payload
+	if first["source"] != "gateway" {
+		t.Errorf("expected aliased payload, got %v", first)
+	}
+	if _, ok := first["tags"].(map[string]interface{}); !ok {
+		t.Errorf("expected nested tags map, got %#v", first["tags"])
+	}
+	second := config.Rules[1].Actions[0].Payload
+	if second["source"] != "status" || second["tags"] == nil {
+		t.Errorf("expected merged payload with override, got %v", second)
+	}
+}
+
+func TestAnalyzeRuleOverlaps(t *testing.T) {
+	rules := []*Rule{
+		{Name: "all-devices", TopicPattern: "gateway/+/device/#"},
+		{Name: "measurements", TopicPattern: "gateway/+/device/+/measurement"},
+		{Name: "heartbeats", TopicPattern: "gateway/+/heartbeat"},
+		{Name: "commands", TopicPattern: "api/command/+"},
+	}
+
+	overlaps := analyzeRuleOverlaps(rules)
+	if len(overlaps) != 1 {
+		t.Fatalf("expected exactly one overlap, got %+v", overlaps)
+	}
+	overlap := overlaps[0]
+	if overlap.RuleA != "all-devices" || overlap.RuleB != "measurements" {
+		t.Errorf("unexpected overlapping pair: %+v", overlap)
+	}
+	if overlap.ExampleTopic != "gateway/any/device/any/measurement" {
+		t.Errorf("unexpected example topic %q", overlap.ExampleTopic)
+	}
+	if !rules[0].MatchesTopic(overlap.ExampleTopic) || !rules[1].MatchesTopic(overlap.ExampleTopic) {
+		t.Errorf("example topic %q should match both rules", overlap.ExampleTopic)
+	}
+}
+
+func TestAnalyzeEndpoint(t *testing.T) {
+	engine := newTestEngine(Config{},
+		&Rule{Name: "a", TopicPattern: "gateway/#"},
+		&Rule{Name: "b", TopicPattern: "gateway/+/status"},
+	)
+
+	recorder := httptest.NewRecorder()
+	engine.handleAnalyzeRequest(recorder, httptest.NewRequest(http.MethodGet, "/analyze", nil))
+
+	var report struct {
+		OverlapCount int           `json:"overlap_count"`
+		Overlaps     []RuleOverlap `json:"overlaps"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatalf("invalid analyze response: %v", err)
+	}
+	if report.OverlapCount != 1 || report.Overlaps[0].ExampleTopic != "gateway/any/status" {
+		t.Errorf("unexpected analyze report: %+v", report)
+	}
+}
+
+func TestWebhookTriggersMatchingRules(t *testing.T) {
+	rule := &Rule{
+		Name:         "external alerts",
+		TopicPattern: "external/+/alerts",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "republish", Topic: "alerts/external"}},
+	}
+	engine := newTestEngine(Config{Webhook: WebhookConfig{Token: "s3cret"}}, rule)
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	send := func(body string, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set(WebhookTokenHeader, token)
+		}
+		engine.handleWebhookRequest(recorder, request)
+		return recorder
+	}
+	post := func(body string) *httptest.ResponseRecorder { return send(body, "s3cret") }
+
+	// Requests without the shared secret are rejected before they reach any rule
+	for _, token := range []string{"", "wrong"} {
+		if recorder := send(`{"topic": "external/gw7/alerts", "payload": {}}`, token); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, recorder.Code)
+		}
+	}
+	if len(client.messages()) != 0 {
+		t.Fatalf("expected unauthenticated requests to trigger nothing")
+	}
+
+	recorder := post(`{"topic": "external/gw7/alerts", "payload": {"level": "high"}}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	messages := client.messages()
+	if len(messages) != 1 || messages[0].Topic != "alerts/external" {
+		t.Fatalf("expected the rule to republish to alerts/external, got %+v", messages)
+	}
+	var republished map[string]interface{}
+	json.Unmarshal(messages[0].Payload, &republished)
+	if republished["level"] != "high" {
+		t.Errorf("expected the webhook payload to be republished, got %v", republished)
+	}
+
+	// Non-matching topics are accepted but trigger nothing
+	if recorder := post(`{"topic": "external/gw7/status", "payload": {}}`); recorder.Code != http.StatusAccepted {
+		t.Errorf("expected 202 for a non-matching topic, got %d", recorder.Code)
+	}
+	if len(client.messages()) != 1 {
+		t.Errorf("expected no actions for a non-matching topic")
+	}
+
+	for _, body := range []string{`not json`, `{"payload": {}}`, `{"topic": "external/+/alerts", "payload": {}}`, `{"topic": "external/gw7/alerts"}`} {
+		if recorder := post(body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("body %s: expected 400, got %d", body, recorder.Code)
+		}
+	}
+}
+
+func TestWebhookServerRequiresTokenAndBindsLocally(t *testing.T) {
+	engine := newTestEngine(Config{Webhook: WebhookConfig{Enabled: true, Port: 18082}})
+	engine.startWebhookServer()
+	if engine.WebhookServer != nil {
+		engine.WebhookServer.Close()
+		t.Fatal("expected the webhook server not to start without a token")
+	}
+
+	engine.Config.Webhook.Token = "s3cret"
+	engine.startWebhookServer()
+	if engine.WebhookServer == nil {
+		t.Fatal("expected the webhook server to start with a token")
+	}
+	defer engine.WebhookServer.Close()
+	if engine.WebhookServer.Addr != "127.0.0.1:18082" {
+		t.Errorf("expected the webhook server to bind to localhost, got %s", engine.WebhookServer.Addr)
+	}
+}
+
+func TestUnitConversionBeforeActions(t *testing.T) {
+	rules := buildRules([]RuleConfig{
+		{
+			Name:         "grams",
+			TopicPattern: "gateway/+/device/+/measurement",
+			Enabled:      true,
+			UnitConversions: []UnitConversionConfig{
+				{Field: "payload.weight_kg", FromField: "payload.units", To: "g"},
+			},
+			Actions: []ActionConfig{{Type: "republish", Topic: "normalized/{device_id}"}},
+		},
+		{
+			Name:         "raw",
+			TopicPattern: "gateway/+/device/+/measurement",
+			Enabled:      true,
+			Actions:      []ActionConfig{{Type: "republish", Topic: "raw/{device_id}"}},
+		},
+		{
+			Name:            "bad units",
+			TopicPattern:    "gateway/#",
+			Enabled:         true,
+			UnitConversions: []UnitConversionConfig{{Field: "payload.weight_kg", From: "kg", To: "stone"}},
+		},
+	})
+	if len(rules) != 2 {
+		t.Fatalf("expected the rule with an unknown unit to be disabled, got %d rules", len(rules))
+	}
+	engine := newTestEngine(Config{}, rules...)
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	engine.messageHandler(client, &mockMessage{
+		topic:   "gateway/gw1/device/d1/measurement",
+		payload: []byte(`{"device_id": "d1", "payload": {"weight_kg": 12.5, "units": "kg"}}`),
+	})
+
+	forwarded := make(map[string]map[string]interface{})
+	for _, message := range client.messages() {
+		var body map[string]interface{}
+		json.Unmarshal(message.Payload, &body)
+		forwarded[message.Topic], _ = body["payload"].(map[string]interface{})
+	}
+	if got := forwarded["normalized/d1"]; got["weight_kg"] != 12500.0 || got["units"] != "g" {
+		t.Errorf("expected 12500 g in the converted payload, got %v", got)
+	}
+	if got := forwarded["raw/d1"]; got["weight_kg"] != 12.5 || got["units"] != "kg" {
+		t.Errorf("expected other rules to see the original payload, got %v", got)
+	}
+
+	converted := convertUnits(map[string]interface{}{"w": 1000.0}, []UnitConversionConfig{{Field: "w", From: "g", To: "lb"}})
+	if w, _ := converted["w"].(float64); math.Abs(w-2.20462) > 1e-5 {
+		t.Errorf("expected 1000 g to be about 2.20462 lb, got %v", w)
+	}
+
+	// An explicit source unit still updates the units field
+	converted = convertUnits(map[string]interface{}{"w": 2.0, "units": "unknown"}, []UnitConversionConfig{{Field: "w", From: "kg", FromField: "units", To: "g"}})
+	if converted["w"] != 2000.0 || converted["units"] != "g" {
+		t.Errorf("expected 2000 with units g, got %v", converted)
+	}
+}
+
+func TestClientOptionsPersistentSession(t *testing.T) {
+	engine := newTestEngine(Config{MQTT: MQTTConfig{Host: "localhost", Port: 1883}})
+	opts := engine.clientOptions()
+	if !opts.CleanSession {
+		t.Errorf("expected clean session by default")
+	}
+
+	engine.Config.MQTT.PersistentSession = true
+	opts = engine.clientOptions()
+	if opts.CleanSession {
+		t.Errorf("expected persistent session to disable clean session")
+	}
+	hostname, _ := os.Hostname()
+	if opts.ClientID != "rules-engine-"+hostname {
+		t.Errorf("expected a client ID derived from the hostname, got %q", opts.ClientID)
+	}
+	if second := engine.clientOptions(); second.ClientID != opts.ClientID {
+		t.Errorf("client ID should be stable across reconnects, got %q and %q", opts.ClientID, second.ClientID)
+	}
+}
+
+func TestPersistentSessionSubscribesAtQoS1(t *testing.T) {
+	rule := &Rule{Name: "measurements", TopicPattern: "gateway/+/device/+/measurement", Enabled: true}
+	engine := newTestEngine(Config{}, rule)
+	client := &mockClient{connected: true}
+	engine.MQTTClient = client
+
+	engine.onConnect(client)
+	engine.Config.MQTT.PersistentSession = true
+	engine.onConnect(client)
+	engine.subscribeTopic(rule.TopicPattern)
+
+	var qos []byte
+	for i, topic := range client.subscribed {
+		if topic == rule.TopicPattern {
+			qos = append(qos, client.subscribedQoS[i])
+		}
+	}
+	if !reflect.DeepEqual(qos, []byte{0, 1, 1}) {
+		t.Errorf("expected QoS 0 without and QoS 1 with a persistent session, got %v", qos)
+	}
+}
+
+func TestMessageHandlerDropsOversizedPayloads(t *testing.T) {
+	rule := &Rule{
+		Name:         "forward",
+		TopicPattern: "gateway/+/heartbeat",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "republish", Topic: "out/heartbeat"}},
+	}
+	engine := newTestEngine(Config{MQTT: MQTTConfig{MaxPayloadBytes: 64, DeadLetterTopic: "dead-letter"}}, rule)
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	engine.messageHandler(client, &mockMessage{topic: "gateway/gw1/heartbeat", payload: []byte(`{"uptime":"1m"}`)})
+	oversized := []byte(`{"data":"` + strings.Repeat("x", 100) + `"}`)
+	engine.messageHandler(client, &mockMessage{topic: "gateway/gw1/heartbeat", payload: oversized})
+
+	var republished, deadLettered int
+	for _, msg := range client.messages() {
+		switch msg.Topic {
+		case "out/heartbeat":
+			republished++
+		case "dead-letter":
+			deadLettered++
+			var summary map[string]interface{}
+			json.Unmarshal(msg.Payload, &summary)
+			if summary["size_bytes"] != float64(len(oversized)) || summary["original_topic"] != "gateway/gw1/heartbeat" {
+				t.Errorf("unexpected dead-letter summary: %v", summary)
+			}
+		}
+	}
+	if republished != 1 {
+		t.Errorf("expected only the normal message to be processed, got %d", republished)
+	}
+	if deadLettered != 1 {
+		t.Errorf("expected the oversized message to be dead-lettered, got %d", deadLettered)
+	}
+}
+
+func TestRulesUpdateSwapsValidRulesAndRejectsInvalid(t *testing.T) {
+	engine := newTestEngine(Config{}, &Rule{Name: "heartbeats", TopicPattern: "gateway/+/heartbeat", Enabled: true})
+	client := newMockClient()
+	engine.MQTTClient = client
+
+	valid := `{"rules": [{"name": "status", "topic_pattern": "gateway/+/status", "enabled": true,
+		"actions": [{"type": "http", "url": "http://backend/api/status"}]}]}`
+	engine.handleRulesUpdate(client, &mockMessage{topic: RulesUpdateTopic, payload: []byte(valid)})
+
+	rules := engine.activeRules()
+	if len(rules) != 1 || rules[0].Name != "status" {
+		t.Fatalf("expected pushed rule to be active, got %+v", rules)
+	}
+	if len(client.subscribed) != 1 || client.subscribed[0] != "gateway/+/status" {
+		t.Errorf("expected subscription to new topic, got %v", client.subscribed)
+	}
+	if len(client.unsubscribed) != 1 || client.unsubscribed[0] != "gateway/+/heartbeat" {
+		t.Errorf("expected old topic to be unsubscribed, got %v", client.unsubscribed)
+	}
+
+	invalid := `[{"name": "broken", "enabled": true, "actions": [{"type": "http"}]}]`
+	engine.handleRulesUpdate(client, &mockMessage{topic: RulesUpdateTopic, payload: []byte(invalid)})
+
+	if rules := engine.activeRules(); len(rules) != 1 || rules[0].Name != "status" {
+		t.Errorf("invalid update should keep existing rules, got %+v", rules)
+	}
+
+	var statuses []map[string]interface{}
+	for _, msg := range client.messages() {
+		if msg.Topic == RulesUpdateStatusTopic {
+			var status map[string]interface{}
+			json.Unmarshal(msg.Payload, &status)
+			statuses = append(statuses, status)
+		}
+	}
+	if len(statuses) != 2 || statuses[0]["accepted"] != true || statuses[1]["accepted"] != false {
+		t.Errorf("expected accepted then rejected status, got %v", statuses)
+	}
+}
+
+func TestBackpressureShedsAndRecovers(t *testing.T) {
+	rule := &Rule{Name: "measurements", TopicPattern: "gateway/+/device/+/measurement", Enabled: true}
+	engine := newTestEngine(Config{Backpressure: BackpressureConfig{
+		Enabled:           true,
+		MaxInFlight:       5,
+		SaturationSeconds: 10,
+		ResumeInFlight:    1,
+	}}, rule)
+	client := newMockClient()
+	engine.MQTTClient = client
+
+	start := time.Now()
+	atomic.StoreInt64(&rule.inFlight, 8)
+	engine.checkBackpressure(start)
+	engine.checkBackpressure(start.Add(5 * time.Second))
+	if len(client.unsubscribed) != 0 {
+		t.Fatalf("short saturation should not shed, got %v", client.unsubscribed)
+	}
+
+	engine.checkBackpressure(start.Add(11 * time.Second))
+	if len(client.unsubscribed) != 1 || client.unsubscribed[0] != rule.TopicPattern {
+		t.Fatalf("sustained saturation should unsubscribe, got %v", client.unsubscribed)
+	}
+	stats := engine.stats()
+	if stats["shed_rules"] != 1 {
+		t.Errorf("expected shed state in stats, got %v", stats)
+	}
+
+	atomic.StoreInt64(&rule.inFlight, 3)
+	engine.checkBackpressure(start.Add(12 * time.Second))
+	if len(client.subscribed) != 0 {
+		t.Fatalf("should stay shed until backlog drops to resume level")
+	}
+
+	atomic.StoreInt64(&rule.inFlight, 1)
+	engine.checkBackpressure(start.Add(13 * time.Second))
+	if len(client.subscribed) != 1 || client.subscribed[0] != rule.TopicPattern {
+		t.Fatalf("recovery should re-subscribe, got %v", client.subscribed)
+	}
+	if stats := engine.stats(); stats["shed_rules"] != 0 {
+		t.Errorf("expected no shed rules after recovery, got %v", stats)
+	}
+}
+
+func TestShedRuleIsSkippedWhileItsTopicStaysSubscribed(t *testing.T) {
+	slow := &Rule{
+		Name:         "slow",
+		TopicPattern: "gateway/+/device/+/measurement",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "republish", Topic: "out/slow"}},
+	}
+	fast := &Rule{
+		Name:         "fast",
+		TopicPattern: "gateway/+/device/+/measurement",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "republish", Topic: "out/fast"}},
+	}
+	other := &Rule{
+		Name:         "heartbeat",
+		TopicPattern: "gateway/+/heartbeat",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "republish", Topic: "out/heartbeat"}},
+	}
+	engine := newTestEngine(Config{}, slow, fast, other)
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	slow.setShed(true)
+	engine.messageHandler(nil, &mockMessage{topic: "gateway/gw1/device/d1/measurement", payload: []byte(`{"value": 1}`)})
+	engine.WaitGroup.Wait()
+
+	messages := client.messages()
+	if len(messages) != 1 || messages[0].Topic != "out/fast" {
+		t.Fatalf("expected only the unshed rule to run, got %+v", messages)
+	}
+
+	// A pattern stays subscribed on reconnect while any of its rules is live
+	engine.onConnect(client)
+	if !client.subscribedTo("gateway/+/device/+/measurement") {
+		t.Errorf("expected shared pattern to be re-subscribed, got %v", client.subscribed)
+	}
+
+	// Once every rule on the pattern is shed, reconnecting leaves it unsubscribed
+	fast.setShed(true)
+	client.subscribed = nil
+	engine.onConnect(client)
+	if client.subscribedTo("gateway/+/device/+/measurement") {
+		t.Errorf("expected shed pattern to stay unsubscribed, got %v", client.subscribed)
+	}
+	if !client.subscribedTo("gateway/+/heartbeat") {
+		t.Errorf("expected live pattern to be re-subscribed, got %v", client.subscribed)
+	}
+}
+
+func TestConcurrentRuleAppliesKeepSubscriptionsConsistent(t *testing.T) {
+	ruleSet := func(topic string) []RuleConfig {
+		return []RuleConfig{{
+			Name:         "rule",
+			TopicPattern: topic,
+			Enabled:      true,
+			Actions:      []ActionConfig{{Type: "lambda", Function: "f"}},
+		}}
+	}
+	engine := newTestEngine(Config{})
+	client := newMockClient()
+	engine.MQTTClient = client
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := engine.applyRules(ruleSet(fmt.Sprintf("topic/%d", i%3))); err != nil {
+				t.Errorf("applyRules failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every topic ends up subscribed exactly when the winning rule set needs it
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	net := map[string]int{}
+	for _, topic := range client.subscribed {
+		net[topic]++
+	}
+	for _, topic := range client.unsubscribed {
+		net[topic]--
+	}
+	active := engine.activeRules()[0].TopicPattern
+	for topic, count := range net {
+		want := 0
+		if topic == active {
+			want = 1
+		}
+		if count != want {
+			t.Errorf("topic %s: expected net subscription %d, got %d", topic, want, count)
+		}
+	}
+}
+
+func TestReloadResubscribesShedTopics(t *testing.T) {
+	config := RuleConfig{
+		Name:         "measurements",
+		TopicPattern: "gateway/+/device/+/measurement",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "lambda", Function: "f"}},
+	}
+	engine := newTestEngine(Config{}, buildRules([]RuleConfig{config})...)
+	client := newMockClient()
+	engine.MQTTClient = client
+	engine.activeRules()[0].setShed(true)
+
+	if err := engine.applyRules([]RuleConfig{config}); err != nil {
+		t.Fatalf("applyRules failed: %v", err)
+	}
+	if !client.subscribedTo(config.TopicPattern) {
+		t.Errorf("expected the shed topic to be subscribed again after a reload, got %v", client.subscribed)
+	}
+}
+
+// encryptForTest seals a payload the same way the gateway does
+func encryptForTest(t *testing.T, plaintext []byte, key []byte, keyID string) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	envelope, _ := json.Marshal(EncryptedPayload{
+		Encrypted:  true,
+		Algorithm:  "AES-GCM",
+		KeyID:      keyID,
+		IV:         base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	})
+	return envelope
+}
+
+func TestEncryptedMeasurementRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	rule := &Rule{
+		Name:         "forward",
+		TopicPattern: "gateway/+/device/+/measurement",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "republish", Topic: "out/measurement"}},
+	}
+	engine := newTestEngine(Config{Encryption: EncryptionConfig{
+		Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(key)},
+	}}, rule)
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	original := []byte(`{"device_id":"scale-gw-1","payload":{"weight_kg":12.5}}`)
+	envelope := encryptForTest(t, original, key, "k1")
+	engine.messageHandler(client, &mockMessage{topic: "gateway/gw1/device/scale-gw-1/measurement", payload: envelope})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected the decrypted message to be republished, got %d", len(messages))
+	}
+	var got, want map[string]interface{}
+	json.Unmarshal(messages[0].Payload, &got)
+	json.Unmarshal(original, &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decrypted payload %v does not match original %v", got, want)
+	}
+
+	// Unknown keys are dropped rather than processed as ciphertext
+	engine.messageHandler(client, &mockMessage{topic: "gateway/gw1/device/scale-gw-1/measurement",
+		payload: encryptForTest(t, original, key, "other")})
+	if len(client.messages()) != 1 {
+		t.Errorf("message with unknown key ID should be dropped")
+	}
+}
+
+func TestMatchesTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"gateway/gw1/heartbeat", "gateway/gw1/heartbeat", true},
+		{"gateway/gw1/heartbeat", "gateway/gw2/heartbeat", false},
+		{"gateway/+/heartbeat", "gateway/scale-gw_20250413.1/heartbeat", true},
+		{"gateway/+/heartbeat", "gateway//heartbeat", true},
+		{"gateway/+/heartbeat", "gateway/a/b/heartbeat", false},
+		{"gateway/+", "gateway/abc", true},
+		{"gateway/+", "gateway/abc/def", false},
+		{"gateway/+", "gateway/", true},
+		{"gateway/+", "gateway", false},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"gateway/#", "gateway", true},
+		{"gateway/#", "gateway/gw1/device/d1/measurement", true},
+		{"gateway/#", "gatewayx/gw1", false},
+		{"gateway/+/device/#", "gateway/gw1/device/d1/measurement", true},
+		{"gateway/+/device/#", "gateway/gw1/status", false},
+		{"gateway/#/status", "gateway/gw1/status", false},
+		{"#", "gateway/gw1/heartbeat", true},
+		{"#", "/leading/slash", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+	}
+
+	for _, tt := range tests {
+		rule := &Rule{TopicPattern: tt.pattern}
+		if got := rule.MatchesTopic(tt.topic); got != tt.want {
+			t.Errorf("MatchesTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestRepublishToMultipleTargets(t *testing.T) {
+	engine := newTestEngine(Config{})
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	action := ActionConfig{
+		Type:  "republish",
+		Topic: "archive/{gateway_id}",
+		QoS:   0,
+		Targets: []RepublishTarget{
+			{Topic: "alerts/{device_id}", QoS: 1, Retain: true},
+			{Topic: "analytics/weights", QoS: 2, Payload: map[string]interface{}{
+				"weight": "{payload.weight_kg}",
+				"source": "{gateway_id}/{device_id}",
+				"raw":    "{payload}",
+			}},
+		},
+	}
+	payload := map[string]interface{}{"weight_kg": 12.5}
+	engine.executeRepublishAction(action, "gateway/gw1/device/d1/measurement", payload)
+
+	messages := client.messages()
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 published messages, got %d", len(messages))
+	}
+	expected := []publishedMessage{
+		{Topic: "archive/gw1", QoS: 0},
+		{Topic: "alerts/d1", QoS: 1, Retain: true},
+		{Topic: "analytics/weights", QoS: 2},
+	}
+	for i, want := range expected {
+		got := messages[i]
+		if got.Topic != want.Topic || got.QoS != want.QoS || got.Retain != want.Retain {
+			t.Errorf("target %d: expected %s qos=%d retain=%v, got %s qos=%d retain=%v",
+				i, want.Topic, want.QoS, want.Retain, got.Topic, got.QoS, got.Retain)
+		}
+	}
+
+	var templated map[string]interface{}
+	json.Unmarshal(messages[2].Payload, &templated)
+	raw, _ := templated["raw"].(map[string]interface{})
+	if templated["weight"] != 12.5 || templated["source"] != "gw1/d1" || raw["weight_kg"] != 12.5 {
+		t.Errorf("unexpected templated payload: %v", templated)
+	}
+}
+
+func TestSQLWhereFiltering(t *testing.T) {
+	waste := map[string]interface{}{"payload": map[string]interface{}{"weight_kg": 12.5, "parameter_set": "waste"}}
+	light := map[string]interface{}{"payload": map[string]interface{}{"weight_kg": 4.0, "parameter_set": "waste"}}
+	airline := map[string]interface{}{"payload": map[string]interface{}{"weight_kg": 20.0, "parameter_set": "airline", "flight": "SQ 101"}}
+	flat := map[string]interface{}{"weight_kg": 12.5, "parameter_set": "waste"}
+
+	tests := []struct {
+		sql     string
+		message map[string]interface{}
+		want    bool
+	}{
+		{"", light, true},
+		{"SELECT *", light, true},
+		{"SELECT * WHERE payload.weight_kg > 10 AND payload.parameter_set = 'waste'", waste, true},
+		{"SELECT * WHERE payload.weight_kg > 10 AND payload.parameter_set = 'waste'", light, false},
+		{"SELECT * WHERE payload.weight_kg > 10 AND payload.parameter_set = 'waste'", airline, false},
+		{"SELECT * WHERE payload.weight_kg > 10 AND payload.parameter_set = 'waste'", flat, true},
+		{"select * from 'gateway/+/device/+/measurement' where payload.weight_kg <= 4", light, true},
+		{"SELECT * WHERE payload.parameter_set = 'airline' OR payload.weight_kg < 5", light, true},
+		{"SELECT * WHERE payload.parameter_set = 'airline' OR payload.weight_kg < 5", waste, false},
+		{"SELECT * WHERE (payload.weight_kg > 15 OR payload.weight_kg < 5) AND payload.parameter_set != 'airline'", light, true},
+		{"SELECT * WHERE (payload.weight_kg > 15 OR payload.weight_kg < 5) AND payload.parameter_set <> 'airline'", airline, false},
+		{"SELECT * WHERE NOT payload.parameter_set = 'waste'", airline, true},
+		{"SELECT * WHERE payload.flight = 'SQ 101'", airline, true},
+		{"SELECT * WHERE payload.missing = 1", waste, false},
+		{"payload.weight_kg >= -1.5", waste, true},
+	}
+
+	for _, tt := range tests {
+		condition, err := parseSQLWhere(tt.sql)
+		if err != nil {
+			t.Errorf("parseSQLWhere(%q) failed: %v", tt.sql, err)
+			continue
+		}
+		rule := &Rule{TopicPattern: "#", Enabled: true, condition: condition}
+		if got := rule.ShouldProcessMessage("gateway/gw1/device/d1/measurement", tt.message); got != tt.want {
+			t.Errorf("%q on %v = %v, want %v", tt.sql, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestMalformedSQLDisablesRule(t *testing.T) {
+	for _, sql := range []string{
+		"SELECT * WHERE payload.weight_kg >",
+		"SELECT * WHERE (payload.weight_kg > 1",
+		"SELECT * WHERE payload.weight_kg 10",
+		"SELECT * WHERE AND",
+	} {
+		if _, err := parseSQLWhere(sql); err == nil {
+			t.Errorf("expected parse error for %q", sql)
+		}
+	}
+
+	rules := buildRules([]RuleConfig{
+		{Name: "broken", TopicPattern: "gateway/#", Enabled: true, SQL: "SELECT * WHERE weight >"},
+		{Name: "valid", TopicPattern: "gateway/#", Enabled: true, SQL: "SELECT * WHERE weight > 1"},
+	})
+	if len(rules) != 1 || rules[0].Name != "valid" {
+		t.Errorf("expected malformed rule to be disabled, got %+v", rules)
+	}
+}
+
+// mockLambda records Lambda invocations
+type mockLambda struct {
+	mu     sync.Mutex
+	inputs []*lambda.InvokeInput
+	output *lambda.InvokeOutput
+}
+
+func (m *mockLambda) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs = append(m.inputs, params)
+	return m.output, nil
+}
+
+func TestLambdaActionInvokesFunction(t *testing.T) {
+	invoker := &mockLambda{output: &lambda.InvokeOutput{StatusCode: 200}}
+	engine := newTestEngine(Config{Lambda: LambdaConfig{Region: "us-east-1"}})
+	engine.lambdaClient = invoker
+
+	action := ActionConfig{Type: "lambda", Function: "process-weight"}
+	engine.executeLambdaAction(action, "gateway/gw1/device/d1/measurement", map[string]interface{}{"weight_kg": 4.2})
+	engine.WaitGroup.Wait()
+
+	if len(invoker.inputs) != 1 {
+		t.Fatalf("expected 1 invocation, got %d", len(invoker.inputs))
+	}
+	input := invoker.inputs[0]
+	if aws.ToString(input.FunctionName) != "process-weight" {
+		t.Errorf("expected function process-weight, got %q", aws.ToString(input.FunctionName))
+	}
+	var event LambdaEvent
+	if err := json.Unmarshal(input.Payload, &event); err != nil {
+		t.Fatalf("invalid event payload: %v", err)
+	}
+	if event.Topic != "gateway/gw1/device/d1/measurement" || event.Payload["weight_kg"] != 4.2 {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestLambdaActionSimulatedWithoutConfig(t *testing.T) {
+	invoker := &mockLambda{output: &lambda.InvokeOutput{StatusCode: 200}}
+	engine := newTestEngine(Config{})
+	engine.lambdaClient = invoker
+
+	engine.executeLambdaAction(ActionConfig{Type: "lambda", Function: "process-weight"}, "gateway/gw1/device/d1/measurement", map[string]interface{}{})
+	engine.WaitGroup.Wait()
+
+	if len(invoker.inputs) != 0 {
+		t.Errorf("expected no invocation without AWS config, got %d", len(invoker.inputs))
+	}
+}
+
+func TestHTTPActionRetriesUntilSuccess(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	engine := newTestEngine(Config{})
+	action := ActionConfig{Type: "http", URL: server.URL, MaxRetries: 3, RetryBackoffMs: 10}
+	result := engine.performHTTPAction(action, "gateway/gw1/device/d1/measurement", map[string]interface{}{"weight_kg": 1.0}, "corr-1")
+
+	if !result.Success || result.Attempts != 3 || result.StatusCode != http.StatusOK {
+		t.Errorf("expected success on attempt 3, got %+v", result)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("expected 3 requests, got %d", got)
+	}
+}
+
+func TestHTTPActionReportsLatencyAndTimestamp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	engine := newTestEngine(Config{})
+	action := ActionConfig{Type: "http", URL: server.URL}
+	result := engine.performHTTPAction(action, "gateway/gw1/device/d1/measurement", map[string]interface{}{}, "corr-latency")
+
+	if result.LatencyMs < 20 {
+		t.Errorf("expected latency of at least 20ms, got %d", result.LatencyMs)
+	}
+	if _, err := time.Parse(time.RFC3339, result.Timestamp); err != nil {
+		t.Errorf("expected an RFC3339 timestamp, got %q", result.Timestamp)
+	}
+}
+
+func TestRetryBackoffIsBounded(t *testing.T) {
+	for _, action := range []ActionConfig{{}, {RetryBackoffMs: 1000, RetryMaxBackoffMs: 5000}} {
+		limit := 30 * time.Second
+		if action.RetryMaxBackoffMs > 0 {
+			limit = time.Duration(action.RetryMaxBackoffMs) * time.Millisecond
+		}
+		for _, retry := range []int{1, 10, 40, 64, 1000} {
+			if delay := retryBackoff(action, retry); delay <= 0 || delay > limit {
+				t.Errorf("retry %d: expected a delay within (0, %v], got %v", retry, limit, delay)
+			}
+		}
+	}
+	if delay := retryBackoff(ActionConfig{RetryBackoffMs: 100}, 1); delay < 100*time.Millisecond || delay > 150*time.Millisecond {
+		t.Errorf("expected the first retry near the base backoff, got %v", delay)
+	}
+}
+
+func TestHTTPActionDoesNotRetryClientErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	engine := newTestEngine(Config{})
+	action := ActionConfig{Type: "http", URL: server.URL, MaxRetries: 3, RetryBackoffMs: 10}
+	result := engine.performHTTPAction(action, "gateway/gw1/device/d1/measurement", map[string]interface{}{}, "corr-2")
+
+	if result.Success || result.Attempts != 1 || result.Error != "HTTP 400" {
+		t.Errorf("expected a single failed attempt, got %+v", result)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("expected 1 request, got %d", got)
+	}
+}
+
+func TestHTTPActionBodySizeLimit(t *testing.T) {
+	var bodies [][]byte
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	engine := newTestEngine(Config{})
+	topic := "gateway/gw1/device/d1/measurement"
+	payload := map[string]interface{}{"weight_kg": 1.0, "notes": strings.Repeat("x", 500)}
+
+	skip := ActionConfig{Type: "http", URL: server.URL, MaxBodyBytes: 300}
+	result := engine.performHTTPAction(skip, topic, payload, "corr-skip")
+	if result.Success || !strings.Contains(result.Error, "exceeds max_body_bytes") {
+		t.Errorf("expected oversized action to be skipped, got %+v", result)
+	}
+	if len(bodies) != 0 {
+		t.Fatalf("expected no request for skipped action, got %d", len(bodies))
+	}
+
+	truncate := ActionConfig{Type: "http", URL: server.URL, MaxBodyBytes: 300, OnOversize: "truncate", TruncateFields: []string{"notes"}}
+	result = engine.performHTTPAction(truncate, topic, payload, "corr-truncate")
+	if !result.Success || len(bodies) != 1 {
+		t.Fatalf("expected truncated request to be sent, got %+v", result)
+	}
+	if len(bodies[0]) > 300 {
+		t.Errorf("expected body within 300 bytes, got %d", len(bodies[0]))
+	}
+	var sent struct {
+		Payload map[string]interface{} `json:"payload"`
+	}
+	if err := json.Unmarshal(bodies[0], &sent); err != nil {
+		t.Fatalf("invalid request body: %v", err)
+	}
+	notes, _ := sent.Payload["notes"].(string)
+	if notes == "" || len(notes) >= 500 || sent.Payload["weight_kg"] != 1.0 {
+		t.Errorf("expected notes to be truncated, got %v", sent.Payload)
+	}
+	if len(payload["notes"].(string)) != 500 {
+		t.Error("truncation modified the original payload")
+	}
+}
+
+func TestMultipleBrokersRegistered(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	data := `
+mqtt:
+  host: broker-1
+  port: 1883
+  brokers:
+    - broker-2:1883
+    - ssl://broker-3:8883
+    - tcp://broker-1:1883
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	engine := newTestEngine(config)
+
+	want := []string{"tcp://broker-1:1883", "tcp://broker-2:1883", "ssl://broker-3:8883"}
+	for name, opts := range map[string]*mqtt.ClientOptions{
+		"main":      engine.clientOptions(),
+		"republish": engine.republishClientOptions(),
+	} {
+		var got []string
+		for _, server := range opts.Servers {
+			got = append(got, server.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s client brokers = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	for _, pattern := range []string{"gateway/+/heartbeat", "gateway/#", "#", "+", "gateway/+/device/+/measurement"} {
+		if err := validateTopicPattern(pattern); err != nil {
+			t.Errorf("expected %q to be valid, got %v", pattern, err)
+		}
+	}
+
+	for pattern, reason := range map[string]string{
+		"":                 "empty",
+		"gateway/#/config": "final level",
+		"gateway/status#":  "whole level",
+		"gate+way/status":  "whole level",
+		"gateway/+x":       "whole level",
+	} {
+		err := validateTopicPattern(pattern)
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("expected %q to be rejected (%s), got %v", pattern, reason, err)
+		}
+	}
+}
+
+func TestUnterminatedSQLStringIsRejected(t *testing.T) {
+	for _, sql := range []string{
+		`SELECT * WHERE payload.x = 'abc`,
+		`SELECT * WHERE payload.x = "abc`,
+		`SELECT * WHERE payload.x = '`,
+	} {
+		if _, err := parseSQLWhere(sql); err == nil {
+			t.Errorf("expected parse error for %q", sql)
+		}
+
+		// Neither startup nor a pushed rule set may take the engine down
+		path := t.TempDir() + "/config.yaml"
+		data := fmt.Sprintf("rules:\n  - name: broken\n    topic_pattern: gateway/#\n    enabled: true\n    sql: %q\n    actions: [{type: lambda, function: f}]\n", sql)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		engine, err := NewRulesEngine(path)
+		if err == nil || engine != nil {
+			t.Errorf("%q: expected startup to reject the malformed rule", sql)
+		}
+
+		engine = newTestEngine(Config{})
+		err = engine.applyRules([]RuleConfig{{
+			Name:         "broken",
+			TopicPattern: "gateway/#",
+			Enabled:      true,
+			SQL:          sql,
+			Actions:      []ActionConfig{{Type: "lambda", Function: "f"}},
+		}})
+		if err == nil {
+			t.Errorf("%q: expected the pushed rule set to be rejected", sql)
+		}
+	}
+}
+
+func TestNewRulesEngineRejectsInvalidPatterns(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	data := `
+rules:
+  - name: valid
+    topic_pattern: gateway/+/heartbeat
+    enabled: true
+  - name: misplaced-hash
+    topic_pattern: gateway/#/config
+    enabled: true
+  - name: embedded-plus
+    topic_pattern: gate+way/status
+    enabled: true
+  - name: disabled
+    topic_pattern: gateway/#/ignored
+    enabled: false
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := NewRulesEngine(path)
+	if err == nil || engine != nil {
+		t.Fatalf("expected an error for invalid patterns, got engine %v", engine)
+	}
+	for _, name := range []string{"misplaced-hash", "embedded-plus"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error to name rule %s: %v", name, err)
+		}
+	}
+	if strings.Contains(err.Error(), "disabled") {
+		t.Errorf("disabled rules should not be validated: %v", err)
+	}
+
+	rules := buildRules([]RuleConfig{
+		{Name: "valid", TopicPattern: "gateway/+/heartbeat", Enabled: true},
+		{Name: "misplaced-hash", TopicPattern: "gateway/#/config", Enabled: true},
+	})
+	if len(rules) != 1 || rules[0].Name != "valid" {
+		t.Errorf("expected invalid rule to be skipped, got %+v", rules)
+	}
+}
+
+func TestReloadConfigSwapsRules(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+rules:
+  - name: heartbeat
+    topic_pattern: gateway/+/heartbeat
+    enabled: true
+    actions: [{type: lambda, function: heartbeat}]
+  - name: status
+    topic_pattern: gateway/+/status
+    enabled: true
+    actions: [{type: lambda, function: status}]
+`)
+	engine, err := NewRulesEngine(path)
+	if err != nil {
+		t.Fatalf("NewRulesEngine failed: %v", err)
+	}
+	client := newMockClient()
+	engine.MQTTClient = client
+	engine.ConfigStorage["gw1"] = "devices: []"
+
+	write(`
+rules:
+  - name: heartbeat
+    topic_pattern: gateway/+/heartbeat
+    enabled: true
+    actions: [{type: lambda, function: heartbeat-v2}]
+  - name: measurement
+    topic_pattern: gateway/+/device/+/measurement
+    enabled: true
+    actions: [{type: lambda, function: measurement}]
+`)
+	if err := engine.reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig failed: %v", err)
+	}
+
+	var names []string
+	for _, rule := range engine.activeRules() {
+		names = append(names, rule.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"heartbeat", "measurement"}) {
+		t.Errorf("unexpected rules after reload: %v", names)
+	}
+	if !reflect.DeepEqual(client.unsubscribed, []string{"gateway/+/status"}) {
+		t.Errorf("expected status topic to be unsubscribed, got %v", client.unsubscribed)
+	}
+	if !reflect.DeepEqual(client.subscribed, []string{"gateway/+/device/+/measurement"}) {
+		t.Errorf("expected measurement topic to be subscribed, got %v", client.subscribed)
+	}
+	if engine.ConfigStorage["gw1"] != "devices: []" {
+		t.Error("expected ConfigStorage to survive reload")
+	}
+
+	// A broken file keeps the current rules
+	write("rules: [unterminated")
+	if err := engine.reloadConfig(); err == nil {
+		t.Error("expected reload of an invalid file to fail")
+	}
+	if len(engine.activeRules()) != 2 {
+		t.Errorf("expected existing rules to be kept, got %d", len(engine.activeRules()))
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	oldRules := []*Rule{
+		{Name: "kept", TopicPattern: "a/#"},
+		{Name: "edited", TopicPattern: "b/#"},
+		{Name: "dropped", TopicPattern: "c/#"},
+	}
+	newRules := []*Rule{
+		{Name: "kept", TopicPattern: "a/#"},
+		{Name: "edited", TopicPattern: "b/+"},
+		{Name: "new", TopicPattern: "d/#"},
+	}
+	added, removed, changed := diffRules(oldRules, newRules)
+	if !reflect.DeepEqual(added, []string{"new"}) || !reflect.DeepEqual(removed, []string{"dropped"}) || !reflect.DeepEqual(changed, []string{"edited"}) {
+		t.Errorf("diffRules = %v, %v, %v", added, removed, changed)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	rule := &Rule{
+		Name:         "measurements",
+		TopicPattern: "gateway/+/device/+/measurement",
+		Enabled:      true,
+		Actions:      []ActionConfig{{Type: "http", URL: server.URL}, {Type: "lambda", Function: "process"}},
+	}
+	engine := newTestEngine(Config{}, rule)
+	engine.messageHandler(nil, &mockMessage{topic: "gateway/gw1/device/d1/measurement", payload: []byte(`{"weight_kg": 1}`)})
+	engine.WaitGroup.Wait()
+
+	recorder := httptest.NewRecorder()
+	engine.handleMetricsRequest(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		`rules_engine_messages_received_total{pattern="gateway/+/device/+/measurement"} 1`,
+		`rules_engine_rule_matches_total{rule="measurements"} 1`,
+		`rules_engine_actions_total{type="http"} 1`,
+		`rules_engine_actions_total{type="lambda"} 1`,
+		`rules_engine_action_failures_total{type="http"} 1`,
+		`rules_engine_http_action_duration_seconds_bucket{le="0.025"} 0`,
+		`rules_engine_http_action_duration_seconds_bucket{le="10"} 1`,
+		`rules_engine_http_action_duration_seconds_bucket{le="+Inf"} 1`,
+		`rules_engine_http_action_duration_seconds_count 1`,
+		"# TYPE rules_engine_http_action_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics output missing %q:\n%s", line, body)
+		}
+	}
+
+	// The 30ms response is observed in seconds, not as a zero sample
+	var sum float64
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "rules_engine_http_action_duration_seconds_sum ") {
+			sum, _ = strconv.ParseFloat(strings.TrimPrefix(line, "rules_engine_http_action_duration_seconds_sum "), 64)
+		}
+	}
+	if sum < 0.03 {
+		t.Errorf("expected a latency sum of at least 0.03s, got %v", sum)
+	}
+}
+
+// mockV5Client is a mockClient that also accepts MQTT 5 publish properties
+type mockV5Client struct {
+	*mockClient
+	expiry         []uint32
+	userProperties []map[string]string
+}
+
+func (c *mockV5Client) PublishWithProperties(topic string, qos byte, retained bool, payload []byte, expirySeconds uint32, userProperties map[string]string) mqtt.Token {
+	c.expiry = append(c.expiry, expirySeconds)
+	c.userProperties = append(c.userProperties, userProperties)
+	return c.Publish(topic, qos, retained, payload)
+}
+
+func TestRepublishSetsV5Properties(t *testing.T) {
+	action := ActionConfig{
+		Type:                 "republish",
+		Topic:                "monitoring/{original_topic}",
+		MessageExpirySeconds: 60,
+		UserProperties:       map[string]string{"source": "rules-engine"},
+		Targets:              []RepublishTarget{{Topic: "archive/{original_topic}"}},
+	}
+
+	engine := newTestEngine(Config{})
+	client := &mockV5Client{mockClient: newMockClient()}
+	engine.RepublishClient = client
+	engine.executeRepublishAction(action, "gateway/gw1/status", map[string]interface{}{"status": "ok"})
+
+	// Only the target with properties goes through PublishWithProperties
+	if len(client.messages()) != 2 || len(client.expiry) != 1 {
+		t.Fatalf("expected 2 publishes, 1 with properties, got %d and %d", len(client.messages()), len(client.expiry))
+	}
+	if client.expiry[0] != 60 || client.userProperties[0]["source"] != "rules-engine" {
+		t.Errorf("unexpected properties: expiry %d, user %v", client.expiry[0], client.userProperties[0])
+	}
+
+	// A v3 client publishes the same message without properties
+	v3 := newMockClient()
+	engine.RepublishClient = v3
+	engine.executeRepublishAction(action, "gateway/gw1/status", map[string]interface{}{"status": "ok"})
+	if got := v3.messages(); len(got) != 2 || got[0].Topic != "monitoring/gateway/gw1/status" {
+		t.Errorf("unexpected v3 publishes: %+v", got)
+	}
+}
+
+func TestMQTTv5ClientRoutesByTopicFilter(t *testing.T) {
+	client := &mqttV5Client{handlers: make(map[string]mqtt.MessageHandler)}
+	var routed, unrouted []string
+	client.AddRoute("gateway/+/status", func(_ mqtt.Client, msg mqtt.Message) { routed = append(routed, msg.Topic()) })
+	client.defaultHandler = func(_ mqtt.Client, msg mqtt.Message) { unrouted = append(unrouted, msg.Topic()) }
+
+	for _, topic := range []string{"gateway/gw1/status", "other/topic"} {
+		client.route(paho.PublishReceived{Packet: &paho.Publish{Topic: topic, Payload: []byte("{}")}})
+	}
+	if !reflect.DeepEqual(routed, []string{"gateway/gw1/status"}) || !reflect.DeepEqual(unrouted, []string{"other/topic"}) {
+		t.Errorf("routed %v, default %v", routed, unrouted)
+	}
+}
+
+func TestNewMQTTv5ClientConfig(t *testing.T) {
+	engine := newTestEngine(Config{MQTT: MQTTConfig{
+		Host: "broker", Port: 1883, Brokers: []string{"ssl://backup:8883"},
+		Username: "user", Password: "pass", ProtocolVersion: 5,
+	}})
+	if !engine.useMQTTv5() {
+		t.Fatalf("protocol_version 5 should select the MQTT 5 client")
+	}
+
+	client, err := engine.newMQTTv5Client("rules", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := client.config
+	if len(config.ServerUrls) != 2 || config.ServerUrls[0].String() != "tcp://broker:1883" || config.ServerUrls[1].Host != "backup:8883" {
+		t.Errorf("unexpected servers: %v", config.ServerUrls)
+	}
+	if config.ClientID != "rules" || config.CleanStartOnInitialConnection || config.SessionExpiryInterval == 0 {
+		t.Errorf("persistent session not applied: %+v", config)
+	}
+	if config.ConnectUsername != "user" || string(config.ConnectPassword) != "pass" {
+		t.Errorf("credentials not applied")
+	}
+
+	engine.Config.MQTT.ProtocolVersion = 0
+	if engine.useMQTTv5() {
+		t.Errorf("MQTT 3.1.1 should stay the default")
+	}
+}
+
+func TestClusterScopedConfigLookup(t *testing.T) {
+	engine := newTestEngine(Config{})
+	client := newMockClient()
+	engine.RepublishClient = client
+
+	engine.handleNewConfig("config/new", map[string]interface{}{"gateway_id": "*", "yaml_config": "scope: wildcard"})
+	engine.handleNewConfig("config/new", map[string]interface{}{"cluster": "eu-west", "yaml_config": "scope: cluster"})
+	engine.handleNewConfig("config/new", map[string]interface{}{"gateway_id": "gw-own", "yaml_config": "scope: gateway", "cluster": "eu-west"})
+
+	sent := func(gatewayID string, payload map[string]interface{}) string {
+		before := len(client.messages())
+		engine.handleConfigRequest("gateway/"+gatewayID+"/request_config", payload)
+		messages := client.messages()
+		if len(messages) != before+1 {
+			t.Fatalf("%s: expected a config to be sent", gatewayID)
+		}
+		var wrapper map[string]interface{}
+		json.Unmarshal(messages[len(messages)-1].Payload, &wrapper)
+		return wrapper["yaml_config"].(string)
+	}
+
+	cases := []struct {
+		gatewayID string
+		payload   map[string]interface{}
+		want      string
+	}{
+		{"gw-own", map[string]interface{}{"cluster": map[string]interface{}{"name": "eu-west"}}, "scope: gateway"},
+		{"gw-2", map[string]interface{}{"cluster": map[string]interface{}{"name": "eu-west"}}, "scope: cluster"},
+		{"gw-3", map[string]interface{}{"cluster": "us-east"}, "scope: wildcard"},
+		{"gw-4", map[string]interface{}{}, "scope: wildcard"},
+	}
+	for _, c := range cases {
+		if got := sent(c.gatewayID, c.payload); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.gatewayID, got, c.want)
+		}
+	}
+
+	// Without a wildcard, a gateway outside any configured cluster gets nothing
+	delete(engine.ConfigStorage, WildcardConfigKey)
+	if _, _, ok := engine.lookupConfig("gw-3", "us-east"); ok {
+		t.Errorf("expected no configuration without a wildcard")
+	}
+}